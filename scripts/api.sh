@@ -0,0 +1,172 @@
+#!/bin/bash
+# Shared HTTP API client (GitHub, GitLab, ...) with per-host rate limiting,
+# retries and call accounting. Every feature talking to a forge API goes
+# through api_request so limits and statistics apply to all of them.
+
+API_MIN_INTERVAL_MS="${API_MIN_INTERVAL_MS:-100}"
+API_RETRIES="${API_RETRIES:-3}"
+# Seconds a single request may take (downloads set their own)
+API_MAX_TIME="${API_MAX_TIME:-60}"
+API_STATE_DIR="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}"
+
+source "$(dirname "${BASH_SOURCE[0]}")/context.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/hosts.sh"
+
+# Token for an API host
+api_token_for() {
+  git_host_token "$1"
+}
+
+# Wait until API_MIN_INTERVAL_MS has passed since the last call to the host
+api_throttle() {
+  local host="$1"
+  local last_file="$API_STATE_DIR/$host.last"
+  mkdir -p "$API_STATE_DIR"
+  (
+    flock 9
+    local now=$(date +%s%3N)
+    local last=$(cat "$last_file" 2>/dev/null || echo 0)
+    local wait_ms=$((last + API_MIN_INTERVAL_MS - now))
+    if [ $wait_ms -gt 0 ]; then
+      sleep "$(awk -v ms="$wait_ms" 'BEGIN { printf "%.3f", ms / 1000 }')"
+    fi
+    date +%s%3N > "$last_file"
+  ) 9>"$API_STATE_DIR/$host.lock"
+}
+
+# Seconds to wait before retrying, from Retry-After or X-RateLimit-Reset headers
+api_retry_delay() {
+  local headers_file="$1"
+  local attempt="$2"
+  local retry_after=$(grep -i '^retry-after:' "$headers_file" | tr -dc '0-9')
+  local remaining=$(grep -i '^x-ratelimit-remaining:' "$headers_file" | tr -dc '0-9')
+  local reset=$(grep -i '^x-ratelimit-reset:' "$headers_file" | tr -dc '0-9')
+
+  if [ -n "$retry_after" ]; then
+    echo "$retry_after"
+  elif [ "$remaining" = "0" ] && [ -n "$reset" ]; then
+    local delay=$((reset - $(date +%s) + 1))
+    echo $((delay > 0 ? delay : 1))
+  else
+    echo $((2 ** attempt))
+  fi
+}
+
+# Perform a request and print the response body on success: api_request <method> <url> [curl args...]
+# Retries on 429, 5xx and rate-limit 403s; fails on any other non-2xx status.
+# API_TOKEN, when set, replaces the host's token (a repository's own token=).
+api_request() {
+  local method="$1"
+  local url="$2"
+  shift 2
+  local host=$(sed -E 's#^[a-z]+://([^/:]+).*#\1#' <<<"$url")
+  local token="${API_TOKEN:-$(api_token_for "$host")}"
+
+  local headers_file=$(mktemp)
+  local body_file=$(mktemp)
+  local attempt=0
+  local status
+  while ! ctx_done; do
+    api_throttle "$host"
+    # The token is read from a pipe so it never shows on curl's command line
+    status=$(curl -sS -X "$method" -H @<([ -z "$token" ] || echo "Authorization: Bearer $token") "$@" \
+      -D "$headers_file" -o "$body_file" -w '%{http_code}' \
+      --max-time "$API_MAX_TIME" "$url" 2>/dev/null)
+
+    if [[ "$status" == 2* ]]; then
+      break
+    fi
+    local rate_limited=false
+    if [ "$status" = "429" ] || { [ "$status" = "403" ] && grep -qi '^x-ratelimit-remaining: 0' "$headers_file"; }; then
+      rate_limited=true
+    fi
+    if [ $attempt -ge "$API_RETRIES" ] || { [ "$rate_limited" = "false" ] && [[ "$status" != 5* ]] && [ "$status" != "000" ]; }; then
+      break
+    fi
+    attempt=$((attempt + 1))
+    api_record "$host" retry
+    ctx_run sleep "$(api_retry_delay "$headers_file" "$attempt")"
+  done
+
+  if [[ "$status" == 2* ]]; then
+    cat "$body_file"
+    rm -f "$headers_file" "$body_file"
+    api_record "$host" ok
+    return 0
+  fi
+  rm -f "$headers_file" "$body_file"
+  api_record "$host" error
+  return 1
+}
+
+api_get() {
+  api_request GET "$@"
+}
+
+# Run a GraphQL query and print its data: api_graphql <endpoint> <query> [variables JSON]
+# Fails when the response carries errors, printing the first one on stderr.
+# Queries selecting rateLimit { cost remaining } have their cost accounted.
+api_graphql() {
+  local body=$(jq -nc --arg query "$2" --argjson variables "${3:-"{}"}" '{query: $query, variables: $variables}')
+  local response
+  response=$(api_request POST "$1" -H "Content-Type: application/json" --data-binary "$body") || return 1
+  local cost=$(jq -r '.data.rateLimit // empty | "\(.cost) \(.remaining)"' <<<"$response" 2>/dev/null)
+  if [ -n "$cost" ]; then
+    mkdir -p "$API_STATE_DIR"
+    echo "$(sed -E 's#^[a-z]+://([^/:]+).*#\1#' <<<"$1") $cost" >> "$API_STATE_DIR/graphql.log"
+  fi
+  if jq -e '.errors | length > 0' <<<"$response" >/dev/null; then
+    jq -r '.errors[0].message' <<<"$response" >&2
+    return 1
+  fi
+  jq -c '.data' <<<"$response"
+}
+
+# Every node of a paginated GraphQL connection, one JSON object per line:
+# api_graphql_nodes <endpoint> <query> <variables JSON> <path to the connection, e.g. .repository.issues>
+# The query takes a $cursor variable and selects pageInfo { hasNextPage endCursor } on the connection.
+api_graphql_nodes() {
+  local endpoint="$1"
+  local query="$2"
+  local variables="$3"
+  local path="$4"
+  local cursor="null"
+  local data
+  while :; do
+    data=$(api_graphql "$endpoint" "$query" "$(jq -c --argjson cursor "$cursor" '. + {cursor: $cursor}' <<<"$variables")") || return 1
+    jq -c "$path.nodes[]" <<<"$data" || return 1
+    if [ "$(jq -r "$path.pageInfo.hasNextPage" <<<"$data")" != "true" ]; then
+      return 0
+    fi
+    cursor=$(jq -c "$path.pageInfo.endCursor" <<<"$data")
+  done
+}
+
+# Account one request outcome (ok, retry, error) for a host
+api_record() {
+  mkdir -p "$API_STATE_DIR"
+  echo "$1 $2" >> "$API_STATE_DIR/calls.log"
+}
+
+# Per-host request statistics of this run as JSON: {"api.github.com": {"requests": 3, ...}},
+# with the GraphQL rate limit points spent and left where queries reported them
+api_stats() {
+  if [ ! -f "$API_STATE_DIR/calls.log" ]; then
+    echo '{}'
+    return
+  fi
+  local graphql='{}'
+  if [ -f "$API_STATE_DIR/graphql.log" ]; then
+    graphql=$(jq -R 'split(" ")' "$API_STATE_DIR/graphql.log" | jq -s '
+      group_by(.[0]) | map({key: .[0][0], value: {
+        graphql_cost: map(.[1] | tonumber) | add,
+        graphql_remaining: (last | .[2] | tonumber)
+      }}) | from_entries')
+  fi
+  jq -R 'split(" ")' "$API_STATE_DIR/calls.log" | jq -s --argjson graphql "$graphql" '
+    group_by(.[0]) | map({key: .[0][0], value: ({
+      requests: map(select(.[1] != "retry")) | length,
+      retries: map(select(.[1] == "retry")) | length,
+      errors: map(select(.[1] == "error")) | length
+    } + ($graphql[.[0][0]] // {}))}) | from_entries'
+}
@@ -0,0 +1,344 @@
+#!/bin/bash
+# Archive formats. ARCHIVE_FORMAT (or format=<...> per repo) is one of:
+#   zip        Zip of the mirror directories (default)
+#   zip-store  Zip without compression, for content that is already compressed
+#   bundle     git bundle of all refs, for a plain mirror without extra content
+#   tar.zst    Zstandard-compressed tarball, for LFS or mixed content
+#   tar.gz     Gzip-compressed tarball, readable anywhere and keeping permissions and symlinks
+#   auto       Pick one of the above from the measured content profile
+#
+# Each format is an archiver: functions named after it, with dots and dashes
+# as underscores. Adding a format means adding its functions:
+#   archiver_<format>_create <dir> <archive name> <contents...>  Create the archive inside <dir>
+#   archiver_<format>_extract <file> <dest dir> <repo name>      Unpack an archive file
+#   archiver_<format>_stream <dest dir>                          Unpack from stdin (optional)
+#   archiver_<format>_available                                  Whether it works here (optional)
+
+source "$(dirname "${BASH_SOURCE[0]}")/walk.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/storage.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/encrypt.sh"
+
+ARCHIVE_FORMAT="${ARCHIVE_FORMAT:-zip}"
+# Where archives are stored: "flat" (<date>_<repo>.<ext>), "by-repo"
+# (<repo>/<date>_<repo>.<ext>) or "by-month" (<YYYY>/<MM>/<date>_<repo>.<ext>)
+ARCHIVE_LAYOUT="${ARCHIVE_LAYOUT:-flat}"
+# In auto mode, store content uncompressed when a sample compresses to more
+# than this percentage of its size
+ARCHIVE_STORE_RATIO="${ARCHIVE_STORE_RATIO:-90}"
+# Deflate level of zip archives (or zip_level=<...> per repo): 0 (store) to 9,
+# or "store" to keep git packfiles, which are already compressed, as they are
+# and deflate everything else at the default level
+ZIP_LEVEL="${ZIP_LEVEL:-6}"
+
+# Stored name of an archive: archive_name_for <repo> <date> <extension> [layout]
+archive_name_for() {
+  local repo_name="$1"
+  local date="$2"
+  local file="${date}_${repo_name}.$3"
+  case "${4:-$ARCHIVE_LAYOUT}" in
+    by-repo) echo "$repo_name/$file" ;;
+    by-month) echo "${date:0:4}/${date:4:2}/$file" ;;
+    *) echo "$file" ;;
+  esac
+}
+
+# File extension of a format
+archive_extension() {
+  case "$1" in
+    zip|zip-store) echo "zip" ;;
+    *) echo "$1" ;;
+  esac
+}
+
+# Format of an archive file or stored archive, from its extension
+archive_format_of() {
+  case "${1%"$(encryption_suffix_of "$1")"}" in
+    *.bundle) echo "bundle" ;;
+    *.tar.zst) echo "tar.zst" ;;
+    *.tar.gz) echo "tar.gz" ;;
+    *) echo "zip" ;;
+  esac
+}
+
+# Prefix of a format's archiver functions: archiver_for <format>
+archiver_for() {
+  local id="${1//./_}"
+  echo "archiver_${id//-/_}"
+}
+
+# zip options for ZIP_LEVEL
+zip_level_options() {
+  case "$ZIP_LEVEL" in
+    store) echo "-6 -n .pack" ;;
+    [0-9]) echo "-$ZIP_LEVEL" ;;
+    *)
+      echo "⚠️ ZIP_LEVEL $ZIP_LEVEL is not 0-9 or store, using 6" >&2
+      echo "-6"
+      ;;
+  esac
+}
+
+archiver_zip_create() {
+  local options=$(zip_level_options)
+  (cd "$1" && zip -qr $options "$2" "${@:3}")
+}
+
+archiver_zip_extract() {
+  unzip -q "$1" -d "$2"
+}
+
+archiver_zip_store_create() {
+  (cd "$1" && zip -qr -0 "$2" "${@:3}")
+}
+
+archiver_zip_store_extract() {
+  archiver_zip_extract "$@"
+}
+
+archiver_bundle_create() {
+  git -C "$1/$3" bundle create "$1/$2" --all 2>/dev/null
+}
+
+archiver_bundle_extract() {
+  git clone -q --mirror "$1" "$2/$3" 2>/dev/null
+}
+
+archiver_tar_zst_available() {
+  command -v zstd >/dev/null
+}
+
+archiver_tar_zst_create() {
+  tar -C "$1" --use-compress-program "zstd -q -T$WALK_WORKERS" -cf "$1/$2" "${@:3}"
+}
+
+archiver_tar_zst_extract() {
+  tar -C "$2" --use-compress-program "zstd -d -q" -xf "$1"
+}
+
+archiver_tar_zst_stream() {
+  tar -C "$1" --use-compress-program "zstd -d -q" -xf -
+}
+
+archiver_tar_gz_create() {
+  tar -C "$1" -czf "$1/$2" "${@:3}"
+}
+
+archiver_tar_gz_extract() {
+  tar -C "$2" -xzf "$1"
+}
+
+archiver_tar_gz_stream() {
+  tar -C "$1" -xzf -
+}
+
+# Whether a mirror tracks files with Git LFS
+mirror_uses_lfs() {
+  local git_dir="$1"
+  [ -d "$git_dir/lfs/objects" ] ||
+    git -C "$git_dir" grep -q "filter=lfs" HEAD -- .gitattributes 2>/dev/null
+}
+
+# Percentage of its size the first 8 MiB of the content compress to: content_compress_ratio <dir> <contents...>
+content_compress_ratio() {
+  local dir="$1"
+  shift
+  local sample=$(mktemp)
+  (cd "$dir" && tar -cf - "$@" 2>/dev/null) | head -c 8388608 > "$sample"
+  local raw=$(file_size "$sample")
+  local packed=$(gzip -1 -c "$sample" | wc -c)
+  rm -f "$sample"
+  if [ "$raw" -eq 0 ]; then
+    echo 0
+    return
+  fi
+  echo $((packed * 100 / raw))
+}
+
+# Pick a format from the content profile: choose_archive_format <dir> <contents...>
+# The first content entry is the repository's mirror.
+choose_archive_format() {
+  local dir="$1"
+  shift
+  local git_dir="$dir/$1"
+
+  if mirror_uses_lfs "$git_dir"; then
+    echo "tar.zst"
+  elif [ $# -eq 1 ] && [ -n "$(git -C "$git_dir" for-each-ref --count=1)" ]; then
+    echo "bundle"
+  elif [ "$(content_compress_ratio "$dir" "$@")" -ge "$ARCHIVE_STORE_RATIO" ]; then
+    echo "zip-store"
+  else
+    echo "tar.zst"
+  fi
+}
+
+# Resolve a requested format to one that can be created here: resolve_archive_format <format> <dir> <contents...>
+resolve_archive_format() {
+  local format="$1"
+  local dir="$2"
+  shift 2
+
+  if [ "$format" = "auto" ]; then
+    format=$(choose_archive_format "$dir" "$@")
+  fi
+  # Bundles hold a single repository and refuse to be empty
+  if [ "$format" = "bundle" ] && { [ $# -gt 1 ] || [ -z "$(git -C "$dir/$1" for-each-ref --count=1)" ]; }; then
+    format="zip"
+  fi
+  local archiver=$(archiver_for "$format")
+  if declare -F "${archiver}_available" >/dev/null && ! "${archiver}_available"; then
+    format="zip"
+  fi
+  echo "$format"
+}
+
+# Create an archive inside <dir>: create_archive <format> <dir> <archive name> <contents...>
+create_archive() {
+  local format="$1"
+  local dir="$2"
+  local archive_name="$3"
+  shift 3
+  local archiver=$(archiver_for "$format")
+  if ! declare -F "${archiver}_create" >/dev/null; then
+    echo "❌ Unknown archive format: $format" >&2
+    return 1
+  fi
+  "${archiver}_create" "$dir" "$archive_name" "$@"
+}
+
+# Unpack any archive format into <dest dir>, leaving the mirror at <dest dir>/<repo name>:
+# extract_archive <file> <dest dir> <repo name>
+extract_archive() {
+  local file="$1"
+  local dest_dir="$2"
+  local repo_name="$3"
+  mkdir -p "$dest_dir"
+  if [ -n "$(encryption_suffix_of "$file")" ]; then
+    local decrypted
+    decrypted=$(decrypt_archive "$file") || return 1
+    extract_archive "$decrypted" "$dest_dir" "$repo_name"
+    local status=$?
+    rm -f "$decrypted"
+    return $status
+  fi
+  "$(archiver_for "$(archive_format_of "$file")")_extract" "$file" "$dest_dir" "$repo_name"
+}
+
+# Check that an archive can be extracted and that what it holds is intact:
+# every git repository in it passes git fsck --full, and every JSON file parses.
+# Delta archives are only extracted, their base is not at hand.
+# verify_archive <file> <repo name>; fails with the reason on stderr, with
+# status 1 when the archive can't be read and 2 when its content is corrupt
+verify_archive() {
+  local file="$1"
+  local repo_name="$2"
+  local scratch=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+  if ! extract_archive "$file" "$scratch/content" "$repo_name" >/dev/null 2>"$scratch/errors" ||
+    { [ ! -e "$scratch/content/$repo_name" ] && [ ! -f "$scratch/content/DELTA.json" ]; }; then
+    echo "Could not extract $(basename "$file")$(tail -n 1 "$scratch/errors" | sed 's/^/: /')" >&2
+    rm -rf "$scratch"
+    return 1
+  fi
+
+  local status=0
+  if [ ! -f "$scratch/content/DELTA.json" ]; then
+    verify_content "$scratch/content"
+    status=$?
+  fi
+  rm -rf "$scratch"
+  return $status
+}
+
+# Check the extracted content of an archive: every git repository in <dir>
+# passes git fsck --full and every JSON file parses; fails with status 2 and
+# the reason on stderr: verify_content <dir>
+verify_content() {
+  local content="$1"
+  local dir json
+  local fsck=$(mktemp)
+  for dir in "$content"/*; do
+    [ -d "$dir" ] || continue
+    if [ -d "$dir/objects" ]; then
+      if ! git -C "$dir" fsck --full --no-progress >"$fsck" 2>&1; then
+        echo "git fsck $(basename "$dir"): $(grep -m 1 -E '^(error|fatal|missing|broken|bad)' "$fsck" || tail -n 1 "$fsck")" >&2
+        rm -f "$fsck"
+        return 2
+      fi
+    else
+      while IFS= read -r -d '' json; do
+        if ! jq empty "$json" 2>/dev/null; then
+          echo "Invalid JSON: ${json#"$content/"}" >&2
+          rm -f "$fsck"
+          return 2
+        fi
+      done < <(find "$dir" -name '*.json' -print0)
+    fi
+  done
+  rm -f "$fsck"
+}
+
+# Extract a stored archive without keeping a copy of it around:
+# unpack_stored_archive <destination> <archive> <dest_dir> <repo>
+# Formats with a stream archiver (tarballs) unpack straight from storage; zip
+# and bundle need random access, so they pass through a temporary file removed
+# right after extraction
+unpack_stored_archive() {
+  local destination="$1"
+  local archive="$2"
+  local dest_dir="$3"
+  local repo_name="$4"
+  mkdir -p "$dest_dir"
+  local archiver=$(archiver_for "$(archive_format_of "$archive")")
+  if [ -z "$(encryption_suffix_of "$archive")" ] && declare -F "${archiver}_stream" >/dev/null; then
+    storage_read "$destination" "$archive" | "${archiver}_stream" "$dest_dir"
+    local statuses=("${PIPESTATUS[@]}")
+    [ "${statuses[0]}" -eq 0 ] && [ "${statuses[1]}" -eq 0 ]
+    return
+  fi
+  local spool_dir=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+  local spool="$spool_dir/$(basename "$archive")"
+  storage_read "$destination" "$archive" > "$spool" && extract_archive "$spool" "$dest_dir" "$repo_name"
+  local status=$?
+  rm -rf "$spool_dir"
+  return $status
+}
+
+# Restore the full content of a stored archive, delta archives (see delta.sh)
+# laid over their base: open_stored_archive <destination> <archive> <dest_dir> <repo>
+open_stored_archive() {
+  unpack_stored_archive "$@" || return 1
+  if [ -f "$3/DELTA.json" ]; then
+    apply_delta_archive "$@"
+  fi
+}
+
+# Replace an unpacked delta archive in <dest_dir> with its base plus the delta:
+# apply_delta_archive <destination> <archive> <dest_dir> <repo>
+apply_delta_archive() {
+  local destination="$1"
+  local archive="$2"
+  local dest_dir="$3"
+  local repo_name="$4"
+  local delta=$(cat "$dest_dir/DELTA.json")
+  rm -f "$dest_dir/DELTA.json"
+  local base=$(jq -r '.base' <<<"$delta")
+  # Migrations may have moved the base since; the catalog knows where it is now
+  if [ -f "$CATALOG_FILE" ]; then
+    base=$(jq -r --arg archive "$archive" --arg base "$base" \
+      '(first(.[] | select(.archive == $archive) | .delta_of) // $base)' "$CATALOG_FILE")
+  fi
+
+  local overlay=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+  mv "$dest_dir" "$overlay/delta" && mkdir -p "$dest_dir" || return 1
+  if ! unpack_stored_archive "$destination" "$base" "$dest_dir" "$repo_name"; then
+    echo "❌ Could not unpack $base, the base of delta archive $archive" >&2
+    rm -rf "$overlay"
+    return 1
+  fi
+  cp -a "$overlay/delta/." "$dest_dir/"
+  local path
+  jq -r '.deleted[]' <<<"$delta" | while IFS= read -r path; do
+    rm -f "$dest_dir/$path"
+  done
+  rm -rf "$overlay"
+}
@@ -0,0 +1,95 @@
+#!/bin/bash
+# GitHub Actions artifacts: for projects without releases, the build outputs
+# of recent workflow runs often exist only as artifacts, which GitHub deletes
+# when they expire. Selected artifacts are downloaded next to the mirror as
+# <repo>.artifacts/<name>-<id>.zip, with artifacts.json describing each one
+# (workflow run, branch, commit, creation and expiry dates).
+
+source "$(dirname "${BASH_SOURCE[0]}")/api.sh"
+
+# Download each repository's recent Actions artifacts into its archive (per repo: artifacts=true)
+BACKUP_ARTIFACTS="${BACKUP_ARTIFACTS:-false}"
+# Comma-separated name patterns of the artifacts to keep, e.g. "dist-*,*.apk" (per repo: artifact_names=); all when empty
+ARTIFACT_NAMES="${ARTIFACT_NAMES:-}"
+# Only artifacts created within this many days
+ARTIFACT_MAX_AGE_DAYS="${ARTIFACT_MAX_AGE_DAYS:-30}"
+# Skip artifacts larger than this
+ARTIFACT_MAX_SIZE_MB="${ARTIFACT_MAX_SIZE_MB:-500}"
+# Seconds one artifact may take to download
+ARTIFACT_TIMEOUT="${ARTIFACT_TIMEOUT:-600}"
+
+# Whether an artifact name matches a comma-separated list of patterns (empty matches all)
+artifact_name_matches() {
+  local name="$1"
+  [ -n "$2" ] || return 0
+  local pattern
+  local -a patterns
+  IFS=',' read -ra patterns <<<"$2"
+  for pattern in "${patterns[@]}"; do
+    [[ "$name" == $pattern ]] && return 0
+  done
+  return 1
+}
+
+# The unexpired artifacts of a repository within the age and size limits, one
+# JSON object per line: artifact_list <repository API URL>
+artifact_list() {
+  local repo_api="$1"
+  local since=$(( $(clock_now) - ARTIFACT_MAX_AGE_DAYS * 86400 ))
+  local max_bytes=$(( ARTIFACT_MAX_SIZE_MB * 1024 * 1024 ))
+  local page=1
+  local response count
+  while :; do
+    response=$(api_get "$repo_api/actions/artifacts?per_page=100&page=$page") || return 1
+    jq -c --argjson since "$since" --argjson max "$max_bytes" '.artifacts[] |
+      select(.expired | not) |
+      select((.created_at | fromdateiso8601) >= $since and .size_in_bytes <= $max)' <<<"$response"
+    count=$(jq '.artifacts | length' <<<"$response")
+    # Artifacts come newest first, so a page older than the limit ends the list
+    if [ "$count" -lt 100 ] || [ "$(jq --argjson since "$since" '[.artifacts[] | select((.created_at | fromdateiso8601) >= $since)] | length' <<<"$response")" -eq 0 ]; then
+      return 0
+    fi
+    page=$((page + 1))
+  done
+}
+
+# Download a repository's selected artifacts into <dir>, printing how many
+# were saved; fails when listing or any download fails:
+# backup_artifacts <repo url> <dir> <name patterns>
+backup_artifacts() {
+  local repo_api=$(git_repo_api "$1")
+  local dir="$2"
+  local names="$3"
+  if [ -z "$repo_api" ] || [ "$(git_url_type "$1")" != "github" ]; then
+    echo "Actions artifacts are only available from GitHub" >&2
+    return 1
+  fi
+
+  local artifacts
+  artifacts=$(artifact_list "$repo_api") || { echo "Listing artifacts failed" >&2; return 1; }
+  mkdir -p "$dir" || return 1
+  local artifact name id file
+  local saved=0 failed=0
+  local index="$dir/artifacts.jsonl"
+  : > "$index"
+  while IFS= read -r artifact; do
+    [ -n "$artifact" ] || continue
+    name=$(jq -r '.name' <<<"$artifact")
+    artifact_name_matches "$name" "$names" || continue
+    id=$(jq -r '.id' <<<"$artifact")
+    file="$(tr -c 'A-Za-z0-9._\n-' '_' <<<"$name")-$id.zip"
+    # The download redirects to blob storage; curl drops the token on the way
+    if API_MAX_TIME="$ARTIFACT_TIMEOUT" api_get "$repo_api/actions/artifacts/$id/zip" -L > "$dir/$file"; then
+      jq -c --arg file "$file" '{id, name, file: $file, size_in_bytes, created_at, expires_at,
+        workflow_run: (.workflow_run // {} | {id, head_branch, head_sha})}' <<<"$artifact" >> "$index"
+      saved=$((saved + 1))
+    else
+      echo "Downloading artifact $name ($id) failed" >&2
+      rm -f "$dir/$file"
+      failed=$((failed + 1))
+    fi
+  done <<<"$artifacts"
+  jq -s . "$index" > "$dir/artifacts.json" && rm -f "$index"
+  echo "$saved"
+  [ $failed -eq 0 ]
+}
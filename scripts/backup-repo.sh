@@ -1,57 +1,645 @@
 #!/bin/bash
 # EXACT COPY of backup_repo function from original workflow
 
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/redact.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/storage.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/messages.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/sensitive-scan.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/archive.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/encrypt.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/context.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/sources.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/delta.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/artifacts.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/metadata.sh"
+
+# Back up the repository's wiki into the same archive (per repo: wiki=true)
+BACKUP_WIKI="${BACKUP_WIKI:-false}"
+# Fetch the Git LFS objects of repositories using LFS into their mirror (per
+# repo: lfs=true); a plain mirror clone only has the pointer files
+BACKUP_LFS="${BACKUP_LFS:-false}"
+# What a failed auxiliary export (wiki, LFS, artifacts, metadata) makes of a backup whose git data
+# succeeded: success, partial or failure
+AUX_FAILURE_POLICY="${AUX_FAILURE_POLICY:-partial}"
+
+# Report dotenv files and private keys found in mirrors
+SENSITIVE_SCAN="${SENSITIVE_SCAN:-false}"
+
+# Extract each new archive and check it with git fsck --full before it is
+# uploaded (or verify=<true|false> per repo)
+VERIFY_ARCHIVES="${VERIFY_ARCHIVES:-false}"
+
+# Upload a manifest with the hash of every archived file as <archive>.manifest
+CONTENT_MANIFEST="${CONTENT_MANIFEST:-false}"
+
+# Don't store another archive when the content equals the last backup's
+DEDUP_ARCHIVES="${DEDUP_ARCHIVES:-false}"
+
+# Keep an uncompressed copy of the newest mirror at <dir>/<owner>/<repo> (disabled when empty)
+MIRROR_TREE_DIR="${MIRROR_TREE_DIR:-}"
+
+# Minutes a clone may take before it is stopped and the repository fails
+# (0 for no limit), so one hung clone can't hold up the whole run
+CLONE_TIMEOUT_MINUTES="${CLONE_TIMEOUT_MINUTES:-30}"
+# Attempts of a clone that failed on the network, and of each upload
+CLONE_ATTEMPTS="${CLONE_ATTEMPTS:-3}"
+UPLOAD_ATTEMPTS="${UPLOAD_ATTEMPTS:-3}"
+# Wait before the first retry, doubled for each further one
+RETRY_BASE_DELAY_SECONDS="${RETRY_BASE_DELAY_SECONDS:-5}"
+# Random share added to or taken from each wait, so retries don't come in step
+RETRY_JITTER_PERCENT="${RETRY_JITTER_PERCENT:-20}"
+
+# Keep each repository's mirror at <dir>/<repo>.git between runs and only fetch
+# what changed, instead of cloning the full history every time (disabled when empty)
+MIRROR_CACHE_DIR="${MIRROR_CACHE_DIR:-}"
+
+# Whether a usable mirror of <name> is cached from an earlier run: mirror_cached <name>
+mirror_cached() {
+  [ -n "$MIRROR_CACHE_DIR" ] &&
+    [ "$(git -C "$MIRROR_CACHE_DIR/$1.git" rev-parse --is-bare-repository 2>/dev/null)" = "true" ]
+}
+
+# Get a mirror of <url> from its source provider at <dest>: a fresh one, or
+# with MIRROR_CACHE_DIR the cached mirror updated (git remote update --prune
+# for git sources) and copied there, the first run filling the cache:
+# fetch_mirror <provider> <token> <url> <dest> [clone options...]
+fetch_mirror() {
+  local provider="$1"
+  local token="$2"
+  local url
+  url=$(source_call "$provider" resolve "$3") || return 1
+  local dest="$4"
+  shift 4
+  if [ -z "$MIRROR_CACHE_DIR" ]; then
+    source_call "$provider" fetch "$url" "$token" "$dest" "$@"
+    return
+  fi
+
+  local name=$(basename "$dest")
+  local cached="$MIRROR_CACHE_DIR/$name.git"
+  if mirror_cached "$name"; then
+    source_call "$provider" fetch "$url" "$token" "$cached" "$@" || return 1
+  else
+    rm -rf "$cached"
+    mkdir -p "$MIRROR_CACHE_DIR" || return 1
+    if ! source_call "$provider" fetch "$url" "$token" "$cached" "$@"; then
+      rm -rf "$cached"
+      return 1
+    fi
+  fi
+  # The archive is built from a copy, so scrubbing it leaves the cache intact
+  cp -a "$cached" "$dest"
+}
+
+# Replace a repository's copy in the mirror tree with a fresh clone: update_mirror_tree <mirror> <url> <name>
+update_mirror_tree() {
+  local mirror_dir="$1"
+  local repo_url="$2"
+  local target="$MIRROR_TREE_DIR/$(repo_owner "$repo_url")/$3"
+
+  mkdir -p "$(dirname "$target")" &&
+    rm -rf "$target.tmp" &&
+    cp -a "$mirror_dir" "$target.tmp" &&
+    git -C "$target.tmp" remote set-url origin "$repo_url" &&
+    rm -rf "$target" &&
+    mv "$target.tmp" "$target"
+}
+
+# Record a backup whose content equals the repository's last one as sharing its
+# stored archive: reuse_previous_archive <repo> <archive name> <content hash> <encryption key>
+reuse_previous_archive() {
+  local repo_name="$1"
+  local archive_name="$2"
+  local previous=$(catalog_same_content "$repo_name" "$3" "$4")
+  [ -n "$previous" ] || return 1
+  local object=$(jq -r '.dedup_of // .archive' <<<"$previous")
+  local size_bytes=$(jq -r '.size_bytes' <<<"$previous")
+  local destination
+  for destination in $BACKUP_DESTINATIONS; do
+    if [ -z "$(storage_size "$destination" "$object")" ]; then
+      echo "ℹ️ Unchanged since $object, but it is missing on $destination; storing a new archive"
+      return 1
+    fi
+  done
+
+  echo "🔗 Unchanged content: $repo_name, sharing $object"
+  result_set archive "$archive_name$(encryption_suffix_of "$object")"
+  result_set dedup_of "$object"
+  result_set archive_format "$(archive_format_of "$object")"
+  result_set_json size_bytes "$size_bytes"
+  local sha256=$(jq -r '.sha256 // empty' <<<"$previous")
+  [ -z "$sha256" ] || result_set sha256 "$sha256"
+  [ -z "$4" ] || result_set encryption_key "$4"
+  for destination in $BACKUP_DESTINATIONS; do
+    if ! storage_update_latest "$destination" "$repo_name" "$object" "$size_bytes"; then
+      echo "⚠️ Failed to update latest pointer: $repo_name ($destination)"
+    fi
+  done
+}
+
+# Final status of a backup whose git data was stored, from the auxiliary
+# exports that failed (the caller's aux_failures) and AUX_FAILURE_POLICY
+backup_outcome() {
+  local repo_name="$1"
+  if [ ${#aux_failures[@]} -gt 0 ]; then
+    result_set_json aux_failures "$(printf '%s\n' "${aux_failures[@]}" | jq -R . | jq -sc .)"
+    case "$AUX_FAILURE_POLICY" in
+      success)
+        ;;
+      failure)
+        echo "❌ Backed up git data but not: ${aux_failures[*]} ($repo_name)"
+        result_set failure_stage auxiliary
+        return 1
+        ;;
+      *)
+        echo "⚠️ Partially backed up: $repo_name (missing ${aux_failures[*]})"
+        return 2
+        ;;
+    esac
+  fi
+  
+  echo "✅ Successfully backed up: $repo_name"
+  return 0
+}
+
+# Transfer statistics from git clone --progress output, as a JSON object
+parse_clone_progress() {
+  local stderr_file="$1"
+  tr '\r' '\n' < "$stderr_file" | awk '
+    function bytes(value, unit) {
+      if (unit ~ /^KiB/) return value * 1024
+      if (unit ~ /^MiB/) return value * 1024 * 1024
+      if (unit ~ /^GiB/) return value * 1024 * 1024 * 1024
+      return value
+    }
+    /^Receiving objects: .*done/ {
+      split($0, parts, /[(\/)]/); objects = parts[3]
+      if (match($0, /, [0-9.]+ [KMG]?i?B \|/)) { split(substr($0, RSTART + 2, RLENGTH - 4), size, " "); received = bytes(size[1], size[2]) }
+      if (match($0, /\| [0-9.]+ [KMG]?i?B\/s/)) { split(substr($0, RSTART + 2, RLENGTH - 4), rate, " "); speed = bytes(rate[1], rate[2]) }
+    }
+    /^Resolving deltas: .*done/ { split($0, parts, /[(\/)]/); deltas = parts[3] }
+    END {
+      printf "{\"objects_received\": %d, \"received_bytes\": %d, \"transfer_rate_bytes_per_sec\": %d, \"deltas_resolved\": %d}\n", objects, received, speed, deltas
+    }'
+}
+
+# Map git's stderr to a failure class reports and retries can act on
+classify_git_error() {
+  local stderr_file="$1"
+  if grep -qiE "enabled or enforced SAML SSO|SAML SSO" "$stderr_file"; then
+    echo "sso_required"
+  elif grep -qiE "authentication failed|could not read username|invalid username or password|returned error: 403" "$stderr_file"; then
+    echo "auth_failed"
+  elif grep -qiE "repository not found|does not exist|does not appear to be a git repository|returned error: 404" "$stderr_file"; then
+    echo "not_found"
+  elif grep -qiE "exceeds maximum allowed size|pack exceeds" "$stderr_file"; then
+    echo "pack_too_large"
+  elif grep -qiE "no space left on device|disk quota exceeded" "$stderr_file"; then
+    echo "disk_full"
+  elif grep -qiE "early eof|remote end hung up|rpc failed|unexpected disconnect" "$stderr_file"; then
+    echo "early_eof"
+  elif grep -qiE "could not resolve host|failed to connect|connection timed out|operation timed out" "$stderr_file"; then
+    echo "network"
+  else
+    echo "unknown"
+  fi
+}
+
+# Seconds to wait before retry number <n> (1 for the first): retry_delay <n>
+retry_delay() {
+  local delay=$(( RETRY_BASE_DELAY_SECONDS * 2 ** ($1 - 1) ))
+  local jitter=$(( delay * RETRY_JITTER_PERCENT / 100 ))
+  if [ $jitter -gt 0 ]; then
+    delay=$(( delay - jitter + RANDOM % (2 * jitter + 1) ))
+  fi
+  echo "$delay"
+}
+
+# Whether a clone that failed with this class may succeed when tried again
+clone_error_transient() {
+  case "$1" in
+    network|early_eof) return 0 ;;
+    *) return 1 ;;
+  esac
+}
+
+# Back up one repository: backup_repo <url> [repos.txt line with options]
+# Returns 0 on success, 1 on failure and 2 when only auxiliary exports failed
+# and AUX_FAILURE_POLICY is "partial".
 backup_repo() {
   local repo_url="$1"
-  local repo_name=$(basename "$repo_url" .git)
-  local temp_dir=$(mktemp -d)
+  local repo_line="${2:-$1}"
+  local repo_name=$(repo_display_name "$repo_line")
+  # Named after this process so gc.sh can tell orphans from a running backup
+  local temp_dir=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+  local archive_contents=("$repo_name")
+  local aux_failures=()
   
   echo "📦 Backing up: $repo_name ($repo_url)"
   
-  # Clone repository
-  if [ -n "$GITHUB_TOKEN" ] && [[ "$repo_url" == *"github.com"* ]]; then
-    # Add token for private repos
-    local auth_url="https://${GITHUB_TOKEN}@${repo_url#https://}"
+  local host=$(git_url_host "$repo_url")
+  if ! git_host_allowed "$repo_url"; then
+    local not_allowed="$host is not in GIT_HOSTS"
+    if [[ "$repo_url" == org-settings:* ]]; then
+      not_allowed="github.com is not in GIT_HOSTS"
+    elif [ -z "$host" ]; then
+      not_allowed=$(local_source_problem "$repo_url")
+    fi
+    echo "❌ Not backing up: $repo_name ($not_allowed)"
+    result_set failure_stage clone
+    result_set error_class host_not_allowed
+    result_set error "$not_allowed"
+    rm -rf "$temp_dir"
+    return 1
+  fi
+  
+  local provider=$(repo_source_provider "$repo_line")
+  if ! source_provider_known "$provider"; then
+    echo "❌ Not backing up: $repo_name (unknown source $provider)"
+    result_set failure_stage clone
+    result_set error "Unknown source provider: $provider"
+    rm -rf "$temp_dir"
+    return 1
+  fi
+  
+  # The repository's own token (token=<name>) or its source's, handed to git
+  # through GIT_ASKPASS and used for its API calls
+  local token=""
+  local API_TOKEN=""
+  local token_name=$(repo_option "$repo_line" token "")
+  if [ -n "$token_name" ]; then
+    token=$(git_named_token "$token_name")
+    if [ -z "$token" ]; then
+      echo "❌ Not backing up: $repo_name (token $token_name: $(git_named_token_variable "$token_name") is not set)"
+      result_set failure_stage clone
+      result_set error_class auth_failed
+      result_set error "$(git_named_token_variable "$token_name") is not set"
+      rm -rf "$temp_dir"
+      return 1
+    fi
+    API_TOKEN="$token"
   else
-    local auth_url="$repo_url"
+    token=$(source_call "$provider" token "$repo_url")
   fi
   
   # Clone with stdin redirected to prevent any consumption issues
-  if ! git clone --mirror "$auth_url" "$temp_dir/$repo_name" </dev/null 2>/dev/null; then
-    echo "❌ Failed to clone: $repo_name"
+  local clone_stderr="$temp_dir/clone.stderr"
+  local clone_started=$(clock_now)
+  local incremental=false
+  if mirror_cached "$repo_name"; then
+    incremental=true
+  fi
+  # Network failures are tried again after a growing pause; anything else
+  # (authentication, missing repository, full disk, a clone that took too
+  # long) would fail the same way
+  local clone_timeout=$(repo_option "$repo_line" clone_timeout "$CLONE_TIMEOUT_MINUTES")
+  [[ "$clone_timeout" =~ ^[0-9]+$ ]] || clone_timeout="$CLONE_TIMEOUT_MINUTES"
+  local clone_attempt=1
+  local cloned=false
+  local clone_status delay
+  while :; do
+    ctx_run_for $((clone_timeout * 60)) fetch_mirror "$provider" "$token" "$repo_url" "$temp_dir/$repo_name" --progress </dev/null 2>"$clone_stderr"
+    clone_status=$?
+    if [ $clone_status -eq 0 ]; then
+      cloned=true
+      break
+    fi
+    if [ $clone_status -eq 125 ] || [ $clone_attempt -ge "$CLONE_ATTEMPTS" ] || ctx_done ||
+      ! clone_error_transient "$(classify_git_error "$clone_stderr")"; then
+      break
+    fi
+    delay=$(retry_delay $clone_attempt)
+    echo "🔁 Clone of $repo_name failed ($(classify_git_error "$clone_stderr")), attempt $((clone_attempt + 1)) of $CLONE_ATTEMPTS in ${delay}s"
+    rm -rf "$temp_dir/$repo_name"
+    ctx_run sleep "$delay"
+    clone_attempt=$((clone_attempt + 1))
+  done
+  result_set_json clone_attempts "$clone_attempt"
+  if [ "$cloned" = "false" ]; then
+    local error_class=$(classify_git_error "$clone_stderr")
+    local error_message=$(grep -v '^[[:space:]]*$' "$clone_stderr" | tail -n 1 | redact_credentials)
+    if ctx_done; then
+      error_class="cancelled"
+      error_message=$(ctx_err)
+    elif [ $clone_status -eq 125 ]; then
+      error_class="clone_timeout"
+      error_message="clone took longer than $clone_timeout minutes"
+    fi
+    echo "❌ Failed to clone: $repo_name ($error_class: $error_message)"
+    result_set failure_stage clone
+    result_set error_class "$error_class"
+    result_set error "$error_message"
+    if [ "$error_class" = "sso_required" ]; then
+      local sso_url=$(grep -oE 'https://github\.com/[^ ]*sso[^ ]*' "$clone_stderr" | head -n 1)
+      result_set remediation "$(msg remediation_sso "$(repo_owner "$repo_url")" "${sso_url:-https://github.com/settings/tokens}")"
+      echo "🔑 $(msg remediation_sso "$(repo_owner "$repo_url")" "${sso_url:-https://github.com/settings/tokens}")"
+    fi
     rm -rf "$temp_dir"
     return 1
   fi
+  result_set_json clone_seconds $(( $(clock_now) - clone_started ))
+  if [ "$incremental" = "true" ]; then
+    echo "🔁 Updated cached mirror: $repo_name"
+    result_set_json incremental true
+  elif [ "$provider" = "org" ]; then
+    local unavailable=$(jq -r '.unavailable | join(", ")' "$temp_dir/$repo_name/export.json")
+    if [ -n "$unavailable" ]; then
+      echo "⚠️ Left out of $repo_name, not readable with its token: $unavailable"
+    fi
+  else
+    result_merge "$(parse_clone_progress "$clone_stderr")"
+  fi
+  
+  # Stars, watchers and topics for the results; never fails the backup
+  if [ "$(repo_option "$repo_line" social "$SOCIAL_METADATA")" = "true" ] && [ -n "$(git_repo_api "$repo_url")" ]; then
+    local social
+    if social=$(metadata_social "$repo_url" 2>/dev/null); then
+      result_set_json social "$social"
+    else
+      echo "⚠️ Could not read social metadata: $repo_name"
+    fi
+  fi
+  
+  # Auxiliary exports go into the same archive next to the mirror; an
+  # organization's settings have none
+  if [ "$provider" != "org" ]; then
+    if [ "$(repo_option "$repo_line" lfs "$BACKUP_LFS")" = "true" ] && mirror_uses_lfs "$temp_dir/$repo_name"; then
+      if ! command -v git-lfs >/dev/null; then
+        echo "⚠️ git-lfs is not installed, LFS objects not backed up: $repo_name"
+        aux_failures+=("lfs")
+      elif ctx_run git_with_token "$token" -C "$temp_dir/$repo_name" lfs fetch --all origin </dev/null 2>"$temp_dir/lfs.stderr"; then
+        echo "📦 LFS objects: $repo_name"
+        result_set_json lfs_objects true
+      else
+        echo "⚠️ Failed to back up LFS objects: $repo_name ($(tail -n 1 "$temp_dir/lfs.stderr" | redact_credentials))"
+        aux_failures+=("lfs")
+      fi
+    fi
+    if [ "$(repo_option "$repo_line" wiki "$BACKUP_WIKI")" = "true" ]; then
+      local wiki_url="${repo_url%.git}.wiki.git"
+      if ctx_run fetch_mirror "$provider" "$token" "$wiki_url" "$temp_dir/$repo_name.wiki" </dev/null 2>"$temp_dir/wiki.stderr"; then
+        archive_contents+=("$repo_name.wiki")
+      elif [ "$(classify_git_error "$temp_dir/wiki.stderr")" = "not_found" ]; then
+        echo "ℹ️ No wiki: $repo_name"
+      else
+        echo "⚠️ Failed to back up wiki: $repo_name"
+        aux_failures+=("wiki")
+      fi
+    fi
+    if [ "$(repo_option "$repo_line" artifacts "$BACKUP_ARTIFACTS")" = "true" ]; then
+      local artifact_count
+      if artifact_count=$(ctx_run backup_artifacts "$repo_url" "$temp_dir/$repo_name.artifacts" \
+        "$(repo_option "$repo_line" artifact_names "$ARTIFACT_NAMES")" 2>"$temp_dir/artifacts.stderr"); then
+        if [ "$artifact_count" -gt 0 ]; then
+          echo "📎 Actions artifacts: $artifact_count ($repo_name)"
+          archive_contents+=("$repo_name.artifacts")
+        else
+          echo "ℹ️ No Actions artifacts: $repo_name"
+          rm -rf "$temp_dir/$repo_name.artifacts"
+        fi
+        result_set_json artifacts "$artifact_count"
+      else
+        echo "⚠️ Failed to back up Actions artifacts: $repo_name ($(tail -n 1 "$temp_dir/artifacts.stderr"))"
+        aux_failures+=("artifacts")
+        # Whatever did download is still kept
+        if [ "${artifact_count:-0}" -gt 0 ]; then
+          archive_contents+=("$repo_name.artifacts")
+          result_set_json artifacts "$artifact_count"
+        fi
+      fi
+    fi
+    local metadata_export_name
+    local metadata_exported=()
+    for metadata_export_name in $(metadata_exports "$repo_line"); do
+      if ! metadata_export_known "$metadata_export_name"; then
+        echo "⚠️ Unknown metadata export $metadata_export_name: $repo_name"
+        aux_failures+=("$metadata_export_name")
+        continue
+      fi
+      mkdir -p "$temp_dir/$repo_name.metadata"
+      if ctx_run metadata_export "$metadata_export_name" "$repo_url" "$temp_dir/$repo_name.metadata/$metadata_export_name.json" \
+        2>"$temp_dir/metadata.stderr"; then
+        metadata_exported+=("$metadata_export_name")
+      else
+        echo "⚠️ Failed to export $metadata_export_name: $repo_name ($(tail -n 1 "$temp_dir/metadata.stderr" | redact_credentials))"
+        aux_failures+=("$metadata_export_name")
+      fi
+    done
+    if [ ${#metadata_exported[@]} -gt 0 ]; then
+      echo "🗂️ Metadata: ${metadata_exported[*]} ($repo_name)"
+      archive_contents+=("$repo_name.metadata")
+      result_set_json metadata "$(printf '%s\n' "${metadata_exported[@]}" | jq -R . | jq -sc .)"
+    fi
+  fi
+  
+  # Make sure no token ends up inside the stored archive
+  local content scrubbed
+  for content in "${archive_contents[@]}"; do
+    scrubbed=$(scrub_mirror_credentials "$temp_dir/$content")
+    if [ -n "$scrubbed" ]; then
+      echo "🧹 Removed credentials from $content: $(echo $scrubbed)"
+      result_set_json credentials_scrubbed true
+    fi
+  done
+  
+  if mirror_uses_lfs "$temp_dir/$repo_name"; then
+    result_set_json lfs true
+  fi
+  
+  if [ "$SENSITIVE_SCAN" = "true" ]; then
+    local findings=$(scan_sensitive_files "$temp_dir/$repo_name")
+    if [ -n "$findings" ]; then
+      echo "🔐 Sensitive files in $repo_name: $(wc -l <<<"$findings")"
+      sed 's/^/    /' <<<"$findings" | head -n 20
+      result_set_json sensitive_files "$(jq -R . <<<"$findings" | jq -sc '.[:100]')"
+    fi
+  fi
+  
+  if [ -n "$MIRROR_TREE_DIR" ] && [ "$provider" != "org" ] && ! update_mirror_tree "$temp_dir/$repo_name" "$repo_url" "$repo_name"; then
+    echo "⚠️ Failed to update mirror tree: $repo_name"
+  fi
+  
+  local content_bytes=0
+  for content in "${archive_contents[@]}"; do
+    content_bytes=$((content_bytes + $(directory_size "$temp_dir/$content")))
+  done
+  result_set_json content_bytes "$content_bytes"
+  
+  local manifest_path=""
+  local content_hash=""
+  if [ "$CONTENT_MANIFEST" = "true" ] || [ "$DEDUP_ARCHIVES" = "true" ] || delta_wanted "$repo_line"; then
+    manifest_path="$temp_dir/manifest"
+    for content in "${archive_contents[@]}"; do
+      directory_manifest "$temp_dir/$content" | sed "s#  \./#  $content/#"
+    done > "$manifest_path"
+    # Same content gives the same key, whatever the archive format or timestamps
+    if content_hash=$(hash_key "$manifest_path"); then
+      result_set content_hash "$content_hash"
+    fi
+    # Only uploaded when asked for
+    if [ "$CONTENT_MANIFEST" != "true" ]; then
+      manifest_path=""
+    fi
+  fi
   
   # Create archive
-  local archive_name="${DATE_PREFIX}_${repo_name}.zip"
-  local archive_path="$temp_dir/$archive_name"
+  local requested_format=$(repo_option "$repo_line" format "$ARCHIVE_FORMAT")
+  local format=$(resolve_archive_format "$requested_format" "$temp_dir" "${archive_contents[@]}")
+  if [ "$format" != "$requested_format" ]; then
+    echo "🗜️ Archive format: $format (requested $requested_format)"
+  fi
+  local archive_name=$(archive_name_for "$repo_name" "$DATE_PREFIX" "$(archive_extension "$format")")
+  local archive_path="$temp_dir/$(basename "$archive_name")"
+  local ZIP_LEVEL=$(repo_option "$repo_line" zip_level "$ZIP_LEVEL")
+  local encryption_key=$(encryption_key_for "$repo_line" "$repo_url")
+  
+  if [ "$DEDUP_ARCHIVES" = "true" ] && [ -n "$content_hash" ] &&
+    reuse_previous_archive "$repo_name" "$archive_name" "$content_hash" "$encryption_key"; then
+    rm -rf "$temp_dir"
+    backup_outcome "$repo_name"
+    return
+  fi
+  
+  # Only what changed since the last full archive, when there is one to build on
+  local archive_dir="$temp_dir"
+  local delta_of=""
+  if delta_wanted "$repo_line" && [ "$format" != "bundle" ] &&
+    delta_of=$(delta_base "$repo_name" "$encryption_key"); then
+    local changed
+    if changed=$(delta_stage "$temp_dir" "$temp_dir/manifest" "$(delta_base_record "$repo_name").manifest" "$delta_of" "$temp_dir/delta"); then
+      archive_dir="$temp_dir/delta"
+      archive_contents=($(ls -A "$archive_dir"))
+      echo "🧩 Delta archive: $changed changed files since $delta_of"
+      result_set delta_of "$delta_of"
+    else
+      delta_of=""
+    fi
+  fi
   
-  (cd "$temp_dir" && zip -qr "$archive_name" "$repo_name")
+  if ! ctx_run create_archive "$format" "$archive_dir" "$(basename "$archive_name")" "${archive_contents[@]}"; then
+    rm -f "$archive_dir/$(basename "$archive_name")"
+  elif [ "$archive_dir" != "$temp_dir" ]; then
+    mv "$archive_dir/$(basename "$archive_name")" "$archive_path"
+  fi
   
   if [ ! -f "$archive_path" ]; then
     echo "❌ Failed to create archive: $repo_name"
+    result_set failure_stage archive
     rm -rf "$temp_dir"
     return 1
   fi
   
-  # Upload to Azure with stdin redirected
-  if ! az storage blob upload \
-    --account-name "$AZURE_STORAGE_ACCOUNT" \
-    --account-key "$AZURE_STORAGE_KEY" \
-    --container-name "$CONTAINER_NAME" \
-    --name "$archive_name" \
-    --file "$archive_path" \
-    --overwrite \
-    --output none </dev/null 2>/dev/null; then
-    echo "❌ Failed to upload: $repo_name"
-    rm -rf "$temp_dir"
-    return 1
+  # Checked before encryption, so no private key is needed, and before
+  # upload, so a broken archive never replaces a good one as the latest
+  if [ "$(repo_option "$repo_line" verify "$VERIFY_ARCHIVES")" = "true" ]; then
+    local verify_started=$(clock_now)
+    ctx_run verify_archive "$archive_path" "$repo_name" 2>"$temp_dir/verify.stderr"
+    local verify_status=$?
+    if [ $verify_status -ne 0 ]; then
+      local verify_error=$(tail -n 1 "$temp_dir/verify.stderr")
+      local verify_class=repository_corrupt
+      [ $verify_status -eq 2 ] || verify_class=archive_unreadable
+      if ctx_done; then
+        verify_class=cancelled
+        verify_error=$(ctx_err)
+      fi
+      echo "❌ Verification failed: $repo_name ($verify_class: ${verify_error:-verification failed})"
+      result_set failure_stage verify
+      result_set error_class "$verify_class"
+      result_set error "${verify_error:-verification failed}"
+      rm -rf "$temp_dir"
+      return 1
+    fi
+    echo "🔍 Verified archive: $repo_name"
+    result_set_json verified true
+    result_set_json verify_seconds $(( $(clock_now) - verify_started ))
+  fi
+  
+  # Encryption policy: a repository that must be encrypted is never stored in the clear
+  local manifest_name="$archive_name.manifest"
+  if [ -n "$encryption_key" ]; then
+    local encrypted_path encryption_error
+    if ! encrypted_path=$(encrypt_archive "$encryption_key" "$archive_path" 2>"$temp_dir/encrypt.stderr") ||
+      { [ -n "$manifest_path" ] && ! manifest_path=$(encrypt_archive "$encryption_key" "$manifest_path" 2>>"$temp_dir/encrypt.stderr"); }; then
+      encryption_error=$(tail -n 1 "$temp_dir/encrypt.stderr")
+      echo "❌ Failed to encrypt: $repo_name (${encryption_error:-encryption failed})"
+      result_set failure_stage encryption
+      result_set error "${encryption_error:-encryption failed}"
+      rm -rf "$temp_dir"
+      return 1
+    fi
+    local suffix="${encrypted_path#"$archive_path"}"
+    archive_path="$encrypted_path"
+    archive_name="$archive_name$suffix"
+    manifest_name="$manifest_name$suffix"
+    echo "🔐 Encrypted with key $encryption_key"
+    result_set encryption_key "$encryption_key"
+  fi
+  
+  result_set archive "$archive_name"
+  result_set archive_format "$format"
+  result_set_json size_bytes "$(file_size "$archive_path")"
+  # Of the stored bytes, encrypted or not, for checksums.txt and later verification
+  result_set sha256 "$(sha256sum "$archive_path" | cut -d' ' -f1)"
+  
+  # Upload to every destination
+  local destination
+  local upload_started upload_attempt uploaded
+  local upload_attempts=0
+  for destination in $BACKUP_DESTINATIONS; do
+    upload_started=$(date +%s.%N)
+    upload_attempt=1
+    uploaded=false
+    while :; do
+      if ctx_run storage_put "$destination" "$archive_path" "$archive_name"; then
+        uploaded=true
+        break
+      fi
+      if [ $upload_attempt -ge "$UPLOAD_ATTEMPTS" ] || ctx_done; then
+        break
+      fi
+      delay=$(retry_delay $upload_attempt)
+      echo "🔁 Upload of $repo_name to $destination failed, attempt $((upload_attempt + 1)) of $UPLOAD_ATTEMPTS in ${delay}s"
+      ctx_run sleep "$delay"
+      upload_attempt=$((upload_attempt + 1))
+    done
+    # The destination that needed the most attempts
+    if [ $upload_attempt -gt $upload_attempts ]; then
+      upload_attempts=$upload_attempt
+      result_set_json upload_attempts "$upload_attempts"
+    fi
+    if [ "$uploaded" = "false" ]; then
+      result_add_upload "$destination" 0 "$upload_started"
+      echo "❌ Failed to upload: $repo_name ($destination)"
+      result_set failure_stage upload
+      rm -rf "$temp_dir"
+      return 1
+    fi
+    result_add_upload "$destination" "$(file_size "$archive_path")" "$upload_started"
+    storage_seal "$destination" "$archive_name"
+    if [ -n "$manifest_path" ]; then
+      upload_started=$(date +%s.%N)
+      if storage_put "$destination" "$manifest_path" "$manifest_name"; then
+        result_add_upload "$destination" "$(file_size "$manifest_path")" "$upload_started"
+        storage_seal "$destination" "$manifest_name"
+      else
+        echo "⚠️ Failed to upload manifest: $repo_name ($destination)"
+      fi
+    fi
+    if ! storage_update_latest "$destination" "$repo_name" "$archive_name" "$(file_size "$archive_path")"; then
+      echo "⚠️ Failed to update latest pointer: $repo_name ($destination)"
+    fi
+  done
+  if delta_wanted "$repo_line" && [ -z "$delta_of" ] &&
+    ! delta_record_base "$repo_name" "$archive_name" "$temp_dir/manifest"; then
+    echo "⚠️ Failed to record $archive_name as the base of delta archives"
   fi
   
-  echo "✅ Successfully backed up: $repo_name"
   rm -rf "$temp_dir"
-  return 0
+  backup_outcome "$repo_name"
 }
 
 # Allow function to be sourced or called directly
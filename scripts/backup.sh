@@ -0,0 +1,108 @@
+#!/bin/bash
+# Command line entry point for working with existing backups
+
+usage() {
+  echo "Usage: $0 <command> [options]"
+  echo ""
+  echo "Commands:"
+  echo "  list [repo] [--destination name] [--json]"
+  echo "      Show stored snapshots with their date, size, checksum, age and destinations"
+  echo "  search <pattern> [--repo name] [--date YYYYMMDD] [--ref ref] [--contents]"
+  echo "      Find file names (or contents) inside stored archives"
+  echo "  verify <repo>|--all [--latest] [--fsck] [--destination name]"
+  echo "      Check stored snapshots against their checksums, and optionally git fsck them"
+  echo "  import-catalog [--destination name] [--checksums]"
+  echo "      Add archives stored by older versions to the catalog and run state"
+  echo "  migrate [--layout flat|by-repo|by-month] [--format fmt] [--rename old=new]... [--repo name] [--alias] [--dry-run]"
+  echo "      Move stored archives to a new layout, format or repository name"
+  echo "  prune [--keep N] [--older-than DAYS] [--repo name] [--dry-run]"
+  echo "      Delete old snapshots, keeping the newest and what kept ones depend on"
+  echo "  check-age"
+  echo "      Alert when a repository's newest archive is older than MAX_ARCHIVE_AGE_DAYS"
+  echo "  quarantine [--release repo]..."
+  echo "      Show repositories quarantined after repeated failures, or release them"
+  echo "  retry <link>"
+  echo "      Redeem a retry link from a failure notification"
+  echo "  diff-runs <run A> <run B> [--threshold percent]"
+  echo "      Compare two runs: added/removed repositories, status and size changes"
+  echo "  digest [--days N] [--send]"
+  echo "      Summarize the last week's runs, and send it as one notification"
+  echo "  generate-monitoring --format grafana|prometheus-rules [--job name]"
+  echo "      Print a Grafana dashboard or Prometheus alert rules for the pushed metrics"
+  echo "  generate-k8s --image image [--name name] [--namespace ns] [--schedule cron] [--secret name] [--env-file file] [--config file] [--file path]..."
+  echo "      Print Kubernetes manifests running backups as a CronJob"
+  echo "  selftest [--github owner] [--keep]"
+  echo "      Back up, restore and compare a scratch repository to validate the deployment"
+  echo "  bench [--repo url] [--formats \"fmt...\"] [--threads \"n...\"] [--destination name]... [--no-upload]"
+  echo "      Measure clone, compression and upload speed here and recommend settings"
+  echo "  daemon [--schedule \"cron\"] [--health-port N] [--run-now]"
+  echo "      Keep running and back up on a cron schedule, with a health endpoint"
+}
+
+# Settings from a single configuration document, for every command
+source "$(dirname "$0")/config-blob.sh"
+config_blob_load || exit 1
+source "$(dirname "$0")/workdir.sh"
+work_dir_enter >/dev/null || exit 1
+
+command="$1"
+shift
+
+case "$command" in
+  list)
+    "$(dirname "$0")/list.sh" "$@"
+    ;;
+  search)
+    "$(dirname "$0")/search.sh" "$@"
+    ;;
+  verify)
+    "$(dirname "$0")/verify.sh" "$@"
+    ;;
+  import-catalog)
+    "$(dirname "$0")/import-catalog.sh" "$@"
+    ;;
+  migrate)
+    "$(dirname "$0")/migrate.sh" "$@"
+    ;;
+  prune)
+    "$(dirname "$0")/prune.sh" "$@"
+    ;;
+  check-age)
+    "$(dirname "$0")/check-age.sh" "$@"
+    ;;
+  quarantine)
+    "$(dirname "$0")/quarantine.sh" "$@"
+    ;;
+  retry)
+    "$(dirname "$0")/retry.sh" "$@"
+    ;;
+  diff-runs)
+    "$(dirname "$0")/diff-runs.sh" "$@"
+    ;;
+  digest)
+    "$(dirname "$0")/digest.sh" "$@"
+    ;;
+  generate-monitoring)
+    "$(dirname "$0")/generate-monitoring.sh" "$@"
+    ;;
+  generate-k8s)
+    "$(dirname "$0")/generate-k8s.sh" "$@"
+    ;;
+  selftest)
+    "$(dirname "$0")/selftest.sh" "$@"
+    ;;
+  bench)
+    "$(dirname "$0")/bench.sh" "$@"
+    ;;
+  daemon)
+    "$(dirname "$0")/daemon.sh" "$@"
+    ;;
+  help|-h|--help|"")
+    usage
+    ;;
+  *)
+    echo "❌ Unknown command: $command"
+    usage
+    exit 1
+    ;;
+esac
@@ -0,0 +1,151 @@
+#!/bin/bash
+# Measure on this machine how fast a sample repository clones, how each
+# archive format compresses it (tar.zst at several thread counts), and how
+# fast the archive uploads to each destination, then recommend the settings
+# with which a backup finishes soonest. Nothing is stored but a temporary
+# _bench/ object on each destination, deleted right after its upload.
+
+source "$(dirname "${BASH_SOURCE[0]}")/backup-repo.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+# Repository cloned for the benchmark; pick one like those being backed up
+BENCH_REPO_URL="${BENCH_REPO_URL:-https://github.com/jqlang/jq.git}"
+# Formats compared; zip:<level> is zip at that ZIP_LEVEL
+BENCH_FORMATS="${BENCH_FORMATS:-zip:1 zip:6 zip:9 zip-store tar.gz tar.zst bundle}"
+# zstd thread counts tried for tar.zst (WALK_WORKERS)
+BENCH_THREADS="${BENCH_THREADS:-1 2 4 $(nproc 2>/dev/null || echo 4)}"
+# Upload rate assumed when uploads aren't measured (--no-upload), in MB/s
+BENCH_ASSUMED_UPLOAD_MBPS="${BENCH_ASSUMED_UPLOAD_MBPS:-50}"
+
+# Seconds since a start taken with date +%s.%N
+bench_seconds() {
+  awk -v started="$1" -v now="$(date +%s.%N)" 'BEGIN { printf "%.2f", now - started }'
+}
+
+# backup_bench [--repo url] [--formats "fmt..."] [--threads "n..."] [--destination name]... [--no-upload]
+backup_bench() {
+  local url="$BENCH_REPO_URL"
+  local formats="$BENCH_FORMATS"
+  local threads="$BENCH_THREADS"
+  local destinations=""
+  local upload=true
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --repo) url="$2"; shift 2 ;;
+      --formats) formats="$2"; shift 2 ;;
+      --threads) threads="$2"; shift 2 ;;
+      --destination) destinations="${destinations:+$destinations }$2"; shift 2 ;;
+      --no-upload) upload=false; shift ;;
+      *)
+        echo "❌ Usage: bench [--repo url] [--formats \"fmt...\"] [--threads \"n...\"] [--destination name]... [--no-upload]"
+        return 2
+        ;;
+    esac
+  done
+  destinations="${destinations:-$BACKUP_DESTINATIONS}"
+  threads=$(tr ' ' '\n' <<<"$threads" | grep -E '^[1-9][0-9]*$' | sort -nu | tr '\n' ' ')
+
+  local scratch=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+  local repo_name=$(basename "${url%/}" .git)
+  local provider=$(source_provider_of "$url")
+  local location token started seconds bytes
+  echo "⏱️ Benchmarking with $url"
+  if ! location=$(source_call "$provider" resolve "$url"); then
+    rm -rf "$scratch"
+    return 1
+  fi
+  token=$(source_call "$provider" token "$url")
+  started=$(date +%s.%N)
+  if ! source_call "$provider" fetch "$location" "$token" "$scratch/$repo_name" >/dev/null 2>"$scratch/clone.err"; then
+    echo "❌ Could not clone $url: $(tail -n 1 "$scratch/clone.err")"
+    rm -rf "$scratch"
+    return 1
+  fi
+  local clone_seconds=$(bench_seconds "$started")
+  local mirror_bytes=$(du -sb "$scratch/$repo_name" | cut -f1)
+  jq -rn "$RESULTS_JQ_DEFS"'"⬇️ Clone: \($bytes | size_human) in \($seconds)s (\(if $seconds > 0 then "\($bytes / $seconds | size_human)/s" else "-" end))"' \
+    --argjson bytes "$mirror_bytes" --argjson seconds "$clone_seconds"
+
+  # One row per format (and thread count), as JSON
+  local spec format level count label archive rows="" upload_file=""
+  for spec in $formats; do
+    format="${spec%%:*}"
+    level=""
+    [[ "$spec" != *:* ]] || level="${spec#*:}"
+    if declare -F "$(archiver_for "$format")_available" >/dev/null && ! "$(archiver_for "$format")_available"; then
+      echo "⚠️ Skipping $format (not installed)"
+      continue
+    fi
+    for count in $([ "$format" = "tar.zst" ] && echo "$threads" || echo 1); do
+      label="$format${level:+ level $level}$([ "$format" = "tar.zst" ] && echo " ×$count")"
+      archive="bench.$(archive_extension "$format")"
+      rm -f "$scratch/$archive"
+      started=$(date +%s.%N)
+      if ! ZIP_LEVEL="${level:-$ZIP_LEVEL}" WALK_WORKERS="$count" create_archive "$format" "$scratch" "$archive" "$repo_name" 2>/dev/null; then
+        echo "⚠️ Could not create a $label archive"
+        continue
+      fi
+      seconds=$(bench_seconds "$started")
+      bytes=$(file_size "$scratch/$archive")
+      echo "🗜️ $label: ${seconds}s, $(jq -rn "$RESULTS_JQ_DEFS"'$bytes | size_human' --argjson bytes "$bytes")"
+      rows="$rows$(jq -cn --arg name "$label" --arg format "$format" --arg level "$level" --argjson threads "$count" \
+        --argjson seconds "$seconds" --argjson bytes "$bytes" \
+        '{name: $name, format: $format, level: $level, threads: $threads, seconds: $seconds, bytes: $bytes}')"$'\n'
+      # The first archive built is the one uploaded
+      if [ -z "$upload_file" ]; then
+        upload_file="$scratch/upload.$(archive_extension "$format")"
+        mv "$scratch/$archive" "$upload_file"
+      fi
+    done
+  done
+  if [ -z "$rows" ]; then
+    echo "❌ No archive format worked"
+    rm -rf "$scratch"
+    return 1
+  fi
+
+  # The slowest destination bounds how fast archives get stored
+  local destination name rate upload_rate=""
+  if [ "$upload" = "true" ]; then
+    bytes=$(file_size "$upload_file")
+    for destination in $destinations; do
+      name="_bench/$(date +%Y%m%d_%H%M%S)_$repo_name.${upload_file##*/upload.}"
+      started=$(date +%s.%N)
+      if ! storage_put "$destination" "$upload_file" "$name"; then
+        echo "⚠️ Could not upload to $destination"
+        continue
+      fi
+      seconds=$(bench_seconds "$started")
+      storage_delete "$destination" "$name" || echo "⚠️ Could not delete $name from $destination"
+      rate=$(awk -v bytes="$bytes" -v seconds="$seconds" 'BEGIN { printf "%d", bytes / (seconds > 0.01 ? seconds : 0.01) }')
+      echo "⬆️ Upload to $destination: $(jq -rn "$RESULTS_JQ_DEFS"'"\($bytes | size_human) in \($seconds)s (\($rate | size_human)/s)"' \
+        --argjson bytes "$bytes" --argjson seconds "$seconds" --argjson rate "$rate")"
+      if [ -z "$upload_rate" ] || [ "$rate" -lt "$upload_rate" ]; then
+        upload_rate="$rate"
+      fi
+    done
+  fi
+  if [ -z "$upload_rate" ]; then
+    upload_rate=$((BENCH_ASSUMED_UPLOAD_MBPS * 1048576))
+    echo "ℹ️ Upload not measured, assuming $BENCH_ASSUMED_UPLOAD_MBPS MB/s"
+  fi
+  rm -rf "$scratch"
+
+  # Archiving plus storing the result, per format; the fastest wins
+  jq -rs --argjson rate "$upload_rate" --argjson clone "$clone_seconds" "$RESULTS_JQ_DEFS"'
+    map(. + {total: (.seconds + .bytes / $rate)}) | sort_by(.total) |
+    "",
+    "Archive and upload, fastest first:",
+    (.[] | "  \(.name): \(.total * 100 | round / 100)s (\(.seconds)s archiving, \(.bytes | size_human))"),
+    "",
+    (.[0] | "✅ Recommended for this machine: ARCHIVE_FORMAT=\(.format)\(
+      if .level != "" then " ZIP_LEVEL=\(.level)" else "" end)\(
+      if .format == "tar.zst" then " WALK_WORKERS=\(.threads)" else "" end)"),
+    (if $clone > .[0].total then "💡 Cloning took longer than archiving and uploading; MIRROR_CACHE_DIR fetches only what changed on later runs" else empty end)
+  ' <<<"$rows"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_bench "$@"
+fi
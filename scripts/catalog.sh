@@ -0,0 +1,86 @@
+#!/bin/bash
+# Catalog of every stored archive, kept with the run state so archives can be
+# found without listing and parsing storage. Each entry looks like
+#   {"repository": "repo1", "archive": "20240115_143000_repo1.zip",
+#    "date": "20240115_143000", "size_bytes": 1234, "destinations": ["azure"]}
+# Backups carry the "sha256" checksum of the stored file, and entries added by
+# import-catalog --checksums a "sha256" or "blake3" one; backups with a content manifest carry the
+# "content_hash" of what was archived. Deduplicated backups have no object of
+# their own: "dedup_of" names the archive that holds their content. Delta
+# archives (see delta.sh) name their base in "delta_of".
+
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/archive.sh"
+
+# Stored archive names: [<dirs>/]<YYYYMMDD_HHMMSS>_<repo>.<zip|bundle|tar.zst|tar.gz>[.age|.gpg|.asc|.aes]
+ARCHIVE_NAME_REGEX='^(.*/)?([0-9]{8}_[0-9]{6})_([^/]+)\.(zip|bundle|tar\.zst|tar\.gz)(\.(age|gpg|asc|aes))?$'
+
+# Read names from stdin and print "<date> <repo> <archive>" for each archive among them
+parse_archive_names() {
+  sed -nE "s#$ARCHIVE_NAME_REGEX#\2 \3 &#p"
+}
+
+# Seconds since the epoch of an archive date (YYYYMMDD_HHMMSS, runner local time)
+archive_date_epoch() {
+  local date="$1"
+  date -d "${date:0:8} ${date:9:2}:${date:11:2}:${date:13:2}" +%s
+}
+
+# Add an archive to the catalog: catalog_add <repo> <archive> <date> <size> [destinations]
+catalog_add() {
+  local tmp="$CATALOG_FILE.tmp"
+  jq --arg repo "$1" --arg archive "$2" --arg date "$3" --argjson size "$4" \
+    --arg destinations "${5:-$BACKUP_DESTINATIONS}" \
+    'map(select(.archive != $archive)) + [{repository: $repo, archive: $archive, date: $date,
+      size_bytes: $size, destinations: ($destinations | split(" ") | map(select(. != "")))}]' \
+    "$CATALOG_FILE" > "$tmp" && mv "$tmp" "$CATALOG_FILE"
+}
+
+# Set a field on an archive's entry: catalog_set <archive> <key> <JSON value>
+catalog_set() {
+  local tmp="$CATALOG_FILE.tmp"
+  jq --arg archive "$1" --arg key "$2" --argjson value "$3" \
+    'map(if .archive == $archive then .[$key] = $value else . end)' \
+    "$CATALOG_FILE" > "$tmp" && mv "$tmp" "$CATALOG_FILE"
+}
+
+# Point deduplicated backups and deltas at an archive's new name: catalog_repoint <old> <new>
+catalog_repoint() {
+  local tmp="$CATALOG_FILE.tmp"
+  jq --arg old "$1" --arg new "$2" \
+    'map(if .dedup_of == $old then .dedup_of = $new else . end |
+      if .delta_of == $old then .delta_of = $new else . end)' \
+    "$CATALOG_FILE" > "$tmp" && mv "$tmp" "$CATALOG_FILE"
+}
+
+# The catalog's JSON, from CATALOG_JSON when the state is kept in memory
+catalog_json() {
+  if [ "$STATE_IN_MEMORY" = "true" ]; then
+    echo "$CATALOG_JSON"
+  else
+    cat "$CATALOG_FILE"
+  fi
+}
+
+# Newest entry of a repository if it has the same content and encryption key:
+# catalog_same_content <repo> <content hash> [encryption key]
+catalog_same_content() {
+  catalog_json | jq -c --arg repo "$1" --arg hash "$2" --arg key "$3" \
+    '[.[] | select(.repository == $repo)] | sort_by(.date) | last // empty |
+      select(.content_hash == $hash and (.encryption_key // "") == $key)'
+}
+
+# Catalog entries, oldest first, one JSON object per line: catalog_entries [repo] [date prefix]
+catalog_entries() {
+  catalog_json | jq -c --arg repo "$1" --arg date "$2" \
+    'sort_by(.date) | .[] | select(($repo == "" or .repository == $repo) and (.date | startswith($date)))'
+}
+
+# Average archive size of a repository's most recent full backups (0 without history)
+catalog_average_size() {
+  local repo_name="$1"
+  local count="${2:-5}"
+  catalog_json | jq --arg repo "$repo_name" --argjson count "$count" \
+    '[.[] | select(.repository == $repo and .delta_of == null)] | sort_by(.date) | .[-$count:] | map(.size_bytes) |
+      if length == 0 then 0 else add / length | floor end'
+}
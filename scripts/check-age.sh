@@ -0,0 +1,77 @@
+#!/bin/bash
+# Alert when the newest stored archive of a repository is too old. Looks at
+# storage rather than run state, so it also catches repositories that silently
+# dropped out of repos.txt or runs that stopped happening altogether.
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/discover.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/send-webhook.sh"
+
+# Newest archive allowed, in days on top of the repository's backup frequency
+MAX_ARCHIVE_AGE_DAYS="${MAX_ARCHIVE_AGE_DAYS:-2}"
+
+# Newest archive of every repository on the primary destination, as "<name> <epoch>"
+newest_archives() {
+  storage_list "$(primary_destination)" | parse_archive_names |
+    sort -k2,2 -k1,1 | awk '{ newest[$2] = $1 } END { for (name in newest) print name, newest[name] }' |
+    while read -r name date; do
+      echo "$name $(archive_date_epoch "$date")"
+    done
+}
+
+# Days a repository's frequency adds to the allowed archive age
+frequency_days() {
+  case "$1" in
+    weekly*) echo 7 ;;
+    monthly*) echo 31 ;;
+    *) echo 0 ;;
+  esac
+}
+
+# Print stale repositories and alert about them; returns 1 if there are any
+check_archive_age() {
+  declare -A newest frequency
+  local name stamp line
+  while read -r name stamp; do
+    newest[$name]="$stamp"
+  done < <(newest_archives)
+  if [ -f "$REPOS_FILE" ]; then
+    while IFS= read -r line; do
+      frequency[$(repo_display_name "$line")]=$(repo_option "$line" frequency daily)
+    done < <(repo_lines)
+  fi
+
+  local now=$(clock_now)
+  local stale=""
+  local checked=0
+  for name in $(printf '%s\n' "${!newest[@]}" "${!frequency[@]}" | sort -u); do
+    checked=$((checked + 1))
+    if [ -z "${newest[$name]}" ]; then
+      stale="${stale}${name} (never), "
+      continue
+    fi
+    local age_days=$(( (now - newest[$name]) / 86400 ))
+    local allowed=$(( MAX_ARCHIVE_AGE_DAYS + $(frequency_days "${frequency[$name]}") ))
+    if [ $age_days -gt $allowed ]; then
+      if [ -n "${frequency[$name]}" ]; then
+        stale="${stale}${name} (${age_days}d), "
+      else
+        stale="${stale}${name} (${age_days}d, not in repos.txt), "
+      fi
+    fi
+  done
+
+  if [ -z "$stale" ]; then
+    echo "✅ All $checked repositories have a recent archive"
+    return 0
+  fi
+  echo "❌ Stale archives: ${stale%, }"
+  queue_webhook false "$(msg result_stale "$MAX_ARCHIVE_AGE_DAYS" "${stale%, }")" ""
+  flush_webhooks
+  return 1
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  check_archive_age
+fi
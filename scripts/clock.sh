@@ -0,0 +1,39 @@
+#!/bin/bash
+# Where retention, naming and cleanup read the time from: the system clock, or
+# with BACKUP_CLOCK_FILE the epoch written in that file, read on every call.
+# A script can then replay a month of daily runs, or a run crossing midnight,
+# by writing the next time to the file between runs instead of waiting for
+# it. What a run records comes from it too: start and finish times and the
+# durations of backups, clones and verifications, so a simulated run is
+# consistent with its own RUN_EPOCH. Waits (timeouts, rate limits) and
+# transfer speeds always use the system clock.
+
+# File holding the current time as seconds since the epoch, for simulations
+BACKUP_CLOCK_FILE="${BACKUP_CLOCK_FILE:-}"
+
+# Seconds since the epoch
+clock_now() {
+  if [ -z "$BACKUP_CLOCK_FILE" ]; then
+    date +%s
+    return
+  fi
+  local now
+  read -r now < "$BACKUP_CLOCK_FILE" 2>/dev/null
+  if ! [[ "$now" =~ ^[0-9]+$ ]]; then
+    echo "❌ BACKUP_CLOCK_FILE $BACKUP_CLOCK_FILE does not hold an epoch" >&2
+    return 1
+  fi
+  echo "$now"
+}
+
+# date for the current time, or that many seconds ago: clock_date [--ago seconds] [date args...]
+clock_date() {
+  local ago=0
+  if [ "$1" = "--ago" ]; then
+    ago="$2"
+    shift 2
+  fi
+  local now
+  now=$(clock_now) || return 1
+  date -d "@$((now - ago))" "$@"
+}
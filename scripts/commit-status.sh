@@ -0,0 +1,101 @@
+#!/bin/bash
+# Commit the status manifest back to this repository (used by the workflow).
+# A push rejected because something else was pushed since the checkout (a
+# tenant's run, a person editing repos.txt) is rebased onto the remote and
+# tried again. The manifests are generated, so when only they conflict this
+# run's version is kept. Returns 1 when the push keeps failing and 3 when
+# another file conflicts, which needs a person to resolve.
+
+# Pushes tried before giving up
+STATUS_PUSH_ATTEMPTS="${STATUS_PUSH_ATTEMPTS:-3}"
+
+# Whether a path is a generated status manifest
+status_manifest_path() {
+  case "$1" in
+    STATUS.md | status.json | "${TENANTS_DIR:-tenants}"/*/STATUS.md | "${TENANTS_DIR:-tenants}"/*/status.json) return 0 ;;
+  esac
+  return 1
+}
+
+# Finish a rebase that stopped on conflicts, as long as every conflicting file
+# is a manifest: this run's version replaces whatever was pushed meanwhile.
+# Returns 1, leaving the rebase stopped, when another file conflicts.
+status_rebase_resolve() {
+  local conflicts file
+  while conflicts=$(git diff --name-only --diff-filter=U) && [ -n "$conflicts" ]; do
+    while IFS= read -r file; do
+      status_manifest_path "$file" || return 1
+    done <<<"$conflicts"
+    echo "🔀 Keeping this run's version of: $(echo $conflicts)"
+    # While rebasing, "theirs" is the commit being replayed: this run's
+    while IFS= read -r file; do
+      git checkout -q --theirs -- "$file"
+      git add -- "$file"
+    done <<<"$conflicts"
+    if git diff --cached --quiet; then
+      # Identical to what was pushed; nothing of this commit is left
+      git rebase --skip >/dev/null 2>&1 && return 0
+    else
+      GIT_EDITOR=true git -c user.name="github-actions[bot]" \
+        -c user.email="41898282+github-actions[bot]@users.noreply.github.com" \
+        rebase --continue >/dev/null 2>&1 && return 0
+    fi
+  done
+  # Still rebasing means it stopped for another reason than a conflict
+  ! [ -d "$(git rev-parse --git-path rebase-merge)" ] && ! [ -d "$(git rev-parse --git-path rebase-apply)" ]
+}
+
+commit_and_push() {
+  local manifests=($(ls STATUS.md status.json "${TENANTS_DIR:-tenants}"/*/STATUS.md "${TENANTS_DIR:-tenants}"/*/status.json 2>/dev/null))
+  if [ ${#manifests[@]} -eq 0 ]; then
+    echo "📋 No status manifest to commit"
+    return 0
+  fi
+
+  git add "${manifests[@]}"
+  if git diff --cached --quiet; then
+    echo "📋 Status unchanged, nothing to commit"
+    return 0
+  fi
+
+  git -c user.name="github-actions[bot]" \
+    -c user.email="41898282+github-actions[bot]@users.noreply.github.com" \
+    commit -q -m "Update backup status"
+  local push_stderr=$(mktemp)
+  local attempt=1
+  while ! git push -q 2>"$push_stderr"; do
+    if [ $attempt -ge "$STATUS_PUSH_ATTEMPTS" ]; then
+      echo "❌ Failed to push status update after $attempt attempts: $(grep -v '^[[:space:]]*$' "$push_stderr" | tail -n 1)"
+      rm -f "$push_stderr"
+      return 1
+    fi
+    echo "🔁 Push of the status update failed, rebasing onto the remote (attempt $((attempt + 1)) of $STATUS_PUSH_ATTEMPTS)"
+    if ! git -c user.name="github-actions[bot]" \
+      -c user.email="41898282+github-actions[bot]@users.noreply.github.com" \
+      pull -q --rebase >/dev/null 2>"$push_stderr"; then
+      if [ -n "$(git diff --name-only --diff-filter=U)" ]; then
+        if ! status_rebase_resolve; then
+          local conflicts=$(git diff --name-only --diff-filter=U | tr '\n' ' ')
+          git rebase --abort
+          echo "❌ Status update conflicts with changes pushed meanwhile: ${conflicts% }"
+          rm -f "$push_stderr"
+          return 3
+        fi
+        # Push the resolved rebase right away
+        attempt=$((attempt + 1))
+        continue
+      fi
+      # Fetching failed too; the next push attempt tells whether it still does
+      git rebase --abort 2>/dev/null
+    fi
+    sleep $((2 ** attempt))
+    attempt=$((attempt + 1))
+  done
+  rm -f "$push_stderr"
+  echo "📋 Status committed"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  commit_and_push
+fi
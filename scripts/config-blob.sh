@@ -0,0 +1,82 @@
+#!/bin/bash
+# The whole configuration as one YAML or JSON document, for containers that
+# get nothing but environment variables and have no repos.txt baked in.
+# BACKUP_CONFIG_YAML holds the document, or BACKUP_CONFIG_FILE names a
+# mounted file with it:
+#   repositories:
+#     - https://github.com/acme/api.git
+#     - https://github.com/acme/monorepo.git frequency=weekly:sun
+#     - {url: "org:acme", exclude: "sandbox-.*"}
+#   settings:
+#     BACKUP_DESTINATIONS: gcs
+#     GCS_BUCKET: acme-backups
+#   messages:
+#     result_success: "%s repositories backed up"
+#   redact_rules:
+#     - 'internal\.acme\.com => [internal]'
+# Settings already in the environment win, so secrets can stay in their own
+# variables. Load it before sourcing anything else, since scripts read their
+# settings when sourced.
+
+BACKUP_CONFIG_YAML="${BACKUP_CONFIG_YAML:-}"
+BACKUP_CONFIG_FILE="${BACKUP_CONFIG_FILE:-}"
+
+# The document as JSON; YAML needs yq (either the Go or the Python one)
+config_blob_json() {
+  local document="$BACKUP_CONFIG_YAML"
+  if [ -z "$document" ]; then
+    document=$(cat "$BACKUP_CONFIG_FILE") || return 1
+  fi
+  if jq -e 'type == "object"' <<<"$document" >/dev/null 2>&1; then
+    jq -c . <<<"$document"
+    return
+  fi
+  if ! command -v yq >/dev/null; then
+    echo "yq is needed for a YAML configuration (or pass it as JSON)" >&2
+    return 1
+  fi
+  { yq -o=json . <<<"$document" 2>/dev/null || yq . <<<"$document"; } |
+    jq -ce 'if type == "object" then . else error("not a mapping") end'
+}
+
+# Export the document's settings and point REPOS_FILE, MESSAGES_FILE and
+# REDACT_RULES at its other parts; does nothing without a document
+config_blob_load() {
+  if [ -z "$BACKUP_CONFIG_YAML" ] && [ -z "$BACKUP_CONFIG_FILE" ]; then
+    return 0
+  fi
+  local config
+  if ! config=$(config_blob_json); then
+    echo "❌ The configuration in ${BACKUP_CONFIG_FILE:-BACKUP_CONFIG_YAML} is not a valid YAML or JSON document"
+    return 1
+  fi
+
+  local key value
+  while read -r key value; do
+    if [ -z "${!key+set}" ]; then
+      export "$key=$(base64 -d <<<"$value")"
+    fi
+  done < <(jq -r '.settings // {} | to_entries[] | select(.key | test("^[A-Za-z_][A-Za-z0-9_]*$")) |
+    "\(.key) \(.value | if type == "string" then . else tojson end | @base64)"' <<<"$config")
+
+  # Written before the run moves into WORK_DIR, which the settings may name
+  local dir="${TMPDIR:-/tmp}/backup-config-$$"
+  if [ -z "$TMPDIR" ] && [ -n "$WORK_DIR" ]; then
+    dir="$WORK_DIR/tmp/backup-config-$$"
+  fi
+  mkdir -p "$dir" || return 1
+  if [ -z "$REPOS_FILE" ] && jq -e 'has("repositories")' <<<"$config" >/dev/null; then
+    # Entries are repos.txt lines, or objects with the URL and the options
+    jq -r '.repositories[] | if type == "string" then . else
+      ([.url] + (del(.url) | to_entries | map("\(.key)=\(.value)")) | join(" ")) end' <<<"$config" > "$dir/repos.txt"
+    export REPOS_FILE="$dir/repos.txt"
+  fi
+  if [ -z "$MESSAGES_FILE" ] && jq -e 'has("messages")' <<<"$config" >/dev/null; then
+    jq '.messages' <<<"$config" > "$dir/messages.json"
+    export MESSAGES_FILE="$dir/messages.json"
+  fi
+  local rules=$(jq -r '.redact_rules // [] | .[]' <<<"$config")
+  if [ -n "$rules" ]; then
+    export REDACT_RULES="${REDACT_RULES:+$REDACT_RULES$'\n'}$rules"
+  fi
+}
@@ -0,0 +1,244 @@
+#!/bin/bash
+# Startup checks for credentials in the wrong place: tokens written into
+# repos.txt or a tenant.env, secrets committed to this repository, and tokens
+# that don't look like tokens. Leaked credentials stop the run; suspicious
+# values are reported with a hint.
+
+source "$(dirname "${BASH_SOURCE[0]}")/redact.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/hosts.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/encrypt.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/send-webhook.sh"
+
+# "strict" refuses to run on errors, "warn" only reports them, "off" skips the checks
+CONFIG_CHECK="${CONFIG_CHECK:-strict}"
+
+# GitHub and GitLab token formats, and URLs with embedded credentials
+CONFIG_TOKEN_PATTERN='(gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,}|glpat-[A-Za-z0-9_-]{20,}|[a-z]+://[^/@[:space:]]+:[^/@[:space:]]+@|[a-z]+://[A-Za-z0-9_]{20,}@)'
+# Settings that are secrets and must only ever come from the environment
+CONFIG_SECRET_VARS="GITHUB_TOKEN GITHUB_APP_PRIVATE_KEY GITLAB_TOKEN WEBHOOK_URL DIGEST_WEBHOOK_URL AZURE_STORAGE_KEY SFTP_KEY RCLONE_CONFIG STATUS_TOKEN RETRY_SECRET"
+
+CONFIG_ERRORS=0
+CONFIG_WARNINGS=0
+
+# Report a problem: config_issue <error|warning> <message> <hint>
+config_issue() {
+  if [ "$1" = "error" ]; then
+    echo "❌ $2"
+    CONFIG_ERRORS=$((CONFIG_ERRORS + 1))
+  else
+    echo "⚠️ $2"
+    CONFIG_WARNINGS=$((CONFIG_WARNINGS + 1))
+  fi
+  echo "   🔑 $3"
+}
+
+# Tokens written literally into a configuration file
+config_check_file() {
+  local file="$1"
+  local hint="$2"
+  [ -f "$file" ] || return 0
+  local number
+  while IFS=: read -r number _; do
+    config_issue error "$file line $number contains a credential" "$hint"
+  done < <(grep -nE "$CONFIG_TOKEN_PATTERN" "$file" | grep -vE '^[0-9]+:[[:space:]]*#')
+}
+
+# Variables holding the passphrases of passphrase keys
+config_passphrase_variables() {
+  local variable spec
+  for variable in $(compgen -v ENCRYPTION_KEY_); do
+    spec="${!variable}"
+    if [ "${spec%%:*}" = "passphrase" ] && [[ "${spec#*:}" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]]; then
+      echo "${spec#*:}"
+    fi
+  done
+}
+
+# Secret values that also appear in files committed to this repository
+config_check_committed_secrets() {
+  git rev-parse --is-inside-work-tree >/dev/null 2>&1 || return 0
+  local variable value files
+  for variable in $CONFIG_SECRET_VARS $(compgen -v GIT_TOKEN_) $(config_passphrase_variables); do
+    value="${!variable}"
+    # Settings that may name a file (a private key's path) are only checked by content
+    if [ ${#value} -lt 12 ] || [ -f "$value" ]; then
+      continue
+    fi
+    files=$(git grep -lF -e "$value" 2>/dev/null | head -n 3 | tr '\n' ' ')
+    if [ -n "$files" ]; then
+      config_issue error "$variable is committed to this repository ($files)" \
+        "Rotate it, remove it from the files and the history, and keep it in a secret"
+    fi
+  done
+}
+
+# token=<name> options in repos.txt whose GIT_TOKEN_<NAME> isn't set
+config_check_named_tokens() {
+  local file="${REPOS_FILE:-repos.txt}"
+  [ -f "$file" ] || return 0
+  local name
+  for name in $(grep -v '^[[:space:]]*#' "$file" | grep -oE '(^|[[:space:]])token=[A-Za-z0-9_.-]+' | sed 's/.*token=//' | sort -u); do
+    if [ -z "$(git_named_token "$name")" ]; then
+      config_issue warning "repos.txt uses token=$name, but $(git_named_token_variable "$name") is not set" \
+        "Add the token as a secret and pass it to the workflow's env as $(git_named_token_variable "$name")"
+    fi
+  done
+}
+
+# frequency= options in repos.txt that repo_is_due can't read
+config_check_frequencies() {
+  local file="${REPOS_FILE:-repos.txt}"
+  [ -f "$file" ] || return 0
+  local frequency
+  for frequency in $(grep -v '^[[:space:]]*#' "$file" | grep -oE '(^|[[:space:]])frequency=[^[:space:]]*' | sed 's/.*frequency=//' | sort -u); do
+    if ! repo_frequency_valid "$frequency"; then
+      config_issue error "repos.txt uses frequency=$frequency, which is not a frequency" \
+        "Write daily, weekly, weekly:<mon..sun>, monthly or monthly:<1..28>"
+    fi
+  done
+}
+
+# Tokens whose format suggests a password or a copy-and-paste mistake
+config_check_tokens() {
+  if [ -n "$GITHUB_TOKEN" ]; then
+    if [[ "$GITHUB_TOKEN" =~ [[:space:]] ]]; then
+      config_issue error "GITHUB_TOKEN contains whitespace" \
+        "Copy the token again without the surrounding spaces or line breaks"
+    elif [[ ! "$GITHUB_TOKEN" =~ ^(gh[pousr]_[A-Za-z0-9]{30,}|github_pat_[A-Za-z0-9_]{30,}|[0-9a-f]{40})$ ]]; then
+      config_issue warning "GITHUB_TOKEN doesn't look like a GitHub token (a password?)" \
+        "GitHub doesn't accept passwords for git; create a fine-grained or classic token with read access to the repositories"
+    fi
+  fi
+  if [ -n "$GITLAB_TOKEN" ] && [[ ! "$GITLAB_TOKEN" =~ ^(glpat-)?[A-Za-z0-9_-]{20,}$ ]]; then
+    config_issue warning "GITLAB_TOKEN doesn't look like a GitLab token" \
+      "Create a personal or group access token with read_repository and read_api scopes"
+  fi
+  if [ -n "$WEBHOOK_URL" ]; then
+    if [[ "$WEBHOOK_URL" != https://* ]]; then
+      config_issue warning "WEBHOOK_URL is not an https URL" \
+        "Notifications (with repository names and errors) would travel unencrypted"
+    elif [[ "$WEBHOOK_URL" =~ ^https://[^/@]+@ ]]; then
+      config_issue warning "WEBHOOK_URL carries credentials before the host" \
+        "Use the URL your chat tool generated; credentials in it show up in proxy and error logs"
+    fi
+  fi
+}
+
+# NOTIFY_TIERS entries that can't be read
+config_check_notify_tiers() {
+  local entry
+  while IFS= read -r entry; do
+    [ -n "$entry" ] || continue
+    config_issue error "NOTIFY_TIERS entry $entry is malformed" \
+      "Write entries as <tier>:<runs failed in a row>:<page|failure|warning>, e.g. archive:3:warning"
+  done < <(notify_tiers_problems)
+}
+
+# GIT_HOSTS entries that can't be read
+config_check_git_hosts() {
+  local entry
+  while IFS= read -r entry; do
+    [ -n "$entry" ] || continue
+    config_issue error "GIT_HOSTS entry $entry is malformed" \
+      "Write entries as host[:port][/path][:type], e.g. *.example.com, git.example.com:8443/gitlab:gitlab"
+  done < <(git_hosts_problems)
+}
+
+# Encryption keys that would fail every backup they are used for: unknown
+# methods, recipients that aren't public keys, and a policy without its key
+config_check_encryption_keys() {
+  local variable spec problem
+  local uses_age=false
+  local uses_gpg=false
+  local uses_passphrase=false
+  for variable in $(compgen -v ENCRYPTION_KEY_); do
+    spec="${!variable}"
+    case "${spec%%:*}" in
+      age)
+        uses_age=true
+        while IFS= read -r problem; do
+          if [[ "$problem" == *"age identity"* ]]; then
+            config_issue error "$variable: $problem" \
+              "Remove the private key from the configuration, rotate it if it was shared, and configure the age1... public key"
+          else
+            config_issue error "$variable: $problem" \
+              "Use age:<recipient>[,<recipient>...] with age1... or SSH public keys, or @<file> listing them"
+          fi
+        done < <(age_recipients_problem "${spec#*:}")
+        ;;
+      gpg)
+        uses_gpg=true
+        while IFS= read -r problem; do
+          config_issue error "$variable: $problem" \
+            "Use gpg:<fingerprint>[,<fingerprint>...] with full fingerprints (gpg --fingerprint <key>)"
+        done < <(gpg_fingerprints_problem "${spec#*:}")
+        ;;
+      passphrase)
+        uses_passphrase=true
+        problem=$(passphrase_problem "${spec#*:}")
+        if [[ "$problem" == *shorter* ]]; then
+          config_issue error "$variable: $problem" \
+            "Generate a long random one, e.g. openssl rand -base64 24, and keep it where restores can get it"
+        elif [ -n "$problem" ]; then
+          config_issue error "$variable: $problem" \
+            "Keep the passphrase in a secret passed as its own variable (passphrase:<VARIABLE>) or in a file (passphrase:@<file>)"
+        fi
+        ;;
+      *)
+        config_issue error "$variable uses an unknown encryption method (${spec%%:*})" \
+          "Write it as age:<recipient>, gpg:<fingerprint> or passphrase:<VARIABLE>"
+        ;;
+    esac
+  done
+  if [ "$ENCRYPTION_POLICY" != "none" ] && [ -z "$(encryption_spec "${ENCRYPTION_DEFAULT_KEY:-default}")" ]; then
+    config_issue error "ENCRYPTION_POLICY is $ENCRYPTION_POLICY, but key ${ENCRYPTION_DEFAULT_KEY:-default} is not configured" \
+      "Set ENCRYPTION_KEY_$(tr 'a-z.-' 'A-Z__' <<<"${ENCRYPTION_DEFAULT_KEY:-default}")=age:<recipient>; repositories the policy covers fail until then"
+  fi
+  if [ "$uses_age" = "true" ] && ! command -v age >/dev/null; then
+    config_issue warning "age is not installed, so archives using age keys can't be encrypted" \
+      "Install age (apt-get install age); the container image and setup.sh include it"
+  fi
+  if [ "$uses_gpg" = "true" ] && ! command -v gpg >/dev/null; then
+    config_issue warning "gpg is not installed, so archives using gpg keys can't be encrypted" \
+      "Install GnuPG (apt-get install gnupg); the container image includes it"
+  fi
+  if [ "$uses_passphrase" = "true" ] && ! openssl kdf -help >/dev/null 2>&1; then
+    config_issue warning "openssl 3 is not installed, so archives using passphrase keys can't be encrypted" \
+      "Install OpenSSL 3 (apt-get install openssl); the container image includes it"
+  fi
+  if [ -n "$GPG_PUBLIC_KEYS_FILE" ] && [ ! -r "$GPG_PUBLIC_KEYS_FILE" ]; then
+    config_issue error "GPG_PUBLIC_KEYS_FILE $GPG_PUBLIC_KEYS_FILE is not readable" \
+      "Point it at the exported public keys (gpg --export --armor <fingerprint>...)"
+  fi
+}
+
+# Run every check; returns 1 when the run should not go ahead
+config_check() {
+  if [ "$CONFIG_CHECK" = "off" ]; then
+    return 0
+  fi
+  CONFIG_ERRORS=0
+  CONFIG_WARNINGS=0
+  config_check_file repos.txt "Remove it and pass tokens through GITHUB_TOKEN/GITLAB_TOKEN; rotate the token, it is in the history"
+  if [ -n "$BACKUP_CONFIG_FILE" ]; then
+    config_check_file "$BACKUP_CONFIG_FILE" "Keep the credential in its own environment variable, which wins over the file's settings"
+  fi
+  config_check_file tenant.env "Reference a secret instead (GITHUB_TOKEN=\$ACME_GITHUB_TOKEN); rotate the token, it is in the history"
+  config_check_committed_secrets
+  config_check_named_tokens
+  config_check_frequencies
+  config_check_tokens
+  config_check_encryption_keys
+  config_check_notify_tiers
+  config_check_git_hosts
+
+  if [ $CONFIG_ERRORS -gt 0 ] && [ "$CONFIG_CHECK" = "strict" ]; then
+    echo "❌ Configuration check failed, not running (set CONFIG_CHECK=warn to run anyway)"
+    return 1
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  config_check
+fi
@@ -0,0 +1,157 @@
+#!/bin/bash
+# Run-wide cancellation and deadline, checked by every stage of the pipeline.
+# Long-running commands go through ctx_run so a deadline or cancellation stops
+# them promptly; loops check ctx_done between units of work. State lives in a
+# file so command substitutions and subshells see it too.
+# Also the run's clock: one start time every date the run records comes from,
+# and its identity: one UUID everything the run produces carries.
+
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+# When the run started, read once so archive names, results, summaries, state
+# and schedules agree even when the run crosses midnight
+RUN_EPOCH="${RUN_EPOCH:-$(clock_now)}"
+
+# A random (version 4) UUID
+new_uuid() {
+  if [ -r /proc/sys/kernel/random/uuid ]; then
+    cat /proc/sys/kernel/random/uuid
+  elif command -v uuidgen >/dev/null; then
+    uuidgen | tr 'A-F' 'a-f'
+  else
+    od -An -N16 -tx1 /dev/urandom | tr -d ' \n' |
+      sed -E 's/^(.{8})(.{4}).(.{3}).(.{3})(.{12})$/\1-\2-4\3-a\4-\5/'
+  fi
+}
+
+# Identifier of the run, in its log, results, metrics, notifications and the
+# metadata of what it uploads, so everything from one run can be found
+# together. Exported for the commands the run starts.
+RUN_UUID="${RUN_UUID:-$(new_uuid)}"
+export RUN_UUID
+
+# Stop starting and running work after this many minutes (0 disables)
+RUN_TIMEOUT_MINUTES="${RUN_TIMEOUT_MINUTES:-0}"
+CONTEXT_CANCEL_FILE="${CONTEXT_CANCEL_FILE:-${TMPDIR:-/tmp}/backup-context-$$.cancel}"
+CONTEXT_DEADLINE="${CONTEXT_DEADLINE:-0}"
+# Seconds between cancellation checks while a command runs
+CONTEXT_POLL_INTERVAL="${CONTEXT_POLL_INTERVAL:-0.2}"
+
+# Format the run's start time: run_date [-u] +<format>
+run_date() {
+  date -d "@$RUN_EPOCH" "$@"
+}
+
+# Start a run's context, with the deadline from RUN_TIMEOUT_MINUTES
+ctx_init() {
+  rm -f "$CONTEXT_CANCEL_FILE"
+  if [ "$RUN_TIMEOUT_MINUTES" -gt 0 ]; then
+    CONTEXT_DEADLINE=$(( $(date +%s) + RUN_TIMEOUT_MINUTES * 60 ))
+  else
+    CONTEXT_DEADLINE=0
+  fi
+  export CONTEXT_CANCEL_FILE CONTEXT_DEADLINE
+}
+
+# Cancel the run: ctx_cancel <reason>
+ctx_cancel() {
+  [ -f "$CONTEXT_CANCEL_FILE" ] || echo "${1:-cancelled}" > "$CONTEXT_CANCEL_FILE"
+}
+
+# Cancel the run on SIGINT and SIGTERM instead of dying: nothing new starts,
+# running commands are stopped, and the run still records and reports what
+# it did. A second signal ends it right away.
+ctx_trap_signals() {
+  trap 'ctx_on_signal INT 130' INT
+  trap 'ctx_on_signal TERM 143' TERM
+}
+
+# Handle a trapped signal: ctx_on_signal <name> <exit code>
+ctx_on_signal() {
+  if [ -n "$CONTEXT_SIGNAL" ]; then
+    echo "⏹️ SIG$1 again, exiting now"
+    exit "$2"
+  fi
+  CONTEXT_SIGNAL="$1"
+  echo "⏹️ SIG$1: stopping, results and notifications are still written (send it again to exit now)"
+  ctx_cancel "interrupted by SIG$1"
+}
+
+# Why the run has to stop ("interrupted", "deadline exceeded", ...), empty while it may go on
+ctx_err() {
+  if [ -f "$CONTEXT_CANCEL_FILE" ]; then
+    cat "$CONTEXT_CANCEL_FILE"
+  elif [ "$CONTEXT_DEADLINE" -gt 0 ] && [ "$(date +%s)" -ge "$CONTEXT_DEADLINE" ]; then
+    echo "deadline exceeded"
+  fi
+}
+
+ctx_done() {
+  [ -n "$(ctx_err)" ]
+}
+
+# Terminate a process and everything it started
+ctx_kill_tree() {
+  local pid="$1"
+  local child
+  for child in $(pgrep -P "$pid" 2>/dev/null); do
+    ctx_kill_tree "$child"
+  done
+  kill -TERM "$pid" 2>/dev/null
+}
+
+# Run a command (or shell function) until it finishes or the context is done,
+# in which case it is terminated and 124 returned: ctx_run <command...>
+ctx_run() {
+  ctx_run_for 0 "$@"
+}
+
+# Like ctx_run, but the command is also terminated once it ran for <seconds>
+# (0 for no limit), and 125 returned: ctx_run_for <seconds> <command...>
+ctx_run_for() {
+  local seconds="$1"
+  shift
+  if ctx_done; then
+    return 124
+  fi
+  local expired="$CONTEXT_CANCEL_FILE.$BASHPID.$RANDOM.expired"
+  local deadline=$(( $(date +%s) + seconds ))
+  "$@" &
+  local pid=$!
+  (
+    while kill -0 "$pid" 2>/dev/null; do
+      if ctx_done; then
+        ctx_kill_tree "$pid"
+        exit
+      fi
+      if [ "$seconds" -gt 0 ] && [ "$(date +%s)" -ge "$deadline" ]; then
+        touch "$expired"
+        ctx_kill_tree "$pid"
+        exit
+      fi
+      sleep "$CONTEXT_POLL_INTERVAL"
+    done
+  ) &
+  local watchdog=$!
+  wait "$pid"
+  local status=$?
+  # A trapped signal interrupts wait; the watchdog then stops the command
+  while kill -0 "$pid" 2>/dev/null; do
+    wait "$pid"
+    status=$?
+  done
+  kill "$watchdog" 2>/dev/null
+  wait "$watchdog" 2>/dev/null
+  # A command that succeeded just as the watchdog gave up on it still succeeded
+  if [ $status -eq 0 ]; then
+    rm -f "$expired"
+    return 0
+  elif ctx_done; then
+    rm -f "$expired"
+    return 124
+  elif [ -f "$expired" ]; then
+    rm -f "$expired"
+    return 125
+  fi
+  return $status
+}
@@ -0,0 +1,319 @@
+#!/bin/bash
+# Run backups on a schedule without GitHub Actions or a CronJob: a long-lived
+# process (systemd service, Docker container, Kubernetes Deployment) that
+# starts a run whenever the cron expression matches, and answers health checks
+# over HTTP. A run still going when the next one is due makes the daemon skip
+# that one. Runs are started like run-workflow.sh starts them, per tenant when
+# TENANTS_DIR exists. The same port redeems retry links from notifications
+# (GET /retry?..., see retry.sh) with a run of just their repositories.
+
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+# When to run, as a cron expression (minute hour day-of-month month day-of-week, in UTC)
+DAEMON_SCHEDULE="${DAEMON_SCHEDULE:-0 2 * * *}"
+# Port of the health endpoint (0 disables it); it needs socat
+DAEMON_HEALTH_PORT="${DAEMON_HEALTH_PORT:-8080}"
+# Health as JSON, rewritten every DAEMON_TICK_SECONDS, also for exec probes
+DAEMON_HEALTH_FILE="${DAEMON_HEALTH_FILE:-${TMPDIR:-/tmp}/backup-daemon-health.json}"
+DAEMON_TICK_SECONDS="${DAEMON_TICK_SECONDS:-30}"
+# Retry links accepted by the endpoint, one per line, until the loop redeems them
+DAEMON_RETRY_QUEUE="${DAEMON_RETRY_QUEUE:-${TMPDIR:-/tmp}/backup-daemon-retries}"
+
+CRON_MONTHS="jan feb mar apr may jun jul aug sep oct nov dec"
+CRON_DAYS="sun mon tue wed thu fri sat"
+
+# Whether a value matches one cron field, returning 2 when the field is
+# malformed or out of range: cron_field_matches <field> <value> <min> <max> [names]
+cron_field_matches() {
+  local field="${1,,}"
+  local value="$2"
+  local min="$3"
+  local max="$4"
+  local names=($5)
+  local i part range step from to
+  # Month and weekday names stand for their numbers
+  for i in "${!names[@]}"; do
+    field="${field//${names[$i]}/$((i + min))}"
+  done
+  IFS=',' read -ra parts <<<"$field"
+  for part in "${parts[@]}"; do
+    range="${part%/*}"
+    step=1
+    [[ "$part" != */* ]] || step="${part#*/}"
+    case "$range" in
+      \*) from="$min"; to="$max" ;;
+      *-*) from="${range%-*}"; to="${range#*-}" ;;
+      *) from="$range"; to="$range"; [[ "$part" != */* ]] || to="$max" ;;
+    esac
+    if ! [[ "$from" =~ ^[0-9]+$ && "$to" =~ ^[0-9]+$ && "$step" =~ ^[1-9][0-9]*$ ]] ||
+      [ "$from" -lt "$min" ] || [ "$to" -gt "$max" ] || [ "$from" -gt "$to" ]; then
+      return 2
+    fi
+    if [ "$value" -ge "$from" ] && [ "$value" -le "$to" ] && [ $(( (value - from) % step )) -eq 0 ]; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Whether a cron expression is valid, every value in range: an expression
+# that can never match would have cron_next search for years
+cron_valid() {
+  local fields
+  read -ra fields <<<"$1"
+  [ ${#fields[@]} -eq 5 ] || return 1
+  local mins=(0 0 1 1 0)
+  local maxs=(59 23 31 12 7)
+  local field status
+  for field in 0 1 2 3 4; do
+    cron_field_matches "${fields[$field]}" -1 "${mins[$field]}" "${maxs[$field]}" \
+      "$([ $field -eq 3 ] && echo "$CRON_MONTHS")$([ $field -eq 4 ] && echo "$CRON_DAYS")"
+    status=$?
+    [ $status -ne 2 ] || return 1
+  done
+}
+
+# Whether a day (UTC) matches the day-of-month, month and day-of-week fields;
+# when both day fields are restricted either may match, as in cron:
+# cron_day_matches <expression> <epoch>
+cron_day_matches() {
+  local fields
+  read -ra fields <<<"$1"
+  local day_of_month month day_of_week
+  read -r day_of_month month day_of_week <<<"$(date -u -d "@$2" '+%-d %-m %w')"
+  cron_field_matches "${fields[3]}" "$month" 1 12 "$CRON_MONTHS" || return 1
+  local dom_matches=false
+  local dow_matches=false
+  cron_field_matches "${fields[2]}" "$day_of_month" 1 31 && dom_matches=true
+  # 7 is Sunday too
+  if cron_field_matches "${fields[4]}" "$day_of_week" 0 7 "$CRON_DAYS" ||
+    { [ "$day_of_week" -eq 0 ] && cron_field_matches "${fields[4]}" 7 0 7 "$CRON_DAYS"; }; then
+    dow_matches=true
+  fi
+  if [ "${fields[2]}" != "*" ] && [ "${fields[4]}" != "*" ]; then
+    [ "$dom_matches" = "true" ] || [ "$dow_matches" = "true" ]
+  else
+    [ "$dom_matches" = "true" ] && [ "$dow_matches" = "true" ]
+  fi
+}
+
+# First minute after <epoch> the expression matches, as an epoch; days and
+# hours that can't match are skipped whole: cron_next <expression> <epoch>
+cron_next() {
+  local fields
+  read -ra fields <<<"$1"
+  local t=$(( ($2 / 60 + 1) * 60 ))
+  local limit=$(( $2 + 5 * 366 * 86400 ))
+  local hour minute
+  while [ $t -le $limit ]; do
+    if ! cron_day_matches "$1" "$t"; then
+      t=$(( (t / 86400 + 1) * 86400 ))
+      continue
+    fi
+    read -r hour minute <<<"$(date -u -d "@$t" '+%-H %-M')"
+    if ! cron_field_matches "${fields[1]}" "$hour" 0 23; then
+      t=$(( (t / 3600 + 1) * 3600 ))
+      continue
+    fi
+    if cron_field_matches "${fields[0]}" "$minute" 0 59; then
+      echo "$t"
+      return 0
+    fi
+    t=$((t + 60))
+  done
+  return 1
+}
+
+# Start one run like run-workflow.sh does; it replaces the background
+# subshell, so signals sent to the run reach it
+daemon_run_backup() {
+  local scripts=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+  if [ -d "${TENANTS_DIR:-tenants}" ]; then
+    exec "$scripts/tenants.sh"
+  else
+    exec "$scripts/main.sh"
+  fi
+}
+
+# Rewrite the health file: daemon_write_health <next run epoch> <running pid or empty>
+daemon_write_health() {
+  local now=$(clock_now)
+  jq -n --argjson now "$now" --argjson next "${1:-null}" --arg running "$2" \
+    --arg schedule "$DAEMON_SCHEDULE" --argjson last "${DAEMON_LAST_RUN:-null}" \
+    --argjson tick "$DAEMON_TICK_SECONDS" '
+    def iso: if . then todate else null end;
+    {status: "ok", schedule: $schedule, checked_at: ($now | iso), heartbeat: $now, max_silence_seconds: ($tick * 3),
+     running: ($running != ""), next_run: ($next | iso), last_run: $last}' > "$DAEMON_HEALTH_FILE.tmp" &&
+    mv "$DAEMON_HEALTH_FILE.tmp" "$DAEMON_HEALTH_FILE"
+}
+
+# Write an HTTP response: daemon_http_reply <status> <content type> <body>
+daemon_http_reply() {
+  printf 'HTTP/1.1 %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n' \
+    "$1" "$2" $(( $(printf '%s\n' "$3" | wc -c) )) "$3"
+}
+
+# HTTP response for one health check: 200 while the scheduler loop keeps
+# writing the health file, 503 once it stopped. A failed backup doesn't make
+# the daemon unhealthy, restarting it wouldn't help; it is in last_run. Fails
+# when unhealthy, for exec probes.
+daemon_health_response() {
+  local health=$(cat "$DAEMON_HEALTH_FILE" 2>/dev/null)
+  local status="200 OK"
+  if [ -z "$health" ] ||
+    ! jq -e --argjson now "$(clock_now)" '$now - .heartbeat <= .max_silence_seconds' <<<"$health" >/dev/null 2>&1; then
+    status="503 Service Unavailable"
+    health=$(jq -cn --arg health "$health" '{status: "stalled", last: ($health | fromjson? // null)}')
+  fi
+  daemon_http_reply "$status" application/json "$health"
+  [ "$status" = "200 OK" ]
+}
+
+# HTTP response for a retry link: a link with a valid signature that hasn't
+# expired is queued for the scheduler loop, which uses it up before starting
+# the run, so nothing answering requests races it for the run state
+daemon_retry_response() {
+  local link="$1"
+  local repos
+  if ! repos=$(bash "$(dirname "${BASH_SOURCE[0]}")/retry.sh" --check "$link" 2>&1); then
+    daemon_http_reply "400 Bad Request" text/plain "${repos#❌ }"
+    return 1
+  fi
+  echo "$link" >> "$DAEMON_RETRY_QUEUE"
+  daemon_http_reply "202 Accepted" text/plain "Retry queued for: $repos"
+}
+
+# Answer one HTTP request read from stdin: retry links on /retry, the health
+# check on any other path
+daemon_http_response() {
+  local method target version
+  read -r method target version
+  target="${target%$'\r'}"
+  case "${target%%\?*}" in
+    */retry) daemon_retry_response "$target" ;;
+    *) daemon_health_response ;;
+  esac
+}
+
+# Redeem the queued retry links, printing the repositories of those still
+# unused (comma-separated); each link's nonce is recorded in the run state
+# before the run starts, through a scratch state directory
+daemon_take_retries() {
+  [ -s "$DAEMON_RETRY_QUEUE" ] || return 0
+  local taken="$DAEMON_RETRY_QUEUE.$$"
+  mv "$DAEMON_RETRY_QUEUE" "$taken" || return 0
+  local state_dir=$(mktemp -d)
+  local link repos all=""
+  while IFS= read -r link; do
+    if repos=$(STATE_DIR="$state_dir" bash "$(dirname "${BASH_SOURCE[0]}")/retry.sh" --verify "$link"); then
+      all="${all:+$all,}$repos"
+    fi
+  done < "$taken"
+  rm -rf "$taken" "$state_dir"
+  echo "$all"
+}
+
+# Serve the health endpoint in the background
+daemon_start_health_server() {
+  [ "$DAEMON_HEALTH_PORT" -gt 0 ] || return 0
+  if ! command -v socat >/dev/null; then
+    echo "⚠️ socat is not installed, no health endpoint (the health file is $DAEMON_HEALTH_FILE)"
+    return 0
+  fi
+  export DAEMON_HEALTH_FILE DAEMON_RETRY_QUEUE BACKUP_CLOCK_FILE
+  socat -T 10 "TCP-LISTEN:$DAEMON_HEALTH_PORT,reuseaddr,fork" \
+    SYSTEM:"bash '$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)/daemon.sh' --http-response" 2>/dev/null &
+  DAEMON_HEALTH_PID=$!
+  echo "💓 Health endpoint on port $DAEMON_HEALTH_PORT"
+}
+
+# Stop the health server, cancel a running backup and wait until it wrote its
+# results and notified, then exit; a second signal exits right away
+daemon_stop() {
+  trap - TERM INT
+  echo "⏹️ Stopping the daemon"
+  [ -z "$DAEMON_HEALTH_PID" ] || kill "$DAEMON_HEALTH_PID" 2>/dev/null
+  if [ -n "$DAEMON_RUN_PID" ] && kill -0 "$DAEMON_RUN_PID" 2>/dev/null; then
+    echo "⏹️ Cancelling the running backup"
+    kill -TERM "$DAEMON_RUN_PID"
+  fi
+  wait 2>/dev/null
+  rm -f "$DAEMON_HEALTH_FILE"
+  exit 0
+}
+
+# backup_daemon [--schedule "cron"] [--health-port N] [--run-now]
+backup_daemon() {
+  local run_now=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --schedule) DAEMON_SCHEDULE="$2"; shift 2 ;;
+      --health-port) DAEMON_HEALTH_PORT="$2"; shift 2 ;;
+      --run-now) run_now=true; shift ;;
+      --http-response) daemon_http_response; return ;;
+      --health-response) daemon_health_response; return ;;
+      *)
+        echo "❌ Usage: daemon [--schedule \"cron\"] [--health-port N] [--run-now]"
+        return 2
+        ;;
+    esac
+  done
+  if ! cron_valid "$DAEMON_SCHEDULE"; then
+    echo "❌ Invalid schedule: $DAEMON_SCHEDULE (expected minute hour day-of-month month day-of-week)"
+    return 2
+  fi
+
+  trap daemon_stop TERM INT
+  DAEMON_RUN_PID=""
+  DAEMON_LAST_RUN=""
+  daemon_start_health_server
+  local next=$(cron_next "$DAEMON_SCHEDULE" "$(clock_now)")
+  if [ "$run_now" = "true" ]; then
+    next=$(clock_now)
+  fi
+  echo "⏰ Running backups on \"$DAEMON_SCHEDULE\" (UTC), next at $(date -u -d "@$next" '+%Y-%m-%dT%H:%M:%SZ')"
+
+  local now started status retry_repos
+  while :; do
+    now=$(clock_now)
+    # A finished run is recorded in the health file
+    if [ -n "$DAEMON_RUN_PID" ] && ! kill -0 "$DAEMON_RUN_PID" 2>/dev/null; then
+      wait "$DAEMON_RUN_PID"
+      status=$?
+      DAEMON_LAST_RUN=$(jq -cn --argjson started "$started" --argjson finished "$now" --argjson status "$status" \
+        '{started_at: ($started | todate), finished_at: ($finished | todate), exit_code: $status, succeeded: ($status == 0)}')
+      DAEMON_RUN_PID=""
+      echo "⏰ Run finished with exit code $status, next at $(date -u -d "@$next" '+%Y-%m-%dT%H:%M:%SZ')"
+    fi
+    if [ "$now" -ge "$next" ]; then
+      if [ -n "$DAEMON_RUN_PID" ]; then
+        echo "⏭️ Skipping the run due at $(date -u -d "@$next" '+%Y-%m-%dT%H:%M:%SZ'), the previous one is still running"
+      else
+        echo "⏰ Starting a run"
+        started="$now"
+        daemon_run_backup &
+        DAEMON_RUN_PID=$!
+      fi
+      next=$(cron_next "$DAEMON_SCHEDULE" "$now")
+    fi
+    # Retry links wait for a running backup to finish
+    if [ -z "$DAEMON_RUN_PID" ] && [ -s "$DAEMON_RETRY_QUEUE" ]; then
+      retry_repos=$(daemon_take_retries)
+      if [ -n "$retry_repos" ]; then
+        echo "🔁 Starting a retry of: $retry_repos"
+        started="$now"
+        BACKUP_ONLY="$retry_repos" daemon_run_backup &
+        DAEMON_RUN_PID=$!
+      fi
+    fi
+    daemon_write_health "$next" "$DAEMON_RUN_PID"
+    # Short sleeps in the background keep the traps responsive
+    sleep "$(( next - now < DAEMON_TICK_SECONDS ? (next - now > 0 ? next - now : 1) : DAEMON_TICK_SECONDS ))" &
+    wait $!
+  done
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_daemon "$@"
+fi
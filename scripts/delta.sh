@@ -0,0 +1,76 @@
+#!/bin/bash
+# Delta archives: with a mirror kept in MIRROR_CACHE_DIR, fetches only add new
+# packfiles and refs, so most of a mirror is the same from one day to the next.
+# A delta archive holds just the files that differ from the repository's last
+# full archive (its base), plus DELTA.json naming the base and the files
+# deleted since. Restoring one (open_stored_archive) unpacks the base and lays
+# the delta over it. Deltas are always taken against the base rather than the
+# previous delta, so a restore needs two archives at most.
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+
+# Store delta archives (or delta=<true|false> per repo); needs MIRROR_CACHE_DIR
+DELTA_ARCHIVES="${DELTA_ARCHIVES:-false}"
+# Take a new full archive after this many deltas against the same base
+DELTA_FULL_EVERY="${DELTA_FULL_EVERY:-7}"
+
+# Whether a repository is backed up with delta archives: delta_wanted <repos.txt line>
+delta_wanted() {
+  [ -n "$MIRROR_CACHE_DIR" ] && [ "$(repo_option "$1" delta "$DELTA_ARCHIVES")" = "true" ]
+}
+
+# Where the last full archive of a repository and its content manifest are
+# recorded: <cache>/<repo>.base and <cache>/<repo>.base.manifest
+delta_base_record() {
+  echo "$MIRROR_CACHE_DIR/$1.base"
+}
+
+# Remember a full archive as the base of the deltas that follow:
+# delta_record_base <repo> <stored archive> <content manifest>
+delta_record_base() {
+  local record=$(delta_base_record "$1")
+  cp "$3" "$record.manifest.tmp" &&
+    mv "$record.manifest.tmp" "$record.manifest" &&
+    echo "$2" > "$record"
+}
+
+# The archive a new delta can be taken against, if any: the recorded base,
+# still in the catalog with the same encryption key and fewer than
+# DELTA_FULL_EVERY deltas: delta_base <repo> [encryption key]
+delta_base() {
+  local record=$(delta_base_record "$1")
+  [ -f "$record" ] && [ -f "$record.manifest" ] && [ -f "$CATALOG_FILE" ] || return 1
+  local base=$(cat "$record")
+  jq -e --arg base "$base" --arg key "$2" --argjson every "$DELTA_FULL_EVERY" '
+    any(.[]; .archive == $base and .delta_of == null and (.encryption_key // "") == $key) and
+      ([.[] | select(.delta_of == $base)] | length) < $every' "$CATALOG_FILE" >/dev/null || return 1
+  echo "$base"
+}
+
+# Put the files of <dir> that differ from the base into <stage>, next to
+# DELTA.json, and print how many there are:
+# delta_stage <dir> <content manifest> <base manifest> <base archive> <stage>
+delta_stage() {
+  local dir="$1"
+  local manifest="$2"
+  local base_manifest="$3"
+  local base="$4"
+  local stage="$5"
+  mkdir -p "$stage" || return 1
+
+  # Manifest lines are "<hash>  <path>"
+  local changed=$(awk 'NR == FNR { base[substr($0, index($0, "  ") + 2)] = $1; next }
+    { path = substr($0, index($0, "  ") + 2); if (base[path] != $1) print path }' "$base_manifest" "$manifest")
+  local deleted=$(awk 'NR == FNR { current[substr($0, index($0, "  ") + 2)] = 1; next }
+    { path = substr($0, index($0, "  ") + 2); if (!current[path]) print path }' "$manifest" "$base_manifest")
+  local path count=0
+  while IFS= read -r path; do
+    [ -n "$path" ] || continue
+    mkdir -p "$stage/$(dirname "$path")" &&
+      { ln "$dir/$path" "$stage/$path" 2>/dev/null || cp -p "$dir/$path" "$stage/$path"; } || return 1
+    count=$((count + 1))
+  done <<<"$changed"
+  jq -n --arg base "$base" --argjson deleted "$(grep -v '^$' <<<"$deleted" | jq -R . | jq -sc .)" \
+    '{base: $base, deleted: $deleted}' > "$stage/DELTA.json" || return 1
+  echo "$count"
+}
@@ -0,0 +1,78 @@
+#!/bin/bash
+# Compare two runs: repositories added or removed, status changes and
+# significant size changes, for post-incident analysis and capacity reviews.
+# Runs are read from results/<YYYYMMDD_HHMMSS>.json on the primary destination
+# (or a local results file); runs from before results were stored fall back to
+# the catalog's archives of that date.
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+# Archive size change (in percent) reported as significant
+DIFF_SIZE_PERCENT="${DIFF_SIZE_PERCENT:-20}"
+
+# Results of a run as {date, repositories: [{name, status, size_bytes}]}:
+# run_results <results file | YYYYMMDD[_HHMMSS]>
+run_results() {
+  local run="$1"
+  if [ -f "$run" ]; then
+    read_results "$run" | jq '{date: (.run.started_at // ""), repositories: [.repositories[] | {name, status, size_bytes}]}'
+    return
+  fi
+  local name=$(storage_list "$(primary_destination)" "results/$run" | grep -E '\.json$' | sort | tail -n 1)
+  if [ -n "$name" ]; then
+    storage_read "$(primary_destination)" "$name" | read_results /dev/stdin |
+      jq --arg date "$(basename "$name" .json)" '{date: $date, repositories: [.repositories[] | {name, status, size_bytes}]}'
+    return
+  fi
+  state_load >/dev/null
+  local entries=$(catalog_entries "" "$run" | jq -s .)
+  if [ "$entries" = "[]" ]; then
+    echo "❌ No run found for $run" >&2
+    return 1
+  fi
+  echo "ℹ️ No stored results for $run, comparing the catalog's archives" >&2
+  jq --arg run "$run" '{date: (map(.date) | max), repositories:
+    (group_by(.repository) | map(max_by(.date) | {name: .repository, status: "success", size_bytes}))}' <<<"$entries"
+}
+
+# diff-runs <run A> <run B> [--threshold percent]
+diff_runs() {
+  local runs=()
+  local threshold="$DIFF_SIZE_PERCENT"
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --threshold) threshold="$2"; shift 2 ;;
+      -*) echo "❌ Unknown option: $1"; return 2 ;;
+      *) runs+=("$1"); shift ;;
+    esac
+  done
+  if [ ${#runs[@]} -ne 2 ]; then
+    echo "❌ Usage: diff-runs <run A> <run B> [--threshold percent] (runs as YYYYMMDD[_HHMMSS] or results files)"
+    return 2
+  fi
+
+  local before after
+  before=$(run_results "${runs[0]}") && after=$(run_results "${runs[1]}") || return 1
+
+  jq -rn --argjson a "$before" --argjson b "$after" --argjson threshold "$threshold" "$RESULTS_JQ_DEFS"'
+    ($a.repositories | map({(.name): .}) | add // {}) as $old |
+    ($b.repositories | map({(.name): .}) | add // {}) as $new |
+    def section(title; lines): if (lines | length) > 0 then "\n\(title):", (lines[] | "  \(.)") else empty end;
+    "🔍 \($a.date) → \($b.date)",
+    section("➕ Added"; [$new | keys[] | select($old[.] == null)]),
+    section("➖ Removed"; [$old | keys[] | select($new[.] == null)]),
+    section("🔁 Status changed"; [$new | to_entries[] | select($old[.key] != null and $old[.key].status != .value.status)
+      | "\(.key): \($old[.key].status) → \(.value.status)"]),
+    section("📈 Size changed by more than \($threshold)%"; [$new | to_entries[]
+      | select($old[.key].size_bytes > 0 and .value.size_bytes != null)
+      | ((.value.size_bytes - $old[.key].size_bytes) * 100 / $old[.key].size_bytes) as $change
+      | select($change > $threshold or $change < -$threshold)
+      | "\(.key): \($old[.key].size_bytes | size_human) → \(.value.size_bytes | size_human) (\(if $change > 0 then "+" else "" end)\($change | round)%)"]),
+    "\nTotal size: \([$old[].size_bytes // 0] | add // 0 | size_human) → \([$new[].size_bytes // 0] | add // 0 | size_human)"'
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  diff_runs "$@"
+fi
@@ -0,0 +1,98 @@
+#!/bin/bash
+# Digest of the last week's runs in one notification, for people who want to
+# know that backups work without a card every day: success rate, failures
+# resolved and still open, and how much storage grew. Reads the results stored
+# under results/ on the primary destination; run it on a schedule of its own
+# (.github/workflows/weekly-digest.yml).
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/send-webhook.sh"
+
+DIGEST_DAYS="${DIGEST_DAYS:-7}"
+# Where the digest goes, e.g. a stakeholders' channel instead of on-call's
+DIGEST_WEBHOOK_URL="${DIGEST_WEBHOOK_URL:-$WEBHOOK_URL}"
+
+# Results of every run since a date, oldest first, as one JSON array:
+# digest_runs <YYYYMMDD>
+digest_runs() {
+  local since="$1"
+  local name
+  storage_list "$(primary_destination)" "results/" | grep -E '^results/[0-9]{8}_[0-9]{6}\.json$' | sort |
+    while IFS= read -r name; do
+      if [[ "${name#results/}" < "$since" ]]; then
+        continue
+      fi
+      storage_read "$(primary_destination)" "$name" | read_results /dev/stdin |
+        jq -c --arg date "$(basename "$name" .json)" \
+          '{date: $date, repositories: [.repositories[] | {name, status, size_bytes, dedup_of}]}'
+    done | jq -s .
+}
+
+# Totals of a week: digest_totals <runs JSON>
+digest_totals() {
+  state_load >/dev/null
+  jq --slurpfile catalog "$CATALOG_FILE" "$RESULTS_JQ_DEFS"'
+    [.[].repositories[] | select(left_out | not)] as $backups |
+    # Status of every repository in its last run of the week
+    (map(.repositories[] | select(left_out | not)) | group_by(.name) | map({(.[0].name): .[-1].status}) | add // {}) as $latest |
+    ([$backups[] | select(.status | IN("failed", "timed-out")) | .name] | unique) as $failed |
+    {
+      runs: length,
+      backups: ($backups | length),
+      succeeded: ($backups | map(select(.status | backed_up)) | length),
+      resolved: ($failed | map(select($latest[.] | backed_up))),
+      open: ($failed | map(select($latest[.] | backed_up | not))),
+      stored_bytes: ($backups | map(select(.dedup_of == null) | .size_bytes // 0) | add // 0),
+      total_bytes: ($catalog[0] | map(select(.dedup_of == null) | .size_bytes // 0) | add // 0)
+    } | .success_percent = (if .backups > 0 then .succeeded * 100 / .backups | floor else 100 end)' <<<"$1"
+}
+
+# digest [--days N] [--send]
+backup_digest() {
+  local days="$DIGEST_DAYS"
+  local send=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --days) days="$2"; shift 2 ;;
+      --send) send=true; shift ;;
+      *) echo "❌ Usage: digest [--days N] [--send]"; return 2 ;;
+    esac
+  done
+
+  local since=$(clock_date --ago $((days * 86400)) +%Y%m%d)
+  local runs totals
+  runs=$(digest_runs "$since") || return 1
+  totals=$(digest_totals "$runs") || return 1
+  local from=$(date -d "$since" +%Y-%m-%d)
+  local to=$(clock_date +%Y-%m-%d)
+
+  jq -r --arg from "$from" --arg to "$to" "$RESULTS_JQ_DEFS"'
+    def names: if length == 0 then "none" else join(", ") end;
+    "📋 Digest \($from) to \($to)",
+    "  Runs: \(.runs)",
+    "  Backups succeeded: \(.success_percent)% (\(.succeeded) of \(.backups))",
+    "  Failures resolved: \(.resolved | names)",
+    "  Still failing: \(.open | names)",
+    "  Storage: +\(.stored_bytes | size_human) this period, \(.total_bytes | size_human) in total"' <<<"$totals"
+
+  if [ "$send" = "true" ]; then
+    local status=true
+    if [ "$(jq '.open | length' <<<"$totals")" -gt 0 ] || [ "$(jq '.runs' <<<"$totals")" -eq 0 ]; then
+      status=warning
+    fi
+    local -a fields
+    mapfile -t fields < <(jq -r --arg from "$from" --arg to "$to" "$RESULTS_JQ_DEFS"'
+      def names: if length == 0 then "none" else join(", ") end;
+      $from, $to, .runs, .success_percent, .succeeded, .backups, (.resolved | names), (.open | names),
+        (.stored_bytes | size_human), (.total_bytes | size_human)' <<<"$totals")
+    WEBHOOK_URL="$DIGEST_WEBHOOK_URL"
+    queue_webhook "$status" "$(msg result_digest "${fields[@]}")" ""
+    flush_webhooks
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_digest "$@"
+fi
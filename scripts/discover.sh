@@ -0,0 +1,124 @@
+#!/bin/bash
+# Configured repositories, with organizations expanded. A repos.txt line
+# "org:<name> [options]" stands for every repository of the GitHub organization,
+# listed through the API on each run, so new repositories are picked up and
+# deleted ones dropped without editing repos.txt. The line's options apply to
+# each discovered repository; a repository also listed on its own line keeps
+# that line's options instead. With settings=true (or ORG_SETTINGS), the
+# organization's settings, teams and permissions are backed up as well, as an
+# org-settings:<org> line (see org-settings.sh).
+
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/org-settings.sh"
+
+# Options of org: lines that steer discovery instead of being passed on
+DISCOVERY_OPTIONS="archived forks exclude settings"
+
+# Clone URLs of an organization's repositories, following pagination:
+# discover_org_repos <org> <include archived: true|false> <include forks: true|false>
+discover_org_repos() {
+  local org="$1"
+  local archived="$2"
+  local forks="$3"
+  local page=1
+  local response
+  while :; do
+    response=$(api_get "https://api.github.com/orgs/$org/repos?type=all&per_page=100&page=$page" \
+      -H "Accept: application/vnd.github+json") || return 1
+    jq -r --argjson archived "$archived" --argjson forks "$forks" \
+      '.[] | select(($archived or (.archived | not)) and ($forks or (.fork | not))) | .clone_url' <<<"$response"
+    [ "$(jq length <<<"$response")" -eq 100 ] || break
+    page=$((page + 1))
+  done
+}
+
+# Comparable form of a repository URL
+discover_url_key() {
+  local url="${1%/}"
+  url="${url%.git}"
+  echo "${url,,}"
+}
+
+# Expand org: lines into one line per repository: expand_repo_lines <line>...
+expand_repo_lines() {
+  local line org exclude url word repos
+  local -a words explicit=()
+  declare -A listed
+  for line in "$@"; do
+    if [[ "$line" != org:* ]]; then
+      explicit+=("$line")
+      listed[$(discover_url_key "$(repo_line_url "$line")")]=1
+    fi
+  done
+  printf '%s\n' "${explicit[@]}"
+
+  for line in "$@"; do
+    [[ "$line" == org:* ]] || continue
+    read -ra words <<<"$line"
+    org="${words[0]#org:}"
+    local options=""
+    for word in "${words[@]:1}"; do
+      if [[ " $DISCOVERY_OPTIONS " != *" ${word%%=*} "* ]]; then
+        options="$options $word"
+      fi
+    done
+    # Listed with the line's own token when it has one
+    if ! repos=$(API_TOKEN=$(git_named_token "$(repo_option "$line" token "")") \
+      discover_org_repos "$org" "$(repo_option "$line" archived true)" "$(repo_option "$line" forks true)"); then
+      echo "❌ Could not list the repositories of $org" >&2
+      return 1
+    fi
+    exclude=$(repo_option "$line" exclude "")
+    while IFS= read -r url; do
+      [ -n "$url" ] || continue
+      if [ -n "$exclude" ] && [[ "$(basename "$url" .git)" =~ ^($exclude)$ ]]; then
+        continue
+      fi
+      if [ -z "${listed[$(discover_url_key "$url")]}" ]; then
+        listed[$(discover_url_key "$url")]=1
+        echo "$url$options"
+      fi
+    done <<<"$repos"
+    url="org-settings:$org"
+    if [ "$(repo_option "$line" settings "$ORG_SETTINGS")" = "true" ] && [ -z "${listed[$(discover_url_key "$url")]}" ]; then
+      listed[$(discover_url_key "$url")]=1
+      echo "$url$options"
+    fi
+  done
+}
+
+# Configured repository lines (comments and blank lines dropped, organizations
+# expanded) from repos.txt, listed once per run. A dry run, which writes
+# nothing, lists them every time it asks.
+repo_lines() {
+  if [ "$DRY_RUN" = "true" ]; then
+    repo_lines_list
+    return
+  fi
+  local cache="$API_STATE_DIR/repo-lines.txt"
+  if [ ! -f "$cache" ] || [ "$REPOS_FILE" -nt "$cache" ]; then
+    mkdir -p "$API_STATE_DIR"
+    repo_lines_list > "$cache.tmp" || { rm -f "$cache.tmp"; return 1; }
+    mv "$cache.tmp" "$cache"
+  fi
+  cat "$cache"
+}
+
+# Repository lines of repos.txt, listed from scratch
+repo_lines_list() {
+  local -a lines=()
+  local line
+  while IFS= read -r line; do
+    if [[ ! "$line" =~ ^[[:space:]]*# ]] && [[ -n "${line// }" ]]; then
+      lines+=("$line")
+    fi
+  done < "$REPOS_FILE"
+  local expanded
+  expanded=$(expand_repo_lines "${lines[@]}") || return 1
+  [ -z "$expanded" ] || sed '/^$/d' <<<"$expanded"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  repo_lines
+fi
@@ -0,0 +1,56 @@
+#!/bin/bash
+# Injected failures for rehearsing alerting and recovery runbooks. Backups run
+# and are stored as usual; only what results, reports and notifications say
+# about them changes, and notifications are marked as a drill. The run state
+# and catalog record what really happened, so later runs aren't affected.
+
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+# Report this many random repositories as failed to clone
+DRILL_FAIL_REPOS="${DRILL_FAIL_REPOS:-0}"
+# Report every backup as failed to upload to this destination
+DRILL_FAIL_UPLOAD="${DRILL_FAIL_UPLOAD:-}"
+# Drop notifications as if the webhook were down
+DRILL_FAIL_WEBHOOK="${DRILL_FAIL_WEBHOOK:-false}"
+# error_class of the injected clone failures
+DRILL_ERROR_CLASS="${DRILL_ERROR_CLASS:-network}"
+
+DRILL_REPOS=""
+
+drill_active() {
+  [ "$DRILL_FAIL_REPOS" -gt 0 ] || [ -n "$DRILL_FAIL_UPLOAD" ] || [ "$DRILL_FAIL_WEBHOOK" = "true" ]
+}
+
+# Pick the repositories reported as failed: drill_pick <name>...
+drill_pick() {
+  if [ "$DRILL_FAIL_REPOS" -gt 0 ]; then
+    DRILL_REPOS=$(printf '%s\n' "$@" | shuf -n "$DRILL_FAIL_REPOS")
+  fi
+}
+
+# What the drill injects, for the log
+drill_describe() {
+  {
+    [ -z "$DRILL_REPOS" ] || echo "clone failures of $(paste -sd ',' <<<"$DRILL_REPOS" | sed 's/,/, /g')"
+    [ -z "$DRILL_FAIL_UPLOAD" ] || echo "upload failures to $DRILL_FAIL_UPLOAD"
+    [ "$DRILL_FAIL_WEBHOOK" != "true" ] || echo "undelivered notifications"
+  } | paste -sd ';' | sed 's/;/; /g'
+}
+
+# Turn the result of a backup that ran into an injected failure when the drill
+# covers it: drill_inject <repo name>
+drill_inject() {
+  local repo_name="$1"
+  if [ -n "$DRILL_REPOS" ] && grep -qxF -- "$repo_name" <<<"$DRILL_REPOS"; then
+    result_set failure_stage clone
+    result_set error_class "$DRILL_ERROR_CLASS"
+    result_set error "Injected failure (drill)"
+  elif [ -n "$DRILL_FAIL_UPLOAD" ]; then
+    result_set failure_stage upload
+    result_set error "Injected upload failure to $DRILL_FAIL_UPLOAD (drill)"
+  else
+    return 1
+  fi
+  result_set_json drill true
+  echo "🧪 Drill: reporting $repo_name as failed"
+}
@@ -0,0 +1,418 @@
+#!/bin/bash
+# Archive encryption, applied to every archive before it is uploaded. Which
+# repositories are encrypted, and with which key, is decided by policy:
+#   ENCRYPTION_POLICY  none (default), private or all: repositories encrypted
+#                      with ENCRYPTION_DEFAULT_KEY
+#   encrypt=<key>      repos.txt option choosing the key for one repository;
+#                      encrypt=none exempts it from the policy
+# A repository that should be encrypted fails its backup when the key or the
+# tool it needs is unavailable; it is never stored unencrypted instead.
+#
+# Keys are ENCRYPTION_KEY_<NAME> variables holding "<method>:<key>", e.g.
+#   ENCRYPTION_KEY_TEAM_A="age:age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+# for encrypt=team-a. Each method adds its own extension to the archive name.
+# An age key is a comma-separated list of recipients: X25519 public keys
+# (age1...), SSH public keys, or @<file> with one recipient per line, so
+# several people (or an escrow key) can each decrypt. A gpg key is a
+# comma-separated list of OpenPGP key fingerprints, e.g.
+#   ENCRYPTION_KEY_OPS="gpg:0123456789ABCDEF0123456789ABCDEF01234567,89AB..."
+# looked up in GPG_PUBLIC_KEYS_FILE or the gpg keyring. A passphrase key, for
+# those who don't manage keypairs, names where the passphrase is:
+#   ENCRYPTION_KEY_VAULT="passphrase:VAULT_PASSPHRASE"       an environment variable
+#   ENCRYPTION_KEY_VAULT="passphrase:@/run/secrets/vault"    a file's first line
+# Its archives (.aes) are AES-256-CTR encrypted and HMAC-SHA256 authenticated
+# with keys derived by scrypt. The passphrase and the keys reach openssl
+# through a file descriptor, never its command line.
+
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+
+ENCRYPTION_POLICY="${ENCRYPTION_POLICY:-none}"
+ENCRYPTION_DEFAULT_KEY="${ENCRYPTION_DEFAULT_KEY:-}"
+# Identities for decrypting age archives (search, migrate)
+AGE_IDENTITY_FILE="${AGE_IDENTITY_FILE:-}"
+# OpenPGP public keys (armored or binary) gpg keys are encrypted to; the gpg
+# keyring (GNUPGHOME) is used when empty. Decryption always uses the keyring.
+GPG_PUBLIC_KEYS_FILE="${GPG_PUBLIC_KEYS_FILE:-}"
+# "true" writes ASCII-armored .asc archives instead of binary .gpg ones
+GPG_ARMOR="${GPG_ARMOR:-false}"
+
+# Extensions encrypted archives end with
+ENCRYPTION_EXTENSIONS="age gpg asc aes"
+
+# scrypt cost of passphrase keys (N, r, p), recorded in each archive
+PASSPHRASE_SCRYPT_N=131072
+PASSPHRASE_SCRYPT_R=8
+PASSPHRASE_SCRYPT_P=1
+# Plaintext bytes per encrypted chunk of passphrase archives; each chunk is
+# decrypted on its own, which bounds the memory a restore needs
+PASSPHRASE_CHUNK_BYTES=$((16 * 1024 * 1024))
+# First line of passphrase archives
+PASSPHRASE_MAGIC="backup-aes-v1"
+
+# Whether a repository is private; unknown counts as private so a failed lookup
+# never leaves a private repository unencrypted
+repo_is_private() {
+  local repo_url="$1"
+  local repo_api=$(git_repo_api "$repo_url")
+  if [ -z "$repo_api" ]; then
+    return 0
+  fi
+  local private
+  private=$(api_get "$repo_api" 2>/dev/null | jq -r '.private') || return 0
+  [ "$private" != "false" ]
+}
+
+# Name of the key a repository's archives are encrypted with, empty for none:
+# encryption_key_for <repos.txt line> <url>
+encryption_key_for() {
+  local key=$(repo_option "$1" encrypt "")
+  if [ "$key" = "none" ]; then
+    return 0
+  fi
+  if [ -n "$key" ]; then
+    echo "$key"
+    return 0
+  fi
+  case "$ENCRYPTION_POLICY" in
+    all)
+      echo "${ENCRYPTION_DEFAULT_KEY:-default}"
+      ;;
+    private)
+      if repo_is_private "$2"; then
+        echo "${ENCRYPTION_DEFAULT_KEY:-default}"
+      fi
+      ;;
+  esac
+}
+
+# age's recipient options for a list of recipients: age_recipient_args <recipients>
+age_recipient_args() {
+  local recipient
+  local -a recipients
+  IFS=',' read -ra recipients <<<"$1"
+  for recipient in "${recipients[@]}"; do
+    recipient="${recipient#"${recipient%%[![:space:]]*}"}"
+    recipient="${recipient%"${recipient##*[![:space:]]}"}"
+    case "$recipient" in
+      "") ;;
+      @*) printf '%s\n' -R "${recipient#@}" ;;
+      *) printf '%s\n' -r "$recipient" ;;
+    esac
+  done
+}
+
+# What is wrong with an age recipient list, empty when nothing is
+age_recipients_problem() {
+  local option value
+  local count=0
+  while IFS= read -r option && IFS= read -r value; do
+    count=$((count + 1))
+    if [ "$option" = "-R" ]; then
+      [ -r "$value" ] || echo "recipients file $value is not readable"
+    elif [[ "$value" == AGE-SECRET-KEY-* ]]; then
+      echo "an age identity (private key) is listed as a recipient; use its public key (age-keygen -y)"
+    elif [[ ! "$value" =~ ^age1[02-9ac-hj-np-z]{58}$ ]] && [[ ! "$value" =~ ^ssh-(ed25519|rsa)\ [A-Za-z0-9+/=]+ ]]; then
+      echo "${value:0:12}... is not an age recipient (age1...) or SSH public key"
+    fi
+  done < <(age_recipient_args "$1")
+  if [ $count -eq 0 ]; then
+    echo "no recipients"
+  fi
+}
+
+# Fingerprints of a gpg key's comma-separated list, one per line, without the
+# spaces and 0x prefix they are often copied with
+gpg_fingerprints() {
+  tr ',' '\n' <<<"$1" | tr -d ' \t' | sed 's/^0[xX]//' | grep -v '^$'
+}
+
+# What is wrong with a gpg fingerprint list, empty when nothing is
+gpg_fingerprints_problem() {
+  local fingerprint
+  local count=0
+  while IFS= read -r fingerprint; do
+    count=$((count + 1))
+    if [[ ! "$fingerprint" =~ ^([0-9A-Fa-f]{40}|[0-9A-Fa-f]{64})$ ]]; then
+      echo "${fingerprint:0:16} is not a full OpenPGP key fingerprint (40 hex digits; short key IDs are ambiguous)"
+    fi
+  done < <(gpg_fingerprints "$1")
+  if [ $count -eq 0 ]; then
+    echo "no recipients"
+  fi
+}
+
+# Home of a keyring holding just GPG_PUBLIC_KEYS_FILE, created once per run;
+# empty for the default keyring
+gpg_home() {
+  [ -n "$GPG_PUBLIC_KEYS_FILE" ] || return 0
+  local home="${TMPDIR:-/tmp}/backup-gnupg-$$"
+  if [ ! -d "$home" ]; then
+    # Parallel backups may get here at once; the first complete keyring wins
+    local staging=$(mktemp -d "$home.XXXXXX")
+    chmod 700 "$staging"
+    if ! gpg --homedir "$staging" --batch --quiet --import "$GPG_PUBLIC_KEYS_FILE" 2>/dev/null; then
+      rm -rf "$staging"
+      echo "importing $GPG_PUBLIC_KEYS_FILE failed" >&2
+      return 1
+    fi
+    mv -T "$staging" "$home" 2>/dev/null || rm -rf "$staging"
+  fi
+  echo "$home"
+}
+
+# The passphrase a passphrase key refers to (<VARIABLE> or @<file>)
+passphrase_of() {
+  case "$1" in
+    @*) head -n 1 "${1#@}" 2>/dev/null | tr -d '\r\n' ;;
+    *) [[ "$1" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]] && echo "${!1}" ;;
+  esac
+}
+
+# What is wrong with a passphrase key, empty when nothing is
+passphrase_problem() {
+  case "$1" in
+    @*)
+      [ -r "${1#@}" ] || { echo "passphrase file ${1#@} is not readable"; return; }
+      ;;
+    *)
+      if [[ ! "$1" =~ ^[A-Za-z_][A-Za-z0-9_]*$ ]]; then
+        echo "names no variable; write passphrase:<VARIABLE> or passphrase:@<file>, never the passphrase itself"
+        return
+      fi
+      [ -n "${!1}" ] || { echo "passphrase variable $1 is not set"; return; }
+      ;;
+  esac
+  if [ "$(passphrase_of "$1" | wc -c)" -lt 12 ]; then
+    echo "the passphrase is shorter than 12 characters"
+  fi
+}
+
+# AES-256 and HMAC keys (hex, 64 bytes together) derived from a passphrase
+# with scrypt: passphrase_kek <passphrase> <salt hex> <N> <r> <p>
+passphrase_kek() {
+  openssl pkeyutl -kdf scrypt -kdflen 64 -pkeyopt_passin pass:fd:3 -pkeyopt "hexsalt:$2" \
+    -pkeyopt "N:$3" -pkeyopt "r:$4" -pkeyopt "p:$5" -pkeyopt maxmem_bytes:$((256 * 1024 * 1024)) \
+    3<<<"$1" </dev/null 2>/dev/null | od -An -v -tx1 | tr -d ' \n'
+}
+
+# HMAC-SHA256 (hex) of a file's SHA-256 under a hex key: passphrase_mac <key hex> <file>
+# HKDF-Extract is that HMAC with the key as its salt, which openssl reads from
+# a file descriptor; the HMAC commands only take keys on the command line.
+passphrase_mac() {
+  openssl pkeyutl -kdf HKDF -kdflen 32 -pkeyopt md:SHA256 -pkeyopt mode:EXTRACT_ONLY \
+    -pkeyopt_passin hexsalt:fd:3 -pkeyopt "hexkey:$(openssl dgst -sha256 -r "$2" | cut -c 1-64)" \
+    3<<<"$1" </dev/null 2>/dev/null | od -An -v -tx1 | tr -d ' \n'
+}
+
+# Encrypt a file with a passphrase: passphrase_encrypt <passphrase> <file> <output>
+# The output is a "backup-aes-v1" line, a JSON line with the scrypt salt and
+# cost, then each chunk as "<length> <HMAC>\n" and its AES-256-CTR ciphertext
+# (openssl enc, salted per chunk). A chunk's plaintext starts with
+# "<index> <count>\n", so dropped, reordered or swapped chunks fail to decrypt
+# like tampered ones.
+passphrase_encrypt() {
+  local file="$2"
+  local output="$3"
+  local salt=$(od -An -v -N 16 -tx1 /dev/urandom | tr -d ' \n')
+  local kek=$(passphrase_kek "$1" "$salt" "$PASSPHRASE_SCRYPT_N" "$PASSPHRASE_SCRYPT_R" "$PASSPHRASE_SCRYPT_P")
+  if [ ${#kek} -ne 128 ]; then
+    echo "deriving the key failed (openssl 3 with scrypt is needed)" >&2
+    return 1
+  fi
+  local size=$(stat -c %s "$file")
+  local count=$(( (size + PASSPHRASE_CHUNK_BYTES - 1) / PASSPHRASE_CHUNK_BYTES ))
+  [ $count -gt 0 ] || count=1
+  local chunk="$output.chunk"
+  echo "$PASSPHRASE_MAGIC" > "$output" &&
+    jq -nc --arg salt "$salt" --argjson n "$PASSPHRASE_SCRYPT_N" --argjson r "$PASSPHRASE_SCRYPT_R" \
+      --argjson p "$PASSPHRASE_SCRYPT_P" --argjson chunk "$PASSPHRASE_CHUNK_BYTES" \
+      '{kdf: "scrypt", salt: $salt, n: $n, r: $r, p: $p, cipher: "aes-256-ctr", mac: "hmac-sha256", chunk_bytes: $chunk}' >> "$output" || return 1
+  local index mac
+  for ((index = 0; index < count; index++)); do
+    if ! { echo "$index $count"; tail -c +$((index * PASSPHRASE_CHUNK_BYTES + 1)) "$file" | head -c "$PASSPHRASE_CHUNK_BYTES"; } |
+      openssl enc -aes-256-ctr -pbkdf2 -iter 1 -md sha256 -pass fd:3 -out "$chunk" 3<<<"${kek:0:64}" ||
+      ! mac=$(passphrase_mac "${kek:64}" "$chunk") || [ ${#mac} -ne 64 ] ||
+      ! echo "$(stat -c %s "$chunk") $mac" >> "$output" || ! cat "$chunk" >> "$output"; then
+      rm -f "$chunk"
+      return 1
+    fi
+  done
+  rm -f "$chunk"
+}
+
+# Decrypt a passphrase archive, failing on a wrong passphrase or any tampering:
+# passphrase_decrypt <passphrase> <file> <output>
+passphrase_decrypt() {
+  local file="$2"
+  local output="$3"
+  [ "$(head -n 1 "$file")" = "$PASSPHRASE_MAGIC" ] || return 1
+  local header=$(head -n 2 "$file" | tail -n 1)
+  local salt=$(jq -r '.salt' <<<"$header")
+  local kek=$(passphrase_kek "$1" "$salt" "$(jq -r '.n' <<<"$header")" "$(jq -r '.r' <<<"$header")" "$(jq -r '.p' <<<"$header")")
+  [ ${#kek} -eq 128 ] || return 1
+  local size=$(stat -c %s "$file")
+  local offset=$(( ${#PASSPHRASE_MAGIC} + ${#header} + 2 ))
+  local index=0 count="" line length prefix
+  local chunk="$output.chunk"
+  : > "$output" || return 1
+  while [ $offset -lt "$size" ]; do
+    line=$(tail -c +$((offset + 1)) "$file" | head -n 1)
+    [[ "$line" =~ ^[0-9]+\ [0-9a-f]{64}$ ]] || break
+    length="${line% *}"
+    offset=$((offset + ${#line} + 1))
+    # The ciphertext is authenticated before anything is decrypted
+    tail -c +$((offset + 1)) "$file" | head -c "$length" > "$chunk.enc" || break
+    [ "$(passphrase_mac "${kek:64}" "$chunk.enc")" = "${line#* }" ] || break
+    openssl enc -d -aes-256-ctr -pbkdf2 -iter 1 -md sha256 -pass fd:3 -in "$chunk.enc" -out "$chunk" \
+      3<<<"${kek:0:64}" 2>/dev/null || break
+    # An authenticated chunk still has to be the one expected here
+    prefix=$(head -n 1 "$chunk")
+    if [ "${prefix% *}" != "$index" ] || { [ -n "$count" ] && [ "${prefix#* }" != "$count" ]; }; then
+      break
+    fi
+    tail -c +$((${#prefix} + 2)) "$chunk" >> "$output" || break
+    count="${prefix#* }"
+    index=$((index + 1))
+    offset=$((offset + length))
+  done
+  rm -f "$chunk" "$chunk.enc"
+  [ $offset -eq "$size" ] && [ -n "$count" ] && [ "$index" -eq "$count" ]
+}
+
+# "<method>:<key>" configured for a key name, empty when not configured
+encryption_spec() {
+  local variable="ENCRYPTION_KEY_$(tr 'a-z.-' 'A-Z__' <<<"$1")"
+  echo "${!variable}"
+}
+
+# Encrypt a file for a named key, printing the encrypted file's path:
+# encrypt_archive <key name> <file>
+encrypt_archive() {
+  local key_name="$1"
+  local file="$2"
+  local spec=$(encryption_spec "$key_name")
+  local method="${spec%%:*}"
+  local key="${spec#*:}"
+  if [ -z "$spec" ]; then
+    echo "key $key_name is not configured (ENCRYPTION_KEY_$(tr 'a-z.-' 'A-Z__' <<<"$key_name"))" >&2
+    return 1
+  fi
+  local extension
+  case "$method" in
+    age)
+      if ! command -v age >/dev/null; then
+        echo "age is not installed" >&2
+        return 1
+      fi
+      local problem=$(age_recipients_problem "$key" | head -n 1)
+      if [ -n "$problem" ]; then
+        echo "key $key_name: $problem" >&2
+        return 1
+      fi
+      local -a recipients
+      mapfile -t recipients < <(age_recipient_args "$key")
+      age "${recipients[@]}" -o "$file.age" "$file" || return 1
+      extension="age"
+      ;;
+    gpg)
+      if ! command -v gpg >/dev/null; then
+        echo "gpg is not installed" >&2
+        return 1
+      fi
+      local problem=$(gpg_fingerprints_problem "$key" | head -n 1)
+      if [ -n "$problem" ]; then
+        echo "key $key_name: $problem" >&2
+        return 1
+      fi
+      local home
+      home=$(gpg_home) || return 1
+      local -a options=(--batch --yes --quiet --trust-model always)
+      [ -z "$home" ] || options+=(--homedir "$home")
+      extension="gpg"
+      if [ "$GPG_ARMOR" = "true" ]; then
+        options+=(--armor)
+        extension="asc"
+      fi
+      local fingerprint
+      while IFS= read -r fingerprint; do
+        options+=(--recipient "$fingerprint")
+      done < <(gpg_fingerprints "$key")
+      # Recipients are pinned by fingerprint, so keys needn't be trusted in the keyring
+      gpg "${options[@]}" --output "$file.$extension" --encrypt "$file" || return 1
+      ;;
+    passphrase)
+      if ! command -v openssl >/dev/null; then
+        echo "openssl is not installed" >&2
+        return 1
+      fi
+      local problem=$(passphrase_problem "$key")
+      if [ -n "$problem" ]; then
+        echo "key $key_name: $problem" >&2
+        return 1
+      fi
+      extension="aes"
+      if ! passphrase_encrypt "$(passphrase_of "$key")" "$file" "$file.aes"; then
+        rm -f "$file.aes"
+        return 1
+      fi
+      ;;
+    *)
+      echo "unknown encryption method: $method" >&2
+      return 1
+      ;;
+  esac
+  rm -f "$file"
+  echo "$file.$extension"
+}
+
+# Extension an encrypted archive name ends with (".age", ".gpg", ".asc", ".aes"), empty when unencrypted
+encryption_suffix_of() {
+  local extension
+  for extension in $ENCRYPTION_EXTENSIONS; do
+    if [[ "$1" == *".$extension" ]]; then
+      echo ".$extension"
+      return
+    fi
+  done
+}
+
+# Decrypt an encrypted archive next to itself, printing the decrypted path
+decrypt_archive() {
+  local file="$1"
+  case "$file" in
+    *.age)
+      if [ -z "$AGE_IDENTITY_FILE" ] || ! command -v age >/dev/null; then
+        echo "decrypting $(basename "$file") needs age and AGE_IDENTITY_FILE" >&2
+        return 1
+      fi
+      age -d -i "$AGE_IDENTITY_FILE" -o "${file%.age}" "$file" || return 1
+      echo "${file%.age}"
+      ;;
+    *.gpg|*.asc)
+      if ! command -v gpg >/dev/null; then
+        echo "decrypting $(basename "$file") needs gpg with the secret key in its keyring" >&2
+        return 1
+      fi
+      gpg --batch --yes --quiet --output "${file%.*}" --decrypt "$file" || return 1
+      echo "${file%.*}"
+      ;;
+    *.aes)
+      # Any configured passphrase key may have encrypted it
+      local variable spec
+      for variable in $(compgen -v ENCRYPTION_KEY_); do
+        spec="${!variable}"
+        if [ "${spec%%:*}" = "passphrase" ] && [ -n "$(passphrase_of "${spec#*:}")" ] &&
+          passphrase_decrypt "$(passphrase_of "${spec#*:}")" "$file" "${file%.aes}"; then
+          echo "${file%.aes}"
+          return 0
+        fi
+      done
+      rm -f "${file%.aes}"
+      echo "no configured passphrase key decrypts $(basename "$file") (wrong passphrase or damaged archive)" >&2
+      return 1
+      ;;
+    *)
+      return 1
+      ;;
+  esac
+}
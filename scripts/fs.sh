@@ -0,0 +1,42 @@
+#!/bin/bash
+# Filesystem operations of the cleanup logic. Ages are measured against the
+# clock (clock.sh) rather than by find -mmin, so a simulated clock ages files
+# too, and fs_touch gives a file any age, so cleanup can be exercised on a
+# scratch directory without waiting.
+
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+# stat arguments printing the modification time, for GNU and BSD/macOS stat
+if stat -c %Y / >/dev/null 2>&1; then
+  STAT_MTIME_ARGS=(-c %Y)
+else
+  STAT_MTIME_ARGS=(-f %m)
+fi
+
+# Modification time of a path, as an epoch
+fs_mtime() {
+  stat "${STAT_MTIME_ARGS[@]}" "$1"
+}
+
+# Set a path's modification time, creating an empty file if it doesn't exist: fs_touch <path> <epoch>
+fs_touch() {
+  touch -d "@$2" "$1"
+}
+
+# Of the paths on stdin, one per line, those last modified more than <seconds> ago
+fs_older_than() {
+  local now
+  now=$(clock_now) || return 1
+  local path mtime
+  while IFS= read -r path; do
+    mtime=$(fs_mtime "$path" 2>/dev/null) || continue
+    if [ $((now - mtime)) -gt "$1" ]; then
+      echo "$path"
+    fi
+  done
+}
+
+# Remove a file or directory tree
+fs_remove() {
+  rm -rf "$1"
+}
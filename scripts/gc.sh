@@ -0,0 +1,82 @@
+#!/bin/bash
+# Startup sweep for artifacts left behind by crashed or killed runs: clone
+# directories, half-written uploads, mirror tree copies and per-run API
+# state. Archives missing from the catalog are reported, never deleted.
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/walk.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/fs.sh"
+
+GC_ON_START="${GC_ON_START:-true}"
+# Leave artifacts modified more recently alone, they may belong to a concurrent run
+GC_MIN_AGE_MINUTES="${GC_MIN_AGE_MINUTES:-60}"
+
+# Whether the process that created a "backup-repo.<pid>.*", "backup-upload.<pid>.*",
+# "backup-api-<pid>", "backup-resources-<pid>", "backup-config-<pid>" or
+# "backup-gnupg-<pid>" path has exited
+gc_owner_gone() {
+  local pid=$(basename "$1" | grep -oE '[0-9]+' | head -n 1)
+  [ -n "$pid" ] && ! kill -0 "$pid" 2>/dev/null
+}
+
+# Orphaned artifacts, one path per line
+gc_candidates() {
+  local path
+  local min_age=$((GC_MIN_AGE_MINUTES * 60))
+  find "${TMPDIR:-/tmp}" -mindepth 1 -maxdepth 1 \( -name 'backup-repo.*' -o -name 'backup-upload.*' -o -name 'backup-api-*' -o -name 'backup-resources-*' -o -name 'backup-config-*' -o -name 'backup-gnupg-*' \) \
+    2>/dev/null | fs_older_than "$min_age" | while IFS= read -r path; do
+    if gc_owner_gone "$path"; then
+      echo "$path"
+    fi
+  done
+  if [[ " $BACKUP_DESTINATIONS " == *" local "* ]] && [ -d "$LOCAL_BACKUP_DIR" ]; then
+    find "$LOCAL_BACKUP_DIR" -type f -name '*.tmp' | fs_older_than "$min_age"
+  fi
+  if [ -n "$MIRROR_TREE_DIR" ] && [ -d "$MIRROR_TREE_DIR" ]; then
+    find "$MIRROR_TREE_DIR" -mindepth 2 -maxdepth 2 -type d -name '*.tmp' | fs_older_than "$min_age"
+  fi
+  # Uploads can't resume once Azure dropped their uncommitted blocks (after 7 days)
+  if [ -d "$(multipart_journal_dir)" ]; then
+    find "$(multipart_journal_dir)" -type f | fs_older_than $((7 * 86400))
+  fi
+}
+
+# Archives on the primary destination that the catalog does not know about
+gc_uncataloged_archives() {
+  storage_list "$(primary_destination)" | parse_archive_names | cut -d' ' -f3 |
+    grep -vxF -f <(jq -r '.[].archive' "$CATALOG_FILE")
+}
+
+# Remove orphaned artifacts and report the space reclaimed
+gc_sweep() {
+  local removed=0
+  local reclaimed=0
+  local path size
+  while IFS= read -r path; do
+    [ -n "$path" ] || continue
+    if [ -d "$path" ]; then
+      size=$(directory_size "$path")
+    else
+      size=$(file_size "$path")
+    fi
+    if fs_remove "$path"; then
+      removed=$((removed + 1))
+      reclaimed=$((reclaimed + ${size:-0}))
+    fi
+  done < <(gc_candidates)
+  if [ $removed -gt 0 ]; then
+    echo "🧹 Removed $removed orphaned artifacts, reclaimed $(jq -rn --argjson bytes "$reclaimed" "$RESULTS_JQ_DEFS"' $bytes | size_human')"
+  fi
+
+  local uncataloged=$(gc_uncataloged_archives | wc -l)
+  if [ "$uncataloged" -gt 0 ]; then
+    echo "ℹ️ $uncataloged archives on $(primary_destination) are not in the catalog (kept)"
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  state_load
+  gc_sweep
+fi
@@ -0,0 +1,198 @@
+#!/bin/bash
+# Google Cloud Storage destination through the JSON API, authenticated as the
+# service account in GOOGLE_SERVICE_ACCOUNT_JSON (see google-auth.sh). Uploads
+# go through resumable sessions, so a dropped connection continues from the
+# bytes Google already has instead of starting over.
+
+source "$(dirname "${BASH_SOURCE[0]}")/google-auth.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/walk.sh"
+
+GCS_BUCKET="${GCS_BUCKET:-}"
+GCS_ENDPOINT="${GCS_ENDPOINT:-https://storage.googleapis.com}"
+# Attempts of one upload session before the upload fails
+GCS_UPLOAD_ATTEMPTS="${GCS_UPLOAD_ATTEMPTS:-3}"
+
+# Access token for the bucket, cached for the run (tokens are good for an hour)
+gcs_token() {
+  local cache="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}/gcs-token.json"
+  if [ -f "$cache" ] &&
+    jq -e --argjson now "$(date +%s)" '.expires_at > $now' "$cache" >/dev/null 2>&1; then
+    jq -r '.token' "$cache"
+    return
+  fi
+  local token=$(google_access_token "https://www.googleapis.com/auth/devstorage.read_write")
+  if [ -z "$token" ]; then
+    echo "❌ Could not get a Google Cloud Storage token (check GOOGLE_SERVICE_ACCOUNT_JSON)" >&2
+    return 1
+  fi
+  mkdir -p "$(dirname "$cache")"
+  (umask 077 && jq -n --arg token "$token" --argjson expires_at $(($(date +%s) + 3000)) \
+    '{token: $token, expires_at: $expires_at}' > "$cache")
+  echo "$token"
+}
+
+# Custom metadata of uploaded objects: the run that wrote them
+gcs_metadata() {
+  jq -cn --arg run_uuid "${RUN_UUID:-}" '{metadata: (if $run_uuid != "" then {run_uuid: $run_uuid} else {} end)}'
+}
+
+# Object name as one URL path segment ("/" included)
+gcs_object() {
+  jq -rn --arg name "$1" '$name | @uri'
+}
+
+# Call the API: gcs_request <method> <path> [curl options...]
+gcs_request() {
+  local method="$1"
+  local path="$2"
+  shift 2
+  local token
+  token=$(gcs_token) || return 1
+  curl -sf -X "$method" -H @<(echo "Authorization: Bearer $token") "$@" "$GCS_ENDPOINT$path"
+}
+
+# Upload a file through a resumable session: gcs_put <file> <name>
+gcs_put() {
+  local file="$1"
+  local name="$2"
+  local size=$(file_size "$file")
+  local headers=$(mktemp)
+  local session
+  gcs_request POST "/upload/storage/v1/b/$GCS_BUCKET/o?uploadType=resumable&name=$(gcs_object "$name")" \
+    -H "X-Upload-Content-Type: application/octet-stream" -H "X-Upload-Content-Length: $size" \
+    -H "Content-Type: application/json" --data-binary "$(gcs_metadata)" -D "$headers" -o /dev/null --max-time 60
+  session=$(tr -d '\r' < "$headers" | sed -n 's/^[Ll]ocation: //p')
+  if [ -z "$session" ]; then
+    rm -f "$headers"
+    return 1
+  fi
+
+  local offset=0 attempt status received
+  for attempt in $(seq 1 "$GCS_UPLOAD_ATTEMPTS"); do
+    if [ "$size" -eq 0 ]; then
+      curl -sf -X PUT -H "Content-Range: bytes */0" -H "Content-Length: 0" -o /dev/null --max-time 60 "$session" &&
+        break
+    elif tail -c +$((offset + 1)) "$file" | curl -sf -X PUT --upload-file - --max-time 900 \
+      -H "Transfer-Encoding:" -H "Content-Length: $((size - offset))" -H "Content-Range: bytes $offset-$((size - 1))/$size" \
+      -o /dev/null "$session"; then
+      break
+    fi
+    # Ask how far the session got: 308 with the bytes received so far, 200/201 when complete
+    status=$(curl -s -X PUT -H "Content-Range: bytes */$size" -H "Content-Length: 0" \
+      -D "$headers" -o /dev/null -w '%{http_code}' --max-time 60 "$session")
+    case "$status" in
+      200|201) break ;;
+      308) ;;
+      *) rm -f "$headers"; return 1 ;;
+    esac
+    received=$(tr -d '\r' < "$headers" | sed -n 's/^[Rr]ange: bytes=0-//p')
+    offset=$((${received:--1} + 1))
+    if [ "$attempt" -eq "$GCS_UPLOAD_ATTEMPTS" ]; then
+      rm -f "$headers"
+      return 1
+    fi
+  done
+  rm -f "$headers"
+}
+
+# Download an object: gcs_get <name> <file>
+gcs_get() {
+  gcs_request GET "/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$1")?alt=media" --max-time 900 -o "$2"
+}
+
+# Stream an object or a byte range of it: gcs_read <name> <offset> [length]
+gcs_read() {
+  local name="$1"
+  local offset="$2"
+  local length="$3"
+  local range=""
+  if [ "$offset" -gt 0 ] || [ -n "$length" ]; then
+    range="$offset-${length:+$((offset + length - 1))}"
+  fi
+  gcs_request GET "/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$name")?alt=media" ${range:+-r "$range"}
+}
+
+# Object names under a prefix, one per line: gcs_list [prefix]
+gcs_list() {
+  local prefix="$1"
+  local page="" response
+  while :; do
+    response=$(gcs_request GET "/storage/v1/b/$GCS_BUCKET/o?prefix=$(gcs_object "$prefix")&fields=nextPageToken,items(name)${page:+&pageToken=$(gcs_object "$page")}" \
+      --max-time 60) || return 1
+    jq -r '.items[]?.name' <<<"$response"
+    page=$(jq -r '.nextPageToken // empty' <<<"$response")
+    [ -n "$page" ] || break
+  done
+}
+
+gcs_size() {
+  gcs_request GET "/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$1")?fields=size" --max-time 60 | jq -r '.size'
+}
+
+gcs_delete() {
+  gcs_request DELETE "/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$1")" --max-time 60 -o /dev/null
+}
+
+# Server-side copy: gcs_copy <source> <target>; large objects take several calls
+gcs_copy() {
+  local path="/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$1")/rewriteTo/b/$GCS_BUCKET/o/$(gcs_object "$2")"
+  local token="" response
+  while :; do
+    response=$(gcs_request POST "$path${token:+?rewriteToken=$(gcs_object "$token")}" \
+      -H "Content-Type: application/json" -d '{}' --max-time 300) || return 1
+    [ "$(jq -r '.done' <<<"$response")" = "true" ] && return 0
+    token=$(jq -r '.rewriteToken' <<<"$response")
+  done
+}
+
+# Combine objects into one: gcs_compose <target> <source...> (at most 32 sources)
+gcs_compose() {
+  local target="$1"
+  shift
+  jq -n --argjson destination "$(gcs_metadata)" \
+    '{sourceObjects: [$ARGS.positional[] | {name: .}], destination: $destination}' --args "$@" |
+    gcs_request POST "/storage/v1/b/$GCS_BUCKET/o/$(gcs_object "$target")/compose" \
+      -H "Content-Type: application/json" --data-binary @- --max-time 300 -o /dev/null
+}
+
+# Multipart hooks for GCS (see multipart.sh): parts are uploaded as objects
+# under _uploads/<id>/ and composed into the archive at the end. The session
+# is "<prefix><TAB><name>".
+gcs_multipart_start() {
+  printf '_uploads/%s-%s%s\t%s\n' "$(date +%Y%m%d%H%M%S)" "$$" "$RANDOM" "$1"
+}
+
+gcs_part_name() {
+  printf '%s/%06d' "${1%%$'\t'*}" "$2"
+}
+
+gcs_multipart_part() {
+  gcs_put "$3" "$(gcs_part_name "$1" "$2")"
+}
+
+gcs_multipart_finish() {
+  local prefix="${1%%$'\t'*}"
+  local name="${1#*$'\t'}"
+  local count="$2"
+  local index round=0
+  local -a sources=() combined
+  for ((index = 0; index < count; index++)); do
+    sources+=("$(gcs_part_name "$1" "$index")")
+  done
+  # Compose takes 32 sources at most, so many parts are combined in rounds
+  while [ ${#sources[@]} -gt 32 ]; do
+    combined=()
+    for ((index = 0; index < ${#sources[@]}; index += 32)); do
+      combined+=("$prefix/round$round-$((index / 32))")
+      gcs_compose "${combined[-1]}" "${sources[@]:index:32}" || return 1
+    done
+    sources=("${combined[@]}")
+    round=$((round + 1))
+  done
+  gcs_compose "$name" "${sources[@]}" || return 1
+  local -a parts
+  mapfile -t parts < <(gcs_list "$prefix/")
+  for index in "${!parts[@]}"; do
+    gcs_delete "${parts[$index]}"
+  done
+}
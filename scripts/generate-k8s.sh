@@ -0,0 +1,164 @@
+#!/bin/bash
+# Kubernetes manifests for running backups as a CronJob: a ConfigMap with
+# repos.txt (or a configuration document) and the settings, and the CronJob running run-container.sh with
+# credentials from a Secret. Printed for kubectl apply -f -.
+
+source "$(dirname "${BASH_SOURCE[0]}")/config-check.sh"
+
+# Settings read from the Secret: everything secret plus the storage account
+K8S_SECRET_VARS="$CONFIG_SECRET_VARS GITHUB_APP_ID AZURE_STORAGE_ACCOUNT GOOGLE_SERVICE_ACCOUNT_JSON RESULTS_DB_URL RETRY_URL"
+
+# A value as a YAML (JSON) string
+k8s_quote() {
+  jq -n --arg value "$1" '$value'
+}
+
+# ConfigMap with files, keyed by base name: k8s_config_map <name> <namespace> <file...>
+k8s_config_map() {
+  local name="$1"
+  local namespace="$2"
+  shift 2
+  cat <<EOF
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: $name
+  namespace: $namespace
+data:
+EOF
+  local file
+  for file in "$@"; do
+    echo "  $(basename "$file"): $(jq -Rs . < "$file")"
+  done
+}
+
+# ConfigMap with the KEY=VALUE lines of an env file: k8s_env_map <name> <namespace> <file>
+k8s_env_map() {
+  cat <<EOF
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: $1
+  namespace: $2
+data:
+EOF
+  local key value
+  while IFS='=' read -r key value; do
+    if [[ "$key" =~ ^[A-Z_][A-Z0-9_]*$ ]]; then
+      value="${value%\"}"
+      echo "  $key: $(k8s_quote "${value#\"}")"
+    fi
+  done < <(grep -v '^[[:space:]]*#' "$3")
+}
+
+# generate-k8s --image image [--name name] [--namespace ns] [--schedule cron]
+#   [--secret name] [--env-file file] [--config file] [--file path]...
+generate_k8s() {
+  local image=""
+  local name="repo-backup"
+  local namespace="default"
+  local schedule="0 2 * * *"
+  local secret=""
+  local env_file=""
+  local config=""
+  local -a files=()
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --image) image="$2"; shift 2 ;;
+      --name) name="$2"; shift 2 ;;
+      --namespace) namespace="$2"; shift 2 ;;
+      --schedule) schedule="$2"; shift 2 ;;
+      --secret) secret="$2"; shift 2 ;;
+      --env-file) env_file="$2"; shift 2 ;;
+      --config) config="$2"; shift 2 ;;
+      --file) files+=("$2"); shift 2 ;;
+      *) image=""; break ;;
+    esac
+  done
+  if [ -z "$image" ]; then
+    echo "❌ Usage: generate-k8s --image image [--name name] [--namespace ns] [--schedule cron] [--secret name] [--env-file file] [--config file] [--file path]..." >&2
+    return 2
+  fi
+  # A configuration document (see config-blob.sh) replaces repos.txt
+  files=("${config:-repos.txt}" "${files[@]}")
+  local file
+  for file in "${files[@]}" $env_file; do
+    if [ ! -f "$file" ]; then
+      echo "❌ $file not found" >&2
+      return 1
+    fi
+  done
+  secret="${secret:-$name}"
+
+  k8s_config_map "$name-config" "$namespace" "${files[@]}"
+  if [ -n "$env_file" ]; then
+    echo "---"
+    k8s_env_map "$name-env" "$namespace" "$env_file"
+  fi
+  cat <<EOF
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: $name
+  namespace: $namespace
+spec:
+  schedule: $(k8s_quote "$schedule")
+  concurrencyPolicy: Forbid
+  successfulJobsHistoryLimit: 3
+  failedJobsHistoryLimit: 3
+  jobTemplate:
+    spec:
+      backoffLimit: 0
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+            - name: backup
+              image: $(k8s_quote "$image")
+              securityContext:
+                readOnlyRootFilesystem: true
+              env:
+                - name: HOME
+                  value: /work
+                - name: BACKUP_CONFIG_DIR
+                  value: /config
+                - name: BACKUP_WORK_DIR
+                  value: /work
+EOF
+  if [ -n "$config" ]; then
+    cat <<EOF
+                - name: BACKUP_CONFIG_FILE
+                  value: $(k8s_quote "/config/$(basename "$config")")
+EOF
+  fi
+  local variable
+  for variable in $K8S_SECRET_VARS; do
+    cat <<EOF
+                - name: $variable
+                  valueFrom:
+                    secretKeyRef: {name: $secret, key: $variable, optional: true}
+EOF
+  done
+  if [ -n "$env_file" ]; then
+    cat <<EOF
+              envFrom:
+                - configMapRef: {name: $name-env}
+EOF
+  fi
+  cat <<EOF
+              volumeMounts:
+                - {name: config, mountPath: /config, readOnly: true}
+                - {name: work, mountPath: /work}
+          volumes:
+            - name: config
+              configMap: {name: $name-config}
+            - name: work
+              emptyDir: {}
+EOF
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  generate_k8s "$@"
+fi
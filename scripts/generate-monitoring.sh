@@ -0,0 +1,142 @@
+#!/bin/bash
+# Monitoring setup for the metrics push-metrics.sh pushes: a Grafana dashboard
+# and Prometheus alert rules, printed for copying into Grafana and the rule
+# files of Prometheus.
+
+source "$(dirname "${BASH_SOURCE[0]}")/push-metrics.sh"
+
+# Alert when no run finished for this many hours
+MONITORING_MAX_RUN_AGE_HOURS="${MONITORING_MAX_RUN_AGE_HOURS:-26}"
+
+# Grafana dashboard JSON, importable with a Prometheus data source: monitoring_grafana <job>
+monitoring_grafana() {
+  jq -n --arg job "$1" '
+    def target(expr; legend): {expr: expr, legendFormat: legend, refId: "A", datasource: {type: "prometheus", uid: "${datasource}"}};
+    def panel(id; title; type; x; y; w; h; targets; unit): {
+      id: id, title: title, type: type, gridPos: {x: x, y: y, w: w, h: h},
+      datasource: {type: "prometheus", uid: "${datasource}"},
+      targets: targets, fieldConfig: {defaults: {unit: unit}, overrides: []}
+    };
+    {
+      title: "Repository Backup",
+      uid: "repository-backup",
+      tags: ["backup"],
+      timezone: "utc",
+      schemaVersion: 39,
+      time: {from: "now-30d", to: "now"},
+      refresh: "5m",
+      templating: {list: [
+        {name: "datasource", label: "Data source", type: "datasource", query: "prometheus"},
+        {name: "job", label: "Job", type: "query", datasource: {type: "prometheus", uid: "${datasource}"},
+          query: "label_values(backup_last_run_timestamp_seconds, job)", current: {text: $job, value: $job}, refresh: 1}
+      ]},
+      panels: [
+        panel(1; "Since last run"; "stat"; 0; 0; 6; 4;
+          [target("time() - max(backup_last_run_timestamp_seconds{job=\"$job\"})"; "")]; "s"),
+        panel(2; "Succeeded"; "stat"; 6; 0; 4; 4; [target("backup_repositories_succeeded{job=\"$job\"}"; "")]; "none"),
+        panel(3; "Failed"; "stat"; 10; 0; 4; 4; [target("backup_repositories_failed{job=\"$job\"}"; "")]; "none"),
+        panel(4; "Partial"; "stat"; 14; 0; 4; 4; [target("backup_repositories_partial{job=\"$job\"}"; "")]; "none"),
+        panel(5; "Skipped"; "stat"; 18; 0; 6; 4; [target("backup_repositories_skipped{job=\"$job\"}"; "")]; "none"),
+        panel(6; "Failing repositories"; "table"; 0; 4; 12; 8;
+          [target("backup_repository_success{job=\"$job\"} == 0"; "{{repository}}") | .format = "table" | .instant = true]; "none"),
+        panel(7; "Run duration"; "timeseries"; 12; 4; 12; 8;
+          [target("backup_run_duration_seconds{job=\"$job\"}"; "run"), (target("backup_clone_seconds{job=\"$job\"}"; "cloning") | .refId = "B")]; "s"),
+        panel(8; "Archive size by repository"; "timeseries"; 0; 12; 12; 8;
+          [target("backup_repository_size_bytes{job=\"$job\"}"; "{{repository}}")]; "bytes"),
+        panel(9; "Clone time by repository"; "timeseries"; 12; 12; 12; 8;
+          [target("backup_repository_clone_seconds{job=\"$job\"}"; "{{repository}}")]; "s"),
+        panel(10; "Uploaded by destination"; "timeseries"; 0; 20; 12; 8;
+          [target("backup_destination_uploaded_bytes{job=\"$job\"}"; "{{destination}}")]; "bytes"),
+        panel(11; "Upload time by destination"; "timeseries"; 12; 20; 12; 8;
+          [target("backup_destination_upload_seconds{job=\"$job\"}"; "{{destination}}")]; "s"),
+        panel(12; "API requests"; "timeseries"; 0; 28; 24; 8;
+          [target("backup_api_requests{job=\"$job\"}"; "{{host}} requests"),
+            (target("backup_api_retries{job=\"$job\"}"; "{{host}} retries") | .refId = "B"),
+            (target("backup_api_errors{job=\"$job\"}"; "{{host}} errors") | .refId = "C")]; "none")
+      ]
+    }'
+}
+
+# Prometheus alerting rules as YAML: monitoring_rules <job>
+monitoring_rules() {
+  local job="$1"
+  local window_seconds=$(( ${BACKUP_WINDOW_MINUTES:-0} * 60 ))
+  cat <<EOF
+groups:
+  - name: repository-backup
+    rules:
+      - alert: BackupRunMissing
+        expr: time() - max(backup_last_run_timestamp_seconds{job="$job"}) > $((MONITORING_MAX_RUN_AGE_HOURS * 3600))
+        labels:
+          severity: critical
+        annotations:
+          summary: No repository backup finished in the last ${MONITORING_MAX_RUN_AGE_HOURS}h
+      - alert: BackupMetricsAbsent
+        expr: absent(backup_last_run_timestamp_seconds{job="$job"})
+        for: 1h
+        labels:
+          severity: critical
+        annotations:
+          summary: No repository backup metrics in the Pushgateway
+      - alert: BackupRepositoriesFailed
+        expr: backup_repositories_failed{job="$job"} > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: "{{ \$value }} repositories failed in the last backup run"
+      - alert: BackupRepositoryFailing
+        expr: backup_repository_success{job="$job"} == 0
+        labels:
+          severity: warning
+        annotations:
+          summary: "Backup of {{ \$labels.repository }} failed"
+      - alert: BackupRepositoriesPartial
+        expr: backup_repositories_partial{job="$job"} > 0
+        labels:
+          severity: info
+        annotations:
+          summary: "{{ \$value }} repositories were backed up without their auxiliary exports"
+      - alert: BackupApiErrors
+        expr: backup_api_errors{job="$job"} > 0
+        labels:
+          severity: warning
+        annotations:
+          summary: "API requests to {{ \$labels.host }} failed during the last backup run"
+EOF
+  if [ "$window_seconds" -gt 0 ]; then
+    cat <<EOF
+      - alert: BackupRunOverWindow
+        expr: backup_run_duration_seconds{job="$job"} > $window_seconds
+        labels:
+          severity: warning
+        annotations:
+          summary: The last backup run took longer than its ${BACKUP_WINDOW_MINUTES}m window
+EOF
+  fi
+}
+
+# generate-monitoring --format grafana|prometheus-rules [--job name]
+generate_monitoring() {
+  local format=""
+  local job="$PUSHGATEWAY_JOB"
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --format) format="$2"; shift 2 ;;
+      --job) job="$2"; shift 2 ;;
+      *) format=""; break ;;
+    esac
+  done
+  case "$format" in
+    grafana) monitoring_grafana "$job" ;;
+    prometheus-rules) monitoring_rules "$job" ;;
+    *)
+      echo "❌ Usage: generate-monitoring --format grafana|prometheus-rules [--job name]" >&2
+      return 2
+      ;;
+  esac
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  generate_monitoring "$@"
+fi
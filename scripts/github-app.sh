@@ -0,0 +1,89 @@
+#!/bin/bash
+# Authentication as a GitHub App: short-lived installation tokens instead of a
+# long-lived personal access token. A token is good for an hour; it is cached
+# for the run and replaced shortly before it expires, so long runs keep working.
+# GITHUB_APP_PRIVATE_KEY may hold the key file's path or its contents.
+
+source "$(dirname "${BASH_SOURCE[0]}")/google-auth.sh"
+
+GITHUB_APP_ID="${GITHUB_APP_ID:-}"
+GITHUB_APP_PRIVATE_KEY="${GITHUB_APP_PRIVATE_KEY:-}"
+# Installation to get tokens for; found by GITHUB_APP_OWNER (or as the only one) when empty
+GITHUB_APP_INSTALLATION_ID="${GITHUB_APP_INSTALLATION_ID:-}"
+GITHUB_APP_OWNER="${GITHUB_APP_OWNER:-}"
+# Get a new token when the cached one expires within this many minutes
+GITHUB_APP_TOKEN_MARGIN_MINUTES="${GITHUB_APP_TOKEN_MARGIN_MINUTES:-10}"
+
+github_app_enabled() {
+  [ -n "$GITHUB_APP_ID" ] && [ -n "$GITHUB_APP_PRIVATE_KEY" ]
+}
+
+# JWT identifying the app, valid for 9 minutes (GitHub allows 10)
+github_app_jwt() {
+  local key_file=$(mktemp)
+  if [ -f "$GITHUB_APP_PRIVATE_KEY" ]; then
+    cat "$GITHUB_APP_PRIVATE_KEY" > "$key_file"
+  else
+    printf '%s\n' "$GITHUB_APP_PRIVATE_KEY" > "$key_file"
+  fi
+  local now=$(date +%s)
+  local header=$(printf '{"alg":"RS256","typ":"JWT"}' | base64url)
+  local claims=$(jq -cn --arg iss "$GITHUB_APP_ID" --argjson now "$now" \
+    '{iss: $iss, iat: ($now - 60), exp: ($now + 540)}' | base64url)
+  local signature
+  signature=$(printf '%s.%s' "$header" "$claims" | openssl dgst -sha256 -sign "$key_file" | base64url)
+  local status=$?
+  rm -f "$key_file"
+  [ $status -eq 0 ] && [ -n "$signature" ] && echo "$header.$claims.$signature"
+}
+
+# Call the API as the app: github_app_api <method> <path> <jwt>
+github_app_api() {
+  curl -sf --max-time 30 -X "$1" \
+    -H @<(echo "Authorization: Bearer $3") \
+    -H "Accept: application/vnd.github+json" \
+    "https://api.github.com$2"
+}
+
+# Installation ID, from GITHUB_APP_INSTALLATION_ID or the app's installations
+github_app_installation() {
+  local jwt="$1"
+  if [ -n "$GITHUB_APP_INSTALLATION_ID" ]; then
+    echo "$GITHUB_APP_INSTALLATION_ID"
+    return
+  fi
+  local installations
+  installations=$(github_app_api GET "/app/installations?per_page=100" "$jwt") || return 1
+  jq -r --arg owner "$GITHUB_APP_OWNER" '
+    if $owner != "" then map(select(.account.login | ascii_downcase == ($owner | ascii_downcase)))
+    elif length == 1 then . else [] end | .[0].id // empty' <<<"$installations"
+}
+
+# Print an installation token, cached until shortly before it expires
+github_app_token() {
+  local cache="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}/github-app-token.json"
+  local margin=$((GITHUB_APP_TOKEN_MARGIN_MINUTES * 60))
+  if [ -f "$cache" ] &&
+    jq -e --argjson now "$(date +%s)" --argjson margin "$margin" \
+      '(.expires_at | fromdateiso8601) - $margin > $now' "$cache" >/dev/null 2>&1; then
+    jq -r '.token' "$cache"
+    return
+  fi
+
+  local jwt installation response
+  jwt=$(github_app_jwt) || return 1
+  installation=$(github_app_installation "$jwt")
+  if [ -z "$installation" ]; then
+    echo "❌ No installation of GitHub App $GITHUB_APP_ID found (set GITHUB_APP_INSTALLATION_ID or GITHUB_APP_OWNER)" >&2
+    return 1
+  fi
+  response=$(github_app_api POST "/app/installations/$installation/access_tokens" "$jwt") || return 1
+  mkdir -p "$(dirname "$cache")"
+  (umask 077 && jq '{token, expires_at}' <<<"$response" > "$cache")
+  jq -r '.token // empty' <<<"$response"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  github_app_token
+fi
@@ -0,0 +1,38 @@
+#!/bin/bash
+# Google service account authentication (OAuth2 JWT bearer flow)
+# GOOGLE_SERVICE_ACCOUNT_JSON may hold the key file's path or its contents.
+
+# Base64url encoding as used by JWTs
+base64url() {
+  base64 -w0 | tr '+/' '-_' | tr -d '='
+}
+
+# Print an access token for the given OAuth scope, or nothing on failure
+google_access_token() {
+  local scope="$1"
+  local key_json="$GOOGLE_SERVICE_ACCOUNT_JSON"
+  if [ -f "$key_json" ]; then
+    key_json=$(cat "$key_json")
+  fi
+  if [ -z "$key_json" ]; then
+    return 1
+  fi
+
+  local key_file=$(mktemp)
+  jq -r '.private_key' <<<"$key_json" > "$key_file"
+
+  local now=$(date +%s)
+  local header=$(printf '{"alg":"RS256","typ":"JWT"}' | base64url)
+  local claims=$(jq -cn \
+    --arg iss "$(jq -r '.client_email' <<<"$key_json")" \
+    --arg scope "$scope" \
+    --argjson iat "$now" \
+    '{iss: $iss, scope: $scope, aud: "https://oauth2.googleapis.com/token", iat: $iat, exp: ($iat + 3600)}' | base64url)
+  local signature=$(printf '%s.%s' "$header" "$claims" | openssl dgst -sha256 -sign "$key_file" | base64url)
+  rm -f "$key_file"
+
+  curl -s --max-time 30 \
+    -d grant_type=urn:ietf:params:oauth:grant-type:jwt-bearer \
+    -d assertion="$header.$claims.$signature" \
+    https://oauth2.googleapis.com/token | jq -r '.access_token // empty'
+}
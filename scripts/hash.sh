@@ -0,0 +1,54 @@
+#!/bin/bash
+# Hash algorithms for content manifests and dedup keys. BLAKE3 (the b3sum
+# tool) hashes a single large file on several threads, so manifests of big
+# mirrors, which are mostly one pack file, don't take as long as archiving them.
+
+# sha256, blake3, or auto (blake3 when b3sum is installed, sha256 otherwise)
+HASH_ALGORITHM="${HASH_ALGORITHM:-auto}"
+# Files at least this large are hashed one at a time on every worker (blake3 only)
+HASH_LARGE_FILE_MB="${HASH_LARGE_FILE_MB:-64}"
+
+# The algorithm in use, with auto resolved
+hash_algorithm() {
+  case "$HASH_ALGORITHM" in
+    auto)
+      if command -v b3sum >/dev/null 2>&1; then
+        echo "blake3"
+      else
+        echo "sha256"
+      fi
+      ;;
+    *) echo "$HASH_ALGORITHM" ;;
+  esac
+}
+
+# Command printing "<hash>  <file>" lines like sha256sum: hash_tool [threads]
+hash_tool() {
+  case "$(hash_algorithm)" in
+    sha256) echo "sha256sum" ;;
+    blake3) echo "b3sum --num-threads ${1:-${WALK_WORKERS:-1}}" ;;
+    *)
+      echo "❌ Unknown HASH_ALGORITHM: $HASH_ALGORITHM" >&2
+      return 1
+      ;;
+  esac
+}
+
+# Hash of a file, or of stdin without an argument: hash_file [file]
+hash_file() {
+  local tool
+  tool=$(hash_tool) || return 1
+  $tool "${1:--}" | cut -d' ' -f1
+}
+
+# Hash of a file prefixed with the algorithm, as stored in results and the catalog
+hash_key() {
+  local hash
+  hash=$(hash_file "$@") || return 1
+  echo "$(hash_algorithm):$hash"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  hash_key "$@"
+fi
@@ -0,0 +1,311 @@
+#!/bin/bash
+# Git hosts repositories may be backed up from, and the token and API of each.
+# GIT_HOSTS lists them as host[:port][/path][:type]. The host may be a shell
+# pattern (*.example.com); an entry with a port only covers URLs with that
+# port, one with a path only URLs under it (a host serving git below
+# /gitlab). The first entry covering a URL applies. The type decides which
+# API is used for .backup.yml, visibility and other metadata:
+#   github  github.com or GitHub Enterprise Server (https://<host>/api/v3)
+#   gitlab  GitLab (https://<host>/api/v4)
+#   gitea   Gitea or Gogs (https://<host>/api/v1)
+#   git     plain git, no API
+# Without a type, github.com is github, gitlab.com is gitlab and others are git.
+# Local paths and file:// URLs (bare repositories or working copies) are
+# only allowed under LOCAL_SOURCE_DIRS, and not at all when it is empty, so a
+# repos.txt can't reach into the machine's files by default. Organization
+# settings (org-settings:<org>) come from github.com.
+
+source "$(dirname "${BASH_SOURCE[0]}")/github-app.sh"
+
+GIT_HOSTS="${GIT_HOSTS:-github.com gitlab.com}"
+# Directories local repositories may be backed up from (none when empty)
+LOCAL_SOURCE_DIRS="${LOCAL_SOURCE_DIRS:-}"
+
+# Host of a git URL (https://host/..., ssh://git@host/..., git@host:...), empty for local paths
+git_url_host() {
+  local url="$1"
+  case "$url" in
+    file://*|/*|.*) return 0 ;;
+    *://*)
+      url="${url#*://}"
+      url="${url%%/*}"
+      url="${url##*@}"
+      echo "${url%%:*}" | tr '[:upper:]' '[:lower:]'
+      ;;
+    *@*:*)
+      url="${url#*@}"
+      echo "${url%%:*}" | tr '[:upper:]' '[:lower:]'
+      ;;
+  esac
+}
+
+# Port of a git URL, empty when it has none
+git_url_port() {
+  local url="$1"
+  case "$url" in
+    file://*) ;;
+    *://*)
+      url="${url#*://}"
+      url="${url%%/*}"
+      url="${url##*@}"
+      if [[ "$url" == *:* ]]; then
+        echo "${url##*:}"
+      fi
+      ;;
+  esac
+}
+
+# Path of a git URL after its host (owner/repo.git), empty for local paths
+git_url_path() {
+  local url="$1"
+  case "$url" in
+    file://*|/*|.*) ;;
+    *://*)
+      url="${url#*://}"
+      if [[ "$url" == */* ]]; then
+        echo "${url#*/}"
+      fi
+      ;;
+    *@*:*) echo "${url#*:}" ;;
+  esac
+}
+
+# Parts of a GIT_HOSTS entry as "host|port|path|type", empty parts left out
+git_host_entry_parts() {
+  local entry="$1"
+  local type=""
+  if [[ "$entry" == *:* ]]; then
+    case "${entry##*:}" in
+      github|gitlab|gitea|git) type="${entry##*:}"; entry="${entry%:*}" ;;
+    esac
+  fi
+  local authority="${entry%%/*}"
+  local path=""
+  [[ "$entry" != */* ]] || path="${entry#*/}"
+  local port=""
+  if [[ "$authority" == *:* ]]; then
+    port="${authority##*:}"
+    authority="${authority%:*}"
+  fi
+  echo "${authority,,}|$port|${path%/}|$type"
+}
+
+# Whether a GIT_HOSTS entry covers a URL: git_host_entry_matches <entry> <url>
+git_host_entry_matches() {
+  local pattern port path type
+  IFS='|' read -r pattern port path type <<<"$(git_host_entry_parts "$1")"
+  local host=$(git_url_host "$2")
+  [ -n "$host" ] && [[ "$host" == $pattern ]] || return 1
+  if [ -n "$port" ] && [ "$(git_url_port "$2")" != "$port" ]; then
+    return 1
+  fi
+  [ -z "$path" ] || [[ "$(git_url_path "$2")/" == "$path/"* ]]
+}
+
+# GIT_HOSTS entry covering a URL, empty when it isn't allowed
+git_url_entry() {
+  local entries entry
+  read -ra entries <<<"$GIT_HOSTS"
+  for entry in "${entries[@]}"; do
+    if git_host_entry_matches "$entry" "$1"; then
+      echo "$entry"
+      return
+    fi
+  done
+}
+
+# GIT_HOSTS entry of a host, empty when it isn't allowed
+git_host_entry() {
+  git_url_entry "https://$1/"
+}
+
+# Entries of GIT_HOSTS that can't be read, one per line
+git_hosts_problems() {
+  local entries entry pattern port path type
+  read -ra entries <<<"$GIT_HOSTS"
+  for entry in "${entries[@]}"; do
+    IFS='|' read -r pattern port path type <<<"$(git_host_entry_parts "$entry")"
+    if ! [[ "$pattern" =~ ^[a-z0-9*?.-]+$ ]] || ! [[ "$port" =~ ^[0-9]*$ ]] || [[ "$path" == *:* ]]; then
+      echo "$entry"
+    fi
+  done
+}
+
+# Whether repositories of a URL may be backed up
+git_host_allowed() {
+  local host=$(git_url_host "$1")
+  if [[ "$1" == org-settings:* ]]; then
+    [ -n "$(git_host_entry github.com)" ]
+    return
+  elif [ -z "$host" ]; then
+    local_source_allowed "$1"
+    return
+  fi
+  [ -n "$(git_url_entry "$1")" ]
+}
+
+# Absolute path of a local repository (a path or file:// URL). Relative paths
+# are taken from the directory the run started in, not WORK_DIR.
+local_source_path() {
+  local path="${1#file://}"
+  case "$path" in
+    "~") path="$HOME" ;;
+    "~/"*) path="$HOME/${path#"~/"}" ;;
+    /*) ;;
+    *) path="${BACKUP_START_DIR:-$PWD}/$path" ;;
+  esac
+  realpath -m "$path" 2>/dev/null || echo "$path"
+}
+
+# Whether a local repository is inside LOCAL_SOURCE_DIRS (symlinks resolved)
+local_source_allowed() {
+  [ -n "$LOCAL_SOURCE_DIRS" ] || return 1
+  local path=$(local_source_path "$1")
+  local dir
+  for dir in $LOCAL_SOURCE_DIRS; do
+    dir=$(realpath -m "$dir")
+    if [ "$path" = "$dir" ] || [[ "$path" == "${dir%/}/"* ]]; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Why a local repository may not be backed up
+local_source_problem() {
+  if [ -z "$LOCAL_SOURCE_DIRS" ]; then
+    echo "local repositories need LOCAL_SOURCE_DIRS"
+  else
+    echo "$(local_source_path "$1") is not in LOCAL_SOURCE_DIRS"
+  fi
+}
+
+# Type of the host serving an allowed URL: github, gitlab, gitea or git
+git_url_type() {
+  local type=$(git_host_entry_parts "$(git_url_entry "$1")" | cut -d'|' -f4)
+  if [ -n "$type" ]; then
+    echo "$type"
+    return
+  fi
+  case "$(git_url_host "$1")" in
+    github.com) echo "github" ;;
+    gitlab.com) echo "gitlab" ;;
+    *) echo "git" ;;
+  esac
+}
+
+# Type of an allowed host: github, gitlab, gitea or git
+git_host_type() {
+  git_url_type "https://$1/"
+}
+
+# Web address of the host serving a URL, with the port of http(s) URLs and
+# the path of its GIT_HOSTS entry: https://git.example.com:8443/gitlab
+git_url_base() {
+  local url="$1"
+  local scheme=https
+  local port=""
+  case "$url" in
+    http://*|https://*)
+      scheme="${url%%://*}"
+      port=$(git_url_port "$url")
+      ;;
+  esac
+  local path=$(git_host_entry_parts "$(git_url_entry "$url")" | cut -d'|' -f3)
+  echo "$scheme://$(git_url_host "$url")${port:+:$port}${path:+/$path}"
+}
+
+# Token for a host: GIT_TOKEN_<HOST> (git.example.com: GIT_TOKEN_GIT_EXAMPLE_COM),
+# falling back to GITHUB_TOKEN (or a GitHub App installation token) for
+# github.com and GITLAB_TOKEN for gitlab.com. A host's token is never sent to
+# another host.
+git_host_token() {
+  local host="$1"
+  local token=$(git_named_token "$host")
+  if [ -n "$token" ]; then
+    echo "$token"
+    return
+  fi
+  case "$host" in
+    github.com|api.github.com)
+      if github_app_enabled; then
+        github_app_token
+      else
+        echo "$GITHUB_TOKEN"
+      fi
+      ;;
+    gitlab.com) echo "$GITLAB_TOKEN" ;;
+  esac
+}
+
+# Environment variable of a named token (token=<name> in repos.txt): GIT_TOKEN_<NAME>
+git_named_token_variable() {
+  echo "GIT_TOKEN_$(tr '[:lower:]' '[:upper:]' <<<"$1" | tr -c 'A-Z0-9\n' '_')"
+}
+
+# Value of a named token, empty when it isn't set
+git_named_token() {
+  [ -n "$1" ] || return 0
+  local variable=$(git_named_token_variable "$1")
+  echo "${!variable}"
+}
+
+# API base URL of the host serving a URL, empty for plain git hosts
+git_url_api() {
+  local base=$(git_url_base "$1")
+  case "$(git_url_type "$1")" in
+    github)
+      if [ "$base" = "https://github.com" ]; then
+        echo "https://api.github.com"
+      else
+        echo "$base/api/v3"
+      fi
+      ;;
+    gitlab) echo "$base/api/v4" ;;
+    gitea) echo "$base/api/v1" ;;
+  esac
+}
+
+# GraphQL endpoint of the GitHub host serving a URL, empty for other hosts
+git_url_graphql() {
+  [ "$(git_url_type "$1")" = "github" ] || return 0
+  local base=$(git_url_base "$1")
+  if [ "$base" = "https://github.com" ]; then
+    echo "https://api.github.com/graphql"
+  else
+    echo "$base/api/graphql"
+  fi
+}
+
+# API URL of a repository on GitHub-style APIs (github and gitea), empty otherwise
+git_repo_api() {
+  local repo_url="$1"
+  [ -n "$(git_url_host "$repo_url")" ] || return 0
+  case "$(git_url_type "$repo_url")" in
+    github|gitea) ;;
+    *) return 0 ;;
+  esac
+  local path=$(git_url_path "$repo_url")
+  local prefix=$(git_host_entry_parts "$(git_url_entry "$repo_url")" | cut -d'|' -f3)
+  [ -z "$prefix" ] || path="${path#"$prefix"/}"
+  path="${path%/}"
+  echo "$(git_url_api "$repo_url")/repos/${path%.git}"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  for url in "$@"; do
+    host=$(git_url_host "$url")
+    if [ -z "$host" ]; then
+      if git_host_allowed "$url"; then
+        echo "✅ $url (local, $(local_source_path "$url"))"
+      else
+        echo "❌ $url ($(local_source_problem "$url"))"
+      fi
+    elif git_host_allowed "$url"; then
+      echo "✅ $url ($(git_url_entry "$url"), $(git_url_type "$url"), API $(git_url_api "$url" | grep . || echo none))"
+    else
+      echo "❌ $url ($host$(port=$(git_url_port "$url"); echo "${port:+:$port}") is not in GIT_HOSTS)"
+    fi
+  done
+fi
@@ -0,0 +1,70 @@
+#!/bin/bash
+# Backfill the catalog and run state from archives stored by versions that
+# predate the catalog, so history features (search, size anomalies, status,
+# schedules) work for existing backups
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+
+# import_catalog [--destination name] [--checksums]
+import_catalog() {
+  local destination="$(primary_destination)"
+  local checksums=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --destination) destination="$2"; shift 2 ;;
+      --checksums) checksums=true; shift ;;
+      *) echo "❌ Usage: import-catalog [--destination name] [--checksums]"; return 2 ;;
+    esac
+  done
+  # Import into the stored catalog; a leftover local copy may be behind it
+
+  state_load
+  local imported=0
+  local failed=0
+  local date repo archive size checksum
+
+  echo "📥 Importing archives from $destination..."
+  while read -r date repo archive; do
+    if jq -e --arg archive "$archive" 'any(.archive == $archive)' "$CATALOG_FILE" >/dev/null; then
+      continue
+    fi
+    size=$(storage_size "$destination" "$archive")
+    if [ -z "$size" ]; then
+      echo "⚠️ Could not read $archive"
+      failed=$((failed + 1))
+      continue
+    fi
+    catalog_add "$repo" "$archive" "$date" "$size" "$destination"
+    if [ "$checksums" = "true" ]; then
+      if checksum=$(set -o pipefail; storage_read "$destination" "$archive" | hash_file); then
+        catalog_set "$archive" "$(hash_algorithm)" "\"$checksum\""
+      else
+        echo "⚠️ Could not read $archive for its checksum"
+      fi
+    fi
+    imported=$((imported + 1))
+  done < <(storage_list "$destination" | parse_archive_names)
+
+  # Newest archive of every repository, for state the runs never recorded
+  local entry iso epoch
+  while IFS= read -r entry; do
+    repo=$(jq -r '.repository' <<<"$entry")
+    date=$(jq -r '.date' <<<"$entry")
+    epoch=$(archive_date_epoch "$date")
+    iso=$(date -u -d "@$epoch" '+%Y-%m-%dT%H:%M:%SZ')
+    if [ "$(state_get '.repos[$repo].last_archive.date // ""' --arg repo "$repo")" \< "$iso" ]; then
+      state_record_archive "$repo" "$(jq -r '.archive' <<<"$entry")" "$(jq -r '.size_bytes' <<<"$entry")" "$iso"
+    fi
+    state_update --arg repo "$repo" --argjson epoch "$epoch" \
+      '.repos[$repo].last_success = ([.repos[$repo].last_success // 0, $epoch] | max)'
+  done < <(jq -c 'group_by(.repository) | .[] | max_by(.date)' "$CATALOG_FILE")
+
+  state_save
+  echo "✅ Imported $imported archives ($(jq 'map(.repository) | unique | length' "$CATALOG_FILE") repositories in catalog)"
+  [ $failed -eq 0 ]
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  import_catalog "$@"
+fi
@@ -0,0 +1,103 @@
+#!/bin/bash
+# List the stored snapshots of every repository, or of one, across all
+# destinations: when each was taken, its size, checksum and age, and which
+# destinations hold it. What the destinations list is authoritative; the
+# catalog adds sizes and checksums without reading every archive, and the
+# deduplicated backups that share an earlier archive.
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+# Snapshots as a JSON array, oldest first: list_snapshots <repo> <destination>...
+list_snapshots() {
+  local repo="$1"
+  shift
+  local destination names stored
+  stored=$(for destination in "$@"; do
+    if ! names=$(storage_list "$destination"); then
+      echo "⚠️ Could not list $destination" >&2
+      continue
+    fi
+    parse_archive_names <<<"$names" | sed "s#^#$destination #"
+  done)
+
+  # Archive dates are runner local time, so ages are measured against local time too
+  jq -R 'split(" ") | select(length == 4) | {destination: .[0], date: .[1], repository: .[2], archive: .[3]}' <<<"$stored" |
+    jq -s --slurpfile catalog "$CATALOG_FILE" --arg repo "$repo" --arg now "$(clock_date '+%Y%m%d_%H%M%S')" '
+      def epoch: strptime("%Y%m%d_%H%M%S") | mktime;
+      ($catalog[0] // [] | map({(.archive): .}) | add // {}) as $entries |
+      (group_by(.archive) | map({key: .[0].archive, value: {
+        repository: .[0].repository, archive: .[0].archive, date: .[0].date,
+        destinations: map(.destination) | unique}}) | from_entries) as $stored |
+      [($stored | .[] | . + ($entries[.archive] // {} | {repository, size_bytes, sha256, blake3, delta_of} |
+          with_entries(select(.value != null)))),
+        ($entries | .[] | select(.dedup_of != null and $stored[.dedup_of] != null) |
+          {repository, archive, date, destinations: $stored[.dedup_of].destinations,
+           size_bytes, sha256, blake3, dedup_of})]
+      | map(select($repo == "" or .repository == $repo) |
+          {repository, archive, date, destinations, size_bytes,
+           checksum: ((.sha256 | select(. != null) | "sha256:\(.)") // (.blake3 | select(. != null) | "blake3:\(.)") // null),
+           age_seconds: (($now | epoch) - (.date | epoch)),
+           dedup_of, delta_of})
+      | sort_by(.date, .repository)'
+}
+
+# Print snapshots as an aligned table
+list_table() {
+  jq -r "$RESULTS_JQ_DEFS"'
+    ["DATE", "REPOSITORY", "SIZE", "AGE", "CHECKSUM", "DESTINATIONS", "ARCHIVE"],
+    (.[] | [(.date | "\(.[0:4])-\(.[4:6])-\(.[6:8]) \(.[9:11]):\(.[11:13])"), .repository,
+      (.size_bytes | if . == null then "?" else size_human end),
+      (.age_seconds | duration_human),
+      (.checksum // "-" | .[0:19]),
+      (.destinations | join(",")),
+      (.archive + (if .dedup_of then " (same as \(.dedup_of))" elif .delta_of then " (delta)" else "" end))])
+    | join("\t")' |
+    awk -F'\t' '{ rows[NR] = $0; for (i = 1; i <= NF; i++) if (length($i) > width[i]) width[i] = length($i) }
+      END { for (n = 1; n <= NR; n++) { count = split(rows[n], cells, "\t"); line = ""
+        for (i = 1; i < count; i++) line = line sprintf("%-" width[i] "s  ", cells[i])
+        print line cells[count] } }'
+}
+
+# backup_list [repo] [--destination name] [--json]
+backup_list() {
+  local repo=""
+  local destinations="$BACKUP_DESTINATIONS"
+  local json=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --destination) destinations="$2"; shift 2 ;;
+      --json) json=true; shift ;;
+      -*) echo "❌ Usage: list [repo] [--destination name] [--json]"; return 2 ;;
+      *) repo="$1"; shift ;;
+    esac
+  done
+
+  state_load
+  local snapshots
+  snapshots=$(list_snapshots "$repo" $destinations) || return 1
+
+  # Archives the catalog doesn't know are sized from their first destination
+  local missing archive destination size
+  missing=$(jq -r '.[] | select(.size_bytes == null) | "\(.archive) \(.destinations[0])"' <<<"$snapshots")
+  while read -r archive destination; do
+    [ -n "$archive" ] || continue
+    size=$(storage_size "$destination" "$archive")
+    [[ "$size" =~ ^[0-9]+$ ]] || continue
+    snapshots=$(jq --arg archive "$archive" --argjson size "$size" \
+      'map(if .archive == $archive then .size_bytes = $size else . end)' <<<"$snapshots")
+  done <<<"$missing"
+
+  if [ "$json" = "true" ]; then
+    echo "$snapshots"
+  elif [ "$(jq length <<<"$snapshots")" -eq 0 ]; then
+    echo "ℹ️ No snapshots${repo:+ of $repo} found"
+  else
+    list_table <<<"$snapshots"
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_list "$@"
+fi
@@ -1,25 +1,209 @@
 #!/bin/bash
 # EXACT COPY of main logic from original workflow
 
+# Suppress identical failure alerts after this many consecutive runs
+NOTIFY_REPEAT_LIMIT="${NOTIFY_REPEAT_LIMIT:-3}"
+
+# --dry-run (or DRY_RUN=true) prints what the run would do instead of doing it
+if [ "$1" = "--dry-run" ]; then
+  export DRY_RUN=true
+fi
+
+# Settings from a single configuration document, before anything reads them
+source "$(dirname "$0")/config-blob.sh"
+if ! config_blob_load; then
+  exit 1
+fi
+
+# Everything the run writes goes to WORK_DIR, checked before the run starts
+source "$(dirname "$0")/workdir.sh"
+if ! work_dir_enter; then
+  exit 1
+fi
+
+# Scratch files of the run (API and storage tokens, rclone.conf, result
+# records, resource samples, the notification spool, the cancellation marker)
+# are removed however it ends; a later run reusing the pid would otherwise
+# start out cancelled
+export API_STATE_DIR="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}"
+run_cleanup() {
+  rm -rf "$API_STATE_DIR" ${RESOURCE_STATE_DIR:+"$RESOURCE_STATE_DIR"} ${WEBHOOK_SPOOL_DIR:+"$WEBHOOK_SPOOL_DIR"}
+  if [ -n "$CONTEXT_CANCEL_FILE" ]; then
+    rm -f "$CONTEXT_CANCEL_FILE" "$CONTEXT_CANCEL_FILE".*.expired
+  fi
+  if [ -n "$RESULTS_RECORDS" ]; then
+    rm -f "$RESULTS_RECORDS" "$RESULTS_RECORDS.lock"
+  fi
+}
+trap run_cleanup EXIT
+
+# Apply the redaction rules to everything the run prints
+source "$(dirname "$0")/redact.sh"
+if redact_rules_enabled; then
+  # They outlive a Ctrl-C, so the run can still print how it stopped
+  exec > >(trap '' INT TERM; redact_text) 2> >(trap '' INT TERM; redact_text >&2)
+fi
+
+# Refuse to run with leaked or malformed credentials
+source "$(dirname "$0")/config-check.sh"
+if ! config_check; then
+  exit 1
+fi
+
+# Authenticating as a GitHub App needs an installation token before anything else
+source "$(dirname "$0")/github-app.sh"
+if github_app_enabled && ! github_app_token >/dev/null; then
+  echo "❌ Could not get an installation token for GitHub App $GITHUB_APP_ID"
+  exit 1
+fi
+
+# Deadline and cancellation for the whole run; SIGINT and SIGTERM (a cancelled
+# workflow, docker stop) cancel it too
+source "$(dirname "$0")/context.sh"
+ctx_init
+ctx_trap_signals
+echo "ℹ️ Run $RUN_UUID"
+
+source "$(dirname "$0")/plan.sh"
+if [ "$DRY_RUN" = "true" ]; then
+  plan_run
+  exit $?
+fi
+
+# Measure CPU, memory, disk and network use for capacity planning
+source "$(dirname "$0")/resources.sh"
+resources_start
+
+# Load state from the previous run
+source "$(dirname "$0")/state.sh"
+state_load
+
+# Clean up after crashed runs before starting
+source "$(dirname "$0")/gc.sh"
+if [ "$GC_ON_START" = "true" ]; then
+  gc_sweep
+fi
+
 # Source required functions
 source "$(dirname "$0")/process-repos.sh"
 source "$(dirname "$0")/send-webhook.sh"
+source "$(dirname "$0")/export-results.sh"
+source "$(dirname "$0")/push-metrics.sh"
+source "$(dirname "$0")/status.sh"
+source "$(dirname "$0")/summary.sh"
 
 # Final summary (EXACT COPY from original workflow)
 echo ""
 echo "📊 Final Summary:"
-echo "  Total repositories: $TOTAL_REPOS"
+echo "  Total repositories: $RESULT_COUNT"
 echo "  Successfully backed up: $SUCCESS_COUNT"
+echo "  Unchanged (sharing their last archive): $UNCHANGED_COUNT"
+echo "  Partial (git data only): $PARTIAL_COUNT"
 echo "  Failed: $FAIL_COUNT"
+echo "  Timed out (deadline, cancellation or clone timeout): $TIMED_OUT_COUNT"
+echo "  Quarantined: $QUARANTINED_COUNT"
+echo "  Skipped (not due or opted out): $FILTERED_COUNT"
+STOPPED_REASON=$(ctx_err)
+if [ -n "$STOPPED_REASON" ]; then
+  echo "  Stopped early: $STOPPED_REASON (not started: ${CANCELLED_REPOS%, })"
+fi
+echo "  Durations: $(jq -r "$RESULTS_JQ_DEFS"'.duration_seconds | "p50 \(.p50 | duration_human), p90 \(.p90 | duration_human), max \(.max | duration_human)"' <<<"$AGGREGATE")"
+echo "  Time spent: $(jq -r "$RESULTS_JQ_DEFS"'[
+  "cloning \(.clone_seconds | duration_human)",
+  (.destinations | to_entries[] | "uploading to \(.key) \(.value.upload_seconds | duration_human) (\(.value.uploaded_bytes | size_human)\(
+    if .value.upload_seconds > 0 then ", \(.value.uploaded_bytes / .value.upload_seconds | size_human)/s" else "" end))")
+] | join(", ")' <<<"$AGGREGATE")"
+if [ -n "$ONBOARDED_REPOS" ]; then
+  echo "  Onboarded $ONBOARDED_COUNT new: ${ONBOARDED_REPOS%, }"
+fi
+if [ -n "$SENSITIVE_REPOS" ]; then
+  echo "  Sensitive files found: ${SENSITIVE_REPOS%, }"
+fi
+resources_stop
+RESOURCES=$(resources_stats)
+if [ "$RESOURCES" != "{}" ]; then
+  echo "  Resources: $(jq -r "$RESULTS_JQ_DEFS"'resources_human' <<<"$RESOURCES")"
+fi
+
+write_results
+write_checksums
+store_results
+echo "  Run: $RUN_UUID"
+echo "  Host: $(hostname) (git $(git --version | awk '{print $3}'), tool $TOOL_VERSION, trigger $(detect_trigger))"
+echo "  Results: $RESULTS_FILE"
+write_summary
+export_results
+push_metrics
+
+# Count how many runs in a row ended with the same set of failures
+FAILED_KEY="${NOTIFY_FAILED_REPOS%, }"
+if [ "$FAILED_KEY" = "$(state_get '.last_run.failed_repos // ""')" ]; then
+  REPEAT_COUNT=$(( $(state_get '.last_run.repeat_count // 0') + 1 ))
+else
+  REPEAT_COUNT=1
+fi
+state_update --arg failed "$FAILED_KEY" --argjson count "$REPEAT_COUNT" \
+  '.last_run = {failed_repos: $failed, repeat_count: $count}'
+state_save
+write_status
+post_status
+if ! storage_snapshot "$DATE_PREFIX"; then
+  echo "⚠️ Failed to snapshot $LOCAL_BACKUP_DIR"
+fi
+
+# Recoveries always notify so on-call knows the incident is closed
+if [ -n "$RECOVERED_REPOS" ]; then
+  queue_webhook true "$(msg result_recovered "${RECOVERED_REPOS%, }")" "${SUCCESSFUL_REPOS%, }"
+fi
+
+if [ -n "$ONBOARDED_REPOS" ]; then
+  queue_webhook true "$(msg result_onboarded "$ONBOARDED_COUNT" "${ONBOARDED_REPOS%, }")" ""
+fi
+if [ -n "$PARTIAL_REPOS" ]; then
+  queue_webhook warning "$(msg result_partial "${PARTIAL_REPOS%, }")" ""
+fi
+if [ -n "$SENSITIVE_REPOS" ]; then
+  queue_webhook warning "$(msg result_sensitive "${SENSITIVE_REPOS%, }")" ""
+fi
+if [ -n "$SIZE_ANOMALIES" ]; then
+  queue_webhook warning "$(msg result_size_anomaly "${SIZE_ANOMALIES%, }")" ""
+fi
+if [ -n "$TIER_WARNINGS" ]; then
+  queue_webhook warning "$(msg result_failing_runs "${TIER_WARNINGS%, }")" ""
+fi
+if [ -n "$QUARANTINED_REPOS" ]; then
+  queue_webhook warning "$(msg result_quarantined "${QUARANTINED_REPOS%, }")" ""
+fi
+
+discard_realtime_failures
 
 # Send webhook notification (EXACT COPY from original workflow)
-if [ $FAIL_COUNT -eq 0 ]; then
-  send_webhook true "Backup successful: All $SUCCESS_COUNT repositories backed up" "${SUCCESSFUL_REPOS%, }"
+if [ $FAIL_COUNT -eq 0 ] && [ $TIMED_OUT_COUNT -eq 0 ] && [ -z "$STOPPED_REASON" ]; then
+  queue_webhook true "$(msg result_success "$RESULT_COUNT"); $RUN_COUNTS" "${SUCCESSFUL_REPOS%, }"
+  flush_webhooks
   echo ""
   echo "✅ Backup completed successfully!"
 else
-  send_webhook false "Backup completed with errors: $SUCCESS_COUNT succeeded, $FAIL_COUNT failed (${FAILED_REPOS%, })" "${SUCCESSFUL_REPOS%, }"
+  if [ -n "$STOPPED_REASON" ]; then
+    queue_webhook false "$(msg result_stopped "$STOPPED_REASON" "${CANCELLED_REPOS%, }")" "${SUCCESSFUL_REPOS%, }" "${CANCELLED_REPOS%, }"
+  fi
+  if [ $NOTIFY_FAIL_COUNT -eq 0 ]; then
+    flush_webhooks
+  elif [ $REPEAT_COUNT -le $NOTIFY_REPEAT_LIMIT ]; then
+    queue_webhook false "$(msg result_failure "$SUCCESS_COUNT" "$NOTIFY_FAIL_COUNT" "${NOTIFY_FAILED_REPOS%, }"); $RUN_COUNTS" "${SUCCESSFUL_REPOS%, }" "${NOTIFY_FAILED_REPOS%, }"
+    if [ -n "$REMEDIATIONS" ]; then
+      queue_webhook false "$(msg result_remediation "${REMEDIATIONS%; }")" ""
+    fi
+    flush_webhooks
+  else
+    echo "🔕 Same failures for $REPEAT_COUNT runs in a row, notification suppressed"
+    flush_webhooks
+  fi
   echo ""
-  echo "⚠️ Backup completed with $FAIL_COUNT failures"
+  if [ -n "$STOPPED_REASON" ]; then
+    echo "⚠️ Backup stopped early ($STOPPED_REASON) with $FAIL_COUNT failed and $TIMED_OUT_COUNT timed out"
+  else
+    echo "⚠️ Backup completed with $FAIL_COUNT failed and $TIMED_OUT_COUNT timed out"
+  fi
   exit 1
-fi 
\ No newline at end of file
+fi
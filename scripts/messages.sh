@@ -0,0 +1,63 @@
+#!/bin/bash
+# Notification text catalog. Any key can be overridden from a JSON file
+# (MESSAGES_FILE) such as {"status_success": "✅ Sicherung erfolgreich"}.
+
+declare -gA MESSAGES=(
+  [title]="GitHub Repository Backup"
+  [card_summary]="Repository Backup %s"
+  [status_success]="✅ Success"
+  [status_failure]="❌ Failed"
+  [status_warning]="⚠️ Warning"
+  [label_status]="Status"
+  [label_result]="Result"
+  [label_successful_repos]="Successful Repositories"
+  [label_workflow]="Workflow"
+  [label_run_id]="Run ID"
+  [label_run_uuid]="Run UUID"
+  [view_run]="View Workflow Run"
+  [label_retry]="Retry Failed Repositories"
+  [drill_prefix]="[DRILL] "
+  [result_success]="Backup successful: %s repositories"
+  [result_failure]="Backup completed with errors: %s succeeded, %s failed or timed out (%s)"
+  [result_counts]="%s succeeded, %s unchanged, %s partial, %s failed, %s timed out, %s quarantined, %s skipped"
+  [result_recovered]="Recovered: %s"
+  [recovered_entry]="%s (failing for %s)"
+  [result_partial]="Backed up git data only, auxiliary exports failed: %s"
+  [result_failing_now]="Backup failing (run still in progress): %s"
+  [failing_now_entry]="%s (%s)"
+  [result_page]="Backup failed, tier %s: %s"
+  [result_failing_runs]="Backups failing for several runs in a row: %s"
+  [failing_runs_entry]="%s (%s runs)"
+  [result_quarantined]="Quarantined after failing too many runs in a row, attempted less and less often until released or backed up again: %s"
+  [result_stopped]="Backup stopped early (%s), not backed up: %s"
+  [result_remediation]="Action needed: %s"
+  [remediation_sso]="The %s organization enforces SAML SSO; authorize the backup token for it at %s"
+  [result_sensitive]="Sensitive files (dotenv files, private keys) are being backed up: %s"
+  [result_stale]="No archive within %s days of schedule: %s"
+  [result_onboarded]="Onboarded %s new repositories: %s"
+  [result_digest]="Digest %s to %s: %s runs, %s%% of backups succeeded (%s of %s). Failures resolved: %s. Still failing: %s. Storage: +%s, %s in total"
+  [result_size_anomaly]="Archive size anomaly: %s"
+  [size_anomaly_entry]="%s %+d%% vs recent average"
+)
+
+# Print a catalog entry, formatting any extra arguments into it: msg <key> [args...]
+# Entries taking arguments are printf formats (%s, and %% for a percent sign);
+# any other entry is printed as it is.
+msg() {
+  local key="$1"
+  shift
+  local text="${MESSAGES[$key]}"
+
+  if [ -n "$MESSAGES_FILE" ] && [ -f "$MESSAGES_FILE" ]; then
+    local override=$(jq -r --arg key "$key" '.[$key] // empty' "$MESSAGES_FILE")
+    if [ -n "$override" ]; then
+      text="$override"
+    fi
+  fi
+
+  if [ $# -eq 0 ]; then
+    printf '%s' "$text"
+  else
+    printf -- "$text" "$@"
+  fi
+}
@@ -0,0 +1,351 @@
+#!/bin/bash
+# Metadata exports: what a repository keeps outside git, such as its GitHub
+# Projects and Discussions, dumped as JSON next to the mirror in
+# <repo>.metadata/<export>.json. Which exports run is set by METADATA_EXPORTS,
+# or metadata=<export>,... on a repos.txt line.
+#
+# Like archive formats, each export is a function named after it:
+#   metadata_export_<name> <repo url>   Print the export's JSON, fail with the reason on stderr
+#
+# Exports:
+#   projects     GitHub Projects (v2) linked to the repository, with their
+#                fields and items (issues, pull requests, drafts) and each
+#                item's field values
+#   discussions  GitHub Discussions with comments and replies
+#   issues       GitHub issues with labels, assignees, milestone and comments
+#   pulls        GitHub pull requests with branches, labels and comments
+#
+# Issues and pull requests can be fetched for many repositories at once:
+# metadata_prefetch, run before the backups, asks for up to
+# METADATA_BATCH_SIZE repositories per GraphQL query, each with its own
+# cursor, and leaves the results for the exports to pick up.
+
+source "$(dirname "${BASH_SOURCE[0]}")/api.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+
+# Exports run for every repository, e.g. "projects discussions" (per repo: metadata=projects,discussions)
+METADATA_EXPORTS="${METADATA_EXPORTS:-}"
+# Repositories fetched together per GraphQL query by metadata_prefetch (1 disables batching)
+METADATA_BATCH_SIZE="${METADATA_BATCH_SIZE:-10}"
+# Issues or pull requests per repository per query
+METADATA_PAGE_SIZE="${METADATA_PAGE_SIZE:-50}"
+
+# Exports of a repos.txt line, one per line
+metadata_exports() {
+  repo_option "$1" metadata "$METADATA_EXPORTS" | tr ', ' '\n\n' | grep -v '^$'
+}
+
+# Whether an export is implemented
+metadata_export_known() {
+  declare -F "metadata_export_$1" >/dev/null
+}
+
+# Write one export of a repository to a file, replacing it only once complete:
+# metadata_export <export> <repo url> <file>
+metadata_export() {
+  "metadata_export_$1" "$2" > "$3.tmp" && mv "$3.tmp" "$3" && return 0
+  rm -f "$3.tmp"
+  return 1
+}
+
+# GraphQL endpoint and variables ({owner, name}) of a GitHub repository:
+# metadata_github_repo <repo url>, failing for other hosts
+metadata_github_repo() {
+  local host=$(git_url_host "$1")
+  local endpoint=$(git_url_graphql "$1")
+  if [ -z "$endpoint" ]; then
+    echo "${host:-local repositories} has no GitHub GraphQL API" >&2
+    return 1
+  fi
+  local path=$(git_repo_api "$1")
+  path="${path#*/repos/}"
+  echo "$endpoint"
+  jq -nc --arg owner "${path%%/*}" --arg name "${path#*/}" '{owner: $owner, name: $name}'
+}
+
+METADATA_PROJECTS_QUERY='query($owner: String!, $name: String!, $cursor: String) {
+  repository(owner: $owner, name: $name) {
+    projectsV2(first: 20, after: $cursor) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        id number title shortDescription readme url closed public createdAt updatedAt
+        owner { ... on Organization { login } ... on User { login } }
+        fields(first: 50) {
+          nodes {
+            ... on ProjectV2FieldCommon { name dataType }
+            ... on ProjectV2SingleSelectField { options { name } }
+            ... on ProjectV2IterationField { configuration { iterations { title startDate duration } } }
+          }
+        }
+      }
+    }
+  }
+  rateLimit { cost remaining }
+}'
+
+METADATA_PROJECT_ITEMS_QUERY='query($id: ID!, $cursor: String) {
+  node(id: $id) {
+    ... on ProjectV2 {
+      items(first: 100, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          type isArchived createdAt updatedAt
+          content {
+            ... on Issue { number title url state repository { nameWithOwner } }
+            ... on PullRequest { number title url state repository { nameWithOwner } }
+            ... on DraftIssue { title body }
+          }
+          fieldValues(first: 50) {
+            nodes {
+              ... on ProjectV2ItemFieldTextValue { text field { ... on ProjectV2FieldCommon { name } } }
+              ... on ProjectV2ItemFieldNumberValue { number field { ... on ProjectV2FieldCommon { name } } }
+              ... on ProjectV2ItemFieldDateValue { date field { ... on ProjectV2FieldCommon { name } } }
+              ... on ProjectV2ItemFieldSingleSelectValue { name field { ... on ProjectV2FieldCommon { name } } }
+              ... on ProjectV2ItemFieldIterationValue { title field { ... on ProjectV2FieldCommon { name } } }
+            }
+          }
+        }
+      }
+    }
+  }
+  rateLimit { cost remaining }
+}'
+
+# Projects linked to the repository; needs a token with read:project
+metadata_export_projects() {
+  local target
+  target=$(metadata_github_repo "$1") || return 1
+  local endpoint=$(head -n 1 <<<"$target")
+  local projects project items exported
+  projects=$(api_graphql_nodes "$endpoint" "$METADATA_PROJECTS_QUERY" "$(tail -n 1 <<<"$target")" .repository.projectsV2) || return 1
+  exported=$(while IFS= read -r project; do
+    [ -n "$project" ] || continue
+    items=$(api_graphql_nodes "$endpoint" "$METADATA_PROJECT_ITEMS_QUERY" "$(jq -c '{id}' <<<"$project")" .node.items) || exit 1
+    # Field values as {"<field>": <value>}; values of other kinds (labels, assignees) are on the content
+    jq -c --slurpfile items <(cat <<<"$items") '.fields = [.fields.nodes[] | select(.name != null)] | .owner = .owner.login |
+      del(.id) + {items: ($items | map(.fieldValues = ([.fieldValues.nodes[] | select(.field.name != null) |
+        {key: .field.name, value: (.text // .number // .date // .name // .title)}] | from_entries)))}' <<<"$project" || exit 1
+  done <<<"$projects") || return 1
+  jq -s . <<<"$exported"
+}
+
+METADATA_DISCUSSIONS_QUERY='query($owner: String!, $name: String!, $cursor: String) {
+  repository(owner: $owner, name: $name) {
+    discussions(first: 50, after: $cursor, orderBy: {field: CREATED_AT, direction: ASC}) {
+      pageInfo { hasNextPage endCursor }
+      nodes {
+        id number title body url createdAt updatedAt closed locked upvoteCount
+        author { login } category { name } answer { id }
+        labels(first: 20) { nodes { name } }
+      }
+    }
+  }
+  rateLimit { cost remaining }
+}'
+
+METADATA_DISCUSSION_COMMENTS_QUERY='query($id: ID!, $cursor: String) {
+  node(id: $id) {
+    ... on Discussion {
+      comments(first: 50, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          id body createdAt updatedAt isAnswer upvoteCount author { login }
+          replies(first: 100) { totalCount nodes { id body createdAt updatedAt author { login } } }
+        }
+      }
+    }
+  }
+  rateLimit { cost remaining }
+}'
+
+# Discussions with their comments and replies (the first 100 replies of a
+# comment; replies_total has the full count)
+metadata_export_discussions() {
+  local target
+  target=$(metadata_github_repo "$1") || return 1
+  local endpoint=$(head -n 1 <<<"$target")
+  local discussions discussion comments exported
+  discussions=$(api_graphql_nodes "$endpoint" "$METADATA_DISCUSSIONS_QUERY" "$(tail -n 1 <<<"$target")" .repository.discussions) || return 1
+  exported=$(while IFS= read -r discussion; do
+    [ -n "$discussion" ] || continue
+    comments=$(api_graphql_nodes "$endpoint" "$METADATA_DISCUSSION_COMMENTS_QUERY" "$(jq -c '{id}' <<<"$discussion")" .node.comments) || exit 1
+    jq -c --slurpfile comments <(cat <<<"$comments") '.author = .author.login | .category = .category.name |
+      .labels = [.labels.nodes[].name] | .answer_id = .answer.id | del(.answer) + {comments: ($comments | map(
+        .author = .author.login | .replies_total = .replies.totalCount | .replies = [.replies.nodes[] | .author = .author.login]))}' <<<"$discussion" || exit 1
+  done <<<"$discussions") || return 1
+  jq -s . <<<"$exported"
+}
+
+# Exports the bulk fetcher can fetch: the repository connection and the fields of its nodes
+METADATA_CONNECTION_issues="issues"
+METADATA_FIELDS_issues='number title body state stateReason url createdAt updatedAt closedAt
+  author { login } labels(first: 20) { nodes { name } } assignees(first: 10) { nodes { login } }
+  milestone { title } comments(first: 50) { totalCount nodes { body createdAt author { login } } }'
+METADATA_CONNECTION_pulls="pullRequests"
+METADATA_FIELDS_pulls='number title body state url createdAt updatedAt closedAt mergedAt isDraft
+  baseRefName headRefName author { login } labels(first: 20) { nodes { name } }
+  comments(first: 50) { totalCount nodes { body createdAt author { login } } }'
+
+# Nodes as stored: {"login": ...} and {"name": ...} objects become their value
+# and single-field connections ({"nodes": [...]}) their list
+METADATA_FLATTEN='def flat: if type == "array" then map(flat)
+  elif type == "object" then
+    if keys == ["login"] then .login elif keys == ["name"] then .name elif keys == ["title"] then .title
+    elif keys == ["nodes"] then .nodes | flat
+    else map_values(flat) end
+  else . end;'
+
+# Whether the bulk fetcher knows an export
+metadata_bulk_known() {
+  local connection="METADATA_CONNECTION_$1"
+  [ -n "${!connection}" ]
+}
+
+# Where metadata_prefetch leaves an export of a repository: metadata_prefetched <owner/name> <export>
+# (<file>.jsonl with one node per line, complete once <file>.done exists)
+metadata_prefetched() {
+  echo "$API_STATE_DIR/metadata/${1//\//__}.$2"
+}
+
+# One repository's connection selection in a query:
+# metadata_connection <export> <cursor JSON (null for the first page)>
+metadata_connection() {
+  local connection="METADATA_CONNECTION_$1"
+  local fields="METADATA_FIELDS_$1"
+  echo "${!connection}(first: $METADATA_PAGE_SIZE, after: $2, orderBy: {field: CREATED_AT, direction: ASC}) {
+    pageInfo { hasNextPage endCursor } nodes { ${!fields} } }"
+}
+
+# Fetch one export of one repository on its own
+metadata_bulk_export() {
+  local export="$1"
+  local connection="METADATA_CONNECTION_$1"
+  local prefetched
+  local target
+  target=$(metadata_github_repo "$2") || return 1
+  prefetched=$(metadata_prefetched "$(jq -r '"\(.owner)/\(.name)"' <<<"$(tail -n 1 <<<"$target")")" "$export")
+  local nodes
+  if [ -f "$prefetched.done" ]; then
+    nodes=$(cat "$prefetched.jsonl")
+  else
+    nodes=$(api_graphql_nodes "$(head -n 1 <<<"$target")" "query(\$owner: String!, \$name: String!, \$cursor: String) {
+      repository(owner: \$owner, name: \$name) { $(metadata_connection "$export" '$cursor') }
+      rateLimit { cost remaining }
+    }" "$(tail -n 1 <<<"$target")" ".repository.${!connection}") || return 1
+  fi
+  jq -s "$METADATA_FLATTEN map(flat)" <<<"$nodes"
+}
+
+metadata_export_issues() {
+  metadata_bulk_export issues "$1"
+}
+
+metadata_export_pulls() {
+  metadata_bulk_export pulls "$1"
+}
+
+# Fetch the issues and pull requests of many repositories in few queries:
+# metadata_prefetch <repos.txt lines...>
+# Repositories with their own token (token=) are left to their export, as is
+# any batch that fails; only complete results are picked up.
+metadata_prefetch() {
+  local -a queue=()
+  local line export target endpoint
+  for line in "$@"; do
+    [ -z "$(repo_option "$line" token "")" ] || continue
+    for export in $(metadata_exports "$line"); do
+      metadata_bulk_known "$export" || continue
+      target=$(metadata_github_repo "$(repo_line_url "$line")" 2>/dev/null) || continue
+      # endpoint, owner/name, export, cursor, and whether it must be queried alone
+      queue+=("$(head -n 1 <<<"$target")"$'\t'"$(jq -r '"\(.owner)/\(.name)"' <<<"$(tail -n 1 <<<"$target")")"$'\t'"$export"$'\t'"null"$'\t'"false")
+    done
+  done
+  [ ${#queue[@]} -gt 0 ] || return 0
+  mkdir -p "$API_STATE_DIR/metadata" || return 1
+
+  local repos=${#queue[@]}
+  local queries=0 failed=0
+  local -a batch rest
+  local item query data index repo cursor alone file
+  while [ ${#queue[@]} -gt 0 ] && ! ctx_done; do
+    # Up to METADATA_BATCH_SIZE pending connections of the same API, each under its own alias
+    endpoint="${queue[0]%%$'\t'*}"
+    batch=()
+    rest=()
+    if [ "${queue[0]##*$'\t'}" = "true" ]; then
+      batch=("${queue[0]}")
+      rest=("${queue[@]:1}")
+    else
+      for item in "${queue[@]}"; do
+        if [ "${item%%$'\t'*}" = "$endpoint" ] && [ "${item##*$'\t'}" = "false" ] &&
+          [ ${#batch[@]} -lt "$METADATA_BATCH_SIZE" ]; then
+          batch+=("$item")
+        else
+          rest+=("$item")
+        fi
+      done
+    fi
+    queue=("${rest[@]}")
+    query="query {"
+    for index in "${!batch[@]}"; do
+      IFS=$'\t' read -r _ repo export cursor _ <<<"${batch[$index]}"
+      query+=" r$index: repository(owner: $(jq -n --arg v "${repo%%/*}" '$v'), name: $(jq -n --arg v "${repo#*/}" '$v')) {
+        $(metadata_connection "$export" "$cursor") }"
+    done
+    query+=" rateLimit { cost remaining } }"
+
+    queries=$((queries + 1))
+    if ! data=$(api_graphql "$endpoint" "$query" 2>/dev/null); then
+      # One inaccessible repository fails the whole query, so the others are
+      # asked for alone; what fails alone falls back to its export
+      if [ ${#batch[@]} -gt 1 ]; then
+        for item in "${batch[@]}"; do
+          queue+=("${item%$'\t'*}"$'\t'"true")
+        done
+        continue
+      fi
+      IFS=$'\t' read -r _ repo export _ <<<"${batch[0]}"
+      rm -f "$(metadata_prefetched "$repo" "$export").jsonl"
+      failed=$((failed + 1))
+      continue
+    fi
+    for index in "${!batch[@]}"; do
+      IFS=$'\t' read -r endpoint repo export cursor alone <<<"${batch[$index]}"
+      file=$(metadata_prefetched "$repo" "$export")
+      jq -c --arg alias "r$index" '.[$alias] | to_entries[0].value.nodes[]' <<<"$data" >> "$file.jsonl"
+      if [ "$(jq -r --arg alias "r$index" '.[$alias] | to_entries[0].value.pageInfo.hasNextPage' <<<"$data")" = "true" ]; then
+        queue+=("$endpoint"$'\t'"$repo"$'\t'"$export"$'\t'"$(jq -c --arg alias "r$index" '.[$alias] | to_entries[0].value.pageInfo.endCursor' <<<"$data")"$'\t'"$alone")
+      else
+        touch "$file.done"
+      fi
+    done
+  done
+  echo "🗂️ Prefetched issues and pull requests: $((repos - failed)) of $repos exports in $queries GraphQL queries"
+}
+
+# Social metadata: the attention a repository gets (stars, watchers, forks,
+# homepage, topics) and its owner's profile. Unlike exports it goes into the
+# results of every run rather than the archive, so the stored results show
+# how a project's traction changes over time.
+SOCIAL_METADATA="${SOCIAL_METADATA:-false}"
+
+# Social metadata of a GitHub or Gitea repository as a JSON object: metadata_social <repo url>
+metadata_social() {
+  local repo_api=$(git_repo_api "$1")
+  if [ -z "$repo_api" ]; then
+    echo "No repository API for $1" >&2
+    return 1
+  fi
+  local response
+  response=$(api_get "$repo_api" -H "Accept: application/vnd.github+json") || return 1
+  # GitHub's watchers_count counts stars; subscribers_count counts watchers
+  jq -c '{
+    stars: (.stargazers_count // .stars_count // 0),
+    watchers: (.subscribers_count // .watchers_count // 0),
+    forks: (.forks_count // 0),
+    open_issues: (.open_issues_count // 0),
+    homepage: ((.homepage // .website // "") | if . == "" then null else . end),
+    topics: (.topics // []),
+    owner: (.owner // {} | {login, type, avatar_url})
+  }' <<<"$response"
+}
@@ -0,0 +1,207 @@
+#!/bin/bash
+# Move stored archives to a new layout, format or repository name, keeping the
+# catalog, run state and latest pointers in step so nothing is left in a
+# mixed, unlistable layout
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+
+# migrate_archives [--layout flat|by-repo|by-month] [--format fmt] [--rename old=new]... [--repo name] [--alias] [--dry-run]
+migrate_archives() {
+  local layout="$ARCHIVE_LAYOUT"
+  local format=""
+  local only_repo=""
+  local alias=false
+  local dry_run=false
+  declare -A renames
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --layout) layout="$2"; shift 2 ;;
+      --format) format="$2"; shift 2 ;;
+      --rename) renames[${2%%=*}]="${2#*=}"; shift 2 ;;
+      --repo) only_repo="$2"; shift 2 ;;
+      --alias) alias=true; shift ;;
+      --dry-run) dry_run=true; shift ;;
+      *)
+        echo "❌ Usage: migrate [--layout flat|by-repo|by-month] [--format fmt] [--rename old=new]... [--repo name] [--alias] [--dry-run]"
+        return 2
+        ;;
+    esac
+  done
+  # Fetched fresh, since the catalog is saved back after the move
+
+  state_load
+  local work_dir=$(mktemp -d)
+  local moved=0
+  local failed=0
+  local entry archive repo new_repo date extension current_format target_format new_name repack destination
+  declare -A touched
+
+  while IFS= read -r entry; do
+    archive=$(jq -r '.archive' <<<"$entry")
+    repo=$(jq -r '.repository' <<<"$entry")
+    date=$(jq -r '.date' <<<"$entry")
+    new_repo="${renames[$repo]:-$repo}"
+    current_format=$(archive_format_of "$archive")
+    target_format="${format:-$current_format}"
+
+    # Aliases only rename the repository in the catalog; stored objects stay put
+    if [ "$alias" = "true" ]; then
+      if [ "$new_repo" != "$repo" ]; then
+        echo "🔗 $archive: $repo → $new_repo"
+        if [ "$dry_run" = "false" ]; then
+          catalog_set "$archive" repository "$(jq -n --arg repo "$new_repo" '$repo')"
+          catalog_set "$archive" alias_of "$(jq -n --arg repo "$repo" '$repo')"
+          touched[$repo]="$new_repo"
+        fi
+        moved=$((moved + 1))
+      fi
+      continue
+    fi
+
+    # Deduplicated backups have no object of their own, they follow the one they share
+    if [ -n "$(jq -r '.dedup_of // empty' <<<"$entry")" ]; then
+      if [ "$new_repo" != "$repo" ] && [ "$dry_run" = "false" ]; then
+        catalog_set "$archive" repository "$(jq -n --arg repo "$new_repo" '$repo')"
+      fi
+      continue
+    fi
+
+    # Renamed repositories are repacked so the mirror inside matches the new name
+    repack=false
+    if [ "$new_repo" != "$repo" ] || [ "$target_format" != "$current_format" ]; then
+      repack=true
+    fi
+    new_name=$(archive_name_for "$new_repo" "$date" "$(archive_extension "$target_format")" "$layout")
+    if [ "$new_name$(encryption_suffix_of "$archive")" = "$archive" ] && [ "$repack" = "false" ]; then
+      continue
+    fi
+    # Delta archives can move, but hold only part of a mirror to repack
+    if [ -n "$(jq -r '.delta_of // empty' <<<"$entry")" ] && [ "$repack" = "true" ]; then
+      echo "⚠️ Skipping delta archive $archive (renaming or reformatting needs a repack)"
+      failed=$((failed + 1))
+      continue
+    fi
+    # Encrypted archives can move, but repacking would store them decrypted
+    if [ -n "$(encryption_suffix_of "$archive")" ]; then
+      if [ "$repack" = "true" ]; then
+        echo "⚠️ Skipping encrypted $archive (renaming or reformatting needs a repack)"
+        failed=$((failed + 1))
+        continue
+      fi
+      new_name="$new_name$(encryption_suffix_of "$archive")"
+    fi
+    echo "📦 $archive → $new_name"
+    if [ "$dry_run" = "true" ]; then
+      moved=$((moved + 1))
+      continue
+    fi
+
+    local destinations=($(jq -r '.destinations[]' <<<"$entry"))
+    local file="$work_dir/$(basename "$archive")"
+    if ! storage_get "${destinations[0]}" "$archive" "$file"; then
+      echo "⚠️ Could not download $archive from ${destinations[0]}"
+      failed=$((failed + 1))
+      continue
+    fi
+    if [ "$repack" = "true" ]; then
+      local extract_dir="$work_dir/extract"
+      if ! extract_archive "$file" "$extract_dir" "$repo"; then
+        echo "⚠️ Could not unpack $archive"
+        failed=$((failed + 1))
+        rm -rf "$file" "$extract_dir"
+        continue
+      fi
+      if [ "$new_repo" != "$repo" ]; then
+        mv "$extract_dir/$repo" "$extract_dir/$new_repo"
+      fi
+      local contents=("$new_repo")
+      # Auxiliary exports stored next to the mirror
+      local aux
+      for aux in wiki artifacts metadata; do
+        if [ "$new_repo" != "$repo" ] && [ -d "$extract_dir/$repo.$aux" ]; then
+          mv "$extract_dir/$repo.$aux" "$extract_dir/$new_repo.$aux"
+        fi
+        [ -d "$extract_dir/$new_repo.$aux" ] && contents+=("$new_repo.$aux")
+      done
+      target_format=$(resolve_archive_format "$target_format" "$extract_dir" "${contents[@]}")
+      new_name=$(archive_name_for "$new_repo" "$date" "$(archive_extension "$target_format")" "$layout")
+      rm -f "$file"
+      file="$extract_dir/$(basename "$new_name")"
+      create_archive "$target_format" "$extract_dir" "$(basename "$new_name")" "${contents[@]}"
+    fi
+
+    local ok=true
+    for destination in "${destinations[@]}"; do
+      if storage_put "$destination" "$file" "$new_name"; then
+        storage_seal "$destination" "$new_name"
+      else
+        ok=false
+      fi
+    done
+    if [ "$ok" = "true" ]; then
+      if [ "$new_name" != "$archive" ]; then
+        for destination in "${destinations[@]}"; do
+          if ! storage_delete "$destination" "$archive"; then
+            echo "⚠️ Kept $archive on $destination (could not delete it, immutable?)"
+          fi
+        done
+      fi
+      catalog_set "$archive" size_bytes "$(file_size "$file")"
+      catalog_set "$archive" repository "$(jq -n --arg repo "$new_repo" '$repo')"
+      catalog_set "$archive" archive "$(jq -n --arg name "$new_name" '$name')"
+      catalog_repoint "$archive" "$new_name"
+      touched[$repo]="$new_repo"
+      moved=$((moved + 1))
+    else
+      echo "⚠️ Could not upload $new_name, kept $archive"
+      failed=$((failed + 1))
+    fi
+    rm -rf "$file" "$work_dir/extract"
+  done < <(catalog_entries "$only_repo")
+  rm -rf "$work_dir"
+
+  if [ "$dry_run" = "true" ]; then
+    echo "ℹ️ Dry run: $moved archives would be migrated"
+    return 0
+  fi
+
+  # Carry state over to new names and repoint latest/ at the moved archives
+  for repo in "${!touched[@]}"; do
+    new_repo="${touched[$repo]}"
+    if [ "$new_repo" != "$repo" ]; then
+      state_update --arg old "$repo" --arg new "$new_repo" \
+        '.repos[$new] = (.repos[$new] // .repos[$old]) | del(.repos[$old])'
+    fi
+    entry=$(catalog_entries "$new_repo" | tail -n 1)
+    archive=$(jq -r '.dedup_of // .archive' <<<"$entry")
+    if [ -n "$(state_get '.repos[$repo].last_archive // empty' --arg repo "$new_repo")" ]; then
+      state_update --arg repo "$new_repo" --arg name "$archive" --argjson size "$(jq '.size_bytes' <<<"$entry")" \
+        '.repos[$repo].last_archive += {name: $name, size_bytes: $size}'
+    fi
+    for destination in $(jq -r '.destinations[]' <<<"$entry"); do
+      if [ "$new_repo" != "$repo" ]; then
+        storage_delete "$destination" "latest/$repo.json"
+      fi
+      for extension in zip bundle tar.zst tar.gz; do
+        storage_delete "$destination" "latest/$repo.$extension"
+        for suffix in $ENCRYPTION_EXTENSIONS; do
+          storage_delete "$destination" "latest/$repo.$extension.$suffix"
+        done
+      done
+      storage_update_latest "$destination" "$new_repo" "$archive" "$(jq '.size_bytes' <<<"$entry")" ||
+        echo "⚠️ Failed to update latest pointer: $new_repo ($destination)"
+    done
+  done
+  state_save
+
+  if [ $failed -gt 0 ]; then
+    echo "⚠️ Migrated $moved archives, $failed failed"
+    return 1
+  fi
+  echo "✅ Migrated $moved archives"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  migrate_archives "$@"
+fi
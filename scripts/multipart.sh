@@ -0,0 +1,83 @@
+#!/bin/bash
+# Multipart uploads for large files. The file is sent in parts, several at a
+# time, and every finished part is recorded in a journal next to the backend's
+# upload session (upload ID, signed URL), so an interrupted upload resumes
+# where it stopped instead of starting over. Backends provide three hooks:
+#   <backend>_multipart_start <name>                   print a new upload session
+#   <backend>_multipart_part <session> <index> <file>  upload one part
+#   <backend>_multipart_finish <session> <count>       assemble the parts into <name>
+
+source "$(dirname "${BASH_SOURCE[0]}")/walk.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/context.sh"
+
+# Files at least this large are uploaded in parts
+MULTIPART_THRESHOLD_MB="${MULTIPART_THRESHOLD_MB:-256}"
+MULTIPART_PART_MB="${MULTIPART_PART_MB:-64}"
+MULTIPART_PARALLEL="${MULTIPART_PARALLEL:-4}"
+# Passes over the missing parts before the upload is given up (and left to resume later)
+MULTIPART_ATTEMPTS="${MULTIPART_ATTEMPTS:-3}"
+
+multipart_journal_dir() {
+  echo "${MULTIPART_JOURNAL_DIR:-${STATE_DIR:-.backup-state}/uploads}"
+}
+
+# Whether a file is large enough to be uploaded in parts
+multipart_wanted() {
+  [ "$(file_size "$1")" -ge $((MULTIPART_THRESHOLD_MB * 1048576)) ]
+}
+
+# Upload a file in parts through a backend's hooks: multipart_upload <backend> <file> <name>
+multipart_upload() {
+  local backend="$1"
+  local file="$2"
+  local name="$3"
+  local size=$(file_size "$file")
+  local part_bytes=$((MULTIPART_PART_MB * 1048576))
+  local count=$(( (size + part_bytes - 1) / part_bytes ))
+  local journal_dir=$(multipart_journal_dir)
+  mkdir -p "$journal_dir"
+  # Keyed by file identity, so a changed file never resumes from stale parts
+  local journal="$journal_dir/$(printf '%s|%s|%s|%s|%s' "$backend" "$name" "$size" "$(date -r "$file" +%s)" "$part_bytes" |
+    sha256sum | cut -c1-32)"
+
+  local session
+  if [ -s "$journal" ]; then
+    session=$(head -n 1 "$journal")
+    echo "🔁 Resuming upload of $name ($(tail -n +2 "$journal" | sort -u | wc -l)/$count parts done)"
+  else
+    session=$("${backend}_multipart_start" "$name") || return 1
+    echo "$session" > "$journal"
+  fi
+
+  local parts_dir=$(mktemp -d "${TMPDIR:-/tmp}/backup-upload.$$.XXXXXX")
+  local attempt index
+  local -a missing
+  for attempt in $(seq 1 "$MULTIPART_ATTEMPTS"); do
+    mapfile -t missing < <(seq 0 $((count - 1)) | grep -vxF -f <(tail -n +2 "$journal"))
+    if [ ${#missing[@]} -eq 0 ] || ctx_done; then
+      break
+    fi
+    for index in "${missing[@]}"; do
+      while [ "$(jobs -rp | wc -l)" -ge "$MULTIPART_PARALLEL" ]; do
+        wait -n
+      done
+      ctx_done && break
+      (
+        dd if="$file" of="$parts_dir/$index" bs=1048576 skip=$((index * MULTIPART_PART_MB)) \
+          count="$MULTIPART_PART_MB" status=none &&
+          "${backend}_multipart_part" "$session" "$index" "$parts_dir/$index" &&
+          echo "$index" >> "$journal"
+        rm -f "$parts_dir/$index"
+      ) &
+    done
+    wait
+  done
+  rm -rf "$parts_dir"
+
+  if [ "$(tail -n +2 "$journal" | sort -u | wc -l)" -lt "$count" ]; then
+    echo "⚠️ Upload of $name incomplete, finished parts are kept to resume from" >&2
+    return 1
+  fi
+  "${backend}_multipart_finish" "$session" "$count" || return 1
+  rm -f "$journal"
+}
@@ -0,0 +1,68 @@
+#!/bin/bash
+# Checks for repositories that appear in the configuration for the first time:
+# whether the token can read them, how large they are, and which license the
+# copies are made under. The backup itself adds whether they use Git LFS.
+
+source "$(dirname "${BASH_SOURCE[0]}")/backup-repo.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+
+ONBOARDING_CHECKS="${ONBOARDING_CHECKS:-true}"
+
+# Whether a repository was never backed up or onboarded before
+repo_is_new() {
+  [ "$(state_get '.repos[$repo] | (.onboarded_at // .last_success) == null' --arg repo "$1")" = "true" ]
+}
+
+# Run the checks and record them as the result's "onboarding" field:
+# onboard_repo <url> <repos.txt line>
+onboard_repo() {
+  local repo_url="$1"
+  local repo_line="$2"
+  local repo_name=$(repo_display_name "$repo_line")
+  local token_name=$(repo_option "$repo_line" token "")
+  local provider=$(repo_source_provider "$repo_line")
+  local token
+  if [ -n "$token_name" ]; then
+    token=$(git_named_token "$token_name")
+  else
+    token=$(source_call "$provider" token "$repo_url")
+  fi
+
+  local access=true
+  local url
+  if ! url=$(source_call "$provider" resolve "$repo_url" 2>/dev/null) ||
+    ! ctx_run source_call "$provider" list_refs "$url" "$token" </dev/null >/dev/null 2>&1; then
+    access=false
+  fi
+
+  # The API's view of the repository; local paths are measured on disk
+  local details="{}"
+  local repo_api=$(git_repo_api "$repo_url")
+  if [ -n "$repo_api" ]; then
+    details=$(API_TOKEN="$token" api_get "$repo_api" 2>/dev/null | jq -c '{
+      size_estimate_bytes: (if .size then .size * 1024 else null end),
+      license: (.license.spdx_id // .license.key // null)
+    }' 2>/dev/null)
+  elif [ -z "$(git_url_host "$repo_url")" ] && [ -d "$(local_source_path "$repo_url")" ]; then
+    details=$(jq -cn --argjson size "$(directory_size "$(local_source_path "$repo_url")")" '{size_estimate_bytes: $size}')
+  fi
+  [ -n "$details" ] || details="{}"
+
+  result_set_json onboarding "$(jq -c --argjson access "$access" \
+    '{access: $access, size_estimate_bytes: null, license: null} + .' <<<"$details")"
+  jq -r --arg name "$repo_name" "$RESULTS_JQ_DEFS"'.onboarding |
+    "🆕 New repository: \($name) (\(if .access then "readable" else "no access" end), \(
+      .size_estimate_bytes | if . then "about \(size_human)" else "size unknown" end), license \(.license // "unknown"))"' \
+    <<<"$RESULT_FIELDS"
+  state_update --arg repo "$repo_name" --argjson now "$(date +%s)" '.repos[$repo].onboarded_at = $now'
+}
+
+# Short description of a repository onboarded in this run, from its result
+onboarded_entry() {
+  jq -r --arg name "$1" "$RESULTS_JQ_DEFS"'"\($name) (\([
+    (.onboarding | if .access then empty else "no access" end),
+    (.size_bytes // .onboarding.size_estimate_bytes | numbers | size_human),
+    (.onboarding.license // empty),
+    (if .lfs then "LFS" else empty end)
+  ] | join(", ")))"' <<<"$RESULT_FIELDS"
+}
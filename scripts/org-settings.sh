@@ -0,0 +1,139 @@
+#!/bin/bash
+# Organization settings: what a GitHub organization keeps outside its
+# repositories, which no git mirror can restore after a compromise or a
+# mistaken deletion: its settings, members and their roles, teams and their
+# members, and the permission every team and person has on each repository.
+# A repos.txt line "org-settings:<org>" (added for org: lines with
+# settings=true) is backed up like a repository by the "org" source provider,
+# its archive holding JSON files instead of a mirror:
+#   organization.json             settings of the organization
+#   members.json                  members with their role (admin or member)
+#   teams.json                    teams with parent, privacy, members (maintainer
+#                                 or member) and repositories with the team's role
+#   repositories.json             repositories with their direct collaborators' roles
+#   outside_collaborators.json    people with access to some repositories only
+#   invitations.json              pending invitations
+#   hooks.json                    organization webhooks (GitHub masks their secrets)
+#   custom_repository_roles.json  roles that role_name fields may refer to
+#   export.json                   the organization and what could not be read
+# The last four need an owner's token; without one they are left out and
+# listed as unavailable in export.json instead of failing the backup.
+
+source "$(dirname "${BASH_SOURCE[0]}")/api.sh"
+
+# Back up the settings of organizations on org: lines (per org: line: settings=true)
+ORG_SETTINGS="${ORG_SETTINGS:-false}"
+
+# Every item of a paginated REST list, one JSON object per line: org_settings_list <url>
+org_settings_list() {
+  local url="$1"
+  local separator="?"
+  [[ "$url" != *\?* ]] || separator="&"
+  local page=1
+  local response
+  while :; do
+    response=$(api_get "$url${separator}per_page=100&page=$page" -H "Accept: application/vnd.github+json") || return 1
+    jq -c '.[]' <<<"$response" || return 1
+    [ "$(jq length <<<"$response")" -eq 100 ] || return 0
+    page=$((page + 1))
+  done
+}
+
+# Members of an organization or team with the given roles, as a JSON array:
+# org_settings_members <members URL> <role>...
+org_settings_members() {
+  local url="$1"
+  shift
+  local role list members
+  members=$(for role in "$@"; do
+    list=$(org_settings_list "$url?role=$role") || exit 1
+    [ -z "$list" ] || jq -c --arg role "$role" '{login, id, role: $role}' <<<"$list"
+  done) || return 1
+  jq -s 'sort_by(.login)' <<<"$members"
+}
+
+# Items of a part of an organization only owners may read, one JSON object
+# per line: org_settings_owner_list <organization API URL> <part>
+org_settings_owner_list() {
+  local api="$1"
+  case "$2" in
+    custom_repository_roles)
+      local response
+      response=$(api_get "$api/custom-repository-roles" -H "Accept: application/vnd.github+json") || return 1
+      jq -c '.custom_roles[]' <<<"$response"
+      ;;
+    *)
+      org_settings_list "$api/${2//_/-}"
+      ;;
+  esac
+}
+
+# Write an organization's settings as JSON files into <dest>, replacing what
+# is there: org_settings_export <org> <token> <dest>
+org_settings_export() {
+  local org="$1"
+  local API_TOKEN="$2"
+  local dest="$3"
+  local api="https://api.github.com/orgs/$org"
+  rm -rf "$dest" && mkdir -p "$dest" || return 1
+
+  if ! api_get "$api" -H "Accept: application/vnd.github+json" > "$dest/organization.json"; then
+    echo "Could not read organization $org" >&2
+    return 1
+  fi
+  if ! org_settings_members "$api/members" admin member > "$dest/members.json"; then
+    echo "Could not list the members of $org" >&2
+    return 1
+  fi
+
+  local teams team slug members repositories
+  if ! teams=$(org_settings_list "$api/teams") ||
+    ! teams=$(while IFS= read -r team; do
+      [ -n "$team" ] || continue
+      slug=$(jq -r '.slug' <<<"$team")
+      members=$(org_settings_members "$api/teams/$slug/members" maintainer member) || exit 1
+      repositories=$(org_settings_list "$api/teams/$slug/repos") || exit 1
+      jq -c --argjson members "$members" \
+        --argjson repositories "$(jq -s '[.[] | {full_name, role_name, permissions}] | sort_by(.full_name)' <<<"$repositories")" \
+        '{slug, name, description, privacy, notification_setting, permission,
+          parent: (.parent.slug // null), members: $members, repositories: $repositories}' <<<"$team"
+    done <<<"$teams"); then
+    echo "Could not list the teams of $org" >&2
+    return 1
+  fi
+  jq -s 'sort_by(.slug)' <<<"$teams" > "$dest/teams.json" || return 1
+
+  # Direct collaborators need admin access to each repository; those that
+  # can't be read are null
+  local repos repo collaborators
+  if ! repos=$(org_settings_list "$api/repos?type=all"); then
+    echo "Could not list the repositories of $org" >&2
+    return 1
+  fi
+  repos=$(while IFS= read -r repo; do
+    [ -n "$repo" ] || continue
+    if collaborators=$(org_settings_list "https://api.github.com/repos/$(jq -r '.full_name' <<<"$repo")/collaborators?affiliation=direct"); then
+      collaborators=$(jq -s '[.[] | {login, id, role_name}] | sort_by(.login)' <<<"$collaborators")
+    else
+      collaborators=null
+    fi
+    jq -c --argjson collaborators "$collaborators" '{name, full_name, visibility, private, archived, fork,
+      default_branch, collaborators: $collaborators}' <<<"$repo"
+  done <<<"$repos")
+  jq -s 'sort_by(.name)' <<<"$repos" > "$dest/repositories.json" || return 1
+
+  # What the token may not read is recorded instead of failing the backup
+  local -a unavailable
+  mapfile -t unavailable < <(jq -r '.[] | select(.collaborators == null) | "repositories/\(.name)/collaborators"' "$dest/repositories.json")
+  local part list
+  for part in outside_collaborators invitations hooks custom_repository_roles; do
+    if list=$(org_settings_owner_list "$api" "$part"); then
+      jq -s . <<<"$list" > "$dest/$part.json"
+    else
+      unavailable+=("$part")
+    fi
+  done
+
+  printf '%s\n' "${unavailable[@]}" | jq -R . |
+    jq -s --arg org "$org" '{organization: $org, unavailable: map(select(. != ""))}' > "$dest/export.json"
+}
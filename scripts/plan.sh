@@ -0,0 +1,156 @@
+#!/bin/bash
+# Dry run (main.sh --dry-run or DRY_RUN=true): what a run would do, without
+# doing it. Settings are resolved as for a run, each destination is listed to
+# prove its credentials, and each repository due is checked against GIT_HOSTS
+# and has its refs listed with its token, which proves the URL and the token
+# work. Then the plan prints what would be cloned, archived, encrypted and
+# uploaded where. Nothing is cloned, stored or sent: the state and catalog
+# are read into memory and never saved, and no notification goes out.
+
+source "$(dirname "${BASH_SOURCE[0]}")/backup-repo.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/discover.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/send-webhook.sh"
+
+DRY_RUN="${DRY_RUN:-false}"
+
+# Check one repository and print what its backup would do; fails when the
+# backup would fail before cloning: plan_repo <repos.txt line>
+plan_repo() {
+  local repo_line="$1"
+  local repo_url=$(repo_line_url "$repo_line")
+  local repo_name=$(repo_display_name "$repo_line")
+  if [ "$REPO_SELF_CONFIG" = "true" ]; then
+    repo_line="$repo_line $(API_TOKEN=$(git_named_token "$(repo_option "$repo_line" token "")") repo_self_options "$repo_url")"
+  fi
+  if [ "$(repo_option "$repo_line" backup true)" = "false" ]; then
+    echo "⏭️ Would skip: $repo_name (opted out in .backup.yml)"
+    return 0
+  fi
+  local next_attempt=$(quarantine_next_attempt "$repo_name" "$(repo_option "$repo_line" quarantine "$QUARANTINE_AFTER_FAILURES")")
+  if [ -z "$BACKUP_ONLY" ] && [ -n "$next_attempt" ] && [ "$next_attempt" -gt "$RUN_EPOCH" ]; then
+    echo "🚧 Would skip: $repo_name (quarantined, next attempt $(date -u -d "@$next_attempt" '+%Y-%m-%dT%H:%M:%SZ'))"
+    return 0
+  fi
+  local frequency=$(repo_option "$repo_line" frequency daily)
+  if [ -z "$BACKUP_ONLY" ] && ! repo_is_due "$repo_name" "$frequency"; then
+    echo "⏭️ Would skip: $repo_name (not due, frequency $frequency)"
+    return 0
+  fi
+
+  if ! git_host_allowed "$repo_url"; then
+    echo "❌ $repo_name: $(git_url_host "$repo_url") is not in GIT_HOSTS"
+    return 1
+  fi
+  local provider=$(repo_source_provider "$repo_line")
+  if ! source_provider_known "$provider"; then
+    echo "❌ $repo_name: unknown source $provider"
+    return 1
+  fi
+  local token
+  local token_name=$(repo_option "$repo_line" token "")
+  if [ -n "$token_name" ]; then
+    token=$(git_named_token "$token_name")
+    if [ -z "$token" ]; then
+      echo "❌ $repo_name: token $token_name: $(git_named_token_variable "$token_name") is not set"
+      return 1
+    fi
+  else
+    token=$(source_call "$provider" token "$repo_url")
+  fi
+  local location refs
+  if ! location=$(source_call "$provider" resolve "$repo_url" 2>&1); then
+    echo "❌ $repo_name: $location"
+    return 1
+  fi
+  # Listing refs needs the same access as cloning, without transferring anything
+  if ! refs=$(source_call "$provider" list_refs "$location" "$token" </dev/null 2>&1); then
+    echo "❌ $repo_name: could not list refs ($(classify_git_error <(echo "$refs")): $(grep -v '^[[:space:]]*$' <<<"$refs" | tail -n 1 | redact_credentials))"
+    return 1
+  fi
+
+  local format=$(repo_option "$repo_line" format "$ARCHIVE_FORMAT")
+  local archive_name=$(archive_name_for "$repo_name" "$DATE_PREFIX" "$(archive_extension "$format")")
+  local details="$(grep -c $'\t' <<<"$refs") refs"
+  mirror_cached "$repo_name" && details="$details, cached mirror"
+  [ "$(repo_option "$repo_line" wiki "$BACKUP_WIKI")" = "true" ] && details="$details, wiki"
+  [ "$(repo_option "$repo_line" lfs "$BACKUP_LFS")" = "true" ] && details="$details, lfs"
+  [ "$(repo_option "$repo_line" artifacts "$BACKUP_ARTIFACTS")" = "true" ] && details="$details, Actions artifacts"
+  echo "📦 $repo_name: clone $repo_url ($details)"
+  local average_size=$(catalog_average_size "$repo_name")
+  local encryption_key=$(encryption_key_for "$repo_line" "$repo_url")
+  echo "   archive $archive_name ($format$( [ "$average_size" -gt 0 ] &&
+    jq -rn "$RESULTS_JQ_DEFS"'", about \($size | size_human)"' --argjson size "$average_size"))${encryption_key:+, encrypted with key $encryption_key}"
+  echo "   upload to $BACKUP_DESTINATIONS"
+}
+
+# Print the plan of a run; fails when a destination or a repository due
+# would fail before cloning
+plan_run() {
+  echo "🧪 Dry run: nothing is cloned, stored or sent"
+  local problems=0
+  local destination
+  for destination in $BACKUP_DESTINATIONS; do
+    if storage_list "$destination" "_state/" >/dev/null; then
+      echo "✅ Destination $destination is reachable"
+    else
+      echo "❌ Destination $destination can't be listed (credentials?)"
+      problems=$((problems + 1))
+    fi
+  done
+  STATE_IN_MEMORY=true
+  state_load
+  DATE_PREFIX=$(run_date +%Y%m%d_%H%M%S)
+
+  local repo_lines
+  if ! repo_lines=$(repo_lines); then
+    echo "❌ Could not read the repository list"
+    return 1
+  fi
+  local -a repos=()
+  [ -z "$repo_lines" ] || mapfile -t repos <<<"$repo_lines"
+  local conflicts=$(repo_name_conflicts "${repos[@]}")
+  if [ -n "$conflicts" ]; then
+    echo "❌ Conflicting repository names in repos.txt (set a unique name= option):"
+    sed 's/^/    /' <<<"$conflicts"
+    return 1
+  fi
+  echo "📋 ${#repos[@]} repositories in the list"
+
+  local repo_line
+  local planned=0
+  local predicted=0
+  for repo_line in "${repos[@]}"; do
+    if [ -n "$BACKUP_ONLY" ] &&
+      [[ ",${BACKUP_ONLY// /}," != *",$(repo_display_name "$repo_line"),"* ]]; then
+      continue
+    fi
+    local output
+    output=$(plan_repo "$repo_line")
+    local status=$?
+    echo "$output"
+    if [ $status -ne 0 ]; then
+      problems=$((problems + 1))
+    elif [[ "$output" == "📦"* ]]; then
+      planned=$((planned + 1))
+      predicted=$((predicted + $(state_average_duration "$(repo_display_name "$repo_line")")))
+    fi
+  done
+
+  echo ""
+  echo "📋 Would back up $planned repositories$([ $predicted -gt 0 ] && echo " in about $(format_duration $predicted)")"
+  echo "ℹ️ Runs never delete archives; backup.sh prune --dry-run shows what pruning would remove"
+  if [ -n "$WEBHOOK_URL" ]; then
+    echo "🔔 Would notify $(sed -E 's#^([a-z]+://[^/]+).*#\1#' <<<"$WEBHOOK_URL")"
+  else
+    echo "🔕 No WEBHOOK_URL, no notification"
+  fi
+  if [ $problems -gt 0 ]; then
+    echo "❌ Dry run found $problems problems"
+    return 1
+  fi
+  echo "✅ Dry run found no problems"
+}
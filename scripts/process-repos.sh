@@ -3,40 +3,334 @@
 
 # Source the backup function
 source "$(dirname "$0")/backup-repo.sh"
+source "$(dirname "$0")/state.sh"
+source "$(dirname "$0")/messages.sh"
+source "$(dirname "$0")/results.sh"
+source "$(dirname "$0")/repo-config.sh"
+source "$(dirname "$0")/discover.sh"
+source "$(dirname "$0")/catalog.sh"
+source "$(dirname "$0")/context.sh"
+source "$(dirname "$0")/send-webhook.sh"
+source "$(dirname "$0")/drill.sh"
+source "$(dirname "$0")/onboard.sh"
+source "$(dirname "$0")/resources.sh"
+[ -f "$STATE_FILE" ] || state_load
 
-# Initialize counters (EXACT COPY from original workflow)
-SUCCESS_COUNT=0
-FAIL_COUNT=0
-FAILED_REPOS=""
-SUCCESSFUL_REPOS=""
-DATE_PREFIX=$(date +%Y%m%d_%H%M%S)
+# "slowest-first" starts the longest backups early; "config" keeps repos.txt order
+SCHEDULE_ORDER="${SCHEDULE_ORDER:-slowest-first}"
+# Warn when the predicted run time exceeds this many minutes (0 disables)
+BACKUP_WINDOW_MINUTES="${BACKUP_WINDOW_MINUTES:-0}"
 
-# Read all repositories into an array first (EXACT COPY from original workflow)
+# Flag archives whose size differs from the recent average by more than this (0 disables)
+SIZE_ANOMALY_PERCENT="${SIZE_ANOMALY_PERCENT:-50}"
+# Back up only these repositories (comma-separated names), e.g. for a retry from a notification
+BACKUP_ONLY="${BACKUP_ONLY:-}"
+
+# Per-run lists for notifications; counts come from results_aggregate after the loop
+RECOVERED_REPOS=""
+SIZE_ANOMALIES=""
+SENSITIVE_REPOS=""
+PARTIAL_REPOS=""
+REMEDIATIONS=""
+CANCELLED_REPOS=""
+# Failures kept out of the failure card by their tier, and those warned about instead
+QUIET_FAILURES=""
+TIER_WARNINGS=""
+# Repositories quarantined by this run's failure
+QUARANTINED_REPOS=""
+ONBOARDED_REPOS=""
+ONBOARDED_COUNT=0
+DATE_PREFIX=$(run_date +%Y%m%d_%H%M%S)
+# A clock behind the newest archive would sort this run's archives before it
+NEWEST_ARCHIVE_DATE=$(jq -r 'map(.date) | max // empty' "$CATALOG_FILE" 2>/dev/null)
+if [[ "$NEWEST_ARCHIVE_DATE" > "$DATE_PREFIX" ]]; then
+  echo "⚠️ The clock ($DATE_PREFIX) is behind the newest archive ($NEWEST_ARCHIVE_DATE); check the runner's time"
+fi
+results_init
+
+# Read all repositories into an array first, expanding org: lines
 echo "📋 Reading repository list..."
 declare -a REPOS_ARRAY
 
-while IFS= read -r line; do
-  # Skip comments and empty lines
-  if [[ ! "$line" =~ ^[[:space:]]*# ]] && [[ -n "${line// }" ]]; then
-    REPOS_ARRAY+=("$line")
-  fi
-done < repos.txt
+if ! REPO_LINES=$(repo_lines); then
+  echo "❌ Could not read the repository list"
+  exit 1
+fi
+if [ -n "$REPO_LINES" ]; then
+  mapfile -t REPOS_ARRAY <<<"$REPO_LINES"
+fi
 
 TOTAL_REPOS=${#REPOS_ARRAY[@]}
 echo "📋 Found $TOTAL_REPOS repositories to backup"
+
+# Archives, state and reports are keyed by name, so names must be unique
+NAME_CONFLICTS=$(repo_name_conflicts "${REPOS_ARRAY[@]}")
+if [ -n "$NAME_CONFLICTS" ]; then
+  echo "❌ Conflicting repository names in repos.txt (set a unique name= option):"
+  sed 's/^/    /' <<<"$NAME_CONFLICTS"
+  exit 1
+fi
+
+if [ -n "$BACKUP_ONLY" ]; then
+  declare -a SELECTED_REPOS=()
+  for repo_line in "${REPOS_ARRAY[@]}"; do
+    if [[ ",${BACKUP_ONLY// /}," == *",$(repo_display_name "$repo_line"),"* ]]; then
+      SELECTED_REPOS+=("$repo_line")
+    fi
+  done
+  REPOS_ARRAY=("${SELECTED_REPOS[@]}")
+  TOTAL_REPOS=${#REPOS_ARRAY[@]}
+  echo "📋 Limited to $TOTAL_REPOS of them: $BACKUP_ONLY"
+fi
+
+if drill_active; then
+  drill_pick $(for repo_line in "${REPOS_ARRAY[@]}"; do repo_display_name "$repo_line"; done)
+  echo "🧪 Drill run, injecting $(drill_describe)"
+fi
+
+# Order by historical duration and predict how long the run will take
+PREDICTED_SECONDS=0
+declare -a SCHEDULE
+for repo_line in "${REPOS_ARRAY[@]}"; do
+  average=$(state_average_duration "$(repo_display_name "$repo_line")")
+  PREDICTED_SECONDS=$((PREDICTED_SECONDS + average))
+  SCHEDULE+=("$average"$'\t'"$repo_line")
+done
+if [ "$SCHEDULE_ORDER" = "slowest-first" ] && [ $TOTAL_REPOS -gt 0 ]; then
+  mapfile -t REPOS_ARRAY < <(printf '%s\n' "${SCHEDULE[@]}" | sort -s -t$'\t' -k1,1nr | cut -f2-)
+fi
+if [ $PREDICTED_SECONDS -gt 0 ]; then
+  echo "⏱️ Predicted run time: $(format_duration $PREDICTED_SECONDS)"
+  if [ "$BACKUP_WINDOW_MINUTES" -gt 0 ] && [ $PREDICTED_SECONDS -gt $((BACKUP_WINDOW_MINUTES * 60)) ]; then
+    echo "⚠️ Predicted run time exceeds the ${BACKUP_WINDOW_MINUTES}m backup window"
+  fi
+fi
+
+# Issues and pull requests of many repositories per GraphQL query, instead of
+# paging through each repository's on its own
+if [ "$METADATA_BATCH_SIZE" -gt 1 ]; then
+  declare -a DUE_REPOS=()
+  for repo_line in "${REPOS_ARRAY[@]}"; do
+    repo_name=$(repo_display_name "$repo_line")
+    next_attempt=$(quarantine_next_attempt "$repo_name" "$(repo_option "$repo_line" quarantine "$QUARANTINE_AFTER_FAILURES")")
+    if [ -n "$BACKUP_ONLY" ] ||
+      { [ "${next_attempt:-0}" -le "$RUN_EPOCH" ] && repo_is_due "$repo_name" "$(repo_option "$repo_line" frequency daily)"; }; then
+      DUE_REPOS+=("$repo_line")
+    fi
+  done
+  metadata_prefetch "${DUE_REPOS[@]}"
+fi
 echo ""
 
 # Process each repository from the array (EXACT COPY from original workflow)
 for i in "${!REPOS_ARRAY[@]}"; do
-  repo_url="${REPOS_ARRAY[$i]}"
+  repo_line="${REPOS_ARRAY[$i]}"
+  repo_url=$(repo_line_url "$repo_line")
   echo "[$(($i + 1))/$TOTAL_REPOS] Processing..."
   
-  if backup_repo "$repo_url"; then
-    SUCCESS_COUNT=$((SUCCESS_COUNT + 1))
-    SUCCESSFUL_REPOS="${SUCCESSFUL_REPOS}$(basename "$repo_url" .git), "
+  repo_name=$(repo_display_name "$repo_line")
+  # Once the run's deadline passed or it was cancelled, only record what was left out
+  if ctx_done; then
+    echo "⏹️ Not started: $repo_name ($(ctx_err))"
+    result_begin
+    result_set skip_reason cancelled
+    result_record "$repo_name" "$repo_url" timed-out
+    CANCELLED_REPOS="${CANCELLED_REPOS}${repo_name}, "
+    continue
+  fi
+  # Settings from the repository's own .backup.yml; repos.txt options take precedence
+  if [ "$REPO_SELF_CONFIG" = "true" ]; then
+    repo_line="$repo_line $(API_TOKEN=$(git_named_token "$(repo_option "$repo_line" token "")") repo_self_options "$repo_url")"
+  fi
+  if [ "$(repo_option "$repo_line" backup true)" = "false" ]; then
+    echo "⏭️ Skipping: $repo_name (opted out in .backup.yml)"
+    result_begin
+    result_set skip_reason opted_out
+    result_record "$repo_name" "$repo_url" skipped-filtered
+    results_progress "$TOTAL_REPOS"
+    echo ""
+    continue
+  fi
+  
+  # Quarantined repositories wait out their pause; BACKUP_ONLY (a retry) doesn't
+  quarantine_after=$(repo_option "$repo_line" quarantine "$QUARANTINE_AFTER_FAILURES")
+  next_attempt=$(quarantine_next_attempt "$repo_name" "$quarantine_after")
+  if [ -z "$BACKUP_ONLY" ] && [ -n "$next_attempt" ] && [ "$next_attempt" -gt "$RUN_EPOCH" ]; then
+    failures=$(state_get '.repos[$repo].consecutive_failures' --arg repo "$repo_name")
+    next_attempt=$(date -u -d "@$next_attempt" '+%Y-%m-%dT%H:%M:%SZ')
+    echo "🚧 Skipping: $repo_name (quarantined after $failures failed runs, next attempt $next_attempt)"
+    result_begin
+    result_set skip_reason quarantined
+    result_set next_attempt "$next_attempt"
+    result_set_json consecutive_failures "$failures"
+    result_record "$repo_name" "$repo_url" quarantined
+    results_progress "$TOTAL_REPOS"
+    echo ""
+    continue
+  fi
+
+  frequency=$(repo_option "$repo_line" frequency daily)
+  # Repositories picked with BACKUP_ONLY run even when not due
+  if [ -z "$BACKUP_ONLY" ] && ! repo_is_due "$repo_name" "$frequency"; then
+    echo "⏭️ Skipping: $repo_name (not due, frequency $frequency)"
+    result_begin
+    result_set skip_reason not_due
+    result_set frequency "$frequency"
+    result_record "$repo_name" "$repo_url" skipped-filtered
+    results_progress "$TOTAL_REPOS"
+    echo ""
+    continue
+  fi
+  repo_started=$(clock_now)
+  result_begin
+  result_set started_at "$(date -u -d "@$repo_started" '+%Y-%m-%dT%H:%M:%SZ')"
+  onboarded=false
+  if [ "$ONBOARDING_CHECKS" = "true" ] && repo_is_new "$repo_name"; then
+    onboard_repo "$repo_url" "$repo_line"
+    onboarded=true
+  fi
+  
+  resources_mark resources_before
+  backup_repo "$repo_url" "$repo_line"
+  backup_status=$?
+  resources_mark resources_after
+  if [ -n "$resources_before" ]; then
+    result_set_json resources "$(resources_between "$resources_before" "$resources_after")"
+  fi
+  if [ "$onboarded" = "true" ]; then
+    ONBOARDED_REPOS="${ONBOARDED_REPOS}$(onboarded_entry "$repo_name"), "
+    ONBOARDED_COUNT=$((ONBOARDED_COUNT + 1))
+  fi
+  # Drills report backups that ran as failed; state and catalog keep the truth
+  drilled=false
+  if [ $backup_status -ne 1 ] && drill_inject "$repo_name"; then
+    drilled=true
+  fi
+  
+  if [ $backup_status -eq 0 ] || [ $backup_status -eq 2 ]; then
+    repo_seconds=$(( $(clock_now) - repo_started ))
+    result_set_json duration_seconds "$repo_seconds"
+    archive_name=$(jq -r '.archive' <<<"$RESULT_FIELDS")
+    archive_size=$(jq -r '.size_bytes' <<<"$RESULT_FIELDS")
+    
+    # Compare with recent archives to catch runaway growth or suspicious shrinkage;
+    # delta archives are meant to be small
+    average_size=$(catalog_average_size "$repo_name")
+    if [ "$SIZE_ANOMALY_PERCENT" -gt 0 ] && [ "$average_size" -gt 0 ] &&
+      [ -z "$(jq -r '.delta_of // empty' <<<"$RESULT_FIELDS")" ]; then
+      size_change=$(( (archive_size - average_size) * 100 / average_size ))
+      if [ ${size_change#-} -gt "$SIZE_ANOMALY_PERCENT" ]; then
+        echo "⚠️ Size anomaly: $repo_name is ${size_change}% vs its recent average"
+        result_set_json size_change_percent "$size_change"
+        SIZE_ANOMALIES="${SIZE_ANOMALIES}$(msg size_anomaly_entry "$repo_name" "$size_change"), "
+      fi
+    fi
+    
+    if [ "$drilled" = "true" ]; then
+      result_record "$repo_name" "$repo_url" failed
+      if [ "$NOTIFY_REALTIME_FAILURES" = "true" ]; then
+        notify_failure_now "$(msg failing_now_entry "$repo_name" "$(jq -r '.error_class // .failure_stage' <<<"$RESULT_FIELDS")")"
+      fi
+    elif [ $backup_status -eq 2 ]; then
+      result_record "$repo_name" "$repo_url" partial
+      PARTIAL_REPOS="${PARTIAL_REPOS}${repo_name} ($(jq -r '.aux_failures | join("/")' <<<"$RESULT_FIELDS")), "
+    elif [ -n "$(jq -r '.dedup_of // empty' <<<"$RESULT_FIELDS")" ]; then
+      result_record "$repo_name" "$repo_url" skipped-unchanged
+    else
+      result_record "$repo_name" "$repo_url" success
+    fi
+    sensitive_count=$(jq '.sensitive_files // [] | length' <<<"$RESULT_FIELDS")
+    if [ "$sensitive_count" -gt 0 ]; then
+      SENSITIVE_REPOS="${SENSITIVE_REPOS}${repo_name} (${sensitive_count}), "
+    fi
+    state_record_duration "$repo_name" "$repo_seconds"
+    stored_archive=$(jq -r '.dedup_of // .archive' <<<"$RESULT_FIELDS")
+    state_record_archive "$repo_name" "$stored_archive" "$archive_size" "$(run_date -u '+%Y-%m-%dT%H:%M:%SZ')"
+    catalog_add "$repo_name" "$archive_name" "$DATE_PREFIX" "$archive_size"
+    # Kept for deduplicating later backups against this one
+    for field in content_hash encryption_key dedup_of delta_of sha256; do
+      value=$(jq -c --arg field "$field" '.[$field] // empty' <<<"$RESULT_FIELDS")
+      if [ -n "$value" ]; then
+        catalog_set "$archive_name" "$field" "$value"
+      fi
+    done
+    failed_for=$(state_mark_succeeded "$repo_name")
+    if [ -n "$failed_for" ]; then
+      echo "🎉 Recovered: $repo_name (failing for $failed_for)"
+      RECOVERED_REPOS="${RECOVERED_REPOS}$(msg recovered_entry "$repo_name" "$failed_for"), "
+    fi
   else
-    FAIL_COUNT=$((FAIL_COUNT + 1))
-    FAILED_REPOS="${FAILED_REPOS}$(basename "$repo_url" .git), "
+    result_set_json duration_seconds $(( $(clock_now) - repo_started ))
+    error_class=$(jq -r '.error_class // .failure_stage // "unknown"' <<<"$RESULT_FIELDS")
+    if [ "$error_class" = "cancelled" ]; then
+      result_record "$repo_name" "$repo_url" timed-out
+      state_mark_failed "$repo_name" false
+    elif [ "$error_class" = "clone_timeout" ]; then
+      result_record "$repo_name" "$repo_url" timed-out
+      state_mark_failed "$repo_name"
+    else
+      result_record "$repo_name" "$repo_url" failed
+      state_mark_failed "$repo_name"
+    fi
+    # The repository's tier decides after how many failures in a row, and how, it is notified
+    tier=$(repo_option "$repo_line" tier standard)
+    read -r tier_failures tier_level <<<"$(notify_tier_rule "$tier")"
+    failures=$(state_get '.repos[$repo].consecutive_failures // 0' --arg repo "$repo_name")
+    if [ "$error_class" = "cancelled" ]; then
+      :
+    elif [ "$quarantine_after" -gt 0 ] && [ "$failures" -ge "$quarantine_after" ]; then
+      # Quarantine replaces the tier's alerts with one notice when it starts
+      QUIET_FAILURES="${QUIET_FAILURES}${repo_name}, "
+      if [ "$failures" -eq "$quarantine_after" ]; then
+        echo "🚧 Quarantined: $repo_name failed $failures runs in a row"
+        QUARANTINED_REPOS="${QUARANTINED_REPOS}$(msg failing_runs_entry "$repo_name" "$failures"), "
+      fi
+    elif [ "$failures" -lt "$tier_failures" ]; then
+      echo "🔕 Not notified yet: $repo_name failed $failures of $tier_failures runs in a row (tier $tier)"
+      QUIET_FAILURES="${QUIET_FAILURES}${repo_name}, "
+    elif [ "$tier_level" = "warning" ]; then
+      QUIET_FAILURES="${QUIET_FAILURES}${repo_name}, "
+      TIER_WARNINGS="${TIER_WARNINGS}$(msg failing_runs_entry "$repo_name" "$failures"), "
+    elif [ "$failures" -eq "$tier_failures" ]; then
+      # Alert on new failures right away; repos already failing wait for the summary
+      if [ "$tier_level" = "page" ]; then
+        echo "📟 Paging: $repo_name (tier $tier)"
+        notify_page "$(msg result_page "$tier" "$(msg failing_now_entry "$repo_name" "$error_class")")" "$repo_name"
+      elif [ "$NOTIFY_REALTIME_FAILURES" = "true" ]; then
+        notify_failure_now "$(msg failing_now_entry "$repo_name" "$error_class")"
+      fi
+    fi
+    remediation=$(jq -r '.remediation // empty' <<<"$RESULT_FIELDS")
+    if [ -n "$remediation" ]; then
+      REMEDIATIONS="${REMEDIATIONS}${remediation}; "
+    fi
   fi
+  results_progress "$TOTAL_REPOS"
   echo ""
-done 
\ No newline at end of file
+done
+
+# Totals of the run for the summary and notifications, one per status so
+# they add up to the total
+AGGREGATE=$(results_aggregate)
+RESULT_COUNT=$(jq '.total' <<<"$AGGREGATE")
+SUCCESS_COUNT=$(jq '.succeeded' <<<"$AGGREGATE")
+FAIL_COUNT=$(jq '.failed' <<<"$AGGREGATE")
+PARTIAL_COUNT=$(jq '.partial' <<<"$AGGREGATE")
+UNCHANGED_COUNT=$(jq '.skipped_unchanged' <<<"$AGGREGATE")
+TIMED_OUT_COUNT=$(jq '.timed_out' <<<"$AGGREGATE")
+QUARANTINED_COUNT=$(jq '.quarantined' <<<"$AGGREGATE")
+FILTERED_COUNT=$(jq '.skipped_filtered' <<<"$AGGREGATE")
+# Every status's count, for the notifications
+RUN_COUNTS=$(msg result_counts "$SUCCESS_COUNT" "$UNCHANGED_COUNT" "$PARTIAL_COUNT" \
+  "$FAIL_COUNT" "$TIMED_OUT_COUNT" "$QUARANTINED_COUNT" "$FILTERED_COUNT")
+SUCCESSFUL_REPOS=$(jq -r '.names.backed_up | map(. + ", ") | add // ""' <<<"$AGGREGATE")
+FAILED_REPOS=$(jq -r '.names.failed | map(. + ", ") | add // ""' <<<"$AGGREGATE")
+# The failures the failure card is about, without those their tier keeps quiet
+NOTIFY_FAILED_REPOS=""
+NOTIFY_FAIL_COUNT=0
+for repo_name in $(jq -r '.names.failed[]' <<<"$AGGREGATE"); do
+  if [[ ", $QUIET_FAILURES" != *", $repo_name, "* ]]; then
+    NOTIFY_FAILED_REPOS="${NOTIFY_FAILED_REPOS}${repo_name}, "
+    NOTIFY_FAIL_COUNT=$((NOTIFY_FAIL_COUNT + 1))
+  fi
+done
@@ -0,0 +1,124 @@
+#!/bin/bash
+# Delete old archives by hand. Runs never delete anything; this removes the
+# snapshots beyond the newest few or older than some days from every
+# destination holding them, and from the catalog. The newest snapshot of a
+# repository is always kept, and so is any archive a kept snapshot still
+# needs: the full archive under a delta, or the object a deduplicated backup
+# shares. Archives missing from the catalog are never touched (see
+# import-catalog).
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+# Catalog entries with prune: true for those to delete, and needed_by naming a
+# kept snapshot that depends on an archive which would have been deleted:
+# prune_plan <repo> <keep> <cutoff date>
+prune_plan() {
+  jq --arg repo "$1" --argjson keep "${2:-0}" --arg cutoff "$3" '
+    group_by(.repository) | map(sort_by(.date) | reverse | to_entries | map(.value + {rank: .key})) | flatten |
+    map(. + {prune: (($repo == "" or .repository == $repo) and .rank >= ([$keep, 1] | max) and
+      ($cutoff == "" or .date < $cutoff))}) |
+    # Keep what kept snapshots need, until nothing else is needed
+    until(
+      (map(select(.prune | not)) | map(.dedup_of, .delta_of | select(. != null)) | unique) as $needed |
+      all(.[]; (.prune and (.archive | IN($needed[]))) | not);
+      (map(select(.prune | not)) | map({dedup_of, delta_of, archive}) ) as $kept |
+      map(if .prune then .archive as $archive |
+        ([$kept[] | select(.dedup_of == $archive or .delta_of == $archive) | .archive] | first) as $by |
+        if $by then .prune = false | .needed_by = $by else . end else . end))
+    | sort_by(.date, .repository)' "$CATALOG_FILE"
+}
+
+# Delete an archive and its manifest from a destination: prune_delete <destination> <archive>
+prune_delete() {
+  local suffix=$(encryption_suffix_of "$2")
+  storage_delete "$1" "$2" || return 1
+  storage_delete "$1" "${2%$suffix}.manifest$suffix" 2>/dev/null
+  return 0
+}
+
+# backup_prune [--keep N] [--older-than DAYS] [--repo name] [--dry-run]
+backup_prune() {
+  local keep=""
+  local older_than=""
+  local repo=""
+  local dry_run=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --keep) keep="$2"; shift 2 ;;
+      --older-than) older_than="$2"; shift 2 ;;
+      --repo) repo="$2"; shift 2 ;;
+      --dry-run) dry_run=true; shift ;;
+      *) echo "❌ Unknown option: $1"; return 2 ;;
+    esac
+  done
+  if { [ -z "$keep" ] && [ -z "$older_than" ]; } ||
+    ! [[ "${keep:-1}" =~ ^[0-9]+$ && "${older_than:-1}" =~ ^[0-9]+$ ]]; then
+    echo "❌ Usage: prune [--keep N] [--older-than DAYS] [--repo name] [--dry-run] (at least one of --keep and --older-than)"
+    return 2
+  fi
+  # The stored catalog, never a local copy left by an earlier command: it is
+  # saved back, and a stale one would drop archives recorded since
+
+  state_load
+  local cutoff=""
+  if [ -n "$older_than" ]; then
+    cutoff=$(clock_date --ago $((older_than * 86400)) '+%Y%m%d_%H%M%S') || return 1
+  fi
+  local plan
+  plan=$(prune_plan "$repo" "$keep" "$cutoff") || return 1
+
+  # The whole plan is printed before anything is deleted
+  jq -r "$RESULTS_JQ_DEFS"'.[] | select(.prune or .needed_by) |
+    if .prune then
+      "🗑️ \(.archive) (\(.repository), \(.size_bytes | size_human)\(if .dedup_of then ", catalog entry only" else "" end), \(.destinations | join(", ")))"
+    else
+      "🔒 Keeping \(.archive): \(.needed_by) needs it"
+    end' <<<"$plan"
+  local count=$(jq 'map(select(.prune)) | length' <<<"$plan")
+  local size=$(jq -r "$RESULTS_JQ_DEFS"'map(select(.prune and .dedup_of == null) | .size_bytes) | add // 0 | size_human' <<<"$plan")
+  if [ "$count" -eq 0 ]; then
+    echo "ℹ️ Nothing to prune"
+    return 0
+  fi
+  if [ "$dry_run" = "true" ]; then
+    echo "ℹ️ Dry run: $count archives ($size) would be deleted"
+    return 0
+  fi
+
+  # Deduplicated backups have no object of their own; the others are removed
+  # from the catalog only once every destination deleted them
+  local entry archive destination deleted=0 failed=0 ok
+  while IFS= read -r entry; do
+    archive=$(jq -r '.archive' <<<"$entry")
+    ok=true
+    if [ "$(jq -r '.dedup_of // empty' <<<"$entry")" = "" ]; then
+      for destination in $(jq -r '.destinations[]' <<<"$entry"); do
+        if ! prune_delete "$destination" "$archive"; then
+          echo "⚠️ Kept $archive on $destination (could not delete it, immutable?)"
+          ok=false
+        fi
+      done
+    fi
+    if [ "$ok" = "true" ]; then
+      jq --arg archive "$archive" 'map(select(.archive != $archive))' "$CATALOG_FILE" > "$CATALOG_FILE.tmp" &&
+        mv "$CATALOG_FILE.tmp" "$CATALOG_FILE"
+      deleted=$((deleted + 1))
+    else
+      failed=$((failed + 1))
+    fi
+  done < <(jq -c '.[] | select(.prune) | del(.prune, .rank)' <<<"$plan")
+  state_save
+
+  if [ $failed -gt 0 ]; then
+    echo "⚠️ Pruned $deleted archives, $failed could not be deleted everywhere"
+    return 1
+  fi
+  echo "✅ Pruned $deleted archives ($size)"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_prune "$@"
+fi
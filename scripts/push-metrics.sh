@@ -0,0 +1,97 @@
+#!/bin/bash
+# Push a run's metrics to a Prometheus Pushgateway (one-shot runs can't be scraped)
+
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+PUSHGATEWAY_URL="${PUSHGATEWAY_URL:-}"
+PUSHGATEWAY_JOB="${PUSHGATEWAY_JOB:-repo_backup}"
+
+# Render a results file in the Prometheus text exposition format
+results_metrics() {
+  read_results "$1" | jq -r --arg statuses "$RESULT_STATUSES" "$RESULTS_JQ_DEFS"'
+    def escape_label: tostring | gsub("\\\\"; "\\\\\\\\") | gsub("\""; "\\\"") | gsub("\n"; "\\n");
+    def seconds: if . == null or . == "" then null else fromdateiso8601 end;
+    "# TYPE backup_run_info gauge",
+    "backup_run_info{run_uuid=\"\(.run.run_uuid // "" | escape_label)\",run_id=\"\(.run.run_id // "" | escape_label)\"} 1",
+    "# TYPE backup_last_run_timestamp_seconds gauge",
+    "backup_last_run_timestamp_seconds \(.run.finished_at | seconds // now | floor)",
+    "# TYPE backup_run_duration_seconds gauge",
+    "backup_run_duration_seconds \((.run.finished_at | seconds // 0) - (.run.started_at | seconds // 0))",
+    "# TYPE backup_repositories_total gauge",
+    "backup_repositories_total \(.totals.total // 0)",
+    "# TYPE backup_repositories_succeeded gauge",
+    "backup_repositories_succeeded \(.totals.succeeded // 0)",
+    "# TYPE backup_repositories_failed gauge",
+    "backup_repositories_failed \(.totals.failed // 0)",
+    "# TYPE backup_repositories_partial gauge",
+    "backup_repositories_partial \(.totals.partial // 0)",
+    "# TYPE backup_repositories_skipped gauge",
+    "backup_repositories_skipped \(.totals.skipped // 0)",
+    "# TYPE backup_repositories gauge",
+    (.repositories as $repositories | $statuses | split(" ")[] as $status |
+      "backup_repositories{status=\"\($status)\"} \($repositories | map(select(.status == $status)) | length)"),
+    "# TYPE backup_destination_uploaded_bytes gauge",
+    (.totals.destinations // {} | to_entries[] | "backup_destination_uploaded_bytes{destination=\"\(.key | escape_label)\"} \(.value.uploaded_bytes)"),
+    "# TYPE backup_destination_upload_seconds gauge",
+    (.totals.destinations // {} | to_entries[] | "backup_destination_upload_seconds{destination=\"\(.key | escape_label)\"} \(.value.upload_seconds)"),
+    (.run.resources // {} | to_entries[] | select(.key != "samples") |
+      "# TYPE backup_run_\(.key) gauge", "backup_run_\(.key) \(.value)"),
+    "# TYPE backup_clone_seconds gauge",
+    "backup_clone_seconds \(.totals.clone_seconds // 0)",
+    "# TYPE backup_api_requests gauge",
+    (.run.api // {} | to_entries[] | "backup_api_requests{host=\"\(.key | escape_label)\"} \(.value.requests)"),
+    "# TYPE backup_api_retries gauge",
+    (.run.api // {} | to_entries[] | "backup_api_retries{host=\"\(.key | escape_label)\"} \(.value.retries)"),
+    "# TYPE backup_api_errors gauge",
+    (.run.api // {} | to_entries[] | "backup_api_errors{host=\"\(.key | escape_label)\"} \(.value.errors)"),
+    "# TYPE backup_api_graphql_cost gauge",
+    (.run.api // {} | to_entries[] | select(.value.graphql_cost != null) | "backup_api_graphql_cost{host=\"\(.key | escape_label)\"} \(.value.graphql_cost)"),
+    "# TYPE backup_repository_success gauge",
+    (.repositories[] | select(left_out | not) | "backup_repository_success{repository=\"\(.name | escape_label)\"} \(if .status | backed_up then 1 else 0 end)"),
+    "# TYPE backup_repository_status gauge",
+    (.repositories[] | "backup_repository_status{repository=\"\(.name | escape_label)\",status=\"\(.status)\"} 1"),
+    "# TYPE backup_repository_size_bytes gauge",
+    (.repositories[] | select(.size_bytes != null) | "backup_repository_size_bytes{repository=\"\(.name | escape_label)\"} \(.size_bytes)"),
+    "# TYPE backup_repository_clone_seconds gauge",
+    (.repositories[] | select(.clone_seconds != null) | "backup_repository_clone_seconds{repository=\"\(.name | escape_label)\"} \(.clone_seconds)"),
+    "# TYPE backup_repository_received_bytes gauge",
+    (.repositories[] | select(.received_bytes != null) | "backup_repository_received_bytes{repository=\"\(.name | escape_label)\"} \(.received_bytes)"),
+    "# TYPE backup_repository_transfer_rate_bytes gauge",
+    (.repositories[] | select(.transfer_rate_bytes_per_sec != null) | "backup_repository_transfer_rate_bytes{repository=\"\(.name | escape_label)\"} \(.transfer_rate_bytes_per_sec)"),
+    "# TYPE backup_repository_cpu_seconds gauge",
+    (.repositories[] | select(.resources.cpu_seconds != null) | "backup_repository_cpu_seconds{repository=\"\(.name | escape_label)\"} \(.resources.cpu_seconds)"),
+    "# TYPE backup_repository_peak_rss_bytes gauge",
+    (.repositories[] | select(.resources.peak_rss_bytes != null) | "backup_repository_peak_rss_bytes{repository=\"\(.name | escape_label)\"} \(.resources.peak_rss_bytes)"),
+    "# TYPE backup_repository_scratch_disk_bytes gauge",
+    (.repositories[] | select(.resources.scratch_disk_bytes != null) | "backup_repository_scratch_disk_bytes{repository=\"\(.name | escape_label)\"} \(.resources.scratch_disk_bytes)"),
+    "# TYPE backup_repository_stars gauge",
+    (.repositories[] | select(.social != null) | "backup_repository_stars{repository=\"\(.name | escape_label)\"} \(.social.stars)"),
+    "# TYPE backup_repository_watchers gauge",
+    (.repositories[] | select(.social != null) | "backup_repository_watchers{repository=\"\(.name | escape_label)\"} \(.social.watchers)"),
+    "# TYPE backup_repository_forks gauge",
+    (.repositories[] | select(.social != null) | "backup_repository_forks{repository=\"\(.name | escape_label)\"} \(.social.forks)")
+  '
+}
+
+# Replace this job's metrics on the Pushgateway with the given run's
+push_metrics() {
+  local results_file="${1:-$RESULTS_FILE}"
+  if [ -z "$PUSHGATEWAY_URL" ]; then
+    return 0
+  fi
+
+  local metrics
+  if ! metrics=$(results_metrics "$results_file") || ! curl -sf -X PUT \
+    "${PUSHGATEWAY_URL%/}/metrics/job/$PUSHGATEWAY_JOB" \
+    --data-binary "$metrics"$'\n' \
+    --max-time 10 >/dev/null; then
+    echo "⚠️ Failed to push metrics to $PUSHGATEWAY_URL"
+    return 0
+  fi
+  echo "📈 Pushed metrics to $PUSHGATEWAY_URL"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  push_metrics "${1:-$RESULTS_FILE}"
+fi
@@ -0,0 +1,56 @@
+#!/bin/bash
+# Show the repositories quarantined after failing too many runs in a row, and
+# release them so the next run attempts them again (a repository that was
+# deleted on purpose is better removed from repos.txt)
+
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/discover.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+# backup_quarantine [--release repo]...
+backup_quarantine() {
+  local -a release=()
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --release) release+=("$2"); shift 2 ;;
+      *) echo "❌ Usage: quarantine [--release repo]..."; return 2 ;;
+    esac
+  done
+
+  state_load
+  if [ ${#release[@]} -gt 0 ]; then
+    local repo_name
+    for repo_name in "${release[@]}"; do
+      if [ "$(state_get '.repos[$repo].consecutive_failures // 0' --arg repo "$repo_name")" -eq 0 ]; then
+        echo "⚠️ $repo_name is not failing"
+        continue
+      fi
+      quarantine_release "$repo_name"
+      echo "✅ Released $repo_name; the next run attempts it"
+    done
+    state_save
+    return 0
+  fi
+
+  local line repo_name next_attempt failures
+  local count=0
+  while IFS= read -r line; do
+    repo_name=$(repo_display_name "$line")
+    next_attempt=$(quarantine_next_attempt "$repo_name" "$(repo_option "$line" quarantine "$QUARANTINE_AFTER_FAILURES")")
+    [ -n "$next_attempt" ] || continue
+    failures=$(state_get '.repos[$repo].consecutive_failures' --arg repo "$repo_name")
+    if [ "$next_attempt" -le "$(clock_now)" ]; then
+      next_attempt="next run"
+    else
+      next_attempt=$(date -u -d "@$next_attempt" '+%Y-%m-%dT%H:%M:%SZ')
+    fi
+    echo "🚧 $repo_name: failed $failures runs in a row, next attempt $next_attempt"
+    count=$((count + 1))
+  done < <(repo_lines)
+  echo "ℹ️ $count quarantined repositories"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_quarantine "$@"
+fi
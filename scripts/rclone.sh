@@ -0,0 +1,79 @@
+#!/bin/bash
+# rclone destination: any remote rclone supports (S3 and compatible stores,
+# Backblaze B2, Dropbox, WebDAV, ...), configured in rclone's own format.
+# rclone takes care of the provider's chunked uploads and retries.
+
+# Where archives go, as rclone's "remote:path", e.g. "b2:my-bucket/backups"
+RCLONE_REMOTE="${RCLONE_REMOTE:-}"
+# rclone's configuration: the rclone.conf path or its contents. Without it
+# rclone uses its default file and RCLONE_CONFIG_<REMOTE>_* variables.
+RCLONE_CONFIG="${RCLONE_CONFIG:-}"
+# Further options for every rclone call, e.g. "--s3-storage-class STANDARD_IA"
+RCLONE_FLAGS="${RCLONE_FLAGS:-}"
+
+# Run rclone with the configuration: rclone_run <arguments...>
+rclone_run() {
+  if ! command -v rclone >/dev/null; then
+    echo "❌ rclone is not installed" >&2
+    return 1
+  fi
+  local config="$RCLONE_CONFIG"
+  if [ -n "$config" ] && [ ! -f "$config" ]; then
+    config="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}/rclone.conf"
+    if [ ! -f "$config" ]; then
+      (umask 077 && mkdir -p "$(dirname "$config")" && printf '%s\n' "$RCLONE_CONFIG" > "$config") || return 1
+    fi
+  fi
+  rclone ${config:+--config "$config"} $RCLONE_FLAGS "$@" </dev/null
+}
+
+# A stored name as an rclone path
+rclone_path() {
+  case "$RCLONE_REMOTE" in
+    *:|*/) echo "$RCLONE_REMOTE$1" ;;
+    *) echo "$RCLONE_REMOTE/$1" ;;
+  esac
+}
+
+# Remotes that keep metadata (S3, GCS, Azure, ...) get the run that wrote the file
+rclone_put() {
+  rclone_run copyto ${RUN_UUID:+--metadata --metadata-set "run_uuid=$RUN_UUID"} "$1" "$(rclone_path "$2")" 2>/dev/null
+}
+
+rclone_get() {
+  rclone_run copyto "$(rclone_path "$1")" "$2" 2>/dev/null
+}
+
+# Stream a file or a byte range of it: rclone_read <name> <offset> [length]
+rclone_read() {
+  rclone_run cat --offset "$2" ${3:+--count "$3"} "$(rclone_path "$1")" 2>/dev/null
+}
+
+# Stored names starting with a prefix, one per line: rclone_list [prefix]
+rclone_list() {
+  local prefix="$1"
+  local dir=""
+  if [[ "$prefix" == */* ]]; then
+    dir="${prefix%/*}"
+  fi
+  rclone_run lsf -R --files-only "$(rclone_path "$dir")" 2>/dev/null | while IFS= read -r name; do
+    name="${dir:+$dir/}$name"
+    if [[ "$name" == "$prefix"* ]]; then
+      echo "$name"
+    fi
+  done | sort
+}
+
+rclone_size() {
+  rclone_run lsjson --stat "$(rclone_path "$1")" 2>/dev/null | jq -r '.Size'
+}
+
+rclone_delete() {
+  rclone_run deletefile "$(rclone_path "$1")" 2>/dev/null
+}
+
+# Copy within the remote, server-side where the provider supports it:
+# rclone_copy <source> <target>
+rclone_copy() {
+  rclone_run copyto "$(rclone_path "$1")" "$(rclone_path "$2")" 2>/dev/null
+}
@@ -0,0 +1,81 @@
+#!/bin/bash
+# Credential redaction for anything that may end up in logs or results, and
+# user-defined rules for other things that must not leave the organization
+# (internal hostnames, people's names or emails in repository names, ...)
+
+# Rules, one per line: "<regex>" or "<regex> => <replacement>" (default [REDACTED]).
+# Extended regular expressions; replacements are literal text.
+REDACT_RULES_FILE="${REDACT_RULES_FILE:-redact-rules.txt}"
+# More rules, newline-separated, e.g. from a secret
+REDACT_RULES="${REDACT_RULES:-}"
+
+# Strip tokens from stdin: the configured token and any user:pass@ in URLs
+redact_credentials() {
+  local token_pattern='$^'
+  if [ -n "$GITHUB_TOKEN" ]; then
+    token_pattern=$(printf '%s' "$GITHUB_TOKEN" | sed 's/[][\.*^$/]/\\&/g')
+  fi
+  sed -E \
+    -e "s/$token_pattern/***/g" \
+    -e 's#(https?://)[^/@[:space:]]+@#\1***@#g'
+}
+
+# Configured rules, comments and blank lines removed
+redact_rules_list() {
+  {
+    [ ! -f "$REDACT_RULES_FILE" ] || cat "$REDACT_RULES_FILE"
+    printf '%s\n' "$REDACT_RULES"
+  } | grep -vE '^[[:space:]]*(#|$)'
+}
+
+redact_rules_enabled() {
+  [ -n "$(redact_rules_list)" ]
+}
+
+# Apply the configured rules to stdin, line by line as it arrives
+redact_text() {
+  local script="" rule pattern replacement
+  while IFS= read -r rule; do
+    pattern="${rule%% => *}"
+    replacement="[REDACTED]"
+    if [[ "$rule" == *" => "* ]]; then
+      replacement="${rule#* => }"
+    fi
+    replacement=$(printf '%s' "$replacement" | sed 's/[\\&]/\\&/g')
+    script+="s"$'\x01'"$pattern"$'\x01'"$replacement"$'\x01'"g"$'\n'
+  done < <(redact_rules_list)
+  if [ -z "$script" ]; then
+    cat
+    return
+  fi
+  sed -u -E "$script"
+}
+
+# Apply the configured rules to every string of a JSON file, in place
+redact_json() {
+  local file="$1"
+  redact_rules_enabled || return 0
+  local rules=$(redact_rules_list | jq -R 'if test(" => ") then {re: sub(" => .*$"; ""), with: sub("^.*? => "; "")}
+    else {re: ., with: "[REDACTED]"} end' | jq -s .)
+  jq --argjson rules "$rules" \
+    'walk(if type == "string" then reduce $rules[] as $rule (.; gsub($rule.re; $rule.with; "g")) else . end)' \
+    "$file" > "$file.redacted" && mv "$file.redacted" "$file"
+}
+
+# Rewrite credential-bearing URLs in a mirror's config, FETCH_HEAD and
+# packed-refs to clean URLs; prints the files that had to be cleaned
+scrub_mirror_credentials() {
+  local mirror_dir="$1"
+  local file
+  for file in config FETCH_HEAD packed-refs; do
+    if [ ! -f "$mirror_dir/$file" ]; then
+      continue
+    fi
+    if grep -qE '[a-z]+://[^/@[:space:]]+@' "$mirror_dir/$file" ||
+      { [ -n "$GITHUB_TOKEN" ] && grep -qF "$GITHUB_TOKEN" "$mirror_dir/$file"; }; then
+      redact_credentials < "$mirror_dir/$file" | sed -E 's#([a-z]+://)\*\*\*@#\1#g; s#\*\*\*##g' > "$mirror_dir/$file.scrubbed" &&
+        mv "$mirror_dir/$file.scrubbed" "$mirror_dir/$file"
+      echo "$file"
+    fi
+  done
+}
@@ -0,0 +1,126 @@
+#!/bin/bash
+# Per-repository settings. Lines in repos.txt are "<url> [key=value ...]", e.g.
+#   https://github.com/username/huge-repo.git frequency=weekly:sun
+
+source "$(dirname "${BASH_SOURCE[0]}")/api.sh"
+
+# The repository list (BACKUP_CONFIG_YAML's repositories point it elsewhere)
+REPOS_FILE="${REPOS_FILE:-repos.txt}"
+# Let repositories tailor their own backup with a .backup.yml file. Off by
+# default: anyone who can push to a source repository could opt it out
+REPO_SELF_CONFIG="${REPO_SELF_CONFIG:-false}"
+
+# The URL part of a repos.txt line
+repo_line_url() {
+  local url rest
+  read -r url rest <<<"$1"
+  echo "$url"
+}
+
+# Name a repository is stored and reported under: its name= option, or the
+# last segment of its URL (the directory, for a working copy's .git);
+# <org>-org-settings for an organization's settings
+repo_display_name() {
+  local url=$(repo_line_url "$1")
+  url="${url%/}"
+  if [[ "$url" == org-settings:* ]]; then
+    repo_option "$1" name "${url#org-settings:}-org-settings"
+    return
+  fi
+  repo_option "$1" name "$(basename "${url%/.git}" .git)"
+}
+
+# Print "<name>: <urls>" for every name that is invalid or shared by several
+# repos.txt lines, which would overwrite each other's archives: repo_name_conflicts <line>...
+repo_name_conflicts() {
+  local line
+  for line in "$@"; do
+    printf '%s\t%s\n' "$(repo_display_name "$line")" "$(repo_line_url "$line")"
+  done | awk -F'\t' '
+    $1 !~ /^[A-Za-z0-9._-]+$/ || $1 ~ /^\./ { print $1 ": invalid name (" $2 ")" }
+    { urls[$1] = urls[$1] ? urls[$1] ", " $2 : $2; count[$1]++ }
+    END { for (name in count) if (count[name] > 1) print name ": used by " urls[name] }'
+}
+
+# Owner (organization or user) of a repository, from the path segment before its name
+repo_owner() {
+  local url="${1%/}"
+  basename "$(dirname "${url#*://}")"
+}
+
+# Value of an option on a repos.txt line: repo_option <line> <key> [default]
+repo_option() {
+  local line="$1"
+  local key="$2"
+  local default="$3"
+  local words word
+  read -ra words <<<"$line"
+  for word in "${words[@]:1}"; do
+    if [[ "$word" == "$key="* ]]; then
+      echo "${word#*=}"
+      return
+    fi
+  done
+  echo "$default"
+}
+
+# Options a repository sets for itself in .backup.yml on its default branch,
+# fetched through the GitHub or Gitea API, as "key=value" words. Only flat
+# "backup: false", "wiki: true", "lfs: false" and "frequency: weekly" lines
+# are honored.
+repo_self_options() {
+  local repo_url="$1"
+  local repo_api=$(git_repo_api "$repo_url")
+  if [ -z "$repo_api" ]; then
+    return 0
+  fi
+
+  local file_url="$repo_api/contents/.backup.yml"
+  if [ "$(git_url_type "$repo_url")" = "gitea" ]; then
+    file_url="$repo_api/raw/.backup.yml"
+  fi
+  api_get "$file_url" -H "Accept: application/vnd.github.raw" 2>/dev/null |
+    sed -nE 's/^(backup|wiki|lfs|frequency):[[:space:]]*"?([A-Za-z0-9:_-]+)"?[[:space:]]*(#.*)?$/\1=\2/p' |
+    tr '\n' ' '
+}
+
+# Whether a frequency option is one repo_is_due understands
+repo_frequency_valid() {
+  [[ "$1" =~ ^(daily|weekly(:(sun|mon|tue|wed|thu|fri|sat))?|monthly(:([1-9]|1[0-9]|2[0-8]))?)$ ]]
+}
+
+# Whether a repository should be backed up on the run's day given its frequency:
+#   daily (default), weekly[:mon..sun], monthly[:1..28]
+# Weekly repos without a day are spread across the week by name. A repo that
+# missed its slot (no success within the period) is always due.
+repo_is_due() {
+  local repo_name="$1"
+  local frequency="${2:-daily}"
+  if ! repo_frequency_valid "$frequency"; then
+    echo "⚠️ Unknown frequency '$frequency' for $repo_name, backing up daily"
+    return 0
+  fi
+  local last_success=$(state_get '.repos[$repo].last_success // 0' --arg repo "$repo_name")
+  local since_success=$(( RUN_EPOCH - last_success ))
+  local days=(sun mon tue wed thu fri sat)
+
+  case "$frequency" in
+    daily)
+      return 0
+      ;;
+    weekly*)
+      local day="${frequency#weekly}"
+      day="${day#:}"
+      if [ -z "$day" ]; then
+        day=${days[$(( $(cksum <<<"$repo_name" | cut -d' ' -f1) % 7 ))]}
+      fi
+      # The day by number (0 is Sunday), as day names depend on the locale
+      [ "${days[$(run_date +%w)]}" = "$day" ] || [ $since_success -ge $((7 * 86400)) ]
+      ;;
+    monthly*)
+      local day_of_month="${frequency#monthly}"
+      day_of_month="${day_of_month#:}"
+      [ "$(run_date +%-d)" -eq "${day_of_month:-1}" ] || [ $since_success -ge $((31 * 86400)) ]
+      ;;
+  esac
+}
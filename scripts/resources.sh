@@ -0,0 +1,130 @@
+#!/bin/bash
+# Resources a run uses, for sizing the runner from data instead of guesses:
+# CPU time, peak memory of the run's processes, scratch disk taken from the
+# filesystem of the temporary directory, and network traffic, for the run and
+# each repository. Memory and disk are sampled every RESOURCE_SAMPLE_SECONDS
+# by a background process, so peaks shorter than that can be missed, and a
+# repository finishing between two samples has none. CPU time is what the
+# run's shell and its finished child processes used. Network bytes are the
+# interface counters of /proc/net/dev, so they include any other traffic of
+# the machine (or container).
+
+# Record resource usage in the results, summary and metrics
+RESOURCE_USAGE="${RESOURCE_USAGE:-true}"
+# Seconds between memory and disk samples
+RESOURCE_SAMPLE_SECONDS="${RESOURCE_SAMPLE_SECONDS:-5}"
+RESOURCE_STATE_DIR="${RESOURCE_STATE_DIR:-${TMPDIR:-/tmp}/backup-resources-$$}"
+
+# CPU seconds used so far by this shell and its finished children; "times"
+# must run in this shell, a subshell would only report its own
+resources_cpu_seconds() {
+  times > "$RESOURCE_STATE_DIR/times"
+  awk '{ for (i = 1; i <= NF; i++) { split($i, part, "m"); total += part[1] * 60 + part[2] } }
+    END { printf "%.2f\n", total }' "$RESOURCE_STATE_DIR/times"
+}
+
+# Bytes received and sent on all interfaces but loopback, as "<received> <sent>"
+resources_network_bytes() {
+  if [ ! -r /proc/net/dev ]; then
+    echo "0 0"
+    return
+  fi
+  awk -F'[: ]+' 'NR > 2 { sub(/^ +/, ""); if ($1 != "lo") { received += $2; sent += $10 } }
+    END { printf "%d %d\n", received, sent }' /proc/net/dev
+}
+
+# Free KB on the filesystem of the temporary directory
+resources_free_kb() {
+  df -Pk "${TMPDIR:-/tmp}" 2>/dev/null | awk 'NR == 2 { print $4 }'
+}
+
+# Resident memory in KB of a process and all its descendants, leaving out
+# the sampler's own: resources_tree_rss <pid> <sampler pid>
+resources_tree_rss() {
+  ps -eo pid=,ppid=,rss= 2>/dev/null | awk -v root="$1" -v skip="$2" '
+    { parent[$1] = $2; rss[$1] = $3 }
+    END {
+      for (pid in parent) {
+        ancestor = pid
+        while (ancestor != root && ancestor != skip && ancestor in parent && ancestor > 1) ancestor = parent[ancestor]
+        if (ancestor == root) total += rss[pid]
+      }
+      print total + 0
+    }'
+}
+
+# Append "<epoch> <rss KB> <scratch disk KB>" samples until the run exits:
+# resources_sample_loop <run pid> <free KB at the start>
+resources_sample_loop() {
+  local run_pid="$1"
+  local start_free="$2"
+  local free
+  while kill -0 "$run_pid" 2>/dev/null; do
+    free=$(resources_free_kb)
+    echo "$(date +%s) $(resources_tree_rss "$run_pid" "$BASHPID") $((start_free - ${free:-$start_free}))" \
+      >> "$RESOURCE_STATE_DIR/samples"
+    sleep "$RESOURCE_SAMPLE_SECONDS"
+  done
+}
+
+# Start measuring the run
+resources_start() {
+  [ "$RESOURCE_USAGE" = "true" ] || return 0
+  mkdir -p "$RESOURCE_STATE_DIR" || return 0
+  : > "$RESOURCE_STATE_DIR/samples"
+  resources_mark RESOURCE_START
+  resources_sample_loop $$ "$(resources_free_kb)" >/dev/null 2>&1 &
+  RESOURCE_SAMPLER_PID=$!
+}
+
+# Stop sampling; the figures stay readable until the run exits
+resources_stop() {
+  if [ -n "$RESOURCE_SAMPLER_PID" ]; then
+    kill "$RESOURCE_SAMPLER_PID" 2>/dev/null
+    wait "$RESOURCE_SAMPLER_PID" 2>/dev/null
+    RESOURCE_SAMPLER_PID=""
+  fi
+  resources_mark RESOURCE_END
+}
+
+# Set a variable to where the counters stand, "<epoch> <cpu seconds>
+# <received> <sent>", or to nothing when not measuring. Not to be called in
+# $(...), whose subshell has CPU times of its own: resources_mark <variable>
+resources_mark() {
+  printf -v "$1" '%s' ""
+  [ -d "$RESOURCE_STATE_DIR" ] || return 0
+  resources_cpu_seconds > "$RESOURCE_STATE_DIR/cpu"
+  printf -v "$1" '%s %s %s' "$(date +%s)" "$(< "$RESOURCE_STATE_DIR/cpu")" "$(resources_network_bytes)"
+}
+
+# Usage between two marks, as JSON; peaks are null without samples in
+# between: resources_between <mark> <mark>
+resources_between() {
+  local from="$1"
+  local to="$2"
+  if [ -z "$from" ] || [ -z "$to" ]; then
+    echo '{}'
+    return
+  fi
+  local from_epoch from_cpu from_received from_sent to_epoch to_cpu to_received to_sent
+  read -r from_epoch from_cpu from_received from_sent <<<"$from"
+  read -r to_epoch to_cpu to_received to_sent <<<"$to"
+  local peaks=$(awk -v from="$from_epoch" -v to="$to_epoch" '
+    $1 >= from && $1 <= to { count++; if ($2 > rss) rss = $2; if ($3 > disk) disk = $3 }
+    END { if (count) printf "%d %d\n", rss * 1024, (disk > 0 ? disk : 0) * 1024; else print "null null" }' "$RESOURCE_STATE_DIR/samples")
+  jq -cn --argjson cpu "$(awk -v a="$from_cpu" -v b="$to_cpu" 'BEGIN { printf "%.2f", b - a }')" \
+    --argjson received "$((to_received - from_received))" --argjson sent "$((to_sent - from_sent))" \
+    --argjson rss "${peaks% *}" --argjson disk "${peaks#* }" \
+    '{cpu_seconds: $cpu, peak_rss_bytes: $rss, scratch_disk_bytes: $disk,
+      network_received_bytes: $received, network_sent_bytes: $sent} | with_entries(select(.value != null))'
+}
+
+# The run's usage so far, as JSON ({} when not measured)
+resources_stats() {
+  if [ -z "$RESOURCE_START" ]; then
+    echo '{}'
+    return
+  fi
+  resources_between "$RESOURCE_START" "$RESOURCE_END" |
+    jq -c --argjson samples "$(wc -l < "$RESOURCE_STATE_DIR/samples")" '. + {samples: $samples}'
+}
@@ -0,0 +1,253 @@
+#!/bin/bash
+# Per-repository results and run metadata, written to backup-results.json
+
+source "$(dirname "${BASH_SOURCE[0]}")/storage.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/redact.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/clock.sh"
+
+RESULTS_FILE="${RESULTS_FILE:-backup-results.json}"
+# SHA-256 of each archive the run stored, in sha256sum's format
+CHECKSUMS_FILE="${CHECKSUMS_FILE:-checksums.txt}"
+# Layout version of RESULTS_FILE, see schemas/backup-results.schema.json
+RESULTS_SCHEMA_VERSION=2
+# Statuses of a repository's result: backed up (fully, without its auxiliary
+# exports, or unchanged and sharing its last archive), failed, stopped by the
+# run's deadline or cancellation or its clone timeout, or left out
+# (quarantined, opted out, not due)
+RESULT_STATUSES="success partial skipped-unchanged failed timed-out quarantined skipped-filtered"
+TOOL_VERSION="${TOOL_VERSION:-$(git -C "$(dirname "${BASH_SOURCE[0]}")" describe --always --dirty 2>/dev/null || echo "unknown")}"
+
+# jq helpers rendering byte counts ("1.5 MB") and seconds ("2h 5m") for people,
+# shared by every report built from results
+RESULTS_JQ_DEFS='
+  def size_human: [., 0] | until(.[0] < 1024 or .[1] == 4; [.[0] / 1024, .[1] + 1])
+    | "\(.[0] * 10 | round / 10) \(["B", "KB", "MB", "GB", "TB"][.[1]])";
+  def duration_human: floor | if . >= 86400 then "\(. / 86400 | floor)d \(. % 86400 / 3600 | floor)h"
+    elif . >= 3600 then "\(. / 3600 | floor)h \(. % 3600 / 60 | floor)m"
+    elif . >= 60 then "\(. / 60 | floor)m \(. % 60)s"
+    else "\(.)s" end;
+  def resources_human: [
+    "CPU \(.cpu_seconds | duration_human)",
+    (.peak_rss_bytes | numbers | "peak memory \(size_human)"),
+    (.scratch_disk_bytes | numbers | "scratch disk \(size_human)"),
+    "network \(.network_received_bytes | size_human) in, \(.network_sent_bytes | size_human) out"
+  ] | join(", ");
+  def backed_up: IN("success", "partial", "skipped-unchanged");
+  # Left out before its backup started: quarantined, filtered, or not started in time
+  def left_out: .skip_reason != null;
+'
+
+# Start a new run's result records
+results_init() {
+  RESULTS_RECORDS=$(mktemp)
+  RUN_STARTED_AT=$(run_date -u '+%Y-%m-%dT%H:%M:%SZ')
+}
+
+# Start collecting fields for one repository's result
+result_begin() {
+  RESULT_FIELDS='{}'
+}
+
+# Attach a string field to the current repository's result
+result_set() {
+  [ -n "$RESULT_FIELDS" ] || result_begin
+  RESULT_FIELDS=$(jq -c --arg key "$1" --arg value "$2" '.[$key] = $value' <<<"$RESULT_FIELDS")
+}
+
+# Attach a JSON field (number, boolean, object) to the current repository's result
+result_set_json() {
+  [ -n "$RESULT_FIELDS" ] || result_begin
+  RESULT_FIELDS=$(jq -c --arg key "$1" --argjson value "$2" '.[$key] = $value' <<<"$RESULT_FIELDS")
+}
+
+# Merge a JSON object of fields into the current repository's result
+result_merge() {
+  [ -n "$RESULT_FIELDS" ] || result_begin
+  RESULT_FIELDS=$(jq -c --argjson fields "$1" '. + $fields' <<<"$RESULT_FIELDS")
+}
+
+# Account time spent uploading to a destination, and the bytes uploaded, to the
+# current repository's result: result_add_upload <destination> <bytes> <started, from date +%s.%N>
+result_add_upload() {
+  local seconds=$(awk -v started="$3" -v now="$(date +%s.%N)" 'BEGIN { printf "%.3f", now - started }')
+  [ -n "$RESULT_FIELDS" ] || result_begin
+  RESULT_FIELDS=$(jq -c --arg destination "$1" --argjson bytes "$2" --argjson seconds "$seconds" '
+    .uploads[$destination] |= {
+      uploaded_bytes: ((.uploaded_bytes // 0) + $bytes),
+      upload_seconds: (((.upload_seconds // 0) + $seconds) * 1000 | round / 1000)
+    }' <<<"$RESULT_FIELDS")
+}
+
+# Append the current repository's result to the run: result_record <name> <url> <status>
+# Records are appended under a lock, so concurrent workers can share one run.
+result_record() {
+  if [[ " $RESULT_STATUSES " != *" $3 "* ]]; then
+    echo "❌ Unknown result status: $3" >&2
+    return 1
+  fi
+  local record=$(jq -c --arg name "$1" --arg url "$2" --arg status "$3" --arg finished_at "$(clock_date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    '{name: $name, url: $url, status: $status} + . + {finished_at: $finished_at}' <<<"$RESULT_FIELDS")
+  (
+    flock 9
+    echo "$record" >> "$RESULTS_RECORDS"
+  ) 9>"$RESULTS_RECORDS.lock"
+}
+
+# Totals over the results recorded so far: counts per status, archived bytes,
+# duration percentiles, clone and upload time (per destination) and the names
+# per status, as JSON
+results_aggregate() {
+  (
+    flock -s 9
+    jq -s "$RESULTS_JQ_DEFS"'
+      def percentile(p): sort | if length == 0 then 0 else .[([(length * p / 100 | ceil) - 1, 0] | max)] end;
+      def count(s): map(select(.status == s)) | length;
+      map(select(left_out | not) | .duration_seconds // empty) as $durations | {
+        total: length,
+        succeeded: count("success"),
+        partial: count("partial"),
+        skipped_unchanged: count("skipped-unchanged"),
+        failed: count("failed"),
+        timed_out: count("timed-out"),
+        quarantined: count("quarantined"),
+        skipped_filtered: count("skipped-filtered"),
+        skipped: map(select(left_out)) | length,
+        size_bytes: (map(.size_bytes // 0) | add // 0),
+        duration_seconds: {
+          p50: ($durations | percentile(50)),
+          p90: ($durations | percentile(90)),
+          p99: ($durations | percentile(99)),
+          max: ($durations | max // 0)
+        },
+        clone_seconds: (map(.clone_seconds // 0) | add // 0),
+        destinations: (map(.uploads // {} | to_entries[]) | group_by(.key) | map({
+          key: .[0].key,
+          value: {
+            uploads: length,
+            uploaded_bytes: (map(.value.uploaded_bytes) | add),
+            upload_seconds: (map(.value.upload_seconds) | add * 1000 | round / 1000)
+          }
+        }) | from_entries),
+        names: {
+          backed_up: map(select(.status | backed_up) | .name),
+          failed: map(select((left_out | not) and (.status | IN("failed", "timed-out"))) | .name),
+          skipped: map(select(left_out) | .name)
+        }
+      }' "$RESULTS_RECORDS"
+  ) 9>"$RESULTS_RECORDS.lock"
+}
+
+# One line of progress over the results so far: results_progress <expected total>
+results_progress() {
+  results_aggregate | jq -r --argjson expected "$1" "$RESULTS_JQ_DEFS"'
+    "📈 \(.total)/\($expected) done: \(.names.backed_up | length) backed up, \(.names.failed | length) failed, \(.skipped) skipped, \(.size_bytes | size_human) archived, p50 \(.duration_seconds.p50 | duration_human)"'
+}
+
+# Where the run was started from: cron, manual, webhook or another Actions event
+detect_trigger() {
+  if [ -n "$BACKUP_TRIGGER" ]; then
+    echo "$BACKUP_TRIGGER"
+    return
+  fi
+  case "${GITHUB_EVENT_NAME:-}" in
+    schedule) echo "cron" ;;
+    workflow_dispatch|"") echo "manual" ;;
+    repository_dispatch) echo "webhook" ;;
+    *) echo "$GITHUB_EVENT_NAME" ;;
+  esac
+}
+
+# Describe the machine and environment the run executed on
+run_metadata() {
+  jq -n \
+    --arg host "$(hostname)" \
+    --arg git_version "$(git --version | awk '{print $3}')" \
+    --arg tool_version "$TOOL_VERSION" \
+    --arg trigger "$(detect_trigger)" \
+    --arg environment "$([ "$GITHUB_ACTIONS" = "true" ] && echo "github-actions" || echo "local")" \
+    --arg run_id "${GITHUB_RUN_ID:-}" \
+    --arg run_uuid "$RUN_UUID" \
+    --arg repository "${GITHUB_REPOSITORY:-}" \
+    --arg started_at "$RUN_STARTED_AT" \
+    --arg finished_at "$(clock_date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    --argjson predicted_seconds "${PREDICTED_SECONDS:-0}" \
+    --argjson api "$(declare -F api_stats >/dev/null && api_stats || echo '{}')" \
+    --argjson resources "$(declare -F resources_stats >/dev/null && resources_stats || echo '{}')" \
+    '{host: $host, git_version: $git_version, tool_version: $tool_version,
+      trigger: $trigger, environment: $environment, run_id: $run_id, run_uuid: $run_uuid,
+      repository: $repository, started_at: $started_at, finished_at: $finished_at,
+      predicted_seconds: $predicted_seconds, api: $api}
+      + if $resources == {} then {} else {resources: $resources} end'
+}
+
+# Combine metadata, totals and per-repository records into RESULTS_FILE
+write_results() {
+  jq -s --argjson version "$RESULTS_SCHEMA_VERSION" --argjson run "$(run_metadata)" \
+    --argjson aggregate "$(results_aggregate)" "$RESULTS_JQ_DEFS"'
+  # Human readable companions of every byte and second count
+  def humanize: with_entries(
+    if (.key | endswith("_bytes")) and (.value | type) == "number" then
+      ., {key: (.key | sub("_bytes$"; "_human")), value: (.value | size_human)}
+    elif .key == "duration_seconds" and (.value | type) == "number" then ., {key: "duration_human", value: (.value | duration_human)}
+    else . end);
+  map(humanize) | {
+    schema_version: $version,
+    run: ($run | .duration_seconds = ((.finished_at | fromdate) - (.started_at | fromdate)) | humanize),
+    totals: ($aggregate | del(.names) | humanize),
+    repositories: .
+  }' "$RESULTS_RECORDS" > "$RESULTS_FILE"
+  redact_json "$RESULTS_FILE"
+}
+
+# Write CHECKSUMS_FILE from RESULTS_FILE: one "<sha256>  <archive>" line per
+# archive stored by the run (not those shared with an earlier backup), so
+# "sha256sum -c" run where the archives are checks them
+write_checksums() {
+  jq -r '.repositories[] | select(.sha256 != null and .dedup_of == null) | "\(.sha256)  \(.archive)"' \
+    "$RESULTS_FILE" > "$CHECKSUMS_FILE"
+}
+
+# Keep the results with the archives as results/<YYYYMMDD_HHMMSS>.json, for
+# comparing runs later (diff-runs), and the checksums as checksums/<YYYYMMDD_HHMMSS>.txt
+store_results() {
+  local destination
+  local run="${DATE_PREFIX:-$(run_date +%Y%m%d_%H%M%S)}"
+  for destination in $BACKUP_DESTINATIONS; do
+    if ! storage_put "$destination" "$RESULTS_FILE" "results/$run.json"; then
+      echo "⚠️ Failed to store results ($destination)"
+    fi
+    if [ -s "$CHECKSUMS_FILE" ] && ! storage_put "$destination" "$CHECKSUMS_FILE" "checksums/$run.txt"; then
+      echo "⚠️ Failed to store checksums ($destination)"
+    fi
+  done
+}
+
+# Print a results file upgraded to the current schema version, so readers
+# only ever deal with one layout
+read_results() {
+  jq '
+    if (.schema_version // 0) == 0 then
+      {schema_version: 1, run: (.run // {}), totals: (.totals // {}), repositories: (.repositories // [])}
+    else . end |
+    # Version 1 had one "skipped" status, with the reason in skip_reason, and
+    # counted backups stopped by the deadline as failed
+    if .schema_version == 1 then
+      .schema_version = 2 |
+      .repositories |= map(
+        if .status == "skipped" then
+          .skip_reason //= "not_due" |
+          .status = ({cancelled: "timed-out", quarantined: "quarantined"}[.skip_reason] // "skipped-filtered")
+        elif .status == "failed" and .error_class == "cancelled" then .status = "timed-out"
+        elif .status == "success" and .dedup_of != null then .status = "skipped-unchanged"
+        else . end) |
+      .totals += (.repositories | {
+        succeeded: map(select(.status == "success")) | length,
+        skipped_unchanged: map(select(.status == "skipped-unchanged")) | length,
+        failed: map(select(.status == "failed")) | length,
+        timed_out: map(select(.status == "timed-out")) | length,
+        quarantined: map(select(.status == "quarantined")) | length,
+        skipped_filtered: map(select(.status == "skipped-filtered")) | length
+      })
+    else . end
+  ' "$1"
+}
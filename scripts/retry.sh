@@ -0,0 +1,106 @@
+#!/bin/bash
+# Signed one-time retry links for failure notifications. A link carries the
+# repositories to retry, an expiry and a nonce, signed with RETRY_SECRET.
+# The daemon's HTTP endpoint redeems them by running a backup of just those
+# repositories (see daemon.sh); without a daemon, "backup.sh retry <link>"
+# starts the workflow through a repository_dispatch event instead.
+
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/api.sh"
+
+# Endpoint that redeems links (it runs "backup.sh retry <link>"); links are only added when set
+RETRY_URL="${RETRY_URL:-}"
+RETRY_SECRET="${RETRY_SECRET:-}"
+RETRY_LINK_TTL_HOURS="${RETRY_LINK_TTL_HOURS:-24}"
+
+# HMAC-SHA256 (hex) of a payload under RETRY_SECRET. HKDF-Extract is that HMAC
+# with the secret as its salt, read from a file descriptor so it stays out of
+# the process list; the HMAC commands only take keys on the command line.
+retry_signature() {
+  openssl pkeyutl -kdf HKDF -kdflen 32 -pkeyopt md:SHA256 -pkeyopt mode:EXTRACT_ONLY \
+    -pkeyopt_passin salt:fd:3 -pkeyopt "key:$1" 3<<<"$RETRY_SECRET" </dev/null 2>/dev/null |
+    od -An -v -tx1 | tr -d ' \n'
+}
+
+# Whether notifications can carry retry links
+retry_enabled() {
+  [ -n "$RETRY_URL" ] && [ -n "$RETRY_SECRET" ]
+}
+
+# Link retrying the given repositories: retry_link "<repo>, <repo>..."
+retry_link() {
+  local repos=$(sed 's/, */,/g' <<<"$1")
+  local expires=$(( $(date +%s) + RETRY_LINK_TTL_HOURS * 3600 ))
+  local payload="repos=$repos&expires=$expires&nonce=$(openssl rand -hex 12)"
+  echo "$RETRY_URL?$payload&sig=$(retry_signature "$payload")"
+}
+
+# Check a link's (or its query string's) signature and expiry and print its
+# repositories, without using it up: retry_check <link>
+retry_check() {
+  local query="${1#*\?}"
+  local payload="${query%&sig=*}"
+  local signature="${query##*&sig=}"
+  if [ -z "$RETRY_SECRET" ] || [ "$payload" = "$query" ] || [ "$(retry_signature "$payload")" != "$signature" ]; then
+    echo "❌ Invalid retry link" >&2
+    return 1
+  fi
+  local expires=$(sed -nE 's/.*&expires=([0-9]+)&.*/\1/p' <<<"$payload")
+  if [ "$(date +%s)" -gt "${expires:-0}" ]; then
+    echo "❌ Retry link expired" >&2
+    return 1
+  fi
+  sed -nE 's/^repos=([^&]*)&.*/\1/p' <<<"$payload"
+}
+
+# Check a link and print its repositories, using up its nonce so it works only
+# once: retry_verify <link>. The state is always fetched fresh and saved right
+# after the nonce is recorded, so a stale local copy can't roll it back.
+retry_verify() {
+  local repos
+  repos=$(retry_check "$1") || return 1
+  local query="${1#*\?}"
+  local payload="${query%&sig=*}"
+  local expires=$(sed -nE 's/.*&expires=([0-9]+)&.*/\1/p' <<<"$payload")
+  local nonce=$(sed -nE 's/.*&nonce=([0-9a-f]+)$/\1/p' <<<"$payload")
+
+  state_load
+  if [ "$(state_get '.retry_nonces // {} | has($nonce)' --arg nonce "$nonce")" = "true" ]; then
+    echo "❌ Retry link already used" >&2
+    return 1
+  fi
+  state_update --arg nonce "$nonce" --argjson expires "$expires" --argjson now "$(date +%s)" \
+    '.retry_nonces = ((.retry_nonces // {}) + {($nonce): $expires} | with_entries(select(.value >= $now)))'
+  if ! storage_put "$(primary_destination)" "$STATE_FILE" "$STATE_BLOB"; then
+    echo "❌ Failed to record the retry link as used" >&2
+    return 1
+  fi
+  echo "$repos"
+}
+
+# Redeem a link: start a backup of its repositories in GITHUB_REPOSITORY
+retry_redeem() {
+  local repos
+  repos=$(retry_verify "$1") || return 1
+  if ! api_request POST "https://api.github.com/repos/$GITHUB_REPOSITORY/dispatches" \
+    -H "Accept: application/vnd.github+json" \
+    -d "$(jq -n --arg repos "$repos" '{event_type: "retry-backup", client_payload: {repos: $repos}}')" >/dev/null; then
+    echo "❌ Failed to start retry for: $repos"
+    return 1
+  fi
+  echo "🔁 Retry started for: $repos"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  case "$1" in
+    # For the daemon: print the repositories of a link, or check it only
+    --verify) retry_verify "$2" ;;
+    --check) retry_check "$2" ;;
+    "")
+      echo "❌ Usage: $0 <retry link>"
+      exit 1
+      ;;
+    *) retry_redeem "$1" ;;
+  esac
+fi
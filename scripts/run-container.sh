@@ -0,0 +1,43 @@
+#!/bin/bash
+# Container entry point, used by the Kubernetes CronJob from generate-k8s.sh:
+# runs a backup like run-workflow.sh, with the tools already in the image and
+# repos.txt (or tenants/) copied from the mounted configuration. With
+# "daemon [options]" as arguments it keeps running and backs up on a schedule
+# instead (see daemon.sh), for a Deployment or a plain docker run.
+
+# Mounted configuration: repos.txt and other files the run reads
+BACKUP_CONFIG_DIR="${BACKUP_CONFIG_DIR:-/config}"
+# Writable directory the run works in
+BACKUP_WORK_DIR="${BACKUP_WORK_DIR:-${WORK_DIR:-/work}}"
+
+run_container() {
+  mkdir -p "$BACKUP_WORK_DIR" && cd "$BACKUP_WORK_DIR" || return 1
+  # Temporary files stay in the work volume too, so the root filesystem can be read-only
+  export WORK_DIR="$BACKUP_WORK_DIR"
+  # The glob skips the ..data links Kubernetes adds to ConfigMap and Secret volumes
+  local file
+  for file in "$BACKUP_CONFIG_DIR"/*; do
+    [ -e "$file" ] && cp -RL "$file" .
+  done
+  if [ ! -f "${REPOS_FILE:-repos.txt}" ] && [ ! -d "${TENANTS_DIR:-tenants}" ] &&
+    [ -z "$BACKUP_CONFIG_YAML" ] && [ -z "$BACKUP_CONFIG_FILE" ]; then
+    echo "❌ No repos.txt in $BACKUP_CONFIG_DIR, and no BACKUP_CONFIG_YAML or BACKUP_CONFIG_FILE"
+    return 1
+  fi
+
+  local scripts=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+  # exec, so docker stop's SIGTERM reaches the run rather than this shell
+  if [ "$1" = "daemon" ]; then
+    shift
+    exec "$scripts/daemon.sh" "$@"
+  elif [ -d "${TENANTS_DIR:-tenants}" ]; then
+    exec "$scripts/tenants.sh"
+  else
+    exec "$scripts/main.sh"
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  run_container "$@"
+fi
@@ -4,5 +4,9 @@
 # Run setup (EXACT COPY from original workflow)
 "$(dirname "$0")/setup.sh"
 
-# Run main backup (EXACT COPY from original workflow)
-"$(dirname "$0")/main.sh" 
\ No newline at end of file
+# Run main backup (EXACT COPY from original workflow), per tenant when configured
+if [ -d "${TENANTS_DIR:-tenants}" ]; then
+  "$(dirname "$0")/tenants.sh"
+else
+  "$(dirname "$0")/main.sh"
+fi 
\ No newline at end of file
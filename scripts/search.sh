@@ -0,0 +1,82 @@
+#!/bin/bash
+# Search file names (or file contents) inside stored archives, using the catalog
+# to find candidate archives
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+
+# backup_search <pattern> [--repo name] [--date YYYYMMDD] [--ref ref] [--contents]
+backup_search() {
+  local pattern=""
+  local repo=""
+  local date=""
+  local ref=""
+  local contents=false
+
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --repo) repo="$2"; shift 2 ;;
+      --date) date="$2"; shift 2 ;;
+      --ref) ref="$2"; shift 2 ;;
+      --contents) contents=true; shift ;;
+      -*) echo "❌ Unknown option: $1"; return 2 ;;
+      *) pattern="$1"; shift ;;
+    esac
+  done
+  if [ -z "$pattern" ]; then
+    echo "❌ Usage: search <pattern> [--repo name] [--date YYYYMMDD] [--ref ref] [--contents]"
+    return 2
+  fi
+
+  state_load
+  local work_dir=$(mktemp -d)
+  local searched=0
+  local matches=0
+  local entry archive repo_name git_dir refs search_ref found
+
+  declare -A opened
+  while IFS= read -r entry; do
+    # Deduplicated backups share the archive of an earlier one
+    archive=$(jq -r '.dedup_of // .archive' <<<"$entry")
+    if [ -n "${opened[$archive]}" ]; then
+      continue
+    fi
+    opened[$archive]=1
+    # Mirrors inside aliased archives still carry the old repository name
+    repo_name=$(jq -r '.alias_of // .repository' <<<"$entry")
+    if ! open_stored_archive "$(primary_destination)" "$archive" "$work_dir/extract" "$repo_name"; then
+      echo "⚠️ Could not open $archive" >&2
+      rm -rf "$work_dir/extract"
+      continue
+    fi
+    searched=$((searched + 1))
+    git_dir="$work_dir/extract/$repo_name"
+
+    # Without --ref, look at the tip of every branch and tag
+    if [ -n "$ref" ]; then
+      refs="$ref"
+    else
+      refs=$(git -C "$git_dir" for-each-ref --format='%(refname)' refs/heads refs/tags)
+    fi
+    for search_ref in $refs; do
+      if [ "$contents" = "true" ]; then
+        found=$(git -C "$git_dir" grep -n -E -e "$pattern" "$search_ref" -- 2>/dev/null)
+      else
+        found=$(git -C "$git_dir" ls-tree -r --name-only "$search_ref" 2>/dev/null | grep -E -e "$pattern" | sed "s#^#$search_ref:#")
+      fi
+      if [ -n "$found" ]; then
+        sed "s#^#$archive:#" <<<"$found"
+        matches=$((matches + $(wc -l <<<"$found")))
+      fi
+    done
+    rm -rf "$work_dir/extract"
+  done < <(catalog_entries "$repo" "$date")
+
+  rm -rf "$work_dir"
+  echo "🔍 $matches matches in $searched archives" >&2
+  [ $matches -gt 0 ]
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_search "$@"
+fi
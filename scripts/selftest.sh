@@ -0,0 +1,170 @@
+#!/bin/bash
+# End-to-end check of a deployment: back up a scratch repository with known
+# content through the real pipeline and destinations, check what was stored,
+# restore it from every destination, compare it with the source and clean up.
+
+source "$(dirname "${BASH_SOURCE[0]}")/backup-repo.sh"
+
+SELFTEST_REPO_NAME="${SELFTEST_REPO_NAME:-backup-selftest}"
+# A scratch repository has no history to share an archive with
+DEDUP_ARCHIVES=false
+
+SELFTEST_FAILURES=0
+
+# Report a step: selftest_step <description> <command...>
+selftest_step() {
+  local description="$1"
+  shift
+  if "$@"; then
+    echo "✅ $description"
+  else
+    echo "❌ $description"
+    SELFTEST_FAILURES=$((SELFTEST_FAILURES + 1))
+    return 1
+  fi
+}
+
+# Fill a repository with known content: two branches, a tag and a binary file
+selftest_seed() {
+  local work="$1"
+  git init -q "$work" &&
+    git -C "$work" config user.name "Backup Self-Test" &&
+    git -C "$work" config user.email "selftest@localhost" &&
+    echo "backup self-test" > "$work/README.md" &&
+    head -c 65536 /dev/urandom > "$work/data.bin" &&
+    git -C "$work" add -A && git -C "$work" commit -qm "Initial content" &&
+    git -C "$work" tag v1 &&
+    git -C "$work" checkout -qb feature &&
+    echo "feature" > "$work/feature.txt" &&
+    git -C "$work" add -A && git -C "$work" commit -qm "Feature branch"
+}
+
+# Create a private repository on github.com: selftest_create_remote <owner> <name>
+selftest_create_remote() {
+  local owner="$1"
+  local name="$2"
+  local endpoint="https://api.github.com/orgs/$owner/repos"
+  if [ "$(api_get "https://api.github.com/user" 2>/dev/null | jq -r '.login')" = "$owner" ]; then
+    endpoint="https://api.github.com/user/repos"
+  fi
+  api_request POST "$endpoint" -H "Accept: application/vnd.github+json" \
+    -d "$(jq -n --arg name "$name" '{name: $name, private: true, description: "Temporary repository of backup selftest"}')" >/dev/null
+}
+
+# Refs and the objects they point to, to compare source and restore
+selftest_refs() {
+  git -C "$1" for-each-ref --format='%(objectname) %(refname)' refs/heads refs/tags
+}
+
+# Restore the stored archive from a destination and compare it with the source:
+# selftest_restore <destination> <archive> <source git dir> <scratch dir>
+selftest_restore() {
+  local destination="$1"
+  local archive="$2"
+  local source_dir="$3"
+  local restore_dir="$4/restore-$destination"
+  open_stored_archive "$destination" "$archive" "$restore_dir" "$SELFTEST_REPO_NAME" &&
+    git -C "$restore_dir/$SELFTEST_REPO_NAME" fsck --full >/dev/null 2>&1 &&
+    [ "$(selftest_refs "$restore_dir/$SELFTEST_REPO_NAME")" = "$(selftest_refs "$source_dir")" ] &&
+    git clone -q "$restore_dir/$SELFTEST_REPO_NAME" "$restore_dir/checkout" 2>/dev/null &&
+    cmp -s "$restore_dir/checkout/data.bin" <(git -C "$source_dir" show feature:data.bin)
+}
+
+# Remove everything the backup stored on a destination: selftest_cleanup <destination> <archive>
+selftest_cleanup() {
+  local destination="$1"
+  local archive="$2"
+  local suffix=$(encryption_suffix_of "$archive")
+  local extension="${archive##*/}"
+  extension="${extension#*_"$SELFTEST_REPO_NAME".}"
+  # Manifests and latest/ copies only exist with some settings
+  if [ "$CONTENT_MANIFEST" = "true" ]; then
+    storage_delete "$destination" "${archive%"$suffix"}.manifest$suffix"
+  fi
+  if [ "$destination" = "local" ] || [ "$LATEST_COPY" = "true" ]; then
+    storage_delete "$destination" "latest/$SELFTEST_REPO_NAME.$extension"
+  fi
+  storage_delete "$destination" "$archive" &&
+    storage_delete "$destination" "latest/$SELFTEST_REPO_NAME.json"
+}
+
+# selftest [--github owner] [--keep]
+backup_selftest() {
+  local github_owner=""
+  local keep=false
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --github) github_owner="$2"; shift 2 ;;
+      --keep) keep=true; shift ;;
+      *) echo "❌ Usage: selftest [--github owner] [--keep]"; return 2 ;;
+    esac
+  done
+
+  local scratch=$(mktemp -d "${TMPDIR:-/tmp}/backup-selftest.XXXXXX")
+  local source_dir="$scratch/source.git"
+  local repo_url="file://$source_dir"
+  local remote_name="$SELFTEST_REPO_NAME-$(date +%Y%m%d%H%M%S)"
+  SELFTEST_FAILURES=0
+  echo "🔍 Self-test of destinations: $BACKUP_DESTINATIONS"
+
+  if ! selftest_step "Created scratch repository with known content" selftest_seed "$scratch/work"; then
+    rm -rf "$scratch"
+    return 1
+  fi
+  git clone -q --mirror "$scratch/work" "$source_dir"
+  if [ -n "$github_owner" ]; then
+    repo_url="https://github.com/$github_owner/$remote_name.git"
+    if ! selftest_step "Created $github_owner/$remote_name on GitHub" selftest_create_remote "$github_owner" "$remote_name" ||
+      ! selftest_step "Pushed content to $github_owner/$remote_name" \
+        git_with_token "$(git_host_token github.com)" -C "$source_dir" push -q --mirror "$repo_url"; then
+      rm -rf "$scratch"
+      return 1
+    fi
+  fi
+
+  # The real backup, as a run would do it, with the scratch repository allowed as a local source
+  local archive=""
+  DATE_PREFIX=$(run_date +%Y%m%d_%H%M%S)
+  result_begin
+  if LOCAL_SOURCE_DIRS="$scratch" backup_repo "$repo_url" "$repo_url name=$SELFTEST_REPO_NAME" > "$scratch/backup.log" 2>&1; then
+    echo "✅ Backed up through the pipeline"
+    archive=$(jq -r '.archive' <<<"$RESULT_FIELDS")
+  else
+    echo "❌ Backed up through the pipeline"
+    SELFTEST_FAILURES=$((SELFTEST_FAILURES + 1))
+    sed 's/^/    /' "$scratch/backup.log"
+  fi
+
+  local destination size
+  if [ -n "$archive" ]; then
+    size=$(jq -r '.size_bytes' <<<"$RESULT_FIELDS")
+    for destination in $BACKUP_DESTINATIONS; do
+      selftest_step "Stored $archive on $destination ($size bytes)" \
+        [ "$(storage_size "$destination" "$archive")" = "$size" ] &&
+        selftest_step "Restored from $destination and matched the source" \
+          selftest_restore "$destination" "$archive" "$source_dir" "$scratch"
+    done
+    if [ "$keep" = "false" ]; then
+      for destination in $BACKUP_DESTINATIONS; do
+        selftest_cleanup "$destination" "$archive" 2>/dev/null ||
+          echo "⚠️ Could not remove everything the self-test stored on $destination ($archive)"
+      done
+    fi
+  fi
+
+  if [ -n "$github_owner" ] && ! api_request DELETE "https://api.github.com/repos/$github_owner/$remote_name" >/dev/null 2>&1; then
+    echo "⚠️ Could not delete $github_owner/$remote_name (needs delete_repo), remove it by hand"
+  fi
+  rm -rf "$scratch"
+
+  if [ $SELFTEST_FAILURES -gt 0 ]; then
+    echo "❌ Self-test failed ($SELFTEST_FAILURES steps)"
+    return 1
+  fi
+  echo "🎉 Self-test passed"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_selftest "$@"
+fi
@@ -1,6 +1,53 @@
 #!/bin/bash
 # EXACT COPY of send_webhook function from original workflow
 
+source "$(dirname "${BASH_SOURCE[0]}")/messages.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/retry.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/drill.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/redact.sh"
+
+# Pending notifications are spooled per status and flushed as one combined
+# card. Each run has its own spool, removed when it exits (see main.sh), so
+# runs sharing a TMPDIR never send each other's notifications.
+WEBHOOK_SPOOL_DIR="${WEBHOOK_SPOOL_DIR:-${TMPDIR:-/tmp}/backup-webhooks-$$}"
+WEBHOOK_MIN_INTERVAL="${WEBHOOK_MIN_INTERVAL:-5}"
+# Send a card for each new repository failure while the run is still going
+NOTIFY_REALTIME_FAILURES="${NOTIFY_REALTIME_FAILURES:-false}"
+# Failures within this many seconds of the last real-time card are batched into the next one
+WEBHOOK_REALTIME_INTERVAL="${WEBHOOK_REALTIME_INTERVAL:-300}"
+# How failures are notified per repository tier (tier=<name> per repo), as
+# <tier>:<runs failed in a row>:<level>. Levels: page (a card right away),
+# failure (the end-of-run failure card) or warning (the end-of-run warning
+# card). Repositories without a tier, or with one not listed, are "standard".
+NOTIFY_TIERS="${NOTIFY_TIERS:-critical:1:page standard:1:failure archive:3:warning}"
+
+# Runs a repository of a tier must fail in a row before it is notified, and
+# how: notify_tier_rule <tier>, printing "<failures> <level>"
+notify_tier_rule() {
+  local tier="$1"
+  local entry
+  for entry in $NOTIFY_TIERS; do
+    if [ "${entry%%:*}" = "$tier" ]; then
+      entry="${entry#*:}"
+      echo "${entry%%:*} ${entry#*:}"
+      return
+    fi
+  done
+  if [ "$tier" = "standard" ]; then
+    echo "1 failure"
+  else
+    notify_tier_rule standard
+  fi
+}
+
+# Malformed NOTIFY_TIERS entries, one per line
+notify_tiers_problems() {
+  local entry
+  for entry in $NOTIFY_TIERS; do
+    [[ "$entry" =~ ^[A-Za-z0-9_-]+:[1-9][0-9]*:(page|failure|warning)$ ]] || echo "$entry"
+  done
+}
+
 send_webhook() {
   if [ -z "$WEBHOOK_URL" ]; then
     return 0
@@ -9,98 +56,198 @@ send_webhook() {
   local success="$1"
   local message="$2"
   local successful_repos="$3"
-  local color=$([ "$success" = "true" ] && echo "00FF00" || echo "FF0000")
-  local status=$([ "$success" = "true" ] && echo "✅ Success" || echo "❌ Failed")
+  local retry_repos="${4:-}"
+  local color status
+  case "$success" in
+    true) color="00FF00"; status=$(msg status_success) ;;
+    warning) color="FFA500"; status=$(msg status_warning) ;;
+    *) color="FF0000"; status=$(msg status_failure) ;;
+  esac
   local workflow_url="https://github.com/${GITHUB_REPOSITORY:-unknown}/actions/runs/${GITHUB_RUN_ID:-}"
+  local title=$(msg title)
+  local summary=$(msg card_summary "$status")
+  if drill_active; then
+    title="$(msg drill_prefix)$title"
+    summary="$(msg drill_prefix)$summary"
+  fi
   
-  # Create adaptive card format for Teams/Power Automate
-  local payload=$(cat <<EOF
-{
-  "@type": "MessageCard",
-  "@context": "http://schema.org/extensions",
-  "themeColor": "$color",
-  "summary": "Repository Backup $status",
-  "sections": [{
-    "activityTitle": "GitHub Repository Backup",
-    "activitySubtitle": "$(date -u '+%Y-%m-%d %H:%M:%S UTC')",
-    "activityImage": "https://github.githubassets.com/images/modules/logos_page/GitHub-Mark.png",
-    "facts": [
-      {
-        "name": "Status",
-        "value": "$status"
-      },
-      {
-        "name": "Result",
-        "value": "$message"
-      },
-      {
-        "name": "Successful Repositories",
-        "value": "$successful_repos"
-      },
-      {
-        "name": "Workflow",
-        "value": "repository-backup"
-      },
-      {
-        "name": "Run ID",
-        "value": "${GITHUB_RUN_ID:-N/A}"
-      }
-    ],
-    "markdown": true
-  }],
-  "potentialAction": [{
-    "@type": "OpenUri",
-    "name": "View Workflow Run",
-    "targets": [{
-      "os": "default",
-      "uri": "$workflow_url"
-    }]
-  }],
-  "attachments": [{
-    "contentType": "application/vnd.microsoft.card.adaptive",
-    "content": {
-      "type": "AdaptiveCard",
-      "version": "1.0",
-      "body": [
-        {
-          "type": "TextBlock",
-          "size": "Medium",
-          "weight": "Bolder",
-          "text": "Repository Backup $status"
-        },
-        {
-          "type": "TextBlock",
-          "text": "$message",
-          "wrap": true
-        },
-        {
-          "type": "TextBlock",
-          "text": "**Successful Repositories:** $successful_repos",
-          "wrap": true
-        },
-        {
-          "type": "TextBlock",
-          "text": "[View Workflow Run]($workflow_url)",
-          "wrap": true
+  # One-time link that re-runs the backup for the failed repositories
+  local retry_url=""
+  if [ -n "$retry_repos" ] && retry_enabled; then
+    retry_url=$(retry_link "$retry_repos")
+  fi
+  
+  # Create adaptive card format for Teams/Power Automate; every text goes in
+  # through --arg, so quotes or backslashes in it can't break the JSON
+  local payload=$(jq -n \
+    --arg color "$color" --arg summary "$summary" --arg title "$title" \
+    --arg subtitle "$(date -u '+%Y-%m-%d %H:%M:%S UTC')" \
+    --arg status "$status" --arg message "$message" --arg successful_repos "$successful_repos" \
+    --arg run_id "${GITHUB_RUN_ID:-N/A}" --arg run_uuid "${RUN_UUID:-N/A}" --arg workflow_url "$workflow_url" \
+    --arg retry_url "$retry_url" \
+    --arg label_status "$(msg label_status)" --arg label_result "$(msg label_result)" \
+    --arg label_successful_repos "$(msg label_successful_repos)" --arg label_workflow "$(msg label_workflow)" \
+    --arg label_run_id "$(msg label_run_id)" --arg label_run_uuid "$(msg label_run_uuid)" \
+    --arg view_run "$(msg view_run)" --arg label_retry "$(msg label_retry)" '
+    {
+      "@type": "MessageCard",
+      "@context": "http://schema.org/extensions",
+      themeColor: $color,
+      summary: $summary,
+      sections: [{
+        activityTitle: $title,
+        activitySubtitle: $subtitle,
+        activityImage: "https://github.githubassets.com/images/modules/logos_page/GitHub-Mark.png",
+        facts: [
+          {name: $label_status, value: $status},
+          {name: $label_result, value: $message},
+          {name: $label_successful_repos, value: $successful_repos},
+          {name: $label_workflow, value: "repository-backup"},
+          {name: $label_run_id, value: $run_id},
+          {name: $label_run_uuid, value: $run_uuid}
+        ],
+        markdown: true
+      }],
+      potentialAction: ([{"@type": "OpenUri", name: $view_run, targets: [{os: "default", uri: $workflow_url}]}]
+        + if $retry_url != "" then [{"@type": "OpenUri", name: $label_retry, targets: [{os: "default", uri: $retry_url}]}] else [] end),
+      attachments: [{
+        contentType: "application/vnd.microsoft.card.adaptive",
+        content: {
+          type: "AdaptiveCard",
+          version: "1.0",
+          body: ([
+            {type: "TextBlock", size: "Medium", weight: "Bolder", text: $summary},
+            {type: "TextBlock", text: $message, wrap: true},
+            {type: "TextBlock", text: "**\($label_successful_repos):** \($successful_repos)", wrap: true},
+            {type: "TextBlock", text: "[\($view_run)](\($workflow_url))", wrap: true}
+          ] + if $retry_url != "" then [{type: "TextBlock", text: "[\($label_retry)](\($retry_url))", wrap: true}] else [] end)
         }
-      ]
-    }
-  }]
-}
-EOF
-)
+      }]
+    }')
   
+  if [ "$DRILL_FAIL_WEBHOOK" = "true" ]; then
+    echo "❌ Notification not delivered: injected webhook failure (drill)"
+    return 0
+  fi
+  if redact_rules_enabled; then
+    payload=$(redact_text <<<"$payload")
+  fi
   curl -X POST "$WEBHOOK_URL" \
     -H "Content-Type: application/json" \
     -d "$payload" \
     --max-time 10 || true
 }
 
+# Queue a notification instead of sending it immediately
+queue_webhook() {
+  if [ -z "$WEBHOOK_URL" ]; then
+    return 0
+  fi
+  
+  local success="$1"
+  local message="$2"
+  local successful_repos="$3"
+  local retry_repos="${4:-}"
+  local status_dir
+  case "$success" in
+    true) status_dir="$WEBHOOK_SPOOL_DIR/success" ;;
+    warning) status_dir="$WEBHOOK_SPOOL_DIR/warning" ;;
+    *) status_dir="$WEBHOOK_SPOOL_DIR/failure" ;;
+  esac
+  
+  mkdir -p "$status_dir"
+  jq -n --arg message "$message" --arg repos "$successful_repos" --arg retry "$retry_repos" \
+    '{message: $message, successful_repos: $repos, retry_repos: $retry}' \
+    > "$status_dir/$(date +%s%N)_$$.json"
+}
+
+# Send all queued notifications, one combined card per status. Sends closer
+# together than WEBHOOK_MIN_INTERVAL are delayed, never dropped.
+flush_webhooks() {
+  if [ -z "$WEBHOOK_URL" ]; then
+    return 0
+  fi
+  
+  mkdir -p "$WEBHOOK_SPOOL_DIR"
+  (
+    flock 9
+    local status pending message repos retry_repos last_sent wait_for
+    for status in failure warning success; do
+      pending=()
+      if [ -d "$WEBHOOK_SPOOL_DIR/$status" ]; then
+        pending=($(ls "$WEBHOOK_SPOOL_DIR/$status"/*.json 2>/dev/null | sort))
+      fi
+      if [ ${#pending[@]} -eq 0 ]; then
+        continue
+      fi
+      
+      message=$(jq -rs 'map(.message) | join("; ")' "${pending[@]}")
+      repos=$(jq -rs '[.[].successful_repos | split(", ")[] | select(. != "")] | unique | join(", ")' "${pending[@]}")
+      retry_repos=$(jq -rs '[.[].retry_repos // "" | split(", ")[] | select(. != "")] | unique | join(", ")' "${pending[@]}")
+      
+      last_sent=$(cat "$WEBHOOK_SPOOL_DIR/.last_sent" 2>/dev/null || echo 0)
+      wait_for=$((last_sent + WEBHOOK_MIN_INTERVAL - $(date +%s)))
+      if [ $wait_for -gt 0 ]; then
+        sleep "$wait_for"
+      fi
+      
+      send_webhook "$(case "$status" in success) echo true ;; warning) echo warning ;; *) echo false ;; esac)" "$message" "$repos" "$retry_repos"
+      date +%s > "$WEBHOOK_SPOOL_DIR/.last_sent"
+      rm -f "${pending[@]}"
+    done
+  ) 9>"$WEBHOOK_SPOOL_DIR/.lock"
+}
+
+# Report a repository failure before the run ends: notify_failure_now <entry>
+notify_failure_now() {
+  if [ -z "$WEBHOOK_URL" ]; then
+    return 0
+  fi
+  mkdir -p "$WEBHOOK_SPOOL_DIR/realtime"
+  echo "$1" > "$WEBHOOK_SPOOL_DIR/realtime/$(date +%s%N)_$$"
+  flush_realtime_failures
+}
+
+# Send a failure card right away, for tiers that page instead of waiting for
+# the real-time batch or the end of the run: notify_page <message> <repository>
+notify_page() {
+  if [ -z "$WEBHOOK_URL" ]; then
+    return 0
+  fi
+  mkdir -p "$WEBHOOK_SPOOL_DIR"
+  (
+    flock 9
+    send_webhook false "$1" "" "$2"
+    date +%s > "$WEBHOOK_SPOOL_DIR/.last_sent"
+  ) 9>"$WEBHOOK_SPOOL_DIR/.lock"
+}
+
+# Send the batched real-time failures once WEBHOOK_REALTIME_INTERVAL has passed
+# since the previous real-time card
+flush_realtime_failures() {
+  (
+    flock 9
+    local pending=($(ls "$WEBHOOK_SPOOL_DIR/realtime"/* 2>/dev/null | sort))
+    local last_sent=$(cat "$WEBHOOK_SPOOL_DIR/.last_realtime" 2>/dev/null || echo 0)
+    if [ ${#pending[@]} -eq 0 ] || [ $(( $(date +%s) - last_sent )) -lt "$WEBHOOK_REALTIME_INTERVAL" ]; then
+      exit 0
+    fi
+    send_webhook false "$(msg result_failing_now "$(cat "${pending[@]}" | paste -sd ',' | sed 's/,/, /g')")" ""
+    date +%s | tee "$WEBHOOK_SPOOL_DIR/.last_realtime" > "$WEBHOOK_SPOOL_DIR/.last_sent"
+    rm -f "${pending[@]}"
+  ) 9>"$WEBHOOK_SPOOL_DIR/.lock"
+}
+
+# Drop real-time failures still waiting for their batch; the end-of-run card covers them
+discard_realtime_failures() {
+  rm -rf "$WEBHOOK_SPOOL_DIR/realtime"
+}
+
 # Allow function to be sourced or called directly
 if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
   if [ $# -lt 2 ]; then
-    echo "❌ Usage: $0 <success> <message> [successful_repos]"
+    echo "❌ Usage: $0 <true|false|warning> <message> [successful_repos] [retry_repos]"
     exit 1
   fi
-  send_webhook "$1" "$2" "${3:-}"
+  send_webhook "$1" "$2" "${3:-}" "${4:-}"
 fi 
\ No newline at end of file
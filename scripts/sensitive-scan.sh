@@ -0,0 +1,29 @@
+#!/bin/bash
+# Scan a mirror for obviously sensitive files (dotenv files, private keys) on
+# the tips of its branches and tags, so secrets being propagated into long-lived
+# backups get noticed
+
+# Paths that are almost always secrets
+SENSITIVE_PATH_PATTERN='(^|/)(\.env(\.[^/]*)?|id_(rsa|dsa|ecdsa|ed25519)|[^/]*\.(pem|p12|pfx|key|keystore|jks)|credentials\.json|\.npmrc|\.pypirc|\.netrc)$'
+# Content that is always a secret
+SENSITIVE_CONTENT_PATTERN='-----BEGIN ([A-Z]+ )?PRIVATE KEY-----'
+
+# Print findings as "<ref>:<path>", one per line: scan_sensitive_files <git dir>
+scan_sensitive_files() {
+  local git_dir="$1"
+  local ref
+  for ref in $(git -C "$git_dir" for-each-ref --format='%(refname)' refs/heads refs/tags); do
+    git -C "$git_dir" ls-tree -r --name-only "$ref" 2>/dev/null |
+      grep -E "$SENSITIVE_PATH_PATTERN" | sed "s#^#$ref:#"
+    git -C "$git_dir" grep -l -E -e "$SENSITIVE_CONTENT_PATTERN" "$ref" -- 2>/dev/null
+  done | sort -u
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  if [ $# -eq 0 ]; then
+    echo "❌ Usage: $0 <mirror_dir>"
+    exit 1
+  fi
+  scan_sensitive_files "$1"
+fi
@@ -3,10 +3,16 @@
 
 curl -sL https://aka.ms/InstallAzureCLIDeb | sudo bash
 sudo apt-get update && sudo apt-get install -y jq
+# Archives are encrypted with age (see encrypt.sh)
+if [ "${ENCRYPTION_POLICY:-none}" != "none" ] || [ -n "$(compgen -v ENCRYPTION_KEY_)" ]; then
+  sudo apt-get install -y age
+fi
 
-# Ensure container exists
-az storage container create \
-  --account-name "$AZURE_STORAGE_ACCOUNT" \
-  --account-key "$AZURE_STORAGE_KEY" \
-  --name "$CONTAINER_NAME" \
-  --public-access off || true 
\ No newline at end of file
+# Ensure container exists (a dry run creates nothing)
+if [[ " ${BACKUP_DESTINATIONS:-azure} " == *" azure "* ]] && [ "$DRY_RUN" != "true" ]; then
+  az storage container create \
+    --account-name "$AZURE_STORAGE_ACCOUNT" \
+    --account-key "$AZURE_STORAGE_KEY" \
+    --name "$CONTAINER_NAME" \
+    --public-access off || true
+fi 
\ No newline at end of file
@@ -0,0 +1,148 @@
+#!/bin/bash
+# SFTP destination: a directory on a server reached over SSH with a key, such
+# as a NAS or an on-premises backup host. Only the SFTP subsystem is used, so
+# accounts limited to SFTP (ForceCommand internal-sftp) work. One SSH
+# connection is shared by all transfers of a run.
+
+SFTP_HOST="${SFTP_HOST:-}"
+SFTP_PORT="${SFTP_PORT:-22}"
+SFTP_USER="${SFTP_USER:-}"
+# Private key: the key file's path or its contents
+SFTP_KEY="${SFTP_KEY:-}"
+# The server's known_hosts entries (path or contents); without them its host
+# key is accepted on first use
+SFTP_KNOWN_HOSTS="${SFTP_KNOWN_HOSTS:-}"
+# Directory on the server the archives go into
+SFTP_DIR="${SFTP_DIR:-backups}"
+
+# Directory with the key, known_hosts and connection socket, set up once per run
+sftp_prepare() {
+  local dir="${API_STATE_DIR:-${TMPDIR:-/tmp}/backup-api-$$}/sftp"
+  if [ ! -f "$dir/key" ]; then
+    (
+      umask 077
+      mkdir -p "$dir" || exit 1
+      if [ -f "$SFTP_KEY" ]; then cat "$SFTP_KEY"; else printf '%s\n' "$SFTP_KEY"; fi > "$dir/key.tmp" &&
+        mv "$dir/key.tmp" "$dir/key"
+      if [ -f "$SFTP_KNOWN_HOSTS" ]; then cat "$SFTP_KNOWN_HOSTS"; else printf '%s\n' "$SFTP_KNOWN_HOSTS"; fi > "$dir/known_hosts"
+    ) || return 1
+  fi
+  echo "$dir"
+}
+
+# Run the sftp commands on stdin; the first failing one fails the batch,
+# except commands starting with "-"
+sftp_batch() {
+  local dir
+  dir=$(sftp_prepare) || return 1
+  local checking=yes
+  if [ -z "$SFTP_KNOWN_HOSTS" ]; then
+    checking=accept-new
+  fi
+  sftp -q -b - -P "$SFTP_PORT" -i "$dir/key" \
+    -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking="$checking" \
+    -o UserKnownHostsFile="$dir/known_hosts" -o ConnectTimeout=30 -o ServerAliveInterval=15 \
+    -o ControlMaster=auto -o ControlPath="$dir/%C" -o ControlPersist=60 \
+    "$SFTP_USER@$SFTP_HOST" | grep -v '^sftp>'
+  return "${PIPESTATUS[0]}"
+}
+
+# A path quoted for an sftp command
+sftp_quote() {
+  local path="${1//\\/\\\\}"
+  printf '"%s"' "${path//\"/\\\"}"
+}
+
+# A stored name's path on the server, quoted
+sftp_path() {
+  sftp_quote "$SFTP_DIR/$1"
+}
+
+# Upload under a temporary name and rename, so a broken transfer never
+# leaves a partial archive: sftp_put <file> <name>
+sftp_put() {
+  local file="$1"
+  local name="$2"
+  local dir="$SFTP_DIR"
+  if [[ "$name" == */* ]]; then
+    dir="$dir/${name%/*}"
+  fi
+  local -a parents=()
+  while [ "$dir" != "." ] && [ "$dir" != "/" ]; do
+    parents=("$dir" "${parents[@]}")
+    dir=$(dirname "$dir")
+  done
+  {
+    for dir in "${parents[@]}"; do
+      echo "-mkdir $(sftp_quote "$dir")"
+    done
+    echo "put $(sftp_quote "$file") $(sftp_path "$name.tmp")"
+    echo "-rm $(sftp_path "$name")"
+    echo "rename $(sftp_path "$name.tmp") $(sftp_path "$name")"
+  } | sftp_batch >/dev/null 2>&1
+}
+
+sftp_get() {
+  echo "get $(sftp_path "$1") $(sftp_quote "$2")" | sftp_batch >/dev/null
+}
+
+# Stream a file or a byte range of it; SFTP has no ranged get, so the file
+# is fetched whole first: sftp_read <name> <offset> [length]
+sftp_read() {
+  local spool=$(mktemp)
+  if ! sftp_get "$1" "$spool"; then
+    rm -f "$spool"
+    return 1
+  fi
+  if [ -n "$3" ]; then
+    tail -c +$(($2 + 1)) "$spool" | head -c "$3"
+  else
+    tail -c +$(($2 + 1)) "$spool"
+  fi
+  rm -f "$spool"
+}
+
+# Files and links below a directory, relative to SFTP_DIR: sftp_walk <dir>
+sftp_walk() {
+  local dir="$1"
+  local listing perms name
+  listing=$(echo "ls -l $(sftp_path "$dir")" | sftp_batch 2>/dev/null) || return 0
+  while read -r perms _ _ _ _ _ _ _ name; do
+    name="${dir:+$dir/}${name##*/}"
+    case "$perms" in
+      d*) sftp_walk "$name" ;;
+      -*|l*) echo "$name" ;;
+    esac
+  done <<<"$listing"
+}
+
+# Stored names starting with a prefix, one per line: sftp_list [prefix]
+sftp_list() {
+  local prefix="$1"
+  local dir=""
+  if [[ "$prefix" == */* ]]; then
+    dir="${prefix%/*}"
+  fi
+  sftp_walk "$dir" | while IFS= read -r name; do
+    if [[ "$name" == "$prefix"* ]]; then
+      echo "$name"
+    fi
+  done | sort
+}
+
+sftp_size() {
+  echo "ls -l $(sftp_path "$1")" | sftp_batch 2>/dev/null | awk 'NR == 1 { print $5 }'
+}
+
+sftp_delete() {
+  echo "rm $(sftp_path "$1")" | sftp_batch >/dev/null 2>&1
+}
+
+# Point a name at a stored file with a relative symlink, as on the local
+# destination: sftp_link <target> <name>
+sftp_link() {
+  {
+    echo "-rm $(sftp_path "$2")"
+    echo "symlink $(sftp_quote "$1") $(sftp_path "$2")"
+  } | sftp_batch >/dev/null 2>&1
+}
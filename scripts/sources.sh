@@ -0,0 +1,153 @@
+#!/bin/bash
+# Where repositories are backed up from. Each kind of source is a provider:
+#   github  GitHub or GitHub Enterprise Server
+#   gitlab  GitLab
+#   gitea   Gitea or Gogs
+#   git     any other git host
+#   local   a path on this machine or a file:// URL
+#   org     a GitHub organization's settings, teams and permissions
+#           (org-settings:<org>, see org-settings.sh)
+# A repository's provider follows from its host (see hosts.sh), or the
+# source=<provider> option on its repos.txt line.
+#
+# Like archive formats, each provider is a set of functions named after it.
+# Adding a provider means adding at least its fetch function; the others
+# default to the plain git ones (source_git_*):
+#   source_<provider>_resolve <url>                             Print the location to fetch from, fail with the reason on stderr
+#   source_<provider>_token <url>                               Print the credential to fetch with, if any
+#   source_<provider>_list_refs <url> <token>                   Print the refs as "<sha>\t<ref>" lines
+#   source_<provider>_fetch <url> <token> <dest> [clone options...]  Mirror the repository into <dest>, updating a mirror already there
+
+source "$(dirname "${BASH_SOURCE[0]}")/repo-config.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/org-settings.sh"
+
+# Run git with a token supplied through GIT_ASKPASS, so it never appears in
+# clone URLs, process listings or the mirror's config: git_with_token <token> <git args...>
+git_with_token() {
+  local token="$1"
+  shift
+  if [ -z "$token" ]; then
+    GIT_TERMINAL_PROMPT=0 git "$@"
+    return
+  fi
+
+  local askpass=$(mktemp)
+  cat > "$askpass" <<'ASKPASS'
+#!/bin/sh
+case "$1" in
+  Username*) echo "x-access-token" ;;
+  *) echo "$BACKUP_GIT_TOKEN" ;;
+esac
+ASKPASS
+  chmod 700 "$askpass"
+  BACKUP_GIT_TOKEN="$token" GIT_ASKPASS="$askpass" GIT_TERMINAL_PROMPT=0 \
+    git -c credential.helper= "$@"
+  local status=$?
+  rm -f "$askpass"
+  return $status
+}
+
+# Provider of a URL from its host: source_provider_of <url>
+source_provider_of() {
+  local host=$(git_url_host "$1")
+  if [[ "$1" == org-settings:* ]]; then
+    echo "org"
+  elif [ -z "$host" ]; then
+    echo "local"
+  else
+    git_url_type "$1"
+  fi
+}
+
+# Provider of a repos.txt line: its source= option or the URL's
+repo_source_provider() {
+  repo_option "$1" source "$(source_provider_of "$(repo_line_url "$1")")"
+}
+
+# Whether a provider is implemented
+source_provider_known() {
+  declare -F "source_$1_fetch" >/dev/null
+}
+
+# Call a provider's function, or the plain git one when it has none:
+# source_call <provider> <resolve|token|list_refs|fetch> <args...>
+source_call() {
+  local function="source_$1_$2"
+  if ! declare -F "$function" >/dev/null; then
+    function="source_git_$2"
+  fi
+  "$function" "${@:3}"
+}
+
+source_git_resolve() {
+  echo "$1"
+}
+
+source_git_token() {
+  git_host_token "$(git_url_host "$1")"
+}
+
+source_git_list_refs() {
+  git_with_token "$2" ls-remote "$1"
+}
+
+source_git_fetch() {
+  local url="$1"
+  local token="$2"
+  local dest="$3"
+  shift 3
+  if [ "$(git -C "$dest" rev-parse --is-bare-repository 2>/dev/null)" = "true" ]; then
+    git -C "$dest" remote set-url origin "$url" &&
+      git_with_token "$token" -C "$dest" remote update --prune
+    return
+  fi
+  git_with_token "$token" clone --mirror "$@" "$url" "$dest"
+}
+
+# GitHub, GitLab and Gitea are fetched with plain git; their tokens (GitHub
+# App installation tokens included) come from the host, see git_host_token
+source_github_fetch() {
+  source_git_fetch "$@"
+}
+
+source_gitlab_fetch() {
+  source_git_fetch "$@"
+}
+
+source_gitea_fetch() {
+  source_git_fetch "$@"
+}
+
+# Local repositories, bare or working copies, need no credential and must
+# exist; a working copy's committed history and refs are backed up, not its
+# uncommitted changes
+source_local_resolve() {
+  local path=$(local_source_path "$1")
+  if ! git -C "$path" rev-parse --git-dir >/dev/null 2>&1; then
+    echo "fatal: repository '$path' does not exist" >&2
+    return 1
+  fi
+  echo "$path"
+}
+
+source_local_token() {
+  :
+}
+
+source_local_fetch() {
+  source_git_fetch "$1" "" "${@:3}"
+}
+
+# Organization settings are exported through the github.com API with its
+# token; listing refs only checks the organization can be read
+source_org_token() {
+  git_host_token github.com
+}
+
+source_org_list_refs() {
+  API_TOKEN="$2" api_get "https://api.github.com/orgs/${1#org-settings:}" >/dev/null
+}
+
+source_org_fetch() {
+  org_settings_export "${1#org-settings:}" "$2" "$3"
+}
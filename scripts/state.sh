@@ -0,0 +1,166 @@
+#!/bin/bash
+# Persistent state carried between runs, stored next to the archives
+
+source "$(dirname "${BASH_SOURCE[0]}")/storage.sh"
+
+STATE_DIR="${STATE_DIR:-.backup-state}"
+STATE_FILE="$STATE_DIR/state.json"
+STATE_BLOB="_state/state.json"
+# Every stored archive, see catalog.sh
+CATALOG_FILE="$STATE_DIR/catalog.json"
+CATALOG_BLOB="_state/catalog.json"
+# Quarantine repositories that failed this many runs in a row (per repo:
+# quarantine=): they are only attempted again after a pause that doubles with
+# every further failure, instead of failing and alerting every run (0 disables)
+QUARANTINE_AFTER_FAILURES="${QUARANTINE_AFTER_FAILURES:-5}"
+# Longest pause between attempts of a quarantined repository, in days
+QUARANTINE_MAX_DAYS="${QUARANTINE_MAX_DAYS:-30}"
+# "true" keeps the state and the catalog in STATE_JSON and CATALOG_JSON
+# instead of STATE_DIR, for a dry run that must leave nothing behind
+STATE_IN_MEMORY=false
+
+# Fetch the previous run's state and the catalog, starting empty on the first run
+state_load() {
+  if [ "$STATE_IN_MEMORY" = "true" ]; then
+    STATE_JSON=$(state_fetch "$STATE_BLOB" '{}')
+    CATALOG_JSON=$(state_fetch "$CATALOG_BLOB" '[]')
+    return 0
+  fi
+  mkdir -p "$STATE_DIR"
+  if ! storage_get "$(primary_destination)" "$STATE_BLOB" "$STATE_FILE" || ! jq -e . "$STATE_FILE" >/dev/null 2>&1; then
+    echo '{}' > "$STATE_FILE"
+  fi
+  if ! storage_get "$(primary_destination)" "$CATALOG_BLOB" "$CATALOG_FILE" || ! jq -e . "$CATALOG_FILE" >/dev/null 2>&1; then
+    echo '[]' > "$CATALOG_FILE"
+  fi
+}
+
+# JSON of a stored state file, or a default when it is missing or broken:
+# state_fetch <blob> <default>
+state_fetch() {
+  local tmp=$(mktemp)
+  local json
+  if storage_get "$(primary_destination)" "$1" "$tmp" && json=$(jq -c . "$tmp" 2>/dev/null) && [ -n "$json" ]; then
+    echo "$json"
+  else
+    echo "$2"
+  fi
+  rm -f "$tmp"
+}
+
+# Store the state and the catalog for the next run
+state_save() {
+  if ! storage_put "$(primary_destination)" "$STATE_FILE" "$STATE_BLOB" ||
+    ! storage_put "$(primary_destination)" "$CATALOG_FILE" "$CATALOG_BLOB"; then
+    echo "⚠️ Failed to save run state"
+  fi
+}
+
+# Read a value from the state: state_get <jq filter> [jq args...]
+state_get() {
+  local filter="$1"
+  shift
+  if [ "$STATE_IN_MEMORY" = "true" ]; then
+    jq -r "$@" "$filter" <<<"$STATE_JSON"
+  else
+    jq -r "$@" "$filter" "$STATE_FILE"
+  fi
+}
+
+# Rewrite the state in place: state_update [jq args...] <jq filter>
+state_update() {
+  if [ "$STATE_IN_MEMORY" = "true" ]; then
+    STATE_JSON=$(jq -c "$@" <<<"$STATE_JSON")
+    return
+  fi
+  local tmp="$STATE_FILE.tmp"
+  jq "$@" "$STATE_FILE" > "$tmp" && mv "$tmp" "$STATE_FILE"
+}
+
+# Remember when a repository started failing (keeps the earliest time) and
+# count the runs in a row it failed. A failure that doesn't count (a cancelled
+# backup) leaves the state alone, so the next success isn't a recovery:
+# state_mark_failed <repo> [counted: true|false]
+state_mark_failed() {
+  local repo_name="$1"
+  state_update --arg repo "$repo_name" --argjson now "$RUN_EPOCH" --argjson counted "${2:-true}" \
+    'if $counted then
+      .repos[$repo].failing_since //= $now |
+        .repos[$repo].consecutive_failures += 1 | .repos[$repo].last_failure = $now
+    else . end'
+}
+
+# Epoch a quarantined repository may be attempted again, printing nothing when
+# it isn't quarantined. The pause is a day after reaching the threshold, then
+# two, four and so on up to QUARANTINE_MAX_DAYS, less an hour so runs at a
+# slightly earlier time of day still count: quarantine_next_attempt <repo> [threshold]
+quarantine_next_attempt() {
+  local threshold="${2:-$QUARANTINE_AFTER_FAILURES}"
+  local failures=$(state_get '.repos[$repo].consecutive_failures // 0' --arg repo "$1")
+  if [ "$threshold" -le 0 ] || [ "$failures" -lt "$threshold" ]; then
+    return 0
+  fi
+  local days=1
+  local extra=$((failures - threshold))
+  while [ $extra -gt 0 ] && [ $days -lt "$QUARANTINE_MAX_DAYS" ]; do
+    days=$((days * 2))
+    extra=$((extra - 1))
+  done
+  [ $days -le "$QUARANTINE_MAX_DAYS" ] || days="$QUARANTINE_MAX_DAYS"
+  local last_failure=$(state_get '.repos[$repo].last_failure // 0' --arg repo "$1")
+  echo $((last_failure + days * 86400 - 3600))
+}
+
+# Take a repository out of quarantine, so the next run attempts it and its
+# failures count from zero again: quarantine_release <repo>
+quarantine_release() {
+  state_update --arg repo "$1" 'del(.repos[$repo].consecutive_failures, .repos[$repo].last_failure)'
+}
+
+# Record a success and clear any failure; prints how long it was failing if it recovered
+state_mark_succeeded() {
+  local repo_name="$1"
+  local failing_since=$(state_get '.repos[$repo].failing_since // empty' --arg repo "$repo_name")
+  state_update --arg repo "$repo_name" --argjson now "$RUN_EPOCH" \
+    'del(.repos[$repo].failing_since, .repos[$repo].consecutive_failures, .repos[$repo].last_failure) |
+      .repos[$repo].last_success = $now'
+  if [ -n "$failing_since" ]; then
+    format_duration $(( RUN_EPOCH - failing_since ))
+  fi
+}
+
+# Render seconds as a short human readable duration, e.g. "2d 3h" or "45m"
+format_duration() {
+  local seconds="$1"
+  local days=$((seconds / 86400))
+  local hours=$((seconds % 86400 / 3600))
+  local minutes=$((seconds % 3600 / 60))
+  if [ $days -gt 0 ]; then
+    echo "${days}d ${hours}h"
+  elif [ $hours -gt 0 ]; then
+    echo "${hours}h ${minutes}m"
+  else
+    echo "${minutes}m"
+  fi
+}
+
+# Remember the newest archive of a repository: state_record_archive <repo> <name> <size> <date>
+state_record_archive() {
+  state_update --arg repo "$1" --arg name "$2" --argjson size "$3" --arg date "$4" \
+    '.repos[$repo].last_archive = {name: $name, size_bytes: $size, date: $date}'
+}
+
+# Keep the durations of a repository's last few successful backups
+state_record_duration() {
+  local repo_name="$1"
+  local seconds="$2"
+  state_update --arg repo "$repo_name" --argjson seconds "$seconds" \
+    '.repos[$repo].durations = ((.repos[$repo].durations // []) + [$seconds] | .[-5:])'
+}
+
+# Average backup duration of a repository in seconds (0 without history)
+state_average_duration() {
+  local repo_name="$1"
+  state_get '(.repos[$repo].durations // []) | if length == 0 then 0 else add / length | floor end' \
+    --arg repo "$repo_name"
+}
@@ -0,0 +1,77 @@
+#!/bin/bash
+# Backup freshness manifest (status.json and STATUS.md) for the repository front page
+
+source "$(dirname "${BASH_SOURCE[0]}")/state.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/discover.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+
+STATUS_JSON="${STATUS_JSON:-status.json}"
+STATUS_MD="${STATUS_MD:-STATUS.md}"
+# Endpoint the status and the run's results are POSTed to after each run, for
+# deployments with no repository to commit STATUS.md to (e.g. Kubernetes)
+STATUS_URL="${STATUS_URL:-}"
+# Bearer token for STATUS_URL
+STATUS_TOKEN="${STATUS_TOKEN:-}"
+
+# Every configured repository with its last successful backup, as JSON
+status_entries() {
+  local line
+  while IFS= read -r line; do
+    local url=$(repo_line_url "$line")
+    jq -cn --arg name "$(repo_display_name "$line")" --arg url "$url" \
+      --arg frequency "$(repo_option "$line" frequency daily)" \
+      --argjson quarantine "$(repo_option "$line" quarantine "$QUARANTINE_AFTER_FAILURES")" \
+      '{name: $name, url: $url, frequency: $frequency, quarantine: $quarantine}'
+  done < <(repo_lines) | jq -s --slurpfile state "$STATE_FILE" '
+    map(. as $repo | ($state[0].repos[$repo.name] // {}) as $saved | del(.quarantine) + {
+      status: (if $repo.quarantine > 0 and ($saved.consecutive_failures // 0) >= $repo.quarantine then "quarantined"
+        elif $saved.failing_since then "failing" elif $saved.last_archive then "ok" else "never" end),
+      last_success: $saved.last_archive.date,
+      size_bytes: $saved.last_archive.size_bytes,
+      archive: $saved.last_archive.name,
+      failing_since: ($saved.failing_since | if . then todate else null end)
+    })'
+}
+
+# Write status.json and STATUS.md from repos.txt and the run state
+write_status() {
+  status_entries | jq --arg updated "$(date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    '{updated_at: $updated, repositories: .}' > "$STATUS_JSON"
+  redact_json "$STATUS_JSON"
+
+  jq -r "$RESULTS_JQ_DEFS"'
+    def icon: {ok: "✅", failing: "❌", quarantined: "🚧", never: "⚪"}[.];
+    "# Backup Status",
+    "",
+    "_Updated \(.updated_at)_",
+    "",
+    "| Repository | Status | Last successful backup | Size | Frequency |",
+    "| ---------- | ------ | ---------------------- | ---- | --------- |",
+    (.repositories[] | "| [\(.name)](\(.url)) | \(.status | icon) \(.status) | \(.last_success // "never") | \(.size_bytes | if . then size_human else "-" end) | \(.frequency) |")
+  ' "$STATUS_JSON" > "$STATUS_MD"
+  echo "📋 Status written to $STATUS_MD and $STATUS_JSON"
+}
+
+# POST status.json plus this run's results to STATUS_URL
+post_status() {
+  if [ -z "$STATUS_URL" ]; then
+    return 0
+  fi
+  local results="{}"
+  if [ -f "$RESULTS_FILE" ]; then
+    results=$(read_results "$RESULTS_FILE")
+  fi
+  if jq --argjson results "$results" '. + {run: $results.run, results: $results.repositories}' "$STATUS_JSON" |
+    curl -sf -X POST -H "Content-Type: application/json" -H @<([ -z "$STATUS_TOKEN" ] || echo "Authorization: Bearer $STATUS_TOKEN") \
+      --data-binary @- --max-time 30 -o /dev/null "$STATUS_URL"; then
+    echo "📋 Status posted to the status endpoint"
+  else
+    echo "⚠️ Failed to post the status to STATUS_URL"
+  fi
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  state_load
+  write_status
+fi
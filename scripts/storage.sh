@@ -0,0 +1,376 @@
+#!/bin/bash
+# Storage destinations for archives. BACKUP_DESTINATIONS lists one or more of:
+#   azure  Azure Blob Storage container (AZURE_STORAGE_ACCOUNT, CONTAINER_NAME)
+#   gcs    Google Cloud Storage bucket (GCS_BUCKET, see gcs.sh)
+#   sftp   Directory on a server reached over SFTP (SFTP_HOST, see sftp.sh)
+#   rclone Any rclone remote (RCLONE_REMOTE, see rclone.sh)
+#   local  Directory on this machine (LOCAL_BACKUP_DIR)
+# The first destination is the primary one, which also holds the run state.
+
+source "$(dirname "${BASH_SOURCE[0]}")/context.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/walk.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/multipart.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/gcs.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/sftp.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/rclone.sh"
+
+BACKUP_DESTINATIONS="${BACKUP_DESTINATIONS:-azure}"
+LOCAL_BACKUP_DIR="${LOCAL_BACKUP_DIR:-backups}"
+# Also keep a full copy of the newest archive at latest/<repo>.zip on remote destinations
+LATEST_COPY="${LATEST_COPY:-false}"
+# Make finished archives on the local destination immutable (chattr +i, needs root)
+LOCAL_IMMUTABLE="${LOCAL_IMMUTABLE:-false}"
+# Snapshot the local destination after each run: btrfs, zfs or a shell command
+LOCAL_SNAPSHOT="${LOCAL_SNAPSHOT:-}"
+LOCAL_SNAPSHOT_DIR="${LOCAL_SNAPSHOT_DIR:-${LOCAL_BACKUP_DIR%/}.snapshots}"
+
+primary_destination() {
+  echo "${BACKUP_DESTINATIONS%% *}"
+}
+
+# Store a file: storage_put <destination> <file> <name>
+storage_put() {
+  local destination="$1"
+  local file="$2"
+  local name="$3"
+  case "$destination" in
+    azure)
+      if multipart_wanted "$file"; then
+        multipart_upload azure "$file" "$name"
+        return
+      fi
+      az storage blob upload \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --container-name "$CONTAINER_NAME" \
+        --name "$name" \
+        --file "$file" \
+        ${RUN_UUID:+--metadata "run_uuid=$RUN_UUID"} \
+        --overwrite \
+        --output none </dev/null 2>/dev/null
+      ;;
+    gcs)
+      if multipart_wanted "$file"; then
+        multipart_upload gcs "$file" "$name"
+        return
+      fi
+      gcs_put "$file" "$name"
+      ;;
+    sftp)
+      sftp_put "$file" "$name"
+      ;;
+    rclone)
+      rclone_put "$file" "$name"
+      ;;
+    local)
+      mkdir -p "$(dirname "$LOCAL_BACKUP_DIR/$name")" &&
+        cp "$file" "$LOCAL_BACKUP_DIR/$name.tmp" &&
+        mv "$LOCAL_BACKUP_DIR/$name.tmp" "$LOCAL_BACKUP_DIR/$name"
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# URL of a blob with a SAS granting it alone some permissions: azure_blob_url <name> <permissions> <expiry>
+azure_blob_url() {
+  local sas=$(az storage blob generate-sas \
+    --account-name "$AZURE_STORAGE_ACCOUNT" \
+    --account-key "$AZURE_STORAGE_KEY" \
+    --container-name "$CONTAINER_NAME" \
+    --name "$1" \
+    --permissions "$2" \
+    --expiry "$(date -u -d "$3" '+%Y-%m-%dT%H:%MZ')" \
+    --output tsv </dev/null 2>/dev/null)
+  [ -n "$sas" ] || return 1
+  echo "${AZURE_BLOB_ENDPOINT:-https://$AZURE_STORAGE_ACCOUNT.blob.core.windows.net}/$CONTAINER_NAME/$1?$sas"
+}
+
+# Multipart hooks for Azure (see multipart.sh): blocks are put through a SAS
+# URL valid as long as Azure keeps uncommitted blocks
+azure_multipart_start() {
+  azure_blob_url "$1" cw '+7 days'
+}
+
+# Block IDs must all have the same length
+azure_block_id() {
+  printf 'block-%06d' "$1" | base64
+}
+
+azure_multipart_part() {
+  curl -sf -X PUT -H "x-ms-version: 2020-10-02" --upload-file "$3" --max-time 900 -o /dev/null \
+    "$1&comp=block&blockid=$(jq -rn --arg id "$(azure_block_id "$2")" '$id | @uri')"
+}
+
+azure_multipart_finish() {
+  local index
+  {
+    echo '<?xml version="1.0" encoding="utf-8"?><BlockList>'
+    for ((index = 0; index < $2; index++)); do
+      echo "<Latest>$(azure_block_id "$index")</Latest>"
+    done
+    echo '</BlockList>'
+  } | curl -sf -X PUT -H "x-ms-version: 2020-10-02" -H "Content-Type: application/xml" ${RUN_UUID:+-H "x-ms-meta-run_uuid: $RUN_UUID"} \
+    --data-binary @- --max-time 60 -o /dev/null "$1&comp=blocklist"
+}
+
+# Fetch a stored file: storage_get <destination> <name> <file>
+storage_get() {
+  local destination="$1"
+  local name="$2"
+  local file="$3"
+  case "$destination" in
+    azure)
+      az storage blob download \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --container-name "$CONTAINER_NAME" \
+        --name "$name" \
+        --file "$file" \
+        --output none </dev/null 2>/dev/null
+      ;;
+    gcs)
+      gcs_get "$name" "$file"
+      ;;
+    sftp)
+      sftp_get "$name" "$file"
+      ;;
+    rclone)
+      rclone_get "$name" "$file"
+      ;;
+    local)
+      [ -f "$LOCAL_BACKUP_DIR/$name" ] && cp "$LOCAL_BACKUP_DIR/$name" "$file"
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# Stream a stored file, or a byte range of it, to stdout without keeping a
+# local copy: storage_read <destination> <name> [offset] [length]
+storage_read() {
+  local destination="$1"
+  local name="$2"
+  local offset="${3:-0}"
+  local length="${4:-}"
+  case "$destination" in
+    azure)
+      local url range=""
+      url=$(azure_blob_url "$name" r '+1 day') || return 1
+      if [ "$offset" -gt 0 ] || [ -n "$length" ]; then
+        range="$offset-${length:+$((offset + length - 1))}"
+      fi
+      curl -sf ${range:+-r "$range"} -H "x-ms-version: 2020-10-02" "$url"
+      ;;
+    gcs)
+      gcs_read "$name" "$offset" "$length"
+      ;;
+    sftp)
+      sftp_read "$name" "$offset" "$length"
+      ;;
+    rclone)
+      rclone_read "$name" "$offset" "$length"
+      ;;
+    local)
+      [ -f "$LOCAL_BACKUP_DIR/$name" ] || return 1
+      if [ -n "$length" ]; then
+        tail -c +$((offset + 1)) "$LOCAL_BACKUP_DIR/$name" | head -c "$length"
+      else
+        tail -c +$((offset + 1)) "$LOCAL_BACKUP_DIR/$name"
+      fi
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# List stored names, one per line: storage_list <destination> [prefix]
+storage_list() {
+  local destination="$1"
+  local prefix="$2"
+  case "$destination" in
+    azure)
+      az storage blob list \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --container-name "$CONTAINER_NAME" \
+        --prefix "$prefix" \
+        --num-results "*" \
+        --query "[].name" \
+        --output tsv </dev/null 2>/dev/null
+      ;;
+    gcs)
+      gcs_list "$prefix"
+      ;;
+    sftp)
+      sftp_list "$prefix"
+      ;;
+    rclone)
+      rclone_list "$prefix"
+      ;;
+    local)
+      [ -d "$LOCAL_BACKUP_DIR" ] || return 0
+      (cd "$LOCAL_BACKUP_DIR" && find . \( -type f -o -type l \) -path "./$prefix*" | sed 's#^\./##' | sort)
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# Size of a stored file in bytes: storage_size <destination> <name>
+storage_size() {
+  local destination="$1"
+  local name="$2"
+  case "$destination" in
+    azure)
+      az storage blob show \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --container-name "$CONTAINER_NAME" \
+        --name "$name" \
+        --query properties.contentLength \
+        --output tsv </dev/null 2>/dev/null
+      ;;
+    gcs)
+      gcs_size "$name"
+      ;;
+    sftp)
+      sftp_size "$name"
+      ;;
+    rclone)
+      rclone_size "$name"
+      ;;
+    local)
+      [ -f "$LOCAL_BACKUP_DIR/$name" ] && file_size "$LOCAL_BACKUP_DIR/$name"
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# Remove a stored file: storage_delete <destination> <name>
+storage_delete() {
+  local destination="$1"
+  local name="$2"
+  case "$destination" in
+    azure)
+      az storage blob delete \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --container-name "$CONTAINER_NAME" \
+        --name "$name" \
+        --output none </dev/null 2>/dev/null
+      ;;
+    gcs)
+      gcs_delete "$name"
+      ;;
+    sftp)
+      sftp_delete "$name"
+      ;;
+    rclone)
+      rclone_delete "$name"
+      ;;
+    local)
+      rm -f "$LOCAL_BACKUP_DIR/$name"
+      ;;
+    *)
+      echo "❌ Unknown destination: $destination" >&2
+      return 1
+      ;;
+  esac
+}
+
+# Protect a finished archive against changes from this host: storage_seal <destination> <name>
+storage_seal() {
+  local destination="$1"
+  local name="$2"
+  if [ "$destination" != "local" ] || [ "$LOCAL_IMMUTABLE" != "true" ]; then
+    return 0
+  fi
+  if ! chattr +i "$LOCAL_BACKUP_DIR/$name" 2>/dev/null; then
+    echo "⚠️ Could not make $name immutable (chattr +i needs root and a supporting filesystem)"
+    return 1
+  fi
+}
+
+# Take a read-only snapshot of the local destination: storage_snapshot <label>
+storage_snapshot() {
+  local label="$1"
+  if [ -z "$LOCAL_SNAPSHOT" ] || [[ " $BACKUP_DESTINATIONS " != *" local "* ]]; then
+    return 0
+  fi
+  case "$LOCAL_SNAPSHOT" in
+    btrfs)
+      mkdir -p "$LOCAL_SNAPSHOT_DIR" &&
+        btrfs subvolume snapshot -r "$LOCAL_BACKUP_DIR" "$LOCAL_SNAPSHOT_DIR/$label" >/dev/null
+      ;;
+    zfs)
+      zfs snapshot "$(findmnt -no SOURCE --target "$LOCAL_BACKUP_DIR")@backup-$label"
+      ;;
+    *)
+      SNAPSHOT_LABEL="$label" LOCAL_BACKUP_DIR="$LOCAL_BACKUP_DIR" bash -c "$LOCAL_SNAPSHOT"
+      ;;
+  esac
+}
+
+# Point latest/<repo> at a stored archive: a symlink locally and over SFTP, a latest/<repo>.json
+# pointer everywhere, and optionally a server-side copy remotely
+storage_update_latest() {
+  local destination="$1"
+  local repo_name="$2"
+  local archive_name="$3"
+  local size_bytes="$4"
+  # Format plus any encryption extension, e.g. "zip", "tar.zst" or "zip.age"
+  local extension=$(grep -oE '\.(zip|bundle|tar\.[a-z0-9]+)(\.[a-z0-9]+)?$' <<<"$archive_name")
+  extension="${extension#.}"
+  local pointer=$(mktemp)
+
+  jq -n --arg repo "$repo_name" --arg archive "$archive_name" --argjson size "$size_bytes" \
+    --arg date "$(run_date -u '+%Y-%m-%dT%H:%M:%SZ')" \
+    '{repository: $repo, archive: $archive, size_bytes: $size, date: $date}' > "$pointer"
+  storage_put "$destination" "$pointer" "latest/$repo_name.json"
+  local status=$?
+  rm -f "$pointer"
+
+  case "$destination" in
+    local)
+      ln -sfn "../$archive_name" "$LOCAL_BACKUP_DIR/latest/$repo_name.$extension" || status=1
+      ;;
+    sftp)
+      sftp_link "../$archive_name" "latest/$repo_name.$extension" || status=1
+      ;;
+    azure)
+      if [ "$LATEST_COPY" = "true" ]; then
+        az storage blob copy start \
+          --account-name "$AZURE_STORAGE_ACCOUNT" \
+          --account-key "$AZURE_STORAGE_KEY" \
+          --destination-container "$CONTAINER_NAME" \
+          --destination-blob "latest/$repo_name.$extension" \
+          --source-container "$CONTAINER_NAME" \
+          --source-blob "$archive_name" \
+          --output none </dev/null 2>/dev/null || status=1
+      fi
+      ;;
+    gcs)
+      if [ "$LATEST_COPY" = "true" ]; then
+        gcs_copy "$archive_name" "latest/$repo_name.$extension" || status=1
+      fi
+      ;;
+    rclone)
+      if [ "$LATEST_COPY" = "true" ]; then
+        rclone_copy "$archive_name" "latest/$repo_name.$extension" || status=1
+      fi
+      ;;
+  esac
+  return $status
+}
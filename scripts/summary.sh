@@ -0,0 +1,76 @@
+#!/bin/bash
+# Markdown summary of a run (totals, per-repository table, failures), written
+# next to the results file and stored with the archives
+
+source "$(dirname "${BASH_SOURCE[0]}")/results.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/storage.sh"
+
+SUMMARY_FILE="${SUMMARY_FILE:-$(dirname "$RESULTS_FILE")/backup-summary.md}"
+SUMMARY_FILE="${SUMMARY_FILE#./}"
+
+# Render a results file as markdown: create_markdown_summary <results file>
+create_markdown_summary() {
+  read_results "$1" | jq -r "$RESULTS_JQ_DEFS"'
+    def icon: {success: "✅", partial: "⚠️", "skipped-unchanged": "🔗", failed: "❌", "timed-out": "⏹️",
+      quarantined: "🚧", "skipped-filtered": "⏭️"}[.] // "";
+    def cell: if . == null then "-" else tostring | gsub("\\|"; "\\|") | gsub("\n"; " ") end;
+    "# Backup Summary",
+    "",
+    "_Started \(.run.started_at), finished \(.run.finished_at) (\(.run.duration_human // "-")) on \(.run.host)\(if .run.run_uuid then ", run \(.run.run_uuid)" else "" end)_",
+    "",
+    "| Total | Succeeded | Unchanged | Partial | Failed | Timed out | Quarantined | Skipped | Archived |",
+    "| ----- | --------- | --------- | ------- | ------ | --------- | ----------- | ------- | -------- |",
+    "| \(.totals.total) | \(.totals.succeeded) | \(.totals.skipped_unchanged // 0) | \(.totals.partial // 0) | \(.totals.failed) | \(.totals.timed_out // 0) | \(.totals.quarantined // 0) | \(.totals.skipped_filtered // 0) | \([.repositories[].size_bytes // 0] | add // 0 | size_human) |",
+    (.totals.duration_seconds | objects | "", "Durations: p50 \(.p50 | duration_human), p90 \(.p90 | duration_human), p99 \(.p99 | duration_human), max \(.max | duration_human)"),
+    (.totals.destinations // {} | select(length > 0) |
+      "",
+      "| Destination | Uploaded | Upload time | Rate |",
+      "| ----------- | -------- | ----------- | ---- |",
+      (to_entries[] | "| \(.key) | \(.value.uploaded_bytes | size_human) | \(.value.upload_seconds | duration_human) | \(if .value.upload_seconds > 0 then "\(.value.uploaded_bytes / .value.upload_seconds | size_human)/s" else "-" end) |")),
+    (.totals.clone_seconds | numbers | "", "Time spent cloning: \(duration_human)"),
+    (.run.resources | objects | "", "Resources: \(resources_human)"),
+    "",
+    "## Repositories",
+    "",
+    "| Repository | Status | Archive | Size | Duration |",
+    "| ---------- | ------ | ------- | ---- | -------- |",
+    (.repositories[] | "| \(.name | cell) | \(.status | icon) \(.status) | \(.archive | cell) | \(.size_human | cell) | \(.duration_human | cell) |"),
+    (.repositories | map(select(.onboarding)) | select(length > 0) |
+      "",
+      "## Onboarded \(length) new repositories",
+      "",
+      "| Repository | Access | Estimated size | License | LFS |",
+      "| ---------- | ------ | -------------- | ------- | --- |",
+      (.[] | "| \(.name | cell) | \(if .onboarding.access then "✅" else "❌" end) | \(.onboarding.size_estimate_bytes | if . then size_human else "-" end) | \(.onboarding.license | cell) | \(if .lfs then "yes" else "no" end) |")),
+    (.repositories | map(select((.status | IN("failed", "partial")) or (.status == "timed-out" and (left_out | not)))) | select(length > 0) |
+      "",
+      "## Failures",
+      "",
+      (.[] | "- **\(.name)** (\(.status)): \(
+        if .status == "partial" then "missing \(.aux_failures | join(", "))"
+        else "\(.failure_stage // "unknown") failed\(if .error_class then " (\(.error_class))" else "" end)\(if .error then ": `\(.error)`" else "" end)" end)\(
+        if .remediation then "\n  - \(.remediation)" else "" end)"))
+  '
+}
+
+# Write SUMMARY_FILE for RESULTS_FILE, add it to the Actions job summary and
+# store it with the archives under summaries/
+write_summary() {
+  create_markdown_summary "$RESULTS_FILE" > "$SUMMARY_FILE" || return 1
+  echo "📄 Summary written to $SUMMARY_FILE"
+  if [ -n "$GITHUB_STEP_SUMMARY" ]; then
+    cat "$SUMMARY_FILE" >> "$GITHUB_STEP_SUMMARY"
+  fi
+
+  local destination
+  for destination in $BACKUP_DESTINATIONS; do
+    if ! storage_put "$destination" "$SUMMARY_FILE" "summaries/${DATE_PREFIX:-$(run_date +%Y%m%d_%H%M%S)}.md"; then
+      echo "⚠️ Failed to store summary ($destination)"
+    fi
+  done
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  create_markdown_summary "${1:-$RESULTS_FILE}"
+fi
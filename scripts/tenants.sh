@@ -0,0 +1,145 @@
+#!/bin/bash
+# Independent tenants in one deployment, e.g. an MSP backing up several
+# customers' organizations. Each tenant is a directory under TENANTS_DIR with
+# its own repos.txt and tenant.env (token, destinations, notifiers). A tenant
+# runs as a separate main.sh process inside its directory with its own scratch
+# space, so state, results, rate limits and notification spools never mix.
+
+TENANTS_DIR="${TENANTS_DIR:-tenants}"
+TENANT_SCRATCH_DIR="${TENANT_SCRATCH_DIR:-${TMPDIR:-${WORK_DIR:-/tmp}}/backup-tenants}"
+# How many tenants are backed up at the same time
+TENANT_PARALLEL="${TENANT_PARALLEL:-1}"
+# Settings only ever taken from tenant.env, never inherited from the deployment
+# (per-host GIT_TOKEN_<HOST> tokens and ENCRYPTION_KEY_<NAME> keys as well)
+TENANT_SCOPED_VARS="GITHUB_TOKEN GITHUB_APP_ID GITHUB_APP_PRIVATE_KEY GITHUB_APP_INSTALLATION_ID GITHUB_APP_OWNER
+  GITLAB_TOKEN WEBHOOK_URL DIGEST_WEBHOOK_URL AZURE_STORAGE_ACCOUNT AZURE_STORAGE_KEY CONTAINER_NAME GCS_BUCKET
+  SFTP_HOST SFTP_PORT SFTP_USER SFTP_KEY SFTP_KNOWN_HOSTS SFTP_DIR RCLONE_REMOTE RCLONE_CONFIG RCLONE_FLAGS
+  BACKUP_DESTINATIONS LOCAL_BACKUP_DIR MIRROR_TREE_DIR MIRROR_CACHE_DIR MESSAGES_FILE RESULTS_CSV GOOGLE_SHEET_ID GOOGLE_SHEET_RANGE
+  GOOGLE_SERVICE_ACCOUNT_JSON RESULTS_DB_URL PUSHGATEWAY_URL PUSHGATEWAY_JOB RETRY_URL RETRY_SECRET STATUS_URL STATUS_TOKEN
+  BACKUP_CONFIG_YAML BACKUP_CONFIG_FILE REPOS_FILE BACKUP_ONLY LOCAL_SOURCE_DIRS GIT_HOSTS STATE_DIR
+  ENCRYPTION_POLICY ENCRYPTION_DEFAULT_KEY AGE_IDENTITY_FILE GPG_PUBLIC_KEYS_FILE REDACT_RULES REDACT_RULES_FILE"
+
+# Tenants with a repos.txt, one name per line
+tenant_names() {
+  local dir
+  for dir in "$TENANTS_DIR"/*/; do
+    if [ -f "$dir/repos.txt" ] && [[ "$(basename "$dir")" =~ ^[A-Za-z0-9._-]+$ ]]; then
+      basename "$dir"
+    fi
+  done
+}
+
+# Back up one tenant, prefixing its output with the tenant name: run_tenant <name>
+run_tenant() {
+  local name="$1"
+  local scripts=$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)
+  local scratch="$TENANT_SCRATCH_DIR/$name"
+  mkdir -p "$scratch"
+  (
+    set -o pipefail
+    unset $TENANT_SCOPED_VARS $(compgen -v GIT_TOKEN_) $(compgen -v ENCRYPTION_KEY_)
+    cd "$TENANTS_DIR/$name" || exit 1
+    if [ -f tenant.env ]; then
+      set -a
+      source ./tenant.env
+      set +a
+    fi
+    export TMPDIR="$scratch"
+    # Each tenant writes to its own part of WORK_DIR
+    if [ -n "$WORK_DIR" ]; then
+      export WORK_DIR="$WORK_DIR/tenants/$name"
+    fi
+    export PUSHGATEWAY_JOB="${PUSHGATEWAY_JOB:-repo_backup_$name}"
+
+    # Ensure the tenant's container exists (as setup.sh does for a single deployment)
+    if [[ " ${BACKUP_DESTINATIONS:-azure} " == *" azure "* ]] && [ "$DRY_RUN" != "true" ]; then
+      az storage container create \
+        --account-name "$AZURE_STORAGE_ACCOUNT" \
+        --account-key "$AZURE_STORAGE_KEY" \
+        --name "$CONTAINER_NAME" \
+        --public-access off >/dev/null || true
+    fi
+
+    bash "$scripts/main.sh" 2>&1 | (trap '' INT TERM; sed -u "s/^/[$name] /")
+  )
+}
+
+# Send SIGTERM to the main.sh runs started under a process, which cancel and
+# still report
+tenants_signal_runs() {
+  local child
+  for child in $(pgrep -P "$1" 2>/dev/null); do
+    if [[ "$(ps -o args= -p "$child" 2>/dev/null)" == *"/main.sh"* ]]; then
+      kill -TERM "$child" 2>/dev/null
+    else
+      tenants_signal_runs "$child"
+    fi
+  done
+}
+
+# SIGINT or SIGTERM: start no further tenants and cancel the running ones
+tenants_stop() {
+  [ "$TENANTS_STOPPING" != "true" ] || return 0
+  TENANTS_STOPPING=true
+  echo "⏹️ Stopping: cancelling the running tenants, no further ones start"
+  tenants_signal_runs $$
+}
+
+# Back up every tenant, TENANT_PARALLEL at a time; fails when any tenant failed
+run_tenants() {
+  local names=($(tenant_names))
+  if [ ${#names[@]} -eq 0 ]; then
+    echo "❌ No tenants found in $TENANTS_DIR (expected $TENANTS_DIR/<tenant>/repos.txt)"
+    return 1
+  fi
+  echo "🏢 Backing up ${#names[@]} tenants: ${names[*]}"
+
+  # Tenants run inside their directories, so paths must not be relative
+  if [ -n "$WORK_DIR" ]; then
+    WORK_DIR=$(mkdir -p "$WORK_DIR" && cd "$WORK_DIR" && pwd) || return 1
+  fi
+  TENANT_SCRATCH_DIR=$(mkdir -p "$TENANT_SCRATCH_DIR" && cd "$TENANT_SCRATCH_DIR" && pwd) || return 1
+
+  local status_dir=$(mktemp -d "$TENANT_SCRATCH_DIR/status.XXXXXX")
+  TENANTS_STOPPING=false
+  trap tenants_stop INT TERM
+  local name
+  for name in "${names[@]}"; do
+    while [ "$TENANTS_STOPPING" != "true" ] && [ "$(jobs -rp | wc -l)" -ge "$TENANT_PARALLEL" ]; do
+      wait -n
+    done
+    if [ "$TENANTS_STOPPING" = "true" ]; then
+      echo "stopped" > "$status_dir/$name"
+      continue
+    fi
+    ( trap - INT TERM; run_tenant "$name"; echo $? > "$status_dir/$name" ) &
+  done
+  # A trapped signal interrupts wait, the tenants it cancelled still finish
+  while [ -n "$(jobs -rp)" ]; do
+    wait
+  done
+  trap - INT TERM
+
+  echo ""
+  echo "🏢 Tenants:"
+  local failed=0 status
+  for name in "${names[@]}"; do
+    status=$(cat "$status_dir/$name" 2>/dev/null || echo 1)
+    if [ "$status" = "stopped" ]; then
+      echo "  ⏹️ $name (not started)"
+      failed=$((failed + 1))
+    elif [ "$status" -eq 0 ]; then
+      echo "  ✅ $name"
+    else
+      echo "  ❌ $name (exit $status)"
+      failed=$((failed + 1))
+    fi
+  done
+  rm -rf "$status_dir"
+  [ $failed -eq 0 ]
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  run_tenants
+fi
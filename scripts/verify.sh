@@ -0,0 +1,137 @@
+#!/bin/bash
+# Check stored snapshots without running a backup: that every destination
+# still holds each archive, that its bytes match the recorded SHA-256 (from
+# the catalog, or the run's checksums/<YYYYMMDD_HHMMSS>.txt), and with --fsck
+# that it restores to repositories passing git fsck --full
+
+source "$(dirname "${BASH_SOURCE[0]}")/catalog.sh"
+
+# Recorded SHA-256 of an archive: the catalog's, or the line for it in the
+# checksums file of the run that stored it: verify_expected_sha256 <destination> <entry>
+verify_expected_sha256() {
+  local sha256=$(jq -r '.sha256 // empty' <<<"$2")
+  if [ -n "$sha256" ]; then
+    echo "$sha256"
+    return
+  fi
+  local archive=$(jq -r '.archive' <<<"$2")
+  storage_read "$1" "checksums/$(jq -r '.date' <<<"$2").txt" 2>/dev/null |
+    awk -v archive="$archive" '$2 == archive { print $1; exit }'
+}
+
+# Verify one stored archive on one destination, printing the outcome; fails
+# when it is missing or corrupt: verify_stored <destination> <entry> <fsck: true|false>
+verify_stored() {
+  local destination="$1"
+  local entry="$2"
+  local fsck="$3"
+  local archive=$(jq -r '.archive' <<<"$entry")
+  local repo_name=$(jq -r '.alias_of // .repository' <<<"$entry")
+  if [ -z "$(storage_size "$destination" "$archive")" ]; then
+    echo "❌ $archive ($destination): missing"
+    return 1
+  fi
+
+  local checked=""
+  local expected=$(verify_expected_sha256 "$destination" "$entry")
+  if [ -n "$expected" ]; then
+    local actual
+    if ! actual=$(set -o pipefail; storage_read "$destination" "$archive" | sha256sum | cut -d' ' -f1); then
+      echo "❌ $archive ($destination): could not be read"
+      return 1
+    fi
+    if [ "$actual" != "$expected" ]; then
+      echo "❌ $archive ($destination): checksum mismatch (expected ${expected:0:12}, got ${actual:0:12})"
+      return 1
+    fi
+    checked="checksum"
+  fi
+
+  if [ "$fsck" = "true" ]; then
+    local scratch=$(mktemp -d "${TMPDIR:-/tmp}/backup-repo.$$.XXXXXX")
+    local reason
+    if ! open_stored_archive "$destination" "$archive" "$scratch/content" "$repo_name" >/dev/null 2>"$scratch/errors"; then
+      echo "❌ $archive ($destination): could not be restored$(tail -n 1 "$scratch/errors" | sed 's/^/: /')"
+      rm -rf "$scratch"
+      return 1
+    fi
+    if ! reason=$(verify_content "$scratch/content" 2>&1); then
+      echo "❌ $archive ($destination): corrupt ($reason)"
+      rm -rf "$scratch"
+      return 1
+    fi
+    rm -rf "$scratch"
+    checked="${checked:+$checked, }git fsck"
+  fi
+
+  if [ -n "$checked" ]; then
+    echo "🔍 $archive ($destination): ok ($checked)"
+  else
+    echo "⚠️ $archive ($destination): present, but no checksum recorded (use --fsck)"
+  fi
+}
+
+# backup_verify <repo>|--all [--latest] [--fsck] [--destination name]
+backup_verify() {
+  local repo=""
+  local all=false
+  local latest=false
+  local fsck=false
+  local only_destination=""
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --all) all=true; shift ;;
+      --latest) latest=true; shift ;;
+      --fsck) fsck=true; shift ;;
+      --destination) only_destination="$2"; shift 2 ;;
+      -*) echo "❌ Unknown option: $1"; return 2 ;;
+      *) repo="$1"; shift ;;
+    esac
+  done
+  if [ -z "$repo" ] && [ "$all" = "false" ]; then
+    echo "❌ Usage: verify <repo>|--all [--latest] [--fsck] [--destination name]"
+    return 2
+  fi
+
+  state_load
+  # Deduplicated backups are verified through the archive they share, once
+  local objects
+  objects=$(jq -c --arg repo "$repo" --argjson latest "$latest" '
+    (map({(.archive): .}) | add // {}) as $entries |
+    map(select($repo == "" or .repository == $repo)) |
+    if $latest then group_by(.repository) | map(max_by(.date)) else . end |
+    map(.dedup_of // .archive) | unique | .[] | $entries[.] // {archive: ., missing: true}' "$CATALOG_FILE") || return 1
+  if [ -z "$objects" ]; then
+    echo "ℹ️ No snapshots${repo:+ of $repo} in the catalog"
+    return 0
+  fi
+
+  local entry destination
+  local checked=0
+  local failed=0
+  while IFS= read -r entry; do
+    if [ "$(jq -r '.missing // false' <<<"$entry")" = "true" ]; then
+      echo "❌ $(jq -r '.archive' <<<"$entry"): shared by a deduplicated backup but not in the catalog"
+      failed=$((failed + 1))
+      continue
+    fi
+    for destination in $(jq -r '.destinations[]' <<<"$entry"); do
+      if [ -n "$only_destination" ] && [ "$destination" != "$only_destination" ]; then
+        continue
+      fi
+      checked=$((checked + 1))
+      verify_stored "$destination" "$entry" "$fsck" || failed=$((failed + 1))
+    done
+  done <<<"$objects"
+
+  if [ $failed -gt 0 ]; then
+    echo "❌ $failed of $checked stored archives missing or corrupt"
+    return 1
+  fi
+  echo "✅ Verified $checked stored archives"
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  backup_verify "$@"
+fi
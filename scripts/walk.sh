@@ -0,0 +1,70 @@
+#!/bin/bash
+# Concurrent file walking shared by sizing, hashing and archiving, so mirrors
+# with hundreds of thousands of loose objects are not processed one file at a time
+
+source "$(dirname "${BASH_SOURCE[0]}")/hash.sh"
+
+# Upper bound on concurrent workers
+WALK_WORKERS="${WALK_WORKERS:-$(nproc 2>/dev/null || echo 4)}"
+# Files handed to each worker invocation
+WALK_BATCH="${WALK_BATCH:-512}"
+# How directory sizes are measured: "apparent" sums file lengths, "disk" sums
+# allocated blocks like du does
+SIZE_MODE="${SIZE_MODE:-apparent}"
+
+# stat arguments printing "<bytes> <blocks> <block size>", for GNU and BSD/macOS stat
+if stat -c %s / >/dev/null 2>&1; then
+  STAT_SIZE_ARGS=(-c '%s %b %B')
+else
+  STAT_SIZE_ARGS=(-f '%z %b 512')
+fi
+
+# Run a command over every file below a directory in parallel batches, with
+# paths relative to it: walk_parallel <dir> <command...>
+walk_parallel() {
+  local dir="$1"
+  shift
+  (cd "$dir" && find . -type f -print0 | xargs -0 -r -P "$WALK_WORKERS" -n "$WALK_BATCH" "$@")
+}
+
+# Size of a single file in bytes
+file_size() {
+  stat "${STAT_SIZE_ARGS[@]}" "$1" | awk '{ print $1 }'
+}
+
+# Total size of the files below a directory in bytes: directory_size <dir> [apparent|disk]
+directory_size() {
+  walk_parallel "$1" stat "${STAT_SIZE_ARGS[@]}" |
+    awk -v mode="${2:-$SIZE_MODE}" '{ total += (mode == "disk" ? $2 * $3 : $1) } END { printf "%d\n", total }'
+}
+
+# Hash of every file below a directory, sorted by path ("<hash>  ./<path>").
+# Small files are hashed in parallel batches; with blake3, large files are
+# hashed one at a time with every worker on the same file.
+directory_manifest() {
+  local dir="$1"
+  local small_tool large_tool
+  small_tool=$(hash_tool 1) && large_tool=$(hash_tool "$WALK_WORKERS") || return 1
+  if [ "$(hash_algorithm)" != "blake3" ]; then
+    walk_parallel "$dir" $small_tool | sort -k 2
+    return
+  fi
+  local large_bytes=$((HASH_LARGE_FILE_MB * 1024 * 1024))
+  (
+    cd "$dir" &&
+      find . -type f -size -"${large_bytes}"c -print0 | xargs -0 -r -P "$WALK_WORKERS" -n "$WALK_BATCH" $small_tool &&
+      find . -type f ! -size -"${large_bytes}"c -print0 | xargs -0 -r -n 1 $large_tool
+  ) | sort -k 2
+}
+
+# Allow function to be sourced or called directly
+if [[ "${BASH_SOURCE[0]}" == "${0}" ]]; then
+  case "$1" in
+    size) directory_size "$2" "$3" ;;
+    manifest) directory_manifest "$2" ;;
+    *)
+      echo "❌ Usage: $0 size <dir> [apparent|disk] | manifest <dir>"
+      exit 1
+      ;;
+  esac
+fi
@@ -0,0 +1,66 @@
+#!/bin/bash
+# Where a run writes: mirrors and archives being built, results, status,
+# summary, state and temporary files. With WORK_DIR set, all of it goes to
+# that directory (a writable volume), so the rest of the filesystem can be
+# read-only; input files named relative to the starting directory are still
+# read from there. Enter it before sourcing anything else, since scripts
+# derive their paths from TMPDIR when sourced.
+
+WORK_DIR="${WORK_DIR:-}"
+# Warn at startup when the work directory has less free space than this
+WORK_MIN_FREE_MB="${WORK_MIN_FREE_MB:-1024}"
+
+# Whether a directory can be written to, creating it if needed
+work_dir_writable() {
+  mkdir -p "$1" 2>/dev/null || return 1
+  local probe="$1/.write-test.$$"
+  (: > "$probe") 2>/dev/null || return 1
+  rm -f "$probe"
+}
+
+# Check the directories the run writes to and move into WORK_DIR
+work_dir_enter() {
+  # Relative paths in the configuration keep meaning the starting directory
+  export BACKUP_START_DIR="${BACKUP_START_DIR:-$PWD}"
+  local dir="${WORK_DIR:-$PWD}"
+  if ! work_dir_writable "$dir"; then
+    if [ -n "$WORK_DIR" ]; then
+      echo "❌ WORK_DIR $WORK_DIR is not writable; mount a writable volume there"
+    else
+      echo "❌ The current directory $dir is not writable (read-only filesystem?); set WORK_DIR to a writable volume"
+    fi
+    return 1
+  fi
+  if [ -n "$WORK_DIR" ]; then
+    WORK_DIR=$(cd "$WORK_DIR" && pwd)
+  fi
+  if [ -n "$WORK_DIR" ] && [ -z "$TMPDIR" ]; then
+    export TMPDIR="$WORK_DIR/tmp"
+  fi
+  if ! work_dir_writable "${TMPDIR:-/tmp}"; then
+    echo "❌ Temporary directory ${TMPDIR:-/tmp} is not writable; set TMPDIR or WORK_DIR to a writable volume"
+    return 1
+  fi
+  local free=$(df -Pm "$dir" 2>/dev/null | awk 'NR == 2 { print $4 }')
+  if [ -n "$free" ] && [ "$free" -lt "$WORK_MIN_FREE_MB" ]; then
+    echo "⚠️ Only $free MB free in $dir (WORK_MIN_FREE_MB is $WORK_MIN_FREE_MB); large repositories may not fit"
+  fi
+  if [ -z "$WORK_DIR" ]; then
+    return 0
+  fi
+
+  # Inputs keep being read from where the run started
+  local variable
+  for variable in REPOS_FILE REDACT_RULES_FILE MESSAGES_FILE BACKUP_CONFIG_FILE; do
+    local value="${!variable}"
+    case "$variable" in
+      REPOS_FILE) value="${value:-repos.txt}" ;;
+      REDACT_RULES_FILE) value="${value:-redact-rules.txt}" ;;
+    esac
+    if [ -n "$value" ] && [[ "$value" != /* ]]; then
+      export "$variable=$PWD/$value"
+    fi
+  done
+  cd "$WORK_DIR" || return 1
+  echo "ℹ️ Working in $WORK_DIR${free:+ ($free MB free)}"
+}
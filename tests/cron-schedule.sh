@@ -0,0 +1,70 @@
+#!/bin/bash
+# The daemon's schedule under a simulated clock (BACKUP_CLOCK_FILE): the next
+# run of a cron expression after "now", with steps, ranges, lists, names,
+# Sunday as 7, leap days and the day-of-month/day-of-week OR of cron, and
+# which expressions are rejected.
+
+export TZ=UTC
+WORK_DIR=$(mktemp -d)
+trap 'rm -rf "$WORK_DIR"' EXIT
+export BACKUP_CLOCK_FILE="$WORK_DIR/clock"
+date -d "2024-02-27 10:30" +%s > "$BACKUP_CLOCK_FILE"
+
+source "$(dirname "${BASH_SOURCE[0]}")/../scripts/daemon.sh"
+
+FAILED=0
+
+fail() {
+  echo "❌ $1"
+  FAILED=1
+}
+
+# Set the simulated clock: set_clock <date>
+set_clock() {
+  date -d "$1" +%s > "$BACKUP_CLOCK_FILE"
+}
+
+# Check the next run after the simulated time: expect_next <expression> <expected date> <what>
+expect_next() {
+  local next
+  next=$(cron_next "$1" "$(clock_now)")
+  next=$([ -n "$next" ] && date -u -d "@$next" '+%Y-%m-%d %H:%M')
+  if [ "$next" = "$2" ]; then
+    echo "✅ $3"
+  else
+    fail "$3: \"$1\" next at '$next', expected $2"
+  fi
+}
+
+# Tuesday, February 27 2024, 10:30
+set_clock "2024-02-27 10:30"
+expect_next "0 2 * * *" "2024-02-28 02:00" "A daily run at 2:00 is next the following night"
+expect_next "*/15 * * * *" "2024-02-27 10:45" "A step runs strictly after now, not at it"
+expect_next "30 9-17/4 * * *" "2024-02-27 13:30" "A stepped range of hours starts from its first hour"
+expect_next "5,10 1 * * *" "2024-02-28 01:05" "Lists take their first value on the next day"
+expect_next "0 0 29 2 *" "2024-02-29 00:00" "February 29 comes in a leap year"
+expect_next "0 0 31 * *" "2024-03-31 00:00" "Months without the day are skipped"
+expect_next "0 8 * * 7" "2024-03-03 08:00" "7 is Sunday"
+expect_next "0 6 * jun-aug sat,sun" "2024-06-01 06:00" "Month and weekday names and ranges"
+expect_next "0 12 1 * mon" "2024-03-01 12:00" "With both day fields set, the day of month matches alone"
+
+set_clock "2024-03-01 12:00"
+expect_next "0 12 1 * mon" "2024-03-04 12:00" "With both day fields set, the day of week matches alone"
+expect_next "0 0 29 2 *" "2028-02-29 00:00" "February 29 waits for the next leap year"
+
+set_clock "2024-12-31 23:59"
+expect_next "* * * * *" "2025-01-01 00:00" "Every minute rolls over into the new year"
+
+for expression in "0 2 * *" "*/0 * * * *" "60 * * * *" "0 24 * * *" "0 0 0 * *" "0 0 * 13 *" "0 0 * * 8" "5-1 * * * *" "x * * * *" "0 0 * foo *"; do
+  if cron_valid "$expression"; then
+    fail "\"$expression\" was accepted"
+  fi
+done
+for expression in "0 2 * * *" "*/5 0-6,22-23 1-15 */2 mon-fri" "0 0 * * 0,7" "0 12 * JAN,jul SUN"; do
+  if ! cron_valid "$expression"; then
+    fail "\"$expression\" was rejected"
+  fi
+done
+[ $FAILED -ne 0 ] || echo "✅ Expressions with a wrong field count, a zero step or values out of range are rejected"
+
+exit $FAILED
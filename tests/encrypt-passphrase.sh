@@ -0,0 +1,57 @@
+#!/bin/bash
+# Passphrase archives decrypt to what was encrypted, and a wrong passphrase,
+# a flipped byte or a truncated archive fails to decrypt.
+
+source "$(dirname "${BASH_SOURCE[0]}")/../scripts/encrypt.sh"
+
+# Cheap scrypt and small chunks, so the archive has several
+PASSPHRASE_SCRYPT_N=1024
+PASSPHRASE_CHUNK_BYTES=100000
+
+WORK_DIR=$(mktemp -d)
+trap 'rm -rf "$WORK_DIR"' EXIT
+PASSPHRASE="correct horse battery staple"
+FAILED=0
+
+fail() {
+  echo "❌ $1"
+  FAILED=1
+}
+
+head -c 350000 /dev/urandom > "$WORK_DIR/archive.zip"
+if ! passphrase_encrypt "$PASSPHRASE" "$WORK_DIR/archive.zip" "$WORK_DIR/archive.zip.aes"; then
+  echo "❌ Encrypting failed"
+  exit 1
+fi
+
+if passphrase_decrypt "$PASSPHRASE" "$WORK_DIR/archive.zip.aes" "$WORK_DIR/restored.zip" &&
+  cmp -s "$WORK_DIR/archive.zip" "$WORK_DIR/restored.zip"; then
+  echo "✅ Round trip restores the archive"
+else
+  fail "Round trip does not restore the archive"
+fi
+
+if passphrase_decrypt "wrong horse battery staple" "$WORK_DIR/archive.zip.aes" "$WORK_DIR/restored.zip"; then
+  fail "A wrong passphrase decrypts"
+else
+  echo "✅ A wrong passphrase is refused"
+fi
+
+cp "$WORK_DIR/archive.zip.aes" "$WORK_DIR/tampered.zip.aes"
+byte=$(od -An -tu1 -j 200000 -N 1 "$WORK_DIR/tampered.zip.aes" | tr -d ' ')
+printf "\\$(printf '%03o' $(( (byte + 1) % 256 )))" |
+  dd of="$WORK_DIR/tampered.zip.aes" bs=1 seek=200000 conv=notrunc 2>/dev/null
+if passphrase_decrypt "$PASSPHRASE" "$WORK_DIR/tampered.zip.aes" "$WORK_DIR/restored.zip"; then
+  fail "A tampered archive decrypts"
+else
+  echo "✅ A tampered archive is refused"
+fi
+
+head -c 250000 "$WORK_DIR/archive.zip.aes" > "$WORK_DIR/truncated.zip.aes"
+if passphrase_decrypt "$PASSPHRASE" "$WORK_DIR/truncated.zip.aes" "$WORK_DIR/restored.zip"; then
+  fail "A truncated archive decrypts"
+else
+  echo "✅ A truncated archive is refused"
+fi
+
+exit $FAILED
@@ -0,0 +1,75 @@
+#!/bin/bash
+# A clone through git_with_token authenticates with the token, and the token
+# ends up nowhere in the mirror (git config --list, FETCH_HEAD, packed-refs).
+
+source "$(dirname "${BASH_SOURCE[0]}")/../scripts/sources.sh"
+
+WORK_DIR=$(mktemp -d)
+SERVER_PID=""
+trap '[ -z "$SERVER_PID" ] || kill "$SERVER_PID" 2>/dev/null; rm -rf "$WORK_DIR"' EXIT
+TOKEN="ghp_test$(od -An -N 12 -tx1 /dev/urandom | tr -d ' \n')"
+FAILED=0
+
+fail() {
+  echo "❌ $1"
+  FAILED=1
+}
+
+# A repository served over git's dumb HTTP protocol, behind Basic auth with the token
+git init -q "$WORK_DIR/work"
+git -C "$WORK_DIR/work" -c user.name=test -c user.email=test@example.com commit -q --allow-empty -m "Initial commit"
+git clone -q --bare "$WORK_DIR/work" "$WORK_DIR/served/repo.git"
+git -C "$WORK_DIR/served/repo.git" update-server-info
+TOKEN="$TOKEN" python3 -u - "$WORK_DIR/served" > "$WORK_DIR/server.log" 2>&1 <<'PYTHON' &
+import base64, functools, http.server, os, sys
+expected = "Basic " + base64.b64encode(("x-access-token:" + os.environ["TOKEN"]).encode()).decode()
+class Handler(http.server.SimpleHTTPRequestHandler):
+    def do_GET(self):
+        if self.headers.get("Authorization") != expected:
+            self.send_response(401)
+            self.send_header("WWW-Authenticate", 'Basic realm="test"')
+            self.end_headers()
+            return
+        super().do_GET()
+    def log_message(self, *args):
+        pass
+server = http.server.HTTPServer(("127.0.0.1", 0), functools.partial(Handler, directory=sys.argv[1]))
+print(server.server_address[1])
+server.serve_forever()
+PYTHON
+SERVER_PID=$!
+for _ in $(seq 1 50); do
+  PORT=$(head -n 1 "$WORK_DIR/server.log")
+  [ -z "$PORT" ] || break
+  sleep 0.1
+done
+if [ -z "$PORT" ]; then
+  echo "❌ The test server did not start"
+  exit 1
+fi
+URL="http://127.0.0.1:$PORT/repo.git"
+
+if git_with_token "" clone -q --mirror "$URL" "$WORK_DIR/anonymous.git" 2>/dev/null; then
+  fail "The server let a clone without the token through"
+else
+  echo "✅ Cloning without the token is refused"
+fi
+
+if ! git_with_token "$TOKEN" clone -q --mirror "$URL" "$WORK_DIR/mirror.git"; then
+  echo "❌ Cloning with the token failed"
+  exit 1
+fi
+echo "✅ Cloned with the token"
+git_with_token "$TOKEN" -C "$WORK_DIR/mirror.git" fetch -q --prune origin
+
+if git -C "$WORK_DIR/mirror.git" config --list | grep -qF "$TOKEN"; then
+  fail "The token is in the mirror's git config"
+else
+  echo "✅ The mirror's git config has no token"
+fi
+if grep -rqF "$TOKEN" "$WORK_DIR/mirror.git"; then
+  fail "The token is in the mirror: $(grep -rlF "$TOKEN" "$WORK_DIR/mirror.git" | tr '\n' ' ')"
+else
+  echo "✅ No file of the mirror has the token"
+fi
+exit $FAILED
@@ -0,0 +1,89 @@
+#!/bin/bash
+# Retention under a simulated clock (BACKUP_CLOCK_FILE): prune --older-than
+# and the crash cleanup age archives and files by the simulated time, with no
+# waiting, and the newest snapshot of a repository is always kept.
+
+export TZ=UTC
+WORK_DIR=$(mktemp -d)
+trap 'rm -rf "$WORK_DIR"' EXIT
+export BACKUP_CLOCK_FILE="$WORK_DIR/clock"
+export STATE_DIR="$WORK_DIR/state"
+export BACKUP_DESTINATIONS=local
+export LOCAL_BACKUP_DIR="$WORK_DIR/backups"
+export TMPDIR="$WORK_DIR/tmp"
+mkdir -p "$STATE_DIR" "$LOCAL_BACKUP_DIR" "$TMPDIR"
+date -d "2024-04-15 12:00" +%s > "$BACKUP_CLOCK_FILE"
+
+source "$(dirname "${BASH_SOURCE[0]}")/../scripts/prune.sh"
+source "$(dirname "${BASH_SOURCE[0]}")/../scripts/gc.sh"
+
+FAILED=0
+
+fail() {
+  echo "❌ $1"
+  FAILED=1
+}
+
+# Set the simulated clock: set_clock <date>
+set_clock() {
+  date -d "$1" +%s > "$BACKUP_CLOCK_FILE"
+}
+
+# Archives of "app" still stored, oldest first, on one line
+stored_archives() {
+  ls "$LOCAL_BACKUP_DIR" | grep '\.zip$' | sort | tr '\n' ' ' | sed 's/ $//'
+}
+
+# A snapshot of app on the first of each month from January to June 2024
+entries=()
+for month in 01 02 03 04 05 06; do
+  archive="2024${month}01_020000_app.zip"
+  echo "$archive" > "$LOCAL_BACKUP_DIR/$archive"
+  entries+=("$(jq -cn --arg archive "$archive" --arg date "2024${month}01_020000" \
+    '{repository: "app", archive: $archive, date: $date, size_bytes: 1, destinations: ["local"]}')")
+done
+# Stored like a run stores them; prune always reads the catalog from there
+mkdir -p "$LOCAL_BACKUP_DIR/_state"
+printf '%s\n' "${entries[@]}" | jq -s . > "$LOCAL_BACKUP_DIR/$CATALOG_BLOB"
+echo '{}' > "$LOCAL_BACKUP_DIR/$STATE_BLOB"
+
+set_clock "2024-04-15 12:00"
+backup_prune --older-than 30 >/dev/null
+expected="20240401_020000_app.zip 20240501_020000_app.zip 20240601_020000_app.zip"
+if [ "$(stored_archives)" = "$expected" ]; then
+  echo "✅ On April 15, snapshots older than 30 days are pruned"
+else
+  fail "On April 15, kept $(stored_archives), expected $expected"
+fi
+
+set_clock "2024-09-01 12:00"
+backup_prune --older-than 30 >/dev/null
+if [ "$(stored_archives)" = "20240601_020000_app.zip" ] &&
+  [ "$(jq -r 'map(.archive) | join(" ")' "$CATALOG_FILE")" = "20240601_020000_app.zip" ]; then
+  echo "✅ Months later, only the newest snapshot is kept, in storage and the catalog"
+else
+  fail "On September 1, kept $(stored_archives) (catalog: $(jq -c 'map(.archive)' "$CATALOG_FILE"))"
+fi
+
+# Leftovers of a crashed run (a pid that can't be running) and of a recent one
+set_clock "2024-09-01 12:00"
+now=$(clock_now)
+mkdir -p "$TMPDIR/backup-repo.4194305.old" "$TMPDIR/backup-repo.4194306.recent"
+fs_touch "$TMPDIR/backup-repo.4194305.old" $((now - 2 * 3600))
+fs_touch "$TMPDIR/backup-repo.4194306.recent" $((now - 10 * 60))
+candidates=$(GC_MIN_AGE_MINUTES=60 gc_candidates | xargs -r -n 1 basename | tr '\n' ' ' | sed 's/ $//')
+if [ "$candidates" = "backup-repo.4194305.old" ]; then
+  echo "✅ Cleanup picks leftovers older than GC_MIN_AGE_MINUTES by the simulated clock"
+else
+  fail "Cleanup picked '$candidates', expected backup-repo.4194305.old"
+fi
+
+set_clock "2024-09-01 13:00"
+candidates=$(GC_MIN_AGE_MINUTES=60 gc_candidates | wc -l)
+if [ "$candidates" -eq 2 ]; then
+  echo "✅ An hour later, the recent leftover is old enough too"
+else
+  fail "An hour later, cleanup picked $candidates leftovers, expected 2"
+fi
+
+exit $FAILED